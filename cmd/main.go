@@ -1,6 +1,7 @@
 package main
 
 import (
+	"os"
 	"marketplace/internal/app"
 	"marketplace/internal/config"
 	"marketplace/internal/datasource"
@@ -13,35 +14,61 @@ import (
 
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:]))
+	}
 
 	app := fx.New(
 		
 		fx.Provide(
 			config.MustLoad,
 			provideLogger,
-			app.NewJwtProvider,
+			app.LoadJwtProvider,
 			app.NewMarketService,
 			app.NewUserService,
+			app.NewAdminService,
 			datasource.NewStorage,
 			datasource.NewMarketRepo,
 			datasource.NewUserRepo,
+			datasource.NewTokenRepo,
+			datasource.NewLocalBlobStore,
+			datasource.NewFileMailer,
+			datasource.NewOIDCClient,
 			web.NewUserHandler,
 			web.NewMarketHandler,
+			web.NewAdminHandler,
 			func (repo *datasource.MarketRepo) app.MarketRepository{
 				return repo
 			},
 			func (market *app.MarketService) app.MarketServicer{
 				return market
 			},
+			func (store *datasource.LocalBlobStore) app.BlobStore{
+				return store
+			},
+			func (mailer *datasource.FileMailer) app.Mailer{
+				return mailer
+			},
+			func (client *datasource.OIDCClient) app.IdentityProvider{
+				return client
+			},
 			func (repo *datasource.UserRepo) app.UserRepository{
 				return repo
 			},
+			func (repo *datasource.TokenRepo) app.TokenRepository{
+				return repo
+			},
 			func (user *app.UserService) app.UserServicer{
 				return user
 			},
+			func (admin *app.AdminService) app.AdminServicer{
+				return admin
+			},
 
 		),
 
+		fx.Invoke(di.RunMigrations),
+		fx.Invoke(di.PromoteAdmins),
 		fx.Invoke(di.StartHTTPServer),
 	)
 
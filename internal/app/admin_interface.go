@@ -0,0 +1,14 @@
+package app
+
+import (
+	"github.com/google/uuid"
+)
+
+type AdminServicer interface {
+	Users(params UsersListParams) (UsersPage, error)
+	UserAds(userID uuid.UUID, page int, limit int) (UserAdsPage, error)
+	BlockUser(userID uuid.UUID, req BlockUserRequest, adminID uuid.UUID) (UserSummary, error)
+	UnblockUser(userID uuid.UUID) (UserSummary, error)
+	ForcePasswordReset(userID uuid.UUID) (UserSummary, error)
+	DeleteUser(userID uuid.UUID, adminID uuid.UUID) error
+}
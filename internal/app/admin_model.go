@@ -0,0 +1,74 @@
+package app
+
+import (
+	"time"
+	"github.com/google/uuid"
+)
+
+// UsersListParams filters the admin users list; empty fields don't filter.
+type UsersListParams struct {
+	Page   int    `query:"page"`
+	Limit  int    `query:"limit"`
+	Query  string `query:"q"` // part of the login
+	Role   string `query:"role"`
+	Status string `query:"status"`
+}
+
+// UserSummary is a user as admins see it, without the password hash.
+type UserSummary struct {
+	UUID                  uuid.UUID  `json:"uuid"`
+	Login                 string     `json:"login"`
+	Role                  string     `json:"role"`
+	Status                string     `json:"status"`
+	StatusReason          string     `json:"status_reason,omitempty"`
+	SuspendedUntil        *time.Time `json:"suspended_until,omitempty"`
+	PasswordResetRequired bool       `json:"password_reset_required"`
+	Email                 string     `json:"email,omitempty"`
+	EmailVerifiedAt       *time.Time `json:"email_verified_at,omitempty"`
+	TwoFactorEnabled      bool       `json:"two_factor_enabled"`
+}
+
+// BlockUserRequest suspends the user until Until, or bans them when Until is omitted.
+type BlockUserRequest struct {
+	Reason string     `json:"reason"`
+	Until  *time.Time `json:"until"`
+}
+
+type UsersPage struct {
+	Total int           `json:"total"`
+	Page  int           `json:"page"`
+	Limit int           `json:"limit"`
+	Pages int           `json:"pages"`
+	Items []UserSummary `json:"items"`
+}
+
+// UserAdsPage lists a user's ads in every status, newest first.
+type UserAdsPage struct {
+	Total int  `json:"total"`
+	Page  int  `json:"page"`
+	Limit int  `json:"limit"`
+	Pages int  `json:"pages"`
+	Items []Ad `json:"items"`
+}
+
+type AdminService struct {
+	users  UserRepository
+	tokens TokenRepository
+	ads    MarketRepository
+	blobs  BlobStore
+}
+
+func userSummary(user User) UserSummary {
+	return UserSummary{
+		UUID:                  user.UUID,
+		Login:                 user.Login,
+		Role:                  user.Role,
+		Status:                user.Status,
+		StatusReason:          user.StatusReason,
+		SuspendedUntil:        user.SuspendedUntil,
+		PasswordResetRequired: user.PasswordResetRequired,
+		Email:                 user.Email,
+		EmailVerifiedAt:       user.EmailVerifiedAt,
+		TwoFactorEnabled:      user.TOTPEnabledAt != nil,
+	}
+}
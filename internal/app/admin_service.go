@@ -0,0 +1,165 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrSelfAction        = errors.New("admins can't block or delete their own account")
+	ErrInvalidUserFilter = errors.New("invalid user filter")
+	ErrInvalidSuspension = errors.New("suspension must end in the future")
+)
+
+// userAdsBatch is how many ads DeleteUser loads at a time.
+const userAdsBatch = 100
+
+func NewAdminService(users UserRepository, tokens TokenRepository, ads MarketRepository, blobs BlobStore) *AdminService {
+	return &AdminService{
+		users:  users,
+		tokens: tokens,
+		ads:    ads,
+		blobs:  blobs,
+	}
+}
+
+func (s *AdminService) Users(params UsersListParams) (UsersPage, error) {
+	if params.Role != "" && params.Role != RoleUser && params.Role != RoleModerator && params.Role != RoleAdmin {
+		return UsersPage{}, fmt.Errorf("%w: unknown role %q", ErrInvalidUserFilter, params.Role)
+	}
+	if params.Status != "" && params.Status != UserStatusActive && params.Status != UserStatusSuspended && params.Status != UserStatusBanned {
+		return UsersPage{}, fmt.Errorf("%w: unknown status %q", ErrInvalidUserFilter, params.Status)
+	}
+	users, err := s.users.ListUsers(params)
+	if err != nil {
+		return UsersPage{}, fmt.Errorf("listusers error: %w", err)
+	}
+	total, err := s.users.CountUsers(params)
+	if err != nil {
+		return UsersPage{}, fmt.Errorf("countusers error: %w", err)
+	}
+
+	items := make([]UserSummary, 0, len(users))
+	for _, user := range users {
+		items = append(items, userSummary(user))
+	}
+	return UsersPage{
+		Total: total,
+		Page:  params.Page,
+		Limit: params.Limit,
+		Pages: (total + params.Limit - 1) / params.Limit,
+		Items: items,
+	}, nil
+}
+
+// UserAds lists the user's ads in every status, including the closed and sold ones.
+func (s *AdminService) UserAds(userID uuid.UUID, page int, limit int) (UserAdsPage, error) {
+	if _, err := s.user(userID); err != nil {
+		return UserAdsPage{}, err
+	}
+	ads, err := s.ads.GetUserAds(userID.String(), limit, (page-1)*limit)
+	if err != nil {
+		return UserAdsPage{}, fmt.Errorf("getuserads error: %w", err)
+	}
+	total, err := s.ads.CountUserAds(userID.String())
+	if err != nil {
+		return UserAdsPage{}, fmt.Errorf("countuserads error: %w", err)
+	}
+	return UserAdsPage{
+		Total: total,
+		Page:  page,
+		Limit: limit,
+		Pages: (total + limit - 1) / limit,
+		Items: ads,
+	}, nil
+}
+
+// BlockUser suspends the user until req.Until or, without it, bans them, and ends all their sessions.
+func (s *AdminService) BlockUser(userID uuid.UUID, req BlockUserRequest, adminID uuid.UUID) (UserSummary, error) {
+	if userID == adminID {
+		return UserSummary{}, ErrSelfAction
+	}
+	now := time.Now()
+	status := UserStatusBanned
+	if req.Until != nil {
+		if !req.Until.After(now) {
+			return UserSummary{}, ErrInvalidSuspension
+		}
+		status = UserStatusSuspended
+	}
+	if err := s.users.SetStatus(userID.String(), status, strings.TrimSpace(req.Reason), req.Until); err != nil {
+		return UserSummary{}, err
+	}
+	if err := s.tokens.RevokeUserTokens(userID.String(), now); err != nil {
+		return UserSummary{}, fmt.Errorf("failed to revoke refresh tokens: %w", err)
+	}
+	return s.summary(userID)
+}
+
+func (s *AdminService) UnblockUser(userID uuid.UUID) (UserSummary, error) {
+	if err := s.users.SetStatus(userID.String(), UserStatusActive, "", nil); err != nil {
+		return UserSummary{}, err
+	}
+	return s.summary(userID)
+}
+
+// ForcePasswordReset ends the user's sessions; they can't log in again until the password is changed.
+func (s *AdminService) ForcePasswordReset(userID uuid.UUID) (UserSummary, error) {
+	if err := s.users.SetPasswordResetRequired(userID.String(), true); err != nil {
+		return UserSummary{}, err
+	}
+	if err := s.tokens.RevokeUserTokens(userID.String(), time.Now()); err != nil {
+		return UserSummary{}, fmt.Errorf("failed to revoke refresh tokens: %w", err)
+	}
+	return s.summary(userID)
+}
+
+// DeleteUser removes the account with its ads and their images. The sessions are revoked first,
+// so the user can't post new ads while the old ones are being deleted.
+func (s *AdminService) DeleteUser(userID uuid.UUID, adminID uuid.UUID) error {
+	if userID == adminID {
+		return ErrSelfAction
+	}
+	if _, err := s.user(userID); err != nil {
+		return err
+	}
+	if err := s.tokens.RevokeUserTokens(userID.String(), time.Now()); err != nil {
+		return fmt.Errorf("failed to revoke refresh tokens: %w", err)
+	}
+	for {
+		ads, err := s.ads.GetUserAds(userID.String(), userAdsBatch, 0)
+		if err != nil {
+			return fmt.Errorf("getuserads error: %w", err)
+		}
+		for _, ad := range ads {
+			if err := s.ads.DeleteAd(ad.UUID.String()); err != nil && !errors.Is(err, ErrAdNotFound) {
+				return err
+			}
+			deleteAdBlobs(s.blobs, ad.Images)
+		}
+		if len(ads) < userAdsBatch {
+			break
+		}
+	}
+	return s.users.DeleteUser(userID.String())
+}
+
+// user loads the user, reporting ErrUserNotFound for an unknown uuid.
+func (s *AdminService) user(userID uuid.UUID) (User, error) {
+	user, err := s.users.FindByUUID(userID.String())
+	if err != nil {
+		return User{}, ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (s *AdminService) summary(userID uuid.UUID) (UserSummary, error) {
+	user, err := s.user(userID)
+	if err != nil {
+		return UserSummary{}, err
+	}
+	return userSummary(user), nil
+}
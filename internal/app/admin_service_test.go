@@ -0,0 +1,167 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+	"github.com/google/uuid"
+)
+
+func newAdminTestService() (*AdminService, *MockUserRepo, *MockTokenRepo, *MockMarketRepo, *MockBlobStore) {
+	users := &MockUserRepo{Users: make(map[string]User)}
+	tokens := &MockTokenRepo{}
+	ads := &MockMarketRepo{}
+	blobs := &MockBlobStore{Blobs: make(map[string][]byte)}
+	return NewAdminService(users, tokens, ads, blobs), users, tokens, ads, blobs
+}
+
+func addTestUser(repo *MockUserRepo, login string, role string) User {
+	user := User{UUID: uuid.New(), Login: login, Role: role, Status: UserStatusActive}
+	repo.Users[login] = user
+	return user
+}
+
+func TestAdminService_Users(t *testing.T) {
+	service, users, _, _, _ := newAdminTestService()
+	for i := 1; i <= 12; i++ {
+		addTestUser(users, fmt.Sprintf("user%02d", i), RoleUser)
+	}
+	admin := addTestUser(users, "boss", RoleAdmin)
+
+	page, err := service.Users(UsersListParams{Page: 2, Limit: 5, Query: "USER"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if page.Total != 12 || page.Pages != 3 || len(page.Items) != 5 || page.Items[0].Login != "user06" {
+		t.Errorf("unexpected page: %+v", page)
+	}
+
+	page, err = service.Users(UsersListParams{Page: 1, Limit: 10, Role: RoleAdmin})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if page.Total != 1 || page.Items[0].UUID != admin.UUID {
+		t.Errorf("expected only the admin, got %+v", page)
+	}
+
+	if _, err := service.Users(UsersListParams{Page: 1, Limit: 10, Status: "gone"}); !errors.Is(err, ErrInvalidUserFilter) {
+		t.Errorf("expected ErrInvalidUserFilter, got %v", err)
+	}
+}
+
+func TestAdminService_UserAds(t *testing.T) {
+	service, users, _, ads, _ := newAdminTestService()
+	user := addTestUser(users, "seller", RoleUser)
+	for _, status := range []string{AdStatusActive, AdStatusSold, AdStatusClosed} {
+		ads.SaveAd(Ad{UUID: uuid.New(), UserID: user.UUID, Status: status})
+	}
+	ads.SaveAd(Ad{UUID: uuid.New(), UserID: uuid.New(), Status: AdStatusActive})
+
+	page, err := service.UserAds(user.UUID, 1, 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if page.Total != 3 || len(page.Items) != 3 || page.Items[0].Status != AdStatusClosed {
+		t.Errorf("expected the user's 3 ads newest first, got %+v", page)
+	}
+
+	if _, err := service.UserAds(uuid.New(), 1, 10); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestAdminService_BlockUser(t *testing.T) {
+	service, users, tokens, _, _ := newAdminTestService()
+	admin := addTestUser(users, "boss", RoleAdmin)
+	user := addTestUser(users, "spammer", RoleUser)
+	tokens.SaveRefreshToken(RefreshToken{ID: "t1", FamilyID: "f1", UserID: user.UUID, ExpiresAt: time.Now().Add(time.Hour)})
+
+	until := time.Now().Add(24 * time.Hour)
+	summary, err := service.BlockUser(user.UUID, BlockUserRequest{Reason: " spam ", Until: &until}, admin.UUID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if summary.Status != UserStatusSuspended || summary.StatusReason != "spam" || summary.SuspendedUntil == nil || !summary.SuspendedUntil.Equal(until) {
+		t.Errorf("expected a suspension until %v for spam, got %+v", until, summary)
+	}
+	if revoked, _ := tokens.FamilyRevoked("f1"); !revoked {
+		t.Error("expected the blocked user's sessions to be revoked")
+	}
+
+	summary, err = service.BlockUser(user.UUID, BlockUserRequest{Reason: "fraud"}, admin.UUID)
+	if err != nil || summary.Status != UserStatusBanned || summary.StatusReason != "fraud" || summary.SuspendedUntil != nil {
+		t.Errorf("expected a ban for fraud, got %+v, %v", summary, err)
+	}
+
+	summary, err = service.UnblockUser(user.UUID)
+	if err != nil || summary.Status != UserStatusActive || summary.StatusReason != "" {
+		t.Errorf("expected the user to be active again, got %+v, %v", summary, err)
+	}
+
+	past := time.Now().Add(-time.Minute)
+	if _, err := service.BlockUser(user.UUID, BlockUserRequest{Until: &past}, admin.UUID); !errors.Is(err, ErrInvalidSuspension) {
+		t.Errorf("expected ErrInvalidSuspension, got %v", err)
+	}
+	if _, err := service.BlockUser(admin.UUID, BlockUserRequest{}, admin.UUID); !errors.Is(err, ErrSelfAction) {
+		t.Errorf("expected ErrSelfAction, got %v", err)
+	}
+	if _, err := service.BlockUser(uuid.New(), BlockUserRequest{}, admin.UUID); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestAdminService_ForcePasswordReset(t *testing.T) {
+	service, users, tokens, _, _ := newAdminTestService()
+	user := addTestUser(users, "victim", RoleUser)
+	tokens.SaveRefreshToken(RefreshToken{ID: "t1", FamilyID: "f1", UserID: user.UUID, ExpiresAt: time.Now().Add(time.Hour)})
+
+	summary, err := service.ForcePasswordReset(user.UUID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !summary.PasswordResetRequired {
+		t.Error("expected password_reset_required to be set")
+	}
+	if revoked, _ := tokens.FamilyRevoked("f1"); !revoked {
+		t.Error("expected the user's sessions to be revoked")
+	}
+}
+
+func TestAdminService_DeleteUser(t *testing.T) {
+	service, users, tokens, ads, blobs := newAdminTestService()
+	admin := addTestUser(users, "boss", RoleAdmin)
+	user := addTestUser(users, "leaver", RoleUser)
+	other := Ad{UUID: uuid.New(), UserID: admin.UUID, Status: AdStatusActive}
+	ads.SaveAd(other)
+	for i := 0; i < userAdsBatch+5; i++ {
+		ads.SaveAd(Ad{UUID: uuid.New(), UserID: user.UUID, Status: AdStatusActive})
+	}
+	withImage := Ad{UUID: uuid.New(), UserID: user.UUID, Status: AdStatusSold, Images: []AdImage{{Key: "ads/leaver.jpg"}}}
+	ads.SaveAd(withImage)
+	blobs.Blobs["ads/leaver.jpg"] = []byte("jpeg")
+	tokens.SaveRefreshToken(RefreshToken{ID: "t1", FamilyID: "f1", UserID: user.UUID, ExpiresAt: time.Now().Add(time.Hour)})
+
+	if err := service.DeleteUser(admin.UUID, admin.UUID); !errors.Is(err, ErrSelfAction) {
+		t.Errorf("expected ErrSelfAction, got %v", err)
+	}
+	if err := service.DeleteUser(user.UUID, admin.UUID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := users.FindByUUID(user.UUID.String()); err == nil {
+		t.Error("expected the user to be deleted")
+	}
+	if len(ads.Ads) != 1 || ads.Ads[0].UUID != other.UUID {
+		t.Errorf("expected only other users' ads to remain, got %d ads", len(ads.Ads))
+	}
+	if _, ok := blobs.Blobs["ads/leaver.jpg"]; ok {
+		t.Error("expected the images of deleted ads to be removed")
+	}
+	if revoked, _ := tokens.FamilyRevoked("f1"); !revoked {
+		t.Error("expected the user's sessions to be revoked")
+	}
+	if err := service.DeleteUser(user.UUID, admin.UUID); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+}
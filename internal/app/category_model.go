@@ -0,0 +1,17 @@
+package app
+
+// Category is a node of the ads taxonomy; Names maps a locale ("ru", "en") to the display name.
+type Category struct {
+	ID       int64             `json:"id"`
+	ParentID *int64            `json:"parent_id,omitempty"`
+	Slug     string            `json:"slug"`
+	Names    map[string]string `json:"names"`
+	Name     string            `json:"name,omitempty"`
+	Children []Category        `json:"children,omitempty"`
+}
+
+type CategoryRequest struct {
+	ParentID *int64            `json:"parent_id"`
+	Slug     string            `json:"slug"`
+	Names    map[string]string `json:"names"`
+}
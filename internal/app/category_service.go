@@ -0,0 +1,156 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrCategoryNotFound  = errors.New("category not found")
+	ErrCategorySlugTaken = errors.New("category slug already exists")
+	ErrCategoryInUse     = errors.New("category has subcategories or ads")
+	ErrCategoryCycle     = errors.New("category cannot be moved under itself")
+)
+
+var categorySlugRe = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// CategoryTree returns the root categories with their children; lang selects Name, falling back to "ru".
+func (s *MarketService) CategoryTree(lang string) ([]Category, error) {
+	categories, err := s.Marketrepo.GetCategories()
+	if err != nil {
+		return nil, fmt.Errorf("getcategories error: %w", err)
+	}
+
+	children := make(map[int64][]Category)
+	var roots []Category
+	for _, c := range categories {
+		c.Name = localizedName(c.Names, lang)
+		if c.ParentID == nil {
+			roots = append(roots, c)
+		} else {
+			children[*c.ParentID] = append(children[*c.ParentID], c)
+		}
+	}
+
+	var attach func(nodes []Category) []Category
+	attach = func(nodes []Category) []Category {
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i].Slug < nodes[j].Slug })
+		for i := range nodes {
+			nodes[i].Children = attach(children[nodes[i].ID])
+		}
+		return nodes
+	}
+	return attach(roots), nil
+}
+
+func localizedName(names map[string]string, lang string) string {
+	if name, ok := names[lang]; ok {
+		return name
+	}
+	if name, ok := names["ru"]; ok {
+		return name
+	}
+	keys := make([]string, 0, len(names))
+	for k := range names {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if len(keys) == 0 {
+		return ""
+	}
+	return names[keys[0]]
+}
+
+func (s *MarketService) NewCategory(req CategoryRequest) (Category, error) {
+	category, err := s.categoryFromRequest(0, req)
+	if err != nil {
+		return Category{}, err
+	}
+	return s.Marketrepo.SaveCategory(category)
+}
+
+func (s *MarketService) UpdateCategory(id int64, req CategoryRequest) (Category, error) {
+	if _, err := s.Marketrepo.GetCategory(id); err != nil {
+		return Category{}, err
+	}
+	category, err := s.categoryFromRequest(id, req)
+	if err != nil {
+		return Category{}, err
+	}
+	return s.Marketrepo.UpdateCategory(category)
+}
+
+func (s *MarketService) DeleteCategory(id int64) error {
+	categories, err := s.Marketrepo.GetCategories()
+	if err != nil {
+		return fmt.Errorf("getcategories error: %w", err)
+	}
+	found := false
+	for _, c := range categories {
+		if c.ID == id {
+			found = true
+		}
+		if c.ParentID != nil && *c.ParentID == id {
+			return ErrCategoryInUse
+		}
+	}
+	if !found {
+		return ErrCategoryNotFound
+	}
+	hasAds, err := s.Marketrepo.CategoryHasAds(id)
+	if err != nil {
+		return fmt.Errorf("categoryhasads error: %w", err)
+	}
+	if hasAds {
+		return ErrCategoryInUse
+	}
+	return s.Marketrepo.DeleteCategory(id)
+}
+
+// categoryFromRequest validates req for the category id (0 for a new one).
+func (s *MarketService) categoryFromRequest(id int64, req CategoryRequest) (Category, error) {
+	req.Slug = strings.TrimSpace(req.Slug)
+	if !categorySlugRe.MatchString(req.Slug) {
+		return Category{}, errors.New("slug must contain only lowercase latin letters, digits and single hyphens")
+	}
+	names := make(map[string]string, len(req.Names))
+	for lang, name := range req.Names {
+		name = strings.TrimSpace(name)
+		if lang == "" || name == "" {
+			return Category{}, errors.New("category names must have a locale and a non-empty name")
+		}
+		names[lang] = name
+	}
+	if len(names) == 0 {
+		return Category{}, errors.New("category must have at least one name")
+	}
+
+	categories, err := s.Marketrepo.GetCategories()
+	if err != nil {
+		return Category{}, fmt.Errorf("getcategories error: %w", err)
+	}
+	parents := make(map[int64]*int64, len(categories))
+	for _, c := range categories {
+		if c.Slug == req.Slug && c.ID != id {
+			return Category{}, ErrCategorySlugTaken
+		}
+		parents[c.ID] = c.ParentID
+	}
+
+	if req.ParentID != nil {
+		if _, ok := parents[*req.ParentID]; !ok {
+			return Category{}, errors.New("parent category not found")
+		}
+		// walk up from the new parent: reaching id means the move would create a loop
+		for p := req.ParentID; p != nil; p = parents[*p] {
+			if *p == id {
+				return Category{}, ErrCategoryCycle
+			}
+		}
+	}
+
+	return Category{ID: id, ParentID: req.ParentID, Slug: req.Slug, Names: names}, nil
+}
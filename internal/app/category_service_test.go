@@ -0,0 +1,103 @@
+package app
+
+import (
+    "errors"
+    "testing"
+)
+
+func TestCategoryTree(t *testing.T) {
+    service := NewMarketService(&MockMarketRepo{Categories: testCategories()}, &MockUserRepo{Users: make(map[string]User)}, &MockBlobStore{})
+
+    tree, err := service.CategoryTree("en")
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if len(tree) != 1 || tree[0].Name != "Electronics" {
+        t.Fatalf("expected single root Electronics, got %+v", tree)
+    }
+    if len(tree[0].Children) != 1 || tree[0].Children[0].Slug != "phones" {
+        t.Errorf("expected phones under electronics, got %+v", tree[0].Children)
+    }
+
+    tree, err = service.CategoryTree("de")
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if tree[0].Name != "Электроника" {
+        t.Errorf("expected fallback to ru name, got %q", tree[0].Name)
+    }
+}
+
+func TestNewCategory(t *testing.T) {
+    service := NewMarketService(&MockMarketRepo{Categories: testCategories()}, &MockUserRepo{Users: make(map[string]User)}, &MockBlobStore{})
+    parent := int64(2)
+
+    created, err := service.NewCategory(CategoryRequest{ParentID: &parent, Slug: "smartphones", Names: map[string]string{"ru": "Смартфоны"}})
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if created.ID == 0 || *created.ParentID != parent {
+        t.Errorf("expected saved category under %d, got %+v", parent, created)
+    }
+
+    _, err = service.NewCategory(CategoryRequest{Slug: "phones", Names: map[string]string{"ru": "Телефоны"}})
+    if !errors.Is(err, ErrCategorySlugTaken) {
+        t.Errorf("expected ErrCategorySlugTaken, got %v", err)
+    }
+
+    missing := int64(42)
+    invalid := []CategoryRequest{
+        {Slug: "Bad Slug", Names: map[string]string{"ru": "Плохо"}},
+        {Slug: "no-names"},
+        {Slug: "blank-name", Names: map[string]string{"ru": "  "}},
+        {ParentID: &missing, Slug: "orphan", Names: map[string]string{"ru": "Сирота"}},
+    }
+    for _, req := range invalid {
+        if _, err := service.NewCategory(req); err == nil {
+            t.Errorf("expected validation error for %+v", req)
+        }
+    }
+}
+
+func TestUpdateCategory(t *testing.T) {
+    service := NewMarketService(&MockMarketRepo{Categories: testCategories()}, &MockUserRepo{Users: make(map[string]User)}, &MockBlobStore{})
+
+    child := int64(2)
+    _, err := service.UpdateCategory(1, CategoryRequest{ParentID: &child, Slug: "electronics", Names: map[string]string{"ru": "Электроника"}})
+    if !errors.Is(err, ErrCategoryCycle) {
+        t.Errorf("expected ErrCategoryCycle, got %v", err)
+    }
+
+    updated, err := service.UpdateCategory(2, CategoryRequest{Slug: "mobile", Names: map[string]string{"ru": "Мобильные"}})
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if updated.ParentID != nil || updated.Slug != "mobile" {
+        t.Errorf("expected mobile to become a root category, got %+v", updated)
+    }
+
+    _, err = service.UpdateCategory(42, CategoryRequest{Slug: "missing", Names: map[string]string{"ru": "Нет"}})
+    if !errors.Is(err, ErrCategoryNotFound) {
+        t.Errorf("expected ErrCategoryNotFound, got %v", err)
+    }
+}
+
+func TestDeleteCategory(t *testing.T) {
+    marketRepo := &MockMarketRepo{Categories: testCategories()}
+    service := NewMarketService(marketRepo, &MockUserRepo{Users: make(map[string]User)}, &MockBlobStore{})
+    marketRepo.Ads = append(marketRepo.Ads, Ad{Title: "Phone", CategoryID: 2})
+
+    if err := service.DeleteCategory(1); !errors.Is(err, ErrCategoryInUse) {
+        t.Errorf("expected ErrCategoryInUse for category with children, got %v", err)
+    }
+    if err := service.DeleteCategory(2); !errors.Is(err, ErrCategoryInUse) {
+        t.Errorf("expected ErrCategoryInUse for category with ads, got %v", err)
+    }
+    marketRepo.Ads = nil
+    if err := service.DeleteCategory(2); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if err := service.DeleteCategory(2); !errors.Is(err, ErrCategoryNotFound) {
+        t.Errorf("expected ErrCategoryNotFound, got %v", err)
+    }
+}
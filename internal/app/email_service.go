@@ -0,0 +1,111 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"marketplace/internal/config"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrEmailRequired            = errors.New("email is required")
+	ErrInvalidEmail             = errors.New("invalid email")
+	ErrEmailTaken               = errors.New("email is already used by another account")
+	ErrNoEmail                  = errors.New("user has no email")
+	ErrEmailAlreadyVerified     = errors.New("email is already verified")
+	ErrEmailNotVerified         = errors.New("email is not verified")
+	ErrInvalidVerificationToken = errors.New("invalid or expired email verification token")
+)
+
+// maxEmailLength is the longest address SMTP allows (RFC 5321).
+const maxEmailLength = 254
+
+// normalizeEmail trims and lower-cases the address and checks it's a bare addr-spec,
+// without a display name. An empty address stays empty.
+func normalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return "", nil
+	}
+	if len(email) > maxEmailLength {
+		return "", ErrInvalidEmail
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", ErrInvalidEmail
+	}
+	return email, nil
+}
+
+// VerifyEmail marks the address a verification link was sent to as verified. The link works
+// once, and not at all if the user's address has changed since it was sent.
+func (s *UserService) VerifyEmail(token string) (User, error) {
+	if token == "" {
+		return User{}, ErrInvalidVerificationToken
+	}
+	now := time.Now()
+	record, err := s.tokens.UseEmailVerificationToken(hashMailToken(token), now)
+	if err != nil {
+		return User{}, err
+	}
+	if err := s.repo.SetEmailVerified(record.UserID.String(), record.Email, now); err != nil {
+		return User{}, err
+	}
+	user, err := s.repo.FindByUUID(record.UserID.String())
+	if err != nil {
+		return User{}, ErrInvalidVerificationToken
+	}
+	return user, nil
+}
+
+// ResendVerification mails a new verification link; the earlier ones stop working.
+func (s *UserService) ResendVerification(userID uuid.UUID, config *config.Config) error {
+	user, err := s.repo.FindByUUID(userID.String())
+	if err != nil {
+		return ErrUserNotFound
+	}
+	if user.Email == "" {
+		return ErrNoEmail
+	}
+	if user.EmailVerifiedAt != nil {
+		return ErrEmailAlreadyVerified
+	}
+	return s.sendVerification(user, config)
+}
+
+func (s *UserService) sendVerification(user User, config *config.Config) error {
+	token, err := newMailToken()
+	if err != nil {
+		return fmt.Errorf("failed to generate verification token: %w", err)
+	}
+
+	now := time.Now()
+	if err := s.tokens.RevokeEmailVerificationTokens(user.UUID.String(), now); err != nil {
+		return fmt.Errorf("failed to revoke verification tokens: %w", err)
+	}
+	record := EmailVerificationToken{
+		ID:        hashMailToken(token),
+		UserID:    user.UUID,
+		Email:     user.Email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Duration(config.Email.VerifyTokenTTL) * time.Minute),
+	}
+	if err := s.tokens.SaveEmailVerificationToken(record); err != nil {
+		return fmt.Errorf("failed to save verification token: %w", err)
+	}
+
+	msg := Message{
+		To:      user.Email,
+		Subject: "Confirm your email",
+		Body: fmt.Sprintf("Hello, %s!\nTo confirm your email open %s?token=%s\nThe link is valid for %d minutes.\n",
+			user.Login, config.Email.VerifyURL, url.QueryEscape(token), config.Email.VerifyTokenTTL),
+	}
+	if err := s.mailer.Send(msg); err != nil {
+		return fmt.Errorf("failed to send verification mail: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package app
+
+import (
+	"errors"
+	"marketplace/internal/config"
+	"strings"
+	"testing"
+	"time"
+	"github.com/google/uuid"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	cases := []struct {
+		name     string
+		email    string
+		expected string
+		err      error
+	}{
+		{"empty", "", "", nil},
+		{"lower-cased and trimmed", "  Alice@Example.COM ", "alice@example.com", nil},
+		{"no domain", "alice", "", ErrInvalidEmail},
+		{"display name", "Alice <alice@example.com>", "", ErrInvalidEmail},
+		{"too long", strings.Repeat("a", 250) + "@example.com", "", ErrInvalidEmail},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := normalizeEmail(tc.email)
+			if got != tc.expected || !errors.Is(err, tc.err) {
+				t.Errorf("expected %q, %v, got %q, %v", tc.expected, tc.err, got, err)
+			}
+		})
+	}
+}
+
+func TestRegisterUser_Email(t *testing.T) {
+	cfg := &config.Config{
+		Username: config.Username{MinLength: 3, MaxLength: 20, AllowedCharacters: "A-Za-z0-9_-"},
+		Password: config.Password{MinLength: 8, MaxLength: 64},
+		Email:    config.Email{VerifyTokenTTL: 60, VerifyURL: "http://localhost/verify-email"},
+	}
+	repo := &MockUserRepo{Users: make(map[string]User)}
+	tokens := &MockTokenRepo{}
+	mailer := &MockMailer{}
+	service := NewUserService(repo, tokens, mailer, &MockIdentityProvider{})
+
+	user, err := service.RegisterUser(SignUpRequest{Login: "alice", Password: "Password1", Email: "Alice@Example.com"}, cfg)
+	if err != nil {
+		t.Fatalf("registration failed: %v", err)
+	}
+	if user.Email != "alice@example.com" || user.EmailVerifiedAt != nil {
+		t.Errorf("expected an unverified normalized email, got %+v", user)
+	}
+	if len(mailer.Sent) != 1 || mailer.Sent[0].To != "alice@example.com" || !strings.Contains(mailer.Sent[0].Body, "http://localhost/verify-email?token=") {
+		t.Errorf("expected a verification mail, got %+v", mailer.Sent)
+	}
+	if len(tokens.VerificationTokens) != 1 {
+		t.Errorf("expected a verification token to be stored, got %d", len(tokens.VerificationTokens))
+	}
+
+	if _, err := service.RegisterUser(SignUpRequest{Login: "bob", Password: "Password1", Email: "ALICE@example.com"}, cfg); !errors.Is(err, ErrEmailTaken) {
+		t.Errorf("expected ErrEmailTaken, got %v", err)
+	}
+	if _, err := service.RegisterUser(SignUpRequest{Login: "bob", Password: "Password1", Email: "bob"}, cfg); !errors.Is(err, ErrInvalidEmail) {
+		t.Errorf("expected ErrInvalidEmail, got %v", err)
+	}
+	if _, err := service.RegisterUser(SignUpRequest{Login: "bob", Password: "Password1"}, cfg); err != nil {
+		t.Errorf("expected the email to be optional, got %v", err)
+	}
+	cfg.Email.Required = true
+	if _, err := service.RegisterUser(SignUpRequest{Login: "carol", Password: "Password1"}, cfg); !errors.Is(err, ErrEmailRequired) {
+		t.Errorf("expected ErrEmailRequired, got %v", err)
+	}
+}
+
+func TestUserService_VerifyEmail(t *testing.T) {
+	cfg := &config.Config{Email: config.Email{VerifyTokenTTL: 60, VerifyURL: "http://localhost/verify-email"}}
+	user := User{UUID: uuid.New(), Login: "alice", Status: UserStatusActive, Email: "alice@example.com"}
+	repo := &MockUserRepo{Users: map[string]User{"alice": user}}
+	tokens := &MockTokenRepo{}
+	mailer := &MockMailer{}
+	service := NewUserService(repo, tokens, mailer, &MockIdentityProvider{})
+
+	resend := func(t *testing.T) string {
+		if err := service.ResendVerification(user.UUID, cfg); err != nil {
+			t.Fatalf("resend failed: %v", err)
+		}
+		return tokenFromMail(t, mailer)
+	}
+
+	t.Run("only the latest link works", func(t *testing.T) {
+		first := resend(t)
+		resend(t)
+		if _, err := service.VerifyEmail(first); !errors.Is(err, ErrInvalidVerificationToken) {
+			t.Errorf("expected an older token to be rejected, got %v", err)
+		}
+	})
+
+	t.Run("address changed since", func(t *testing.T) {
+		token := resend(t)
+		changed := repo.Users["alice"]
+		changed.Email = "new@example.com"
+		repo.Users["alice"] = changed
+		defer func() { repo.Users["alice"] = user }()
+		if _, err := service.VerifyEmail(token); !errors.Is(err, ErrInvalidVerificationToken) {
+			t.Errorf("expected ErrInvalidVerificationToken, got %v", err)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		token := resend(t)
+		stored := tokens.VerificationTokens[hashMailToken(token)]
+		stored.ExpiresAt = time.Now().Add(-time.Minute)
+		tokens.VerificationTokens[stored.ID] = stored
+		if _, err := service.VerifyEmail(token); !errors.Is(err, ErrInvalidVerificationToken) {
+			t.Errorf("expected an expired token to be rejected, got %v", err)
+		}
+	})
+
+	t.Run("success", func(t *testing.T) {
+		token := resend(t)
+		verified, err := service.VerifyEmail(token)
+		if err != nil {
+			t.Fatalf("verification failed: %v", err)
+		}
+		if verified.EmailVerifiedAt == nil {
+			t.Error("expected the email to be verified")
+		}
+		if _, err := service.VerifyEmail(token); !errors.Is(err, ErrInvalidVerificationToken) {
+			t.Errorf("expected a used token to be rejected, got %v", err)
+		}
+		if err := service.ResendVerification(user.UUID, cfg); !errors.Is(err, ErrEmailAlreadyVerified) {
+			t.Errorf("expected ErrEmailAlreadyVerified, got %v", err)
+		}
+	})
+
+	t.Run("no email", func(t *testing.T) {
+		noEmail := User{UUID: uuid.New(), Login: "noemail", Status: UserStatusActive}
+		repo.Users["noemail"] = noEmail
+		if err := service.ResendVerification(noEmail.UUID, cfg); !errors.Is(err, ErrNoEmail) {
+			t.Errorf("expected ErrNoEmail, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,12 @@
+package app
+
+import (
+	"io"
+)
+
+// BlobStore keeps uploaded files under slash-separated keys such as "ads/<uuid>/<id>.jpg".
+type BlobStore interface {
+	Put(key string, r io.Reader, contentType string) error
+	Open(key string) (io.ReadCloser, error) // ErrImageNotFound for unknown keys
+	Delete(key string) error
+}
@@ -0,0 +1,30 @@
+package app
+
+// AdImage is one picture of an ad gallery; exactly one image of a non-empty gallery is the cover.
+type AdImage struct {
+	ID       int64  `json:"id"`
+	URL      string `json:"url"`
+	Position int    `json:"position"`
+	IsCover  bool   `json:"is_cover"`
+	Key      string `json:"-"` // blob key, empty for images not stored by us
+	// Variants is nil for images stored before variants were generated.
+	Variants *ImageVariants `json:"variants,omitempty"`
+}
+
+// ImageVariants holds the URLs of the resized copies made when an image is stored.
+type ImageVariants struct {
+	Thumb  string `json:"thumb"`
+	Medium string `json:"medium"`
+	Large  string `json:"large"`
+}
+
+// ReorderImagesRequest lists every image id of the ad in the new order; CoverID optionally picks the cover.
+type ReorderImagesRequest struct {
+	Order   []int64 `json:"order"`
+	CoverID *int64  `json:"cover_id"`
+}
+
+type UploadedImage struct {
+	URL      string         `json:"url"`
+	Variants *ImageVariants `json:"variants"`
+}
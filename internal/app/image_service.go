@@ -0,0 +1,415 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"marketplace/internal/config"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"github.com/google/uuid"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+var (
+	ErrImageTooLarge   = errors.New("image is too large")
+	ErrImageType       = errors.New("unsupported image type")
+	ErrImageDimensions = errors.New("image dimensions are out of range")
+	ErrImageNotFound   = errors.New("image not found")
+	ErrTooManyImages   = errors.New("too many images for one ad")
+	ErrImageInUse      = errors.New("the image is already attached to an ad")
+)
+
+// imageFormats maps sniffed content types to the extensions accepted by ad.img_type.
+var imageFormats = map[string][]string{
+	"image/jpeg": {".jpg", ".jpeg"},
+	"image/png":  {".png"},
+	"image/webp": {".webp"},
+}
+
+// imageVariant is a resized copy made for every stored image. Crop variants are cut to the
+// exact size from the centre, the others keep the aspect ratio and fit into the box.
+// Images are never upscaled.
+type imageVariant struct {
+	name          string
+	width, height int
+	crop          bool
+}
+
+var imageVariants = []imageVariant{
+	{name: "thumb", width: 200, height: 200, crop: true},
+	{name: "medium", width: 640, height: 640},
+	{name: "large", width: 1280, height: 1280},
+}
+
+// UploadImage stores an image that is not attached to an ad yet; its URL can be passed to NewAd.
+func (s *MarketService) UploadImage(userid uuid.UUID, file io.Reader, config config.Config) (UploadedImage, error) {
+	key, err := s.storeImage(file, path.Join("uploads", userid.String()), config)
+	if err != nil {
+		return UploadedImage{}, err
+	}
+	return UploadedImage{URL: imageURL(config, key), Variants: variantURLs(config, key)}, nil
+}
+
+// UploadAdImage validates the uploaded file by its content rather than its name and appends
+// it to the ad gallery; the first image becomes the cover.
+func (s *MarketService) UploadAdImage(aduuid uuid.UUID, userid uuid.UUID, file io.Reader, config config.Config) (Ad, error) {
+	ad, err := s.ownedAd(aduuid, userid)
+	if err != nil {
+		return Ad{}, err
+	}
+	if ad.Status != AdStatusActive {
+		return Ad{}, ErrAdClosed
+	}
+	if len(ad.Images) >= config.Images.MaxPerAd {
+		return Ad{}, fmt.Errorf("%w: max %d", ErrTooManyImages, config.Images.MaxPerAd)
+	}
+
+	key, err := s.storeImage(file, path.Join("ads", aduuid.String()), config)
+	if err != nil {
+		return Ad{}, err
+	}
+	img, err := s.Marketrepo.AddAdImage(aduuid.String(), AdImage{
+		URL:      imageURL(config, key),
+		Key:      key,
+		Variants: variantURLs(config, key),
+		Position: len(ad.Images),
+		IsCover:  len(ad.Images) == 0,
+	})
+	if err != nil {
+		s.deleteBlobs([]AdImage{{Key: key, Variants: variantURLs(config, key)}})
+		return Ad{}, err
+	}
+	ad.Images = append(ad.Images, img)
+	return s.touchAd(ad)
+}
+
+// ReorderAdImages applies a new gallery order and/or cover.
+func (s *MarketService) ReorderAdImages(aduuid uuid.UUID, req ReorderImagesRequest, userid uuid.UUID) (Ad, error) {
+	ad, err := s.ownedAd(aduuid, userid)
+	if err != nil {
+		return Ad{}, err
+	}
+	if ad.Status != AdStatusActive {
+		return Ad{}, ErrAdClosed
+	}
+
+	images := ad.Images
+	if req.Order != nil {
+		byID := make(map[int64]AdImage, len(images))
+		for _, img := range images {
+			byID[img.ID] = img
+		}
+		if len(req.Order) != len(images) {
+			return Ad{}, errors.New("order must list every image of the ad exactly once")
+		}
+		images = make([]AdImage, 0, len(req.Order))
+		for _, id := range req.Order {
+			img, ok := byID[id]
+			if !ok {
+				return Ad{}, errors.New("order must list every image of the ad exactly once")
+			}
+			delete(byID, id)
+			images = append(images, img)
+		}
+	}
+	if req.CoverID != nil {
+		found := false
+		for i := range images {
+			images[i].IsCover = images[i].ID == *req.CoverID
+			found = found || images[i].IsCover
+		}
+		if !found {
+			return Ad{}, ErrImageNotFound
+		}
+	}
+
+	ad.Images = arrangeGallery(images)
+	if err := s.Marketrepo.SetAdImages(aduuid.String(), ad.Images); err != nil {
+		return Ad{}, err
+	}
+	return s.touchAd(ad)
+}
+
+// DeleteAdImage removes an image from the gallery; if it was the cover, the next image takes its place.
+func (s *MarketService) DeleteAdImage(aduuid uuid.UUID, imageID int64, userid uuid.UUID) (Ad, error) {
+	ad, err := s.ownedAd(aduuid, userid)
+	if err != nil {
+		return Ad{}, err
+	}
+	if ad.Status != AdStatusActive {
+		return Ad{}, ErrAdClosed
+	}
+
+	var removed *AdImage
+	images := make([]AdImage, 0, len(ad.Images))
+	for i, img := range ad.Images {
+		if img.ID == imageID {
+			removed = &ad.Images[i]
+			continue
+		}
+		images = append(images, img)
+	}
+	if removed == nil {
+		return Ad{}, ErrImageNotFound
+	}
+
+	ad.Images = arrangeGallery(images)
+	if err := s.Marketrepo.SetAdImages(aduuid.String(), ad.Images); err != nil {
+		return Ad{}, err
+	}
+	s.deleteBlobs([]AdImage{*removed})
+	return s.touchAd(ad)
+}
+
+// OpenImage returns a stored image by the key taken from its URL.
+func (s *MarketService) OpenImage(key string) (io.ReadCloser, error) {
+	if !validImageKey(key) {
+		return nil, ErrImageNotFound
+	}
+	return s.Blobs.Open(key)
+}
+
+func (s *MarketService) touchAd(ad Ad) (Ad, error) {
+	ad.UpdatedAt = time.Now()
+	return s.Marketrepo.UpdateAd(ad)
+}
+
+func (s *MarketService) deleteBlobs(images []AdImage) {
+	deleteAdBlobs(s.Blobs, images)
+}
+
+// deleteAdBlobs removes the stored files of the images and their resized variants.
+func deleteAdBlobs(blobs BlobStore, images []AdImage) {
+	for _, img := range images {
+		if img.Key == "" {
+			continue
+		}
+		blobs.Delete(img.Key)
+		if img.Variants != nil {
+			for _, v := range imageVariants {
+				blobs.Delete(variantKey(img.Key, v.name))
+			}
+		}
+	}
+}
+
+// storeImage checks the file content, size and dimensions and saves it under dir with a random name.
+func (s *MarketService) storeImage(file io.Reader, dir string, config config.Config) (string, error) {
+	data, err := io.ReadAll(io.LimitReader(file, config.Images.MaxBytes+1))
+	if err != nil {
+		return "", fmt.Errorf("read image error: %w", err)
+	}
+	if int64(len(data)) > config.Images.MaxBytes {
+		return "", fmt.Errorf("%w: max %d bytes", ErrImageTooLarge, config.Images.MaxBytes)
+	}
+	contentType, ext, err := imageFormat(data, config)
+	if err != nil {
+		return "", err
+	}
+	if err := checkImageSize(data, config); err != nil {
+		return "", err
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrImageType, err)
+	}
+
+	key := path.Join(dir, uuid.NewString()+ext)
+	if err := s.Blobs.Put(key, bytes.NewReader(data), contentType); err != nil {
+		return "", fmt.Errorf("store image error: %w", err)
+	}
+	for i, v := range imageVariants {
+		if err := s.storeVariant(src, key, v); err != nil {
+			s.Blobs.Delete(key)
+			for _, stored := range imageVariants[:i] {
+				s.Blobs.Delete(variantKey(key, stored.name))
+			}
+			return "", fmt.Errorf("store image variant %s error: %w", v.name, err)
+		}
+	}
+	return key, nil
+}
+
+func (s *MarketService) storeVariant(src image.Image, key string, v imageVariant) error {
+	dst := resizeImage(src, v)
+	var buf bytes.Buffer
+	var err error
+	contentType := "image/jpeg"
+	if path.Ext(variantKey(key, v.name)) == ".png" {
+		contentType = "image/png"
+		err = png.Encode(&buf, dst)
+	} else {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+	}
+	if err != nil {
+		return err
+	}
+	return s.Blobs.Put(variantKey(key, v.name), &buf, contentType)
+}
+
+// resizeImage scales src for the variant, cropping the centre first when the variant asks for it.
+func resizeImage(src image.Image, v imageVariant) image.Image {
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	srcRect := bounds
+	var dw, dh int
+	if v.crop {
+		// the largest centred part of the source with the variant's aspect ratio
+		cw, ch := w, w*v.height/v.width
+		if ch > h {
+			cw, ch = h*v.width/v.height, h
+		}
+		x, y := bounds.Min.X+(w-cw)/2, bounds.Min.Y+(h-ch)/2
+		srcRect = image.Rect(x, y, x+cw, y+ch)
+		dw, dh = min(v.width, cw), min(v.height, ch)
+	} else {
+		dw, dh = w, h
+		if w > v.width || h > v.height {
+			if w*v.height > h*v.width {
+				dw, dh = v.width, max(1, h*v.width/w)
+			} else {
+				dw, dh = max(1, w*v.height/h), v.height
+			}
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, srcRect, draw.Src, nil)
+	return dst
+}
+
+// variantKey names a variant after the original: ads/x/id.webp -> ads/x/id_thumb.jpg.
+// PNG keeps its format for transparency, everything else is re-encoded as JPEG.
+func variantKey(key, name string) string {
+	ext := path.Ext(key)
+	variantExt := ".jpg"
+	if strings.ToLower(ext) == ".png" {
+		variantExt = ".png"
+	}
+	return strings.TrimSuffix(key, ext) + "_" + name + variantExt
+}
+
+func variantURLs(config config.Config, key string) *ImageVariants {
+	return &ImageVariants{
+		Thumb:  imageURL(config, variantKey(key, "thumb")),
+		Medium: imageURL(config, variantKey(key, "medium")),
+		Large:  imageURL(config, variantKey(key, "large")),
+	}
+}
+
+// newGallery validates the images passed to NewAd: each one must be uploaded by the author via UploadImage
+// and not be attached to another ad, since deleting that ad would remove the shared file.
+func (s *MarketService) newGallery(images []AdImage, config config.Config, userid uuid.UUID) ([]AdImage, error) {
+	if len(images) > config.Images.MaxPerAd {
+		return nil, fmt.Errorf("%w: max %d", ErrTooManyImages, config.Images.MaxPerAd)
+	}
+	uploads := path.Join("uploads", userid.String()) + "/"
+	seen := make(map[string]bool, len(images))
+	covers := 0
+	for i, img := range images {
+		key, ok := imageKey(config, img.URL)
+		if !ok || !strings.HasPrefix(key, uploads) {
+			return nil, errors.New("images must be uploaded with POST /images first")
+		}
+		if seen[key] {
+			return nil, errors.New("the same image is listed twice")
+		}
+		seen[key] = true
+		if ext := filepath.Ext(strings.ToLower(key)); !config.Ad.AllowedImgTypesMap[ext] {
+			return nil, fmt.Errorf("image type %s is not allowed", ext)
+		}
+		if err := s.checkUpload(key); err != nil {
+			return nil, err
+		}
+		if img.IsCover {
+			covers++
+		}
+		images[i] = AdImage{URL: img.URL, Key: key, Variants: variantURLs(config, key), IsCover: img.IsCover}
+	}
+	if covers > 1 {
+		return nil, errors.New("only one image can be the cover")
+	}
+	return arrangeGallery(images), nil
+}
+
+// checkUpload makes sure the uploaded file is stored and still free to attach.
+func (s *MarketService) checkUpload(key string) error {
+	rc, err := s.Blobs.Open(key)
+	if errors.Is(err, ErrImageNotFound) {
+		return errors.New("images must be uploaded with POST /images first")
+	}
+	if err != nil {
+		return fmt.Errorf("open image error: %w", err)
+	}
+	rc.Close()
+	inUse, err := s.Marketrepo.ImageKeyInUse(key)
+	if err != nil {
+		return err
+	}
+	// only a fast path: the unique index on the key settles a race between two ads
+	if inUse {
+		return ErrImageInUse
+	}
+	return nil
+}
+
+// arrangeGallery numbers images by their order and makes the first one the cover if none is chosen.
+func arrangeGallery(images []AdImage) []AdImage {
+	hasCover := false
+	for i := range images {
+		images[i].Position = i
+		hasCover = hasCover || images[i].IsCover
+	}
+	if !hasCover && len(images) > 0 {
+		images[0].IsCover = true
+	}
+	return images
+}
+
+func imageFormat(data []byte, config config.Config) (string, string, error) {
+	contentType := http.DetectContentType(data)
+	for _, ext := range imageFormats[contentType] {
+		if config.Ad.AllowedImgTypesMap[ext] {
+			return contentType, ext, nil
+		}
+	}
+	return "", "", fmt.Errorf("%w: %s", ErrImageType, contentType)
+}
+
+func checkImageSize(data []byte, config config.Config) error {
+	img, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrImageType, err)
+	}
+	limits := config.Images
+	if img.Width < limits.MinWidth || img.Height < limits.MinHeight || img.Width > limits.MaxWidth || img.Height > limits.MaxHeight {
+		return fmt.Errorf("%w: got %dx%d, allowed from %dx%d to %dx%d", ErrImageDimensions,
+			img.Width, img.Height, limits.MinWidth, limits.MinHeight, limits.MaxWidth, limits.MaxHeight)
+	}
+	return nil
+}
+
+func imageURL(config config.Config, key string) string {
+	return config.Images.BaseURL + "/" + key
+}
+
+// imageKey extracts the blob key from a URL produced by imageURL.
+func imageKey(config config.Config, url string) (string, bool) {
+	key, ok := strings.CutPrefix(url, config.Images.BaseURL+"/")
+	if !ok || !validImageKey(key) {
+		return "", false
+	}
+	return key, true
+}
+
+func validImageKey(key string) bool {
+	return key != "" && !strings.HasPrefix(key, "/") && path.Clean(key) == key && !strings.HasPrefix(key, "..")
+}
@@ -0,0 +1,371 @@
+package app
+
+import (
+    "bytes"
+    "errors"
+    "image"
+    "image/jpeg"
+    "image/png"
+    "io"
+    "strings"
+    "testing"
+    "marketplace/internal/config"
+    "github.com/google/uuid"
+)
+
+func testPNG(t *testing.T, width, height int) []byte {
+    var buf bytes.Buffer
+    if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+        t.Fatalf("failed to encode png: %v", err)
+    }
+    return buf.Bytes()
+}
+
+func imageLimits(cfg config.Config) config.Config {
+    cfg.Images.MaxBytes = 1 << 20
+    cfg.Images.MinWidth, cfg.Images.MinHeight = 10, 10
+    cfg.Images.MaxWidth, cfg.Images.MaxHeight = 100, 100
+    cfg.Images.MaxPerAd = 3
+    return cfg
+}
+
+func TestUploadImage(t *testing.T) {
+    service, _, cfg, user, _ := newLifecycleService(t)
+    cfg = imageLimits(cfg)
+
+    uploaded, err := service.UploadImage(user.UUID, bytes.NewReader(testPNG(t, 50, 40)), cfg)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if !strings.HasPrefix(uploaded.URL, "/images/uploads/"+user.UUID.String()+"/") || !strings.HasSuffix(uploaded.URL, ".png") {
+        t.Fatalf("unexpected image url %q", uploaded.URL)
+    }
+
+    rc, err := service.OpenImage(strings.TrimPrefix(uploaded.URL, "/images/"))
+    if err != nil {
+        t.Fatalf("unexpected error opening image: %v", err)
+    }
+    data, _ := io.ReadAll(rc)
+    rc.Close()
+    if len(data) == 0 {
+        t.Error("expected stored image content")
+    }
+    if _, err := service.OpenImage("../secret"); !errors.Is(err, ErrImageNotFound) {
+        t.Errorf("expected ErrImageNotFound for path traversal, got %v", err)
+    }
+
+    ad, err := service.NewAd(Ad{
+        Title: "With upload",
+        Description: "Test Description for Ad",
+        Images: []AdImage{{URL: uploaded.URL}},
+        Price: 10,
+        CategoryID: 1,
+    }, cfg, user.UUID)
+    if err != nil {
+        t.Fatalf("unexpected error creating ad with uploaded image: %v", err)
+    }
+    if len(ad.Images) != 1 || ad.Images[0].URL != uploaded.URL || !ad.Images[0].IsCover {
+        t.Errorf("expected uploaded image to be the cover, got %+v", ad.Images)
+    }
+
+    // an upload belongs to one ad, and the URL must point to a stored file
+    for _, url := range []string{uploaded.URL, "/images/uploads/" + user.UUID.String() + "/missing.png"} {
+        _, err := service.NewAd(Ad{
+            Title: "Reused upload",
+            Description: "Test Description for Ad",
+            Images: []AdImage{{URL: url}},
+            Price: 10,
+            CategoryID: 1,
+        }, cfg, user.UUID)
+        if err == nil {
+            t.Errorf("expected %s to be rejected", url)
+        }
+        if url == uploaded.URL && !errors.Is(err, ErrImageInUse) {
+            t.Errorf("expected ErrImageInUse for a reused upload, got %v", err)
+        }
+    }
+}
+
+func blobSize(t *testing.T, blobs *MockBlobStore, url string) (int, int) {
+    data, ok := blobs.Blobs[strings.TrimPrefix(url, "/images/")]
+    if !ok {
+        t.Fatalf("expected %s to be stored", url)
+    }
+    img, _, err := image.DecodeConfig(bytes.NewReader(data))
+    if err != nil {
+        t.Fatalf("failed to decode %s: %v", url, err)
+    }
+    return img.Width, img.Height
+}
+
+func TestUploadImage_Variants(t *testing.T) {
+    service, _, cfg, user, _ := newLifecycleService(t)
+    blobs := service.Blobs.(*MockBlobStore)
+    cfg = imageLimits(cfg)
+
+    uploaded, err := service.UploadImage(user.UUID, bytes.NewReader(testPNG(t, 50, 40)), cfg)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    v := uploaded.Variants
+    if v == nil || !strings.HasSuffix(v.Thumb, "_thumb.png") || !strings.HasSuffix(v.Medium, "_medium.png") || !strings.HasSuffix(v.Large, "_large.png") {
+        t.Fatalf("unexpected variants %+v", v)
+    }
+    // small images are cropped but never upscaled
+    if w, h := blobSize(t, blobs, v.Thumb); w != 40 || h != 40 {
+        t.Errorf("expected a 40x40 thumb, got %dx%d", w, h)
+    }
+    if w, h := blobSize(t, blobs, v.Large); w != 50 || h != 40 {
+        t.Errorf("expected the large variant to keep 50x40, got %dx%d", w, h)
+    }
+
+    ad, err := service.NewAd(Ad{
+        Title: "With variants",
+        Description: "Test Description for Ad",
+        Images: []AdImage{{URL: uploaded.URL}},
+        Price: 10,
+        CategoryID: 1,
+    }, cfg, user.UUID)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if ad.Images[0].Variants == nil || *ad.Images[0].Variants != *v {
+        t.Errorf("expected the ad image to keep the variants, got %+v", ad.Images[0].Variants)
+    }
+
+    if err := service.DeleteAd(ad.UUID, user.UUID); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if _, ok := blobs.Blobs[strings.TrimPrefix(v.Thumb, "/images/")]; ok {
+        t.Error("expected variants to be removed with the ad")
+    }
+}
+
+func TestResizeImage(t *testing.T) {
+    src := image.NewRGBA(image.Rect(0, 0, 1000, 500))
+    tests := []struct {
+        variant       string
+        width, height int
+    }{
+        {"thumb", 200, 200},
+        {"medium", 640, 320},
+        {"large", 1000, 500},
+    }
+    for _, tc := range tests {
+        for _, v := range imageVariants {
+            if v.name != tc.variant {
+                continue
+            }
+            got := resizeImage(src, v).Bounds()
+            if got.Dx() != tc.width || got.Dy() != tc.height {
+                t.Errorf("%s: expected %dx%d, got %dx%d", tc.variant, tc.width, tc.height, got.Dx(), got.Dy())
+            }
+        }
+    }
+
+    if key := variantKey("ads/1/a.webp", "thumb"); key != "ads/1/a_thumb.jpg" {
+        t.Errorf("expected webp variants to be stored as jpeg, got %s", key)
+    }
+}
+
+func TestUploadAdImage_JPEGVariants(t *testing.T) {
+    service, _, cfg, user, created := newLifecycleService(t)
+    blobs := service.Blobs.(*MockBlobStore)
+    cfg = imageLimits(cfg)
+
+    var buf bytes.Buffer
+    if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 30, 60)), nil); err != nil {
+        t.Fatalf("failed to encode jpeg: %v", err)
+    }
+    ad, err := service.UploadAdImage(created.UUID, user.UUID, &buf, cfg)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    v := ad.Images[len(ad.Images)-1].Variants
+    if v == nil || !strings.HasSuffix(v.Medium, "_medium.jpg") {
+        t.Fatalf("unexpected variants %+v", v)
+    }
+    if w, h := blobSize(t, blobs, v.Thumb); w != 30 || h != 30 {
+        t.Errorf("expected a 30x30 thumb, got %dx%d", w, h)
+    }
+}
+
+func TestUploadAdImage(t *testing.T) {
+    service, _, cfg, user, created := newLifecycleService(t)
+    blobs := service.Blobs.(*MockBlobStore)
+    cfg = imageLimits(cfg)
+
+    ad, err := service.UploadAdImage(created.UUID, user.UUID, bytes.NewReader(testPNG(t, 50, 40)), cfg)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if len(ad.Images) != 2 {
+        t.Fatalf("expected image to be appended, got %+v", ad.Images)
+    }
+    added := ad.Images[1]
+    if added.IsCover || added.Position != 1 || !strings.HasPrefix(added.URL, "/images/ads/"+created.UUID.String()+"/") {
+        t.Errorf("unexpected appended image %+v", added)
+    }
+    if _, ok := blobs.Blobs[added.Key]; !ok {
+        t.Errorf("expected blob %q to be stored", added.Key)
+    }
+
+    if _, err := service.UploadAdImage(created.UUID, user.UUID, bytes.NewReader(testPNG(t, 20, 20)), cfg); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    _, err = service.UploadAdImage(created.UUID, user.UUID, bytes.NewReader(testPNG(t, 20, 20)), cfg)
+    if !errors.Is(err, ErrTooManyImages) {
+        t.Errorf("expected ErrTooManyImages, got %v", err)
+    }
+}
+
+func TestUploadAdImage_Fail(t *testing.T) {
+    service, _, cfg, user, created := newLifecycleService(t)
+    cfg = imageLimits(cfg)
+    cfg.Images.MaxBytes = 2048
+
+    gif := []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00;")
+    tests := []struct {
+        name     string
+        data     []byte
+        userID   uuid.UUID
+        expected error
+    }{
+        {"not an image", []byte("<html><script>alert(1)</script></html>"), user.UUID, ErrImageType},
+        {"format not allowed", gif, user.UUID, ErrImageType},
+        {"too small", testPNG(t, 5, 50), user.UUID, ErrImageDimensions},
+        {"too wide", testPNG(t, 101, 50), user.UUID, ErrImageDimensions},
+        {"too large", append(testPNG(t, 50, 50), make([]byte, 4096)...), user.UUID, ErrImageTooLarge},
+        {"not owner", testPNG(t, 50, 50), uuid.New(), ErrNotAdOwner},
+    }
+    blobs := service.Blobs.(*MockBlobStore)
+    stored := len(blobs.Blobs)
+    for _, tc := range tests {
+        t.Run(tc.name, func(t *testing.T) {
+            _, err := service.UploadAdImage(created.UUID, tc.userID, bytes.NewReader(tc.data), cfg)
+            if !errors.Is(err, tc.expected) {
+                t.Errorf("expected %v, got %v", tc.expected, err)
+            }
+        })
+    }
+    if len(blobs.Blobs) != stored {
+        t.Errorf("expected nothing to be stored, got %d new blobs", len(blobs.Blobs)-stored)
+    }
+
+    // a failed insert removes the original and its variants
+    marketRepo := service.Marketrepo.(*MockMarketRepo)
+    marketRepo.AddImageErr = errors.New("db is down")
+    if _, err := service.UploadAdImage(created.UUID, user.UUID, bytes.NewReader(testPNG(t, 50, 50)), cfg); err == nil {
+        t.Fatal("expected the repository error")
+    }
+    if len(blobs.Blobs) != stored {
+        t.Errorf("expected the stored files to be cleaned up, got %d left", len(blobs.Blobs)-stored)
+    }
+}
+
+// newGalleryService returns an ad with three stored images.
+func newGalleryService(t *testing.T) (*MarketService, User, Ad) {
+    service, _, cfg, user, created := newLifecycleService(t)
+    cfg = imageLimits(cfg)
+    var ad Ad
+    for i := 0; i < 2; i++ {
+        var err error
+        ad, err = service.UploadAdImage(created.UUID, user.UUID, bytes.NewReader(testPNG(t, 20, 20)), cfg)
+        if err != nil {
+            t.Fatalf("unexpected error: %v", err)
+        }
+    }
+    return service, user, ad
+}
+
+func imageIDs(images []AdImage) []int64 {
+    ids := make([]int64, len(images))
+    for i, img := range images {
+        ids[i] = img.ID
+    }
+    return ids
+}
+
+func TestReorderAdImages(t *testing.T) {
+    service, user, ad := newGalleryService(t)
+    ids := imageIDs(ad.Images)
+
+    reordered, err := service.ReorderAdImages(ad.UUID, ReorderImagesRequest{Order: []int64{ids[2], ids[0], ids[1]}}, user.UUID)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if got := imageIDs(reordered.Images); got[0] != ids[2] || got[1] != ids[0] || got[2] != ids[1] {
+        t.Errorf("unexpected order %v", got)
+    }
+    if !reordered.Images[1].IsCover || reordered.Images[0].Position != 0 {
+        t.Errorf("expected cover to stay with its image, got %+v", reordered.Images)
+    }
+
+    stored, _ := service.GetAd(ad.UUID, user.UUID)
+    if imageIDs(stored.Images)[0] != ids[2] {
+        t.Errorf("expected new order to be persisted, got %v", imageIDs(stored.Images))
+    }
+
+    reordered, err = service.ReorderAdImages(ad.UUID, ReorderImagesRequest{CoverID: &ids[1]}, user.UUID)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    for _, img := range reordered.Images {
+        if img.IsCover != (img.ID == ids[1]) {
+            t.Errorf("unexpected cover flag on %+v", img)
+        }
+    }
+
+    missing := int64(999)
+    invalid := []ReorderImagesRequest{
+        {Order: []int64{ids[0], ids[1]}},
+        {Order: []int64{ids[0], ids[0], ids[1]}},
+        {Order: []int64{ids[0], ids[1], missing}},
+        {CoverID: &missing},
+    }
+    for _, req := range invalid {
+        if _, err := service.ReorderAdImages(ad.UUID, req, user.UUID); err == nil {
+            t.Errorf("expected error for %+v", req)
+        }
+    }
+    if _, err := service.ReorderAdImages(ad.UUID, ReorderImagesRequest{CoverID: &ids[0]}, uuid.New()); !errors.Is(err, ErrNotAdOwner) {
+        t.Errorf("expected ErrNotAdOwner, got %v", err)
+    }
+}
+
+func TestDeleteAdImage(t *testing.T) {
+    service, user, ad := newGalleryService(t)
+    blobs := service.Blobs.(*MockBlobStore)
+    ids := imageIDs(ad.Images)
+    removedKey := ad.Images[1].Key
+
+    updated, err := service.DeleteAdImage(ad.UUID, ids[1], user.UUID)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if got := imageIDs(updated.Images); len(got) != 2 || got[1] != ids[2] || updated.Images[1].Position != 1 {
+        t.Errorf("expected remaining images to be compacted, got %+v", updated.Images)
+    }
+    if _, ok := blobs.Blobs[removedKey]; ok {
+        t.Error("expected deleted image blob to be removed")
+    }
+
+    updated, err = service.DeleteAdImage(ad.UUID, ids[0], user.UUID)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if len(updated.Images) != 1 || !updated.Images[0].IsCover {
+        t.Errorf("expected the next image to become the cover, got %+v", updated.Images)
+    }
+
+    if _, err := service.DeleteAdImage(ad.UUID, ids[0], user.UUID); !errors.Is(err, ErrImageNotFound) {
+        t.Errorf("expected ErrImageNotFound, got %v", err)
+    }
+
+    if err := service.DeleteAd(ad.UUID, user.UUID); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if len(blobs.Blobs) != 0 {
+        t.Errorf("expected ad images to be removed with the ad, %d left", len(blobs.Blobs))
+    }
+}
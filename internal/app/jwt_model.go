@@ -1,21 +1,112 @@
 package app
 
+import (
+	"crypto"
+	"time"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
 type JwtRequest struct {
 	Login    string `json:"login"`
 	Password string `json:"password"`
+	Device   Device `json:"-"`
 }
 
+// JwtResponse is a token pair, or with Type "2fa" a challenge token for LoginTwoFactor.
 type JwtResponse struct {
 	Type string `json:"type"`
-	AccessToken string `json:"access_token"`
-	RefreshToken string `json:"refresh_token"`
+	AccessToken string `json:"access_token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ChallengeToken string `json:"challenge_token,omitempty"`
 }
 
 type RefreshJwtRequest struct{
 	RefreshToken string `json:"refresh_token"`
+	Device       Device `json:"-"`
+}
+
+// Device describes the client that logged in or refreshed its tokens.
+type Device struct {
+	UserAgent string
+	IP        string
 }
 
 type JwtProvider struct{
 	accessSecret []byte
 	refreshSecret []byte
-}
\ No newline at end of file
+	signingKey *jwtKey // nil signs access tokens with HS256 and accessSecret
+	verifyKeys map[string]*jwtKey // by kid; when set, access tokens must be signed by one of them
+	issuer string
+	audience string
+	leeway time.Duration // allowed clock skew for exp, nbf and iat
+}
+
+// jwtKey is an asymmetric access token key loaded from config.JWTKey.
+type jwtKey struct {
+	id      string
+	method  jwt.SigningMethod
+	private crypto.Signer // nil for keys kept only for verification
+	public  crypto.PublicKey
+}
+
+// JWK is a public key in the JSON Web Key format (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// RefreshToken is the server-side record of an issued refresh token. Every token rotated
+// from one login shares its FamilyID, so a stolen token can be cut off with all its successors.
+type RefreshToken struct {
+	ID        string // jti claim
+	FamilyID  string
+	UserID    uuid.UUID
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time // set when the token is exchanged for a new pair
+	RevokedAt *time.Time
+}
+
+// PasswordResetToken is the server-side record of a password reset link. Only the SHA-256 of
+// the token is stored, so the links can't be recovered from the database.
+type PasswordResetToken struct {
+	ID        string // hex SHA-256 of the token sent by mail
+	UserID    uuid.UUID
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// EmailVerificationToken is the server-side record of an e-mail verification link; like
+// PasswordResetToken it's stored hashed. Email is the address the link was sent to.
+type EmailVerificationToken struct {
+	ID        string // hex SHA-256 of the token sent by mail
+	UserID    uuid.UUID
+	Email     string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// Session is a login as the user sees it: one per refresh token family, so its ID is the FamilyID
+// and the sid claim of its access tokens.
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     uuid.UUID `json:"-"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	Current    bool      `json:"current"`
+}
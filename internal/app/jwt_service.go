@@ -1,74 +1,290 @@
 package app
 
 import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
 	"marketplace/internal/config"
 	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
 	"time"
 	"github.com/golang-jwt/jwt/v5"
 )
 
 
+// typ claim values, so that an access token can't be used as a refresh token and vice versa.
+const (
+	tokenTypeAccess  = "access"
+	tokenTypeRefresh = "refresh"
+	tokenTypeChallenge = "2fa"
+)
 
 func NewJwtProvider(config *config.Config) *JwtProvider {
 	return &JwtProvider{
 		accessSecret: []byte(config.JWT_ACCESS_SECRET),
 		refreshSecret: []byte(config.JWT_REFRESH_SECRET),
+		issuer: config.JWT.Issuer,
+		audience: config.JWT.Audience,
+		leeway: time.Duration(config.JWT.Leeway) * time.Second,
 	}
 }
 
-func (j *JwtProvider) GenerateAccessToken(user User, config *config.Config) (string, error) {
-	claims := jwt.MapClaims{
-		"uuid":  user.UUID.String(),
-        "exp": time.Now().Add(time.Minute * time.Duration(config.JWT_EXP_ACCESS_TOKEN)).Unix(),
+// LoadJwtProvider is NewJwtProvider plus the asymmetric access token keys from config.JWT.
+func LoadJwtProvider(config *config.Config) (*JwtProvider, error) {
+	provider := NewJwtProvider(config)
+	if len(config.JWT.Keys) == 0 {
+		if config.JWT.SigningKey != "" {
+			return nil, fmt.Errorf("jwt signing key %q is not configured", config.JWT.SigningKey)
+		}
+		return provider, nil
+	}
+
+	provider.verifyKeys = make(map[string]*jwtKey, len(config.JWT.Keys))
+	for _, keyConfig := range config.JWT.Keys {
+		if keyConfig.ID == "" {
+			return nil, fmt.Errorf("jwt key %s has no kid", keyConfig.Path)
+		}
+		if _, ok := provider.verifyKeys[keyConfig.ID]; ok {
+			return nil, fmt.Errorf("duplicate jwt kid %q", keyConfig.ID)
+		}
+		key, err := loadJwtKey(keyConfig)
+		if err != nil {
+			return nil, err
+		}
+		provider.verifyKeys[key.id] = key
+	}
+
+	signing, ok := provider.verifyKeys[config.JWT.SigningKey]
+	if !ok {
+		return nil, fmt.Errorf("jwt signing key %q is not configured", config.JWT.SigningKey)
+	}
+	if signing.private == nil {
+		return nil, fmt.Errorf("jwt signing key %q has no private key", signing.id)
+	}
+	provider.signingKey = signing
+	return provider, nil
+}
+
+// loadJwtKey reads an RSA or Ed25519 key, private or public, from a PEM file.
+func loadJwtKey(keyConfig config.JWTKey) (*jwtKey, error) {
+	data, err := os.ReadFile(keyConfig.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read jwt key %q: %w", keyConfig.ID, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("jwt key %q is not PEM encoded", keyConfig.ID)
+	}
+
+	var parsed any
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("jwt key %q: unsupported PEM block %q", keyConfig.ID, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse jwt key %q: %w", keyConfig.ID, err)
+	}
+
+	key := &jwtKey{id: keyConfig.ID}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.private, key.public = k, &k.PublicKey
+	case ed25519.PrivateKey:
+		key.private, key.public = k, k.Public()
+	case *rsa.PublicKey, ed25519.PublicKey:
+		key.public = k
+	default:
+		return nil, fmt.Errorf("jwt key %q: only RSA and Ed25519 keys are supported", keyConfig.ID)
+	}
+	switch public := key.public.(type) {
+	case *rsa.PublicKey:
+		if public.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("jwt key %q: RSA keys must be at least 2048 bits", keyConfig.ID)
+		}
+		key.method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		key.method = jwt.SigningMethodEdDSA
+	}
+	return key, nil
+}
+
+// GenerateAccessToken signs an access token; sid is the login session (refresh token family) it belongs to.
+// The user's role is copied into the token, so a role change reaches the user with the next refresh.
+func (j *JwtProvider) GenerateAccessToken(user User, sid string, config *config.Config) (string, error) {
+	claims := j.claims(tokenTypeAccess, time.Minute * time.Duration(config.JWT_EXP_ACCESS_TOKEN))
+	claims["uuid"] = user.UUID.String()
+	claims["sid"] = sid
+	claims["role"] = user.Role
+	if user.Role == "" {
+		claims["role"] = RoleUser
+	}
+	if j.signingKey != nil {
+		token := jwt.NewWithClaims(j.signingKey.method, claims)
+		token.Header["kid"] = j.signingKey.id
+		return token.SignedString(j.signingKey.private)
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString(j.accessSecret)
 }
 
-func (j *JwtProvider) GenerateRefreshToken(user User, config *config.Config) (string, error) {
-	claims := jwt.MapClaims{
-		"uuid":  user.UUID.String(),
-        "exp": time.Now().Add(time.Hour * time.Duration(config.JWT_EXP_REFRESH_TOKEN)).Unix(),
-	}
+// GenerateRefreshToken signs a refresh token; jti is the id of its RefreshToken record.
+func (j *JwtProvider) GenerateRefreshToken(user User, jti string, config *config.Config) (string, error) {
+	claims := j.claims(tokenTypeRefresh, refreshTokenTTL(config))
+	claims["uuid"] = user.UUID.String()
+	claims["jti"] = jti
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString(j.refreshSecret)
 }
 
-func (j *JwtProvider) ValidateAccessToken(tokenStr string) (jwt.MapClaims, error) {
+// GenerateChallengeToken signs the token a user with two-factor authentication gets for the
+// password; it's exchanged for a token pair together with a code.
+func (j *JwtProvider) GenerateChallengeToken(user User, ttl time.Duration) (string, error) {
+	claims := j.claims(tokenTypeChallenge, ttl)
+	claims["uuid"] = user.UUID.String()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(j.refreshSecret)
+}
 
-    token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (any, error) {
-        return j.accessSecret, nil
+func (j *JwtProvider) ValidateChallengeToken(tokenStr string) (jwt.MapClaims, error) {
+    claims, err := j.validate(tokenStr, tokenTypeChallenge, []string{jwt.SigningMethodHS256.Alg()}, func(token *jwt.Token) (any, error) {
+        return j.refreshSecret, nil
     })
-    if err != nil || !token.Valid {
-        return nil, errors.New("invalid access token")
-    }
-    claims, ok := token.Claims.(jwt.MapClaims)
-    if !ok {
-        return nil, errors.New("invalid claims")
+    if err != nil {
+        return nil, errors.New("invalid challenge token")
     }
-    
-    exp, ok := claims["exp"].(float64)
-    if !ok || time.Unix(int64(exp), 0).Before(time.Now()) {
-        return nil, errors.New("token has expired")
+    return claims, nil
+}
+
+func (j *JwtProvider) ValidateAccessToken(tokenStr string) (jwt.MapClaims, error) {
+    claims, err := j.validate(tokenStr, tokenTypeAccess, j.accessMethods(), j.accessKey)
+    if err != nil {
+        return nil, errors.New("invalid access token")
     }
     return claims, nil
 }
 
 func (j *JwtProvider) ValidateRefreshToken(tokenStr string) (jwt.MapClaims, error) {
-    token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (any, error) {
+    claims, err := j.validate(tokenStr, tokenTypeRefresh, []string{jwt.SigningMethodHS256.Alg()}, func(token *jwt.Token) (any, error) {
         return j.refreshSecret, nil
     })
-    if err != nil || !token.Valid {
+    if err != nil {
         return nil, errors.New("invalid refresh token")
     }
-    claims, ok := token.Claims.(jwt.MapClaims)
-    if !ok {
-        return nil, errors.New("invalid claims")
-    }
-    
-    exp, ok := claims["exp"].(float64)
-    if !ok || time.Unix(int64(exp), 0).Before(time.Now()) {
-        return nil, errors.New("token has expired")
-    }
     return claims, nil
-}
\ No newline at end of file
+}
+
+// claims starts a token of the given type with the registered claims every token carries.
+func (j *JwtProvider) claims(typ string, ttl time.Duration) jwt.MapClaims {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"typ": typ,
+		"iat": now.Unix(),
+		"nbf": now.Unix(),
+		"exp": now.Add(ttl).Unix(),
+	}
+	if j.issuer != "" {
+		claims["iss"] = j.issuer
+	}
+	if j.audience != "" {
+		claims["aud"] = j.audience
+	}
+	return claims
+}
+
+// validate checks the signature with one of the allowed methods, the time claims with leeway,
+// the issuer and audience when configured, and the typ claim.
+func (j *JwtProvider) validate(tokenStr, typ string, methods []string, keyFunc jwt.Keyfunc) (jwt.MapClaims, error) {
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(methods),
+		jwt.WithLeeway(j.leeway),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	}
+	if j.issuer != "" {
+		options = append(options, jwt.WithIssuer(j.issuer))
+	}
+	if j.audience != "" {
+		options = append(options, jwt.WithAudience(j.audience))
+	}
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(tokenStr, claims, keyFunc, options...); err != nil {
+		return nil, err
+	}
+	if iat, err := claims.GetIssuedAt(); err != nil || iat == nil {
+		return nil, errors.New("token has no iat claim")
+	}
+	if nbf, err := claims.GetNotBefore(); err != nil || nbf == nil {
+		return nil, errors.New("token has no nbf claim")
+	}
+	if claims["typ"] != typ {
+		return nil, fmt.Errorf("expected a %s token, got %v", typ, claims["typ"])
+	}
+	return claims, nil
+}
+
+// accessMethods lists the algorithms access tokens may be signed with.
+func (j *JwtProvider) accessMethods() []string {
+	if j.verifyKeys == nil {
+		return []string{jwt.SigningMethodHS256.Alg()}
+	}
+	methods := []string{}
+	for _, key := range j.verifyKeys {
+		methods = append(methods, key.method.Alg())
+	}
+	return methods
+}
+
+// accessKey picks the verification key by the kid header. Once asymmetric keys are configured,
+// only tokens signed by one of them with its own algorithm are accepted.
+func (j *JwtProvider) accessKey(token *jwt.Token) (any, error) {
+	if j.verifyKeys == nil {
+		return j.accessSecret, nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	key, ok := j.verifyKeys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s for kid %q", token.Method.Alg(), kid)
+	}
+	return key.public, nil
+}
+
+// JWKS publishes the public halves of the access token keys so other services can verify tokens locally.
+func (j *JwtProvider) JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range j.verifyKeys {
+		jwk := JWK{Kid: key.id, Use: "sig", Alg: key.method.Alg()}
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	sort.Slice(set.Keys, func(a, b int) bool { return set.Keys[a].Kid < set.Keys[b].Kid })
+	return set
+}
+
+func refreshTokenTTL(config *config.Config) time.Duration {
+	return time.Hour * time.Duration(config.JWT_EXP_REFRESH_TOKEN)
+}
@@ -1,9 +1,21 @@
 package app
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
 	"marketplace/internal/config"
+	"math/big"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 )
 
@@ -11,7 +23,7 @@ func TestJwtProvider_AccessToken(t *testing.T) {
     cfg := &config.Config{JWT_ACCESS_SECRET: "secret", JWT_EXP_ACCESS_TOKEN: 15}
     jwtProvider := NewJwtProvider(cfg)
     user := User{UUID: uuid.New(), Login: "user"}
-    token, err := jwtProvider.GenerateAccessToken(user, cfg)
+    token, err := jwtProvider.GenerateAccessToken(user, "session-id", cfg)
     if err != nil {
         t.Fatalf("failed to generate token: %v", err)
     }
@@ -22,13 +34,23 @@ func TestJwtProvider_AccessToken(t *testing.T) {
     if claims["uuid"] != user.UUID.String() {
         t.Errorf("expected uuid %v, got %v", user.UUID.String(), claims["uuid"])
     }
+    if claims["sid"] != "session-id" {
+        t.Errorf("expected sid session-id, got %v", claims["sid"])
+    }
+    if claims["role"] != RoleUser {
+        t.Errorf("expected users without a role to get %q, got %v", RoleUser, claims["role"])
+    }
+    admin, _ := jwtProvider.GenerateAccessToken(User{UUID: uuid.New(), Role: RoleAdmin}, "session-id", cfg)
+    if claims, _ := jwtProvider.ValidateAccessToken(admin); claims["role"] != RoleAdmin {
+        t.Errorf("expected role %q, got %v", RoleAdmin, claims["role"])
+    }
 }
 
 func TestJwtProvider_RefreshToken(t *testing.T) {
     cfg := &config.Config{JWT_REFRESH_SECRET: "secret", JWT_EXP_REFRESH_TOKEN: 24}
     jwtProvider := NewJwtProvider(cfg)
     user := User{UUID: uuid.New(), Login: "user"}
-    token, err := jwtProvider.GenerateRefreshToken(user, cfg)
+    token, err := jwtProvider.GenerateRefreshToken(user, "token-id", cfg)
     if err != nil {
         t.Fatalf("failed to generate token: %v", err)
     }
@@ -39,4 +61,263 @@ func TestJwtProvider_RefreshToken(t *testing.T) {
     if claims["uuid"] != user.UUID.String() {
         t.Errorf("expected uuid %v, got %v", user.UUID.String(), claims["uuid"])
     }
-}
\ No newline at end of file
+    if claims["jti"] != "token-id" {
+        t.Errorf("expected jti token-id, got %v", claims["jti"])
+    }
+}
+// writeKey stores key as a PEM file in dir and returns its config entry.
+func writeKey(t *testing.T, dir, kid string, key any) config.JWTKey {
+    t.Helper()
+    var block *pem.Block
+    switch k := key.(type) {
+    case *rsa.PrivateKey, ed25519.PrivateKey:
+        der, err := x509.MarshalPKCS8PrivateKey(k)
+        if err != nil {
+            t.Fatalf("failed to marshal key: %v", err)
+        }
+        block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+    default:
+        der, err := x509.MarshalPKIXPublicKey(k)
+        if err != nil {
+            t.Fatalf("failed to marshal key: %v", err)
+        }
+        block = &pem.Block{Type: "PUBLIC KEY", Bytes: der}
+    }
+    path := filepath.Join(dir, kid+".pem")
+    if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+        t.Fatalf("failed to write key: %v", err)
+    }
+    return config.JWTKey{ID: kid, Path: path}
+}
+
+func TestLoadJwtProvider_AsymmetricKeys(t *testing.T) {
+    dir := t.TempDir()
+    rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+    _, edKey, _ := ed25519.GenerateKey(rand.Reader)
+    keys := []config.JWTKey{writeKey(t, dir, "rsa", rsaKey), writeKey(t, dir, "ed", edKey)}
+    user := User{UUID: uuid.New(), Login: "user"}
+
+    for _, tc := range []struct{ kid, alg string }{{"rsa", "RS256"}, {"ed", "EdDSA"}} {
+        t.Run(tc.alg, func(t *testing.T) {
+            cfg := &config.Config{JWT_ACCESS_SECRET: "secret", JWT_EXP_ACCESS_TOKEN: 15, JWT: config.JWT{SigningKey: tc.kid, Keys: keys}}
+            provider, err := LoadJwtProvider(cfg)
+            if err != nil {
+                t.Fatalf("failed to load keys: %v", err)
+            }
+            token, err := provider.GenerateAccessToken(user, "sid", cfg)
+            if err != nil {
+                t.Fatalf("failed to generate token: %v", err)
+            }
+            parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+            if err != nil {
+                t.Fatalf("failed to parse token: %v", err)
+            }
+            if parsed.Header["kid"] != tc.kid || parsed.Header["alg"] != tc.alg {
+                t.Errorf("expected kid %s and alg %s, got %v", tc.kid, tc.alg, parsed.Header)
+            }
+            claims, err := provider.ValidateAccessToken(token)
+            if err != nil || claims["uuid"] != user.UUID.String() {
+                t.Errorf("expected a valid token, got %v, %v", claims, err)
+            }
+
+            hs256, _ := NewJwtProvider(cfg).GenerateAccessToken(user, "sid", cfg)
+            if _, err := provider.ValidateAccessToken(hs256); err == nil {
+                t.Error("expected HS256 tokens to be rejected once keys are configured")
+            }
+        })
+    }
+
+    t.Run("algorithm must match the key", func(t *testing.T) {
+        cfg := &config.Config{JWT_EXP_ACCESS_TOKEN: 15, JWT: config.JWT{SigningKey: "rsa", Keys: keys}}
+        provider, _ := LoadJwtProvider(cfg)
+        // an HS256 token keyed with the public key must not pass as the RSA key
+        public, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+        forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"uuid": user.UUID.String(), "sid": "sid", "exp": time.Now().Add(time.Minute).Unix()})
+        forged.Header["kid"] = "rsa"
+        token, _ := forged.SignedString(public)
+        if _, err := provider.ValidateAccessToken(token); err == nil {
+            t.Error("expected a token with a foreign algorithm to be rejected")
+        }
+    })
+}
+
+func TestLoadJwtProvider_Rotation(t *testing.T) {
+    dir := t.TempDir()
+    oldKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+    _, newKey, _ := ed25519.GenerateKey(rand.Reader)
+    user := User{UUID: uuid.New(), Login: "user"}
+
+    oldCfg := &config.Config{JWT_EXP_ACCESS_TOKEN: 15, JWT: config.JWT{SigningKey: "old", Keys: []config.JWTKey{writeKey(t, dir, "old", oldKey)}}}
+    oldProvider, err := LoadJwtProvider(oldCfg)
+    if err != nil {
+        t.Fatalf("failed to load keys: %v", err)
+    }
+    oldToken, _ := oldProvider.GenerateAccessToken(user, "sid", oldCfg)
+
+    // the retired key is kept as a public key only
+    retired := writeKey(t, dir, "old-public", &oldKey.PublicKey)
+    retired.ID = "old"
+    next := writeKey(t, dir, "new", newKey)
+    newCfg := &config.Config{JWT_EXP_ACCESS_TOKEN: 15, JWT: config.JWT{SigningKey: "new", Keys: []config.JWTKey{next, retired}}}
+    newProvider, err := LoadJwtProvider(newCfg)
+    if err != nil {
+        t.Fatalf("failed to load keys: %v", err)
+    }
+    newToken, _ := newProvider.GenerateAccessToken(user, "sid", newCfg)
+
+    if _, err := newProvider.ValidateAccessToken(oldToken); err != nil {
+        t.Errorf("expected tokens of the retired key to stay valid, got %v", err)
+    }
+    if _, err := newProvider.ValidateAccessToken(newToken); err != nil {
+        t.Errorf("expected tokens of the new key to be valid, got %v", err)
+    }
+    if _, err := oldProvider.ValidateAccessToken(newToken); err == nil {
+        t.Error("expected an unknown kid to be rejected")
+    }
+
+    jwks := newProvider.JWKS()
+    if len(jwks.Keys) != 2 {
+        t.Fatalf("expected 2 keys, got %+v", jwks.Keys)
+    }
+    edJWK, rsaJWK := jwks.Keys[0], jwks.Keys[1]
+    if edJWK.Kid != "new" || edJWK.Kty != "OKP" || edJWK.Crv != "Ed25519" || edJWK.Alg != "EdDSA" || edJWK.Use != "sig" {
+        t.Errorf("unexpected Ed25519 JWK: %+v", edJWK)
+    }
+    if x, _ := base64.RawURLEncoding.DecodeString(edJWK.X); !bytes.Equal(x, newKey.Public().(ed25519.PublicKey)) {
+        t.Error("Ed25519 JWK does not hold the public key")
+    }
+    if rsaJWK.Kid != "old" || rsaJWK.Kty != "RSA" || rsaJWK.Alg != "RS256" || rsaJWK.E != "AQAB" {
+        t.Errorf("unexpected RSA JWK: %+v", rsaJWK)
+    }
+    if n, _ := base64.RawURLEncoding.DecodeString(rsaJWK.N); new(big.Int).SetBytes(n).Cmp(oldKey.N) != 0 {
+        t.Error("RSA JWK does not hold the modulus")
+    }
+    if keys := NewJwtProvider(newCfg).JWKS().Keys; keys == nil || len(keys) != 0 {
+        t.Errorf("expected an empty key set for HS256, got %+v", keys)
+    }
+}
+
+func TestLoadJwtProvider_InvalidConfig(t *testing.T) {
+    dir := t.TempDir()
+    rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+    weakKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+    private := writeKey(t, dir, "key", rsaKey)
+    public := writeKey(t, dir, "public", &rsaKey.PublicKey)
+    weak := writeKey(t, dir, "weak", weakKey)
+    garbage := filepath.Join(dir, "garbage.pem")
+    os.WriteFile(garbage, []byte("not a key"), 0o600)
+
+    cases := []struct {
+        name string
+        jwt  config.JWT
+    }{
+        {"unknown signing key", config.JWT{SigningKey: "missing", Keys: []config.JWTKey{private}}},
+        {"signing key without keys", config.JWT{SigningKey: "key"}},
+        {"public signing key", config.JWT{SigningKey: "public", Keys: []config.JWTKey{public}}},
+        {"duplicate kid", config.JWT{SigningKey: "key", Keys: []config.JWTKey{private, private}}},
+        {"missing kid", config.JWT{SigningKey: "key", Keys: []config.JWTKey{private, {Path: public.Path}}}},
+        {"weak RSA key", config.JWT{SigningKey: "key", Keys: []config.JWTKey{private, weak}}},
+        {"not PEM", config.JWT{SigningKey: "key", Keys: []config.JWTKey{private, {ID: "garbage", Path: garbage}}}},
+        {"missing file", config.JWT{SigningKey: "key", Keys: []config.JWTKey{private, {ID: "gone", Path: filepath.Join(dir, "gone.pem")}}}},
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            if _, err := LoadJwtProvider(&config.Config{JWT: tc.jwt}); err == nil {
+                t.Error("expected an error")
+            }
+        })
+    }
+}
+
+func TestJwtProvider_StandardClaims(t *testing.T) {
+    // the same secret for both token types, as in config/local.yaml
+    cfg := &config.Config{
+        JWT_ACCESS_SECRET: "secret", JWT_REFRESH_SECRET: "secret", JWT_EXP_ACCESS_TOKEN: 15, JWT_EXP_REFRESH_TOKEN: 24,
+        JWT: config.JWT{Issuer: "marketplace", Audience: "marketplace-api", Leeway: 30},
+    }
+    jwtProvider := NewJwtProvider(cfg)
+    user := User{UUID: uuid.New(), Login: "user"}
+
+    access, _ := jwtProvider.GenerateAccessToken(user, "sid", cfg)
+    refresh, _ := jwtProvider.GenerateRefreshToken(user, "jti", cfg)
+    claims, err := jwtProvider.ValidateAccessToken(access)
+    if err != nil {
+        t.Fatalf("failed to validate token: %v", err)
+    }
+    if claims["iss"] != "marketplace" || claims["aud"] != "marketplace-api" || claims["typ"] != "access" || claims["iat"] == nil || claims["nbf"] == nil {
+        t.Errorf("expected the standard claims, got %v", claims)
+    }
+    if _, err := jwtProvider.ValidateRefreshToken(refresh); err != nil {
+        t.Errorf("failed to validate refresh token: %v", err)
+    }
+
+    t.Run("token types are not interchangeable", func(t *testing.T) {
+        if _, err := jwtProvider.ValidateRefreshToken(access); err == nil {
+            t.Error("expected an access token to be rejected as a refresh token")
+        }
+        if _, err := jwtProvider.ValidateAccessToken(refresh); err == nil {
+            t.Error("expected a refresh token to be rejected as an access token")
+        }
+    })
+
+    now := time.Now()
+    valid := func() jwt.MapClaims {
+        return jwt.MapClaims{
+            "uuid": user.UUID.String(), "sid": "sid", "typ": "access", "iss": "marketplace", "aud": "marketplace-api",
+            "iat": now.Unix(), "nbf": now.Unix(), "exp": now.Add(time.Minute).Unix(),
+        }
+    }
+    sign := func(method jwt.SigningMethod, claims jwt.MapClaims) string {
+        key := any([]byte("secret"))
+        if method == jwt.SigningMethodNone {
+            key = jwt.UnsafeAllowNoneSignatureType
+        }
+        token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+        if err != nil {
+            t.Fatalf("failed to sign token: %v", err)
+        }
+        return token
+    }
+    with := func(key string, value any) jwt.MapClaims {
+        claims := valid()
+        if value == nil {
+            delete(claims, key)
+        } else {
+            claims[key] = value
+        }
+        return claims
+    }
+
+    cases := []struct {
+        name   string
+        token  string
+        accept bool
+    }{
+        {"valid", sign(jwt.SigningMethodHS256, valid()), true},
+        {"alg none", sign(jwt.SigningMethodNone, valid()), false},
+        {"other HMAC", sign(jwt.SigningMethodHS384, valid()), false},
+        {"wrong issuer", sign(jwt.SigningMethodHS256, with("iss", "someone-else")), false},
+        {"no issuer", sign(jwt.SigningMethodHS256, with("iss", nil)), false},
+        {"wrong audience", sign(jwt.SigningMethodHS256, with("aud", "other-api")), false},
+        {"no typ", sign(jwt.SigningMethodHS256, with("typ", nil)), false},
+        {"no iat", sign(jwt.SigningMethodHS256, with("iat", nil)), false},
+        {"no nbf", sign(jwt.SigningMethodHS256, with("nbf", nil)), false},
+        {"no exp", sign(jwt.SigningMethodHS256, with("exp", nil)), false},
+        {"issued in the future", sign(jwt.SigningMethodHS256, with("iat", now.Add(time.Minute).Unix())), false},
+        {"not valid yet", sign(jwt.SigningMethodHS256, with("nbf", now.Add(time.Minute).Unix())), false},
+        {"nbf within leeway", sign(jwt.SigningMethodHS256, with("nbf", now.Add(10*time.Second).Unix())), true},
+        {"expired", sign(jwt.SigningMethodHS256, with("exp", now.Add(-time.Minute).Unix())), false},
+        {"expired within leeway", sign(jwt.SigningMethodHS256, with("exp", now.Add(-10*time.Second).Unix())), true},
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            _, err := jwtProvider.ValidateAccessToken(tc.token)
+            if tc.accept && err != nil {
+                t.Errorf("expected the token to be accepted, got %v", err)
+            }
+            if !tc.accept && err == nil {
+                t.Error("expected the token to be rejected")
+            }
+        })
+    }
+}
@@ -0,0 +1,6 @@
+package app
+
+// Mailer delivers messages to users, e.g. password reset links.
+type Mailer interface {
+	Send(msg Message) error
+}
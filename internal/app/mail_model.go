@@ -0,0 +1,7 @@
+package app
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
@@ -1,16 +1,49 @@
 package app
 
 import(
+	"io"
 	"marketplace/internal/config"
 	"github.com/google/uuid"
 )
 
 type MarketServicer interface {
 	NewAd(ad Ad, config config.Config, userid uuid.UUID) (Ad, error)
-	AdsList(params AdsListParams, id uuid.UUID) ([]AdsListResponse, error)
+	AdsList(params AdsListParams, id uuid.UUID) (AdsPage, error)
+	AdsFeed(params AdsListParams, cursor string, id uuid.UUID) (AdsFeedResponse, error)
+	GetAd(aduuid uuid.UUID, userid uuid.UUID) (Ad, error)
+	UpdateAd(aduuid uuid.UUID, req UpdateAdRequest, config config.Config, userid uuid.UUID) (Ad, error)
+	DeleteAd(aduuid uuid.UUID, userid uuid.UUID) error
+	CloseAd(aduuid uuid.UUID, req CloseAdRequest, userid uuid.UUID) (Ad, error)
+	UploadImage(userid uuid.UUID, file io.Reader, config config.Config) (UploadedImage, error)
+	UploadAdImage(aduuid uuid.UUID, userid uuid.UUID, file io.Reader, config config.Config) (Ad, error)
+	ReorderAdImages(aduuid uuid.UUID, req ReorderImagesRequest, userid uuid.UUID) (Ad, error)
+	DeleteAdImage(aduuid uuid.UUID, imageID int64, userid uuid.UUID) (Ad, error)
+	OpenImage(key string) (io.ReadCloser, error)
+	CategoryTree(lang string) ([]Category, error)
+	NewCategory(req CategoryRequest) (Category, error)
+	UpdateCategory(id int64, req CategoryRequest) (Category, error)
+	DeleteCategory(id int64) error
 }
 
 type MarketRepository interface {
 	SaveAd(ad Ad) (Ad, error)
 	GetAdsList(params AdsListParams, user_id string) ([]AdsListResponse, error)
-}
\ No newline at end of file
+	CountAds(params AdsListParams) (int, error)
+	GetAdByUUID(uuid string) (Ad, error)
+	// GetUserAds lists the user's ads in every status, newest first.
+	GetUserAds(userID string, limit int, offset int) ([]Ad, error)
+	CountUserAds(userID string) (int, error)
+	UpdateAd(ad Ad) (Ad, error)
+	DeleteAd(uuid string) error
+	AddAdImage(aduuid string, image AdImage) (AdImage, error)
+	SetAdImages(aduuid string, images []AdImage) error
+	// ImageKeyInUse reports whether any ad image refers to the stored file. A file attached to
+	// two ads makes SaveAd and AddAdImage fail with ErrImageInUse.
+	ImageKeyInUse(key string) (bool, error)
+	SaveCategory(category Category) (Category, error)
+	GetCategories() ([]Category, error)
+	GetCategory(id int64) (Category, error)
+	UpdateCategory(category Category) (Category, error)
+	DeleteCategory(id int64) error
+	CategoryHasAds(id int64) (bool, error)
+}
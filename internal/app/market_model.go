@@ -5,38 +5,99 @@ import (
 	"github.com/google/uuid"
 )
 
+const (
+	AdStatusActive = "active"
+	AdStatusSold   = "sold"
+	AdStatusClosed = "closed"
+)
+
 type Ad struct {
 	ID          int64 	  `json:"id"`
 	UUID        uuid.UUID `json:"uuid"`
 	Title       string    `json:"title"`
 	Description string    `json:"description"`
-	ImageURL    string    `json:"image_url"`
+	Images      []AdImage `json:"images"`
 	UserID      uuid.UUID `json:"user_id"`
 	Username    string    `json:"username"`
 	Price       float64   `json:"price"`
+	CategoryID  int64     `json:"category_id,omitempty"`
+	Status      string    `json:"status"`
 	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
 	Owner      	bool      `json:"owner,omitempty"` 
 }
 
 type AdsListResponse struct {
-	Title       string    `json:"title"`
-	Description string    `json:"description"`
-	ImageURL    string    `json:"image_url"`
-	Username    string    `json:"username"`
-	Price       float64   `json:"price"`
-	Owner      	bool      `json:"owner,omitempty"`
+	ID          int64      `json:"-"`
+	UUID        uuid.UUID  `json:"uuid"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	ImageURL    string     `json:"image_url,omitempty"` // cover image
+	Images      *ImageVariants `json:"images,omitempty"`  // resized copies of the cover
+	Username    string     `json:"username"`
+	Price       float64    `json:"price"`
+	CategoryID  int64      `json:"category_id,omitempty"`
+	Owner      	bool       `json:"owner,omitempty"`
+	Snippet     *AdSnippet `json:"snippet,omitempty"`
+	CreatedAt   time.Time  `json:"-"`
+}
+
+// AdSnippet holds search matches wrapped in <mark></mark>; filled only when searching by q.
+type AdSnippet struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+// UpdateAdRequest is a partial update: only non-nil fields are changed.
+type UpdateAdRequest struct {
+	Title       *string  `json:"title"`
+	Description *string  `json:"description"`
+	Price       *float64 `json:"price"`
+	CategoryID  *int64   `json:"category_id"`
+}
+
+type CloseAdRequest struct {
+	Sold bool `json:"sold"`
 }
 
 type MarketService struct {
 	Marketrepo MarketRepository
 	Userrepo   UserRepository
+	Blobs      BlobStore
 }
 
 type AdsListParams struct {
 	Page     int     `query:"page"`      
 	Limit    int     `query:"limit"`     
-	SortBy   string  `query:"sort_by"`   
+	SortBy   string  `query:"sort_by"` // "date", "price" or "relevance" (with q)
 	Order    string  `query:"order"` // "asc" or "desc"
 	MinPrice int     `query:"min_price"` 
 	MaxPrice int     `query:"max_price"` 
-}
\ No newline at end of file
+	Query    string  `query:"q"` // full-text search over title and description
+	Category string  `query:"category"` // category id or slug, descendants included
+	After    *AdsCursor // keyset mode: continue after this ad instead of using Page
+}
+
+// AdsCursor is the position of the last ad of a feed page: its sort key and id.
+// Clients get it base64-encoded as an opaque next_cursor.
+type AdsCursor struct {
+	SortBy    string    `json:"s"`
+	Order     string    `json:"o"`
+	Price     float64   `json:"p,omitempty"`
+	CreatedAt time.Time `json:"t"`
+	ID        int64     `json:"id"`
+}
+
+// AdsPage is one page of the ads list with what a pager needs to show "page 3 of 12".
+type AdsPage struct {
+	Total int               `json:"total"`
+	Page  int               `json:"page"`
+	Limit int               `json:"limit"`
+	Pages int               `json:"pages"`
+	Items []AdsListResponse `json:"items"`
+}
+
+type AdsFeedResponse struct {
+	Items      []AdsListResponse `json:"items"`
+	NextCursor string            `json:"next_cursor,omitempty"` // empty on the last page
+}
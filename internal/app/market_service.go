@@ -1,64 +1,265 @@
 package app
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"marketplace/internal/config"
-	"path/filepath"
-	"strings"
 	"time"
 	"unicode/utf8"
 	"github.com/google/uuid"
 )
 
+var (
+	ErrAdNotFound = errors.New("ad not found")
+	ErrNotAdOwner = errors.New("only the owner can modify this ad")
+	ErrAdClosed   = errors.New("ad is already closed")
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
 
-func NewMarketService(marketrepo MarketRepository, userrepo UserRepository) *MarketService {
+func NewMarketService(marketrepo MarketRepository, userrepo UserRepository, blobs BlobStore) *MarketService {
 	return &MarketService{
 		Marketrepo: marketrepo,
 		Userrepo:   userrepo,
+		Blobs:      blobs,
 	}
 }
 
 func (s *MarketService) NewAd(ad Ad, config config.Config, userid uuid.UUID) (Ad, error) {
 
-	if ad.Title == "" || ad.Description == "" || ad.ImageURL == "" || ad.Price < config.Ad.PriceMin {
-		return Ad{}, errors.New("all fields must be filled and price must be greater than zero")
-	}
-
-	if utf8.RuneCountInString(ad.Title) < config.Ad.MinLengthTitle || utf8.RuneCountInString(ad.Title) > config.Ad.MaxLengthTitle {
-		return Ad{}, fmt.Errorf("title must be between %d and %d characters", config.Ad.MinLengthTitle, config.Ad.MaxLengthTitle)
+	if err := validateAd(ad, config); err != nil {
+		return Ad{}, err
 	}
-
-	if utf8.RuneCountInString(ad.Description) < config.Ad.MinLengthDescription || utf8.RuneCountInString(ad.Description) > config.Ad.MaxLengthDescription {
-		return Ad{}, fmt.Errorf("description must be between %d and %d characters", config.Ad.MinLengthDescription, config.Ad.MaxLengthDescription)
+	if err := s.checkCategory(ad.CategoryID); err != nil {
+		return Ad{}, err
 	}
-
-	ext := filepath.Ext(strings.ToLower(ad.ImageURL))
-
-	if !config.Ad.AllowedImgTypesMap[ext] {
-		return Ad{}, fmt.Errorf("image type %s is not allowed", ext)
+	images, err := s.newGallery(ad.Images, config, userid)
+	if err != nil {
+		return Ad{}, err
 	}
+	ad.Images = images
 
 	ad.CreatedAt = time.Now()
+	ad.UpdatedAt = ad.CreatedAt
+	ad.Status = AdStatusActive
 	ad.UserID = userid
 	user, err := s.Userrepo.FindByUUID(userid.String())
 	if err != nil {
 		return Ad{}, fmt.Errorf("FindByUUID error: %w", err)
 	}
+	if err := accountBlocked(user, ad.CreatedAt); err != nil {
+		return Ad{}, err
+	}
+	if config.Email.RequireVerified && user.EmailVerifiedAt == nil {
+		return Ad{}, ErrEmailNotVerified
+	}
 	ad.Username = user.Login
 	ad.UUID = uuid.New()
 	return s.Marketrepo.SaveAd(ad)
 }
 
-func (s *MarketService) AdsList(params AdsListParams, id uuid.UUID) ([]AdsListResponse, error) {
+func validateAd(ad Ad, config config.Config) error {
+	if ad.Title == "" || ad.Description == "" || ad.Price < config.Ad.PriceMin {
+		return errors.New("all fields must be filled and price must be greater than zero")
+	}
+
+	if utf8.RuneCountInString(ad.Title) < config.Ad.MinLengthTitle || utf8.RuneCountInString(ad.Title) > config.Ad.MaxLengthTitle {
+		return fmt.Errorf("title must be between %d and %d characters", config.Ad.MinLengthTitle, config.Ad.MaxLengthTitle)
+	}
+
+	if utf8.RuneCountInString(ad.Description) < config.Ad.MinLengthDescription || utf8.RuneCountInString(ad.Description) > config.Ad.MaxLengthDescription {
+		return fmt.Errorf("description must be between %d and %d characters", config.Ad.MinLengthDescription, config.Ad.MaxLengthDescription)
+	}
+	return nil
+}
+
+func (s *MarketService) checkCategory(id int64) error {
+	if id == 0 {
+		return errors.New("category_id is required")
+	}
+	_, err := s.Marketrepo.GetCategory(id)
+	if errors.Is(err, ErrCategoryNotFound) {
+		return fmt.Errorf("category %d does not exist", id)
+	}
+	if err != nil {
+		return fmt.Errorf("getcategory error: %w", err)
+	}
+	return nil
+}
+
+func (s *MarketService) AdsList(params AdsListParams, id uuid.UUID) (AdsPage, error) {
 
 	Adslist, err := s.Marketrepo.GetAdsList(params, id.String())
 	if err != nil {
-		return nil, fmt.Errorf("getadslist error: %w", err)
+		return AdsPage{}, fmt.Errorf("getadslist error: %w", err)
+	}
+	total, err := s.Marketrepo.CountAds(params)
+	if err != nil {
+		return AdsPage{}, fmt.Errorf("countads error: %w", err)
+	}
+	if Adslist == nil {
+		Adslist = []AdsListResponse{}
+	}
+
+	return AdsPage{
+		Total: total,
+		Page:  params.Page,
+		Limit: params.Limit,
+		Pages: (total + params.Limit - 1) / params.Limit,
+		Items: withCoverVariants(Adslist),
+	}, nil
+}
+
+// AdsFeed pages through the list by keyset: cursor is empty for the first page and the
+// next_cursor of the previous page afterwards. Ads added while scrolling don't shift the pages.
+func (s *MarketService) AdsFeed(params AdsListParams, cursor string, id uuid.UUID) (AdsFeedResponse, error) {
+	if params.SortBy == "relevance" {
+		return AdsFeedResponse{}, fmt.Errorf("%w: sort_by=relevance is not supported with cursor", ErrInvalidCursor)
+	}
+	if cursor != "" {
+		after, err := decodeAdsCursor(cursor)
+		if err != nil {
+			return AdsFeedResponse{}, err
+		}
+		if after.SortBy != params.SortBy || after.Order != params.Order {
+			return AdsFeedResponse{}, fmt.Errorf("%w: sort_by and order must not change while scrolling", ErrInvalidCursor)
+		}
+		params.After = &after
+	}
+	params.Page = 1
+	limit := params.Limit
+	// one extra row tells whether there is a next page
+	params.Limit++
+
+	items, err := s.Marketrepo.GetAdsList(params, id.String())
+	if err != nil {
+		return AdsFeedResponse{}, fmt.Errorf("getadslist error: %w", err)
+	}
+	feed := AdsFeedResponse{Items: withCoverVariants(items)}
+	if feed.Items == nil {
+		feed.Items = []AdsListResponse{}
 	}
-	if len(Adslist) == 0 {
-		return nil, errors.New("list is empty")
+	if len(feed.Items) > limit {
+		feed.Items = feed.Items[:limit]
+		last := feed.Items[limit-1]
+		feed.NextCursor = encodeAdsCursor(AdsCursor{
+			SortBy:    params.SortBy,
+			Order:     params.Order,
+			Price:     last.Price,
+			CreatedAt: last.CreatedAt,
+			ID:        last.ID,
+		})
 	}
+	return feed, nil
+}
+
+func encodeAdsCursor(cursor AdsCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
 
-	return Adslist, nil
-}
\ No newline at end of file
+func decodeAdsCursor(cursor string) (AdsCursor, error) {
+	var after AdsCursor
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return AdsCursor{}, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(data, &after); err != nil || after.ID == 0 {
+		return AdsCursor{}, ErrInvalidCursor
+	}
+	return after, nil
+}
+
+func (s *MarketService) GetAd(aduuid uuid.UUID, userid uuid.UUID) (Ad, error) {
+	ad, err := s.Marketrepo.GetAdByUUID(aduuid.String())
+	if err != nil {
+		return Ad{}, err
+	}
+	ad.Owner = userid != uuid.Nil && ad.UserID == userid
+	return ad, nil
+}
+
+func withCoverVariants(ads []AdsListResponse) []AdsListResponse {
+	for i, ad := range ads {
+		// covers stored before variants existed are served as they are
+		if ad.ImageURL != "" && ad.Images == nil {
+			ads[i].Images = &ImageVariants{Thumb: ad.ImageURL, Medium: ad.ImageURL, Large: ad.ImageURL}
+		}
+	}
+	return ads
+}
+
+// ownedAd loads an ad and makes sure it belongs to userid.
+func (s *MarketService) ownedAd(aduuid uuid.UUID, userid uuid.UUID) (Ad, error) {
+	ad, err := s.Marketrepo.GetAdByUUID(aduuid.String())
+	if err != nil {
+		return Ad{}, err
+	}
+	if ad.UserID != userid {
+		return Ad{}, ErrNotAdOwner
+	}
+	ad.Owner = true
+	return ad, nil
+}
+
+func (s *MarketService) UpdateAd(aduuid uuid.UUID, req UpdateAdRequest, config config.Config, userid uuid.UUID) (Ad, error) {
+	ad, err := s.ownedAd(aduuid, userid)
+	if err != nil {
+		return Ad{}, err
+	}
+	if ad.Status != AdStatusActive {
+		return Ad{}, ErrAdClosed
+	}
+
+	if req.Title != nil {
+		ad.Title = *req.Title
+	}
+	if req.Description != nil {
+		ad.Description = *req.Description
+	}
+	if req.Price != nil {
+		ad.Price = *req.Price
+	}
+	if err := validateAd(ad, config); err != nil {
+		return Ad{}, err
+	}
+	if req.CategoryID != nil {
+		if err := s.checkCategory(*req.CategoryID); err != nil {
+			return Ad{}, err
+		}
+		ad.CategoryID = *req.CategoryID
+	}
+
+	ad.UpdatedAt = time.Now()
+	return s.Marketrepo.UpdateAd(ad)
+}
+
+func (s *MarketService) CloseAd(aduuid uuid.UUID, req CloseAdRequest, userid uuid.UUID) (Ad, error) {
+	ad, err := s.ownedAd(aduuid, userid)
+	if err != nil {
+		return Ad{}, err
+	}
+	if ad.Status != AdStatusActive {
+		return Ad{}, ErrAdClosed
+	}
+
+	ad.Status = AdStatusClosed
+	if req.Sold {
+		ad.Status = AdStatusSold
+	}
+	ad.UpdatedAt = time.Now()
+	return s.Marketrepo.UpdateAd(ad)
+}
+
+func (s *MarketService) DeleteAd(aduuid uuid.UUID, userid uuid.UUID) error {
+	ad, err := s.ownedAd(aduuid, userid)
+	if err != nil {
+		return err
+	}
+	if err := s.Marketrepo.DeleteAd(aduuid.String()); err != nil {
+		return err
+	}
+	s.deleteBlobs(ad.Images)
+	return nil
+}
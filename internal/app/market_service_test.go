@@ -1,16 +1,18 @@
 package app
 
 import (
+    "errors"
     "testing"
     "marketplace/internal/config"
     "github.com/google/uuid"
     "strings"
+    "time"
 )
 
 func TestNewAd_Success(t *testing.T) {
-    marketRepo := &MockMarketRepo{}
+    marketRepo := &MockMarketRepo{Categories: testCategories()}
     userRepo := &MockUserRepo{Users: make(map[string]User)}
-    service := NewMarketService(marketRepo, userRepo)
+    service := NewMarketService(marketRepo, userRepo, &MockBlobStore{})
     cfg := config.Config{
         Ad: config.Ad{
             MinLengthTitle: 3, MaxLengthTitle: 100,
@@ -19,14 +21,16 @@ func TestNewAd_Success(t *testing.T) {
             AllowedImgTypesMap: map[string]bool{".jpg": true, ".png": true},
             PriceMin: 1,
         },
+        Images: config.Images{BaseURL: "/images", MaxPerAd: 10},
     }
     user := User{UUID: uuid.New(), Login: "user", Password: "pass"}
     userRepo.SaveNewUser(user)
     ad := Ad{
         Title: "Test Ad",
         Description: "Test Description for Ad",
-        ImageURL: "image.jpg",
+        Images: testImages(service, user.UUID, "front.jpg", "back.png"),
         Price: 10,
+        CategoryID: 1,
     }
     created, err := service.NewAd(ad, cfg, user.UUID)
     if err != nil {
@@ -38,8 +42,8 @@ func TestNewAd_Success(t *testing.T) {
     if created.Description != ad.Description {
         t.Errorf("expected description %v, got %v", ad.Description, created.Description)
     }
-    if created.ImageURL != ad.ImageURL {
-        t.Errorf("expected image URL %v, got %v", ad.ImageURL, created.ImageURL)
+    if len(created.Images) != 2 || !created.Images[0].IsCover || created.Images[1].IsCover || created.Images[1].Position != 1 {
+        t.Errorf("expected two images with the first as cover, got %+v", created.Images)
     }
     if created.Price != ad.Price {
         t.Errorf("expected price %v, got %v", ad.Price, created.Price)
@@ -58,6 +62,60 @@ func TestNewAd_Success(t *testing.T) {
     }
 }
 
+func TestNewAd_BlockedUser(t *testing.T) {
+    userRepo := &MockUserRepo{Users: make(map[string]User)}
+    marketRepo := &MockMarketRepo{Categories: testCategories()}
+    service := NewMarketService(marketRepo, userRepo, &MockBlobStore{})
+    cfg := config.Config{
+        Ad: config.Ad{MinLengthTitle: 3, MaxLengthTitle: 100, MinLengthDescription: 10, MaxLengthDescription: 1000, PriceMin: 1},
+        Images: config.Images{BaseURL: "/images", MaxPerAd: 10},
+    }
+    until := time.Now().Add(time.Hour)
+    suspended := User{UUID: uuid.New(), Login: "suspended", Status: UserStatusSuspended, StatusReason: "spam", SuspendedUntil: &until}
+    banned := User{UUID: uuid.New(), Login: "banned", Status: UserStatusBanned}
+    userRepo.SaveNewUser(suspended)
+    userRepo.SaveNewUser(banned)
+    ad := Ad{Title: "Test Ad", Description: "Test Description for Ad", Price: 10, CategoryID: 1}
+
+    if _, err := service.NewAd(ad, cfg, suspended.UUID); !errors.Is(err, ErrUserSuspended) {
+        t.Errorf("expected ErrUserSuspended, got %v", err)
+    }
+    if _, err := service.NewAd(ad, cfg, banned.UUID); !errors.Is(err, ErrUserBanned) {
+        t.Errorf("expected ErrUserBanned, got %v", err)
+    }
+    if len(marketRepo.Ads) != 0 {
+        t.Errorf("expected no ads to be saved, got %d", len(marketRepo.Ads))
+    }
+}
+
+func TestNewAd_EmailNotVerified(t *testing.T) {
+    userRepo := &MockUserRepo{Users: make(map[string]User)}
+    marketRepo := &MockMarketRepo{Categories: testCategories()}
+    service := NewMarketService(marketRepo, userRepo, &MockBlobStore{})
+    cfg := config.Config{
+        Ad: config.Ad{MinLengthTitle: 3, MaxLengthTitle: 100, MinLengthDescription: 10, MaxLengthDescription: 1000, PriceMin: 1},
+        Images: config.Images{BaseURL: "/images", MaxPerAd: 10},
+        Email: config.Email{RequireVerified: true},
+    }
+    verifiedAt := time.Now()
+    unverified := User{UUID: uuid.New(), Login: "unverified", Status: UserStatusActive, Email: "a@example.com"}
+    verified := User{UUID: uuid.New(), Login: "verified", Status: UserStatusActive, Email: "b@example.com", EmailVerifiedAt: &verifiedAt}
+    userRepo.SaveNewUser(unverified)
+    userRepo.SaveNewUser(verified)
+    ad := Ad{Title: "Test Ad", Description: "Test Description for Ad", Price: 10, CategoryID: 1}
+
+    if _, err := service.NewAd(ad, cfg, unverified.UUID); !errors.Is(err, ErrEmailNotVerified) {
+        t.Errorf("expected ErrEmailNotVerified, got %v", err)
+    }
+    if _, err := service.NewAd(ad, cfg, verified.UUID); err != nil {
+        t.Errorf("expected a verified user to post, got %v", err)
+    }
+    cfg.Email.RequireVerified = false
+    if _, err := service.NewAd(ad, cfg, unverified.UUID); err != nil {
+        t.Errorf("expected the check to be off by default, got %v", err)
+    }
+}
+
 func TestNewAd_Fail(t *testing.T) {
 	cfg := config.Config{
 		Ad: config.Ad{
@@ -74,11 +132,12 @@ func TestNewAd_Fail(t *testing.T) {
 			},
 			PriceMin: 0.01,
 		},
+		Images: config.Images{BaseURL: "/images", MaxPerAd: 10},
 	}
 	user := User{UUID: uuid.New(), Login: "user", Password: "pass"}
 	userRepo := &MockUserRepo{Users: make(map[string]User)}
 	userRepo.SaveNewUser(user)
-	service := NewMarketService(&MockMarketRepo{}, userRepo)
+	service := NewMarketService(&MockMarketRepo{Categories: testCategories()}, userRepo, &MockBlobStore{})
 
 	tests := []struct {
 		name string
@@ -89,8 +148,8 @@ func TestNewAd_Fail(t *testing.T) {
 			ad: Ad{
 				Title:       "Hi",
 				Description: "Valid description here",
-				ImageURL:    "image.jpg",
 				Price:       10,
+				CategoryID:  1,
 			},
 		},
 		{
@@ -98,8 +157,8 @@ func TestNewAd_Fail(t *testing.T) {
 			ad: Ad{
 				Title:       strings.Repeat("a", 101),
 				Description: "Valid description here",
-				ImageURL:    "image.jpg",
 				Price:       10,
+				CategoryID:  1,
 			},
 		},
 		{
@@ -107,8 +166,8 @@ func TestNewAd_Fail(t *testing.T) {
 			ad: Ad{
 				Title:       "Valid title",
 				Description: "short",
-				ImageURL:    "image.jpg",
 				Price:       10,
+				CategoryID:  1,
 			},
 		},
 		{
@@ -116,8 +175,8 @@ func TestNewAd_Fail(t *testing.T) {
 			ad: Ad{
 				Title:       "Valid title",
 				Description: strings.Repeat("a", 1001),
-				ImageURL:    "image.jpg",
 				Price:       10,
+				CategoryID:  1,
 			},
 		},
 		{
@@ -125,8 +184,42 @@ func TestNewAd_Fail(t *testing.T) {
 			ad: Ad{
 				Title:       "Valid title",
 				Description: "Valid description here",
-				ImageURL:    "image.zip",
+				Images:      testImages(service, user.UUID, "image.zip"),
+				Price:       10,
+				CategoryID:  1,
+			},
+		},
+		{
+			name: "external image url",
+			ad: Ad{
+				Title:       "Valid title",
+				Description: "Valid description here",
+				Images:      []AdImage{{URL: "https://evil.example.com/evil.png"}},
 				Price:       10,
+				CategoryID:  1,
+			},
+		},
+		{
+			name: "image uploaded by another user",
+			ad: Ad{
+				Title:       "Valid title",
+				Description: "Valid description here",
+				Images:      testImages(service, uuid.New(), "image.jpg"),
+				Price:       10,
+				CategoryID:  1,
+			},
+		},
+		{
+			name: "two covers",
+			ad: Ad{
+				Title:       "Valid title",
+				Description: "Valid description here",
+				Images: []AdImage{
+					{URL: testImages(service, user.UUID, "a.jpg")[0].URL, IsCover: true},
+					{URL: testImages(service, user.UUID, "b.jpg")[0].URL, IsCover: true},
+				},
+				Price:      10,
+				CategoryID: 1,
 			},
 		},
 		{
@@ -134,8 +227,25 @@ func TestNewAd_Fail(t *testing.T) {
 			ad: Ad{
 				Title:       "Valid title",
 				Description: "Valid description here",
-				ImageURL:    "image.jpg",
 				Price:       0.0,
+				CategoryID:  1,
+			},
+		},
+		{
+			name: "missing category",
+			ad: Ad{
+				Title:       "Valid title",
+				Description: "Valid description here",
+				Price:       10,
+			},
+		},
+		{
+			name: "unknown category",
+			ad: Ad{
+				Title:       "Valid title",
+				Description: "Valid description here",
+				Price:       10,
+				CategoryID:  42,
 			},
 		},
 	}
@@ -150,24 +260,43 @@ func TestNewAd_Fail(t *testing.T) {
 	}
 }
 
+// testImages returns images as if they were uploaded by userID with POST /images.
+func testImages(service *MarketService, userID uuid.UUID, names ...string) []AdImage {
+	images := make([]AdImage, len(names))
+	for i, name := range names {
+		key := "uploads/" + userID.String() + "/" + name
+		service.Blobs.Put(key, strings.NewReader("image"), "image/jpeg")
+		images[i] = AdImage{URL: "/images/" + key}
+	}
+	return images
+}
+
+func testCategories() []Category {
+	parent := int64(1)
+	return []Category{
+		{ID: 1, Slug: "electronics", Names: map[string]string{"ru": "Электроника", "en": "Electronics"}},
+		{ID: 2, ParentID: &parent, Slug: "phones", Names: map[string]string{"ru": "Телефоны", "en": "Phones"}},
+	}
+}
+
 func TestAdsList_Empty(t *testing.T) {
     marketRepo := &MockMarketRepo{}
     userRepo := &MockUserRepo{Users: make(map[string]User)}
-    service := NewMarketService(marketRepo, userRepo)
+    service := NewMarketService(marketRepo, userRepo, &MockBlobStore{})
     params := AdsListParams{Page: 1, Limit: 10}
-    ads, err := service.AdsList(params, uuid.Nil)
-    if err != nil && err.Error() != "list is empty" {
+    page, err := service.AdsList(params, uuid.Nil)
+    if err != nil {
         t.Fatalf("unexpected error: %v", err)
     }
-    if len(ads) != len(marketRepo.Ads) {
-        t.Errorf("expected %d ads, got %d", len(marketRepo.Ads), len(ads))
+    if page.Items == nil || len(page.Items) != 0 || page.Total != 0 || page.Pages != 0 {
+        t.Errorf("expected an empty page, got %+v", page)
     }
 }
 
 func TestAdsList_Success(t *testing.T) {
-    marketRepo := &MockMarketRepo{}
+    marketRepo := &MockMarketRepo{Categories: testCategories()}
     userRepo := &MockUserRepo{Users: make(map[string]User)}
-    service := NewMarketService(marketRepo, userRepo)
+    service := NewMarketService(marketRepo, userRepo, &MockBlobStore{})
     cfg := config.Config{
         Ad: config.Ad{
             MinLengthTitle: 3, MaxLengthTitle: 100,
@@ -176,25 +305,259 @@ func TestAdsList_Success(t *testing.T) {
             AllowedImgTypesMap: map[string]bool{".jpg": true, ".png": true},
             PriceMin: 1,
         },
+        Images: config.Images{BaseURL: "/images", MaxPerAd: 10},
     }
     user := User{UUID: uuid.New(), Login: "user", Password: "pass"}
     userRepo.SaveNewUser(user)
     ad := Ad{
         Title: "Test Ad",
         Description: "Test Description for Ad",
-        ImageURL: "image.jpg",
+        Images: testImages(service, user.UUID, "image.jpg"),
         Price: 10,
+        CategoryID: 1,
     }
     _, err := service.NewAd(ad, cfg, user.UUID)
     if err != nil {
         t.Fatalf("unexpected error: %v", err)
     }
     params := AdsListParams{Page: 1, Limit: 10}
-    ads, err := service.AdsList(params, uuid.Nil)
-    if err != nil && err.Error() != "list is empty" {
+    page, err := service.AdsList(params, uuid.Nil)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if len(page.Items) != len(marketRepo.AdsResponse) {
+        t.Errorf("expected %d ads, got %d", len(marketRepo.AdsResponse), len(page.Items))
+    }
+}
+
+func TestAdsList_PageMetadata(t *testing.T) {
+    marketRepo := &MockMarketRepo{AdsResponse: make([]AdsListResponse, 25)}
+    service := NewMarketService(marketRepo, &MockUserRepo{Users: make(map[string]User)}, &MockBlobStore{})
+
+    page, err := service.AdsList(AdsListParams{Page: 2, Limit: 10}, uuid.Nil)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if page.Total != 25 || page.Page != 2 || page.Limit != 10 || page.Pages != 3 {
+        t.Errorf("unexpected page metadata %+v", page)
+    }
+}
+func TestAdsList_CoverVariants(t *testing.T) {
+    variants := &ImageVariants{Thumb: "/images/a_thumb.jpg", Medium: "/images/a_medium.jpg", Large: "/images/a_large.jpg"}
+    marketRepo := &MockMarketRepo{AdsResponse: []AdsListResponse{
+        {Title: "with variants", ImageURL: "/images/a.jpg", Images: variants},
+        {Title: "legacy cover", ImageURL: "/images/b.jpg"},
+        {Title: "no images"},
+    }}
+    service := NewMarketService(marketRepo, &MockUserRepo{Users: make(map[string]User)}, &MockBlobStore{})
+
+    page, err := service.AdsList(AdsListParams{Page: 1, Limit: 10}, uuid.Nil)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    ads := page.Items
+    if ads[0].Images != variants {
+        t.Errorf("expected stored variants, got %+v", ads[0].Images)
+    }
+    if ads[1].Images == nil || ads[1].Images.Thumb != "/images/b.jpg" {
+        t.Errorf("expected the legacy cover to be used for every variant, got %+v", ads[1].Images)
+    }
+    if ads[2].Images != nil {
+        t.Errorf("expected no variants without a cover, got %+v", ads[2].Images)
+    }
+}
+
+func TestAdsFeed(t *testing.T) {
+    base := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+    marketRepo := &MockMarketRepo{AdsResponse: []AdsListResponse{
+        {ID: 3, Title: "third", CreatedAt: base.Add(2 * time.Minute)},
+        {ID: 2, Title: "second", CreatedAt: base.Add(time.Minute)},
+        {ID: 1, Title: "first", CreatedAt: base},
+    }}
+    service := NewMarketService(marketRepo, &MockUserRepo{Users: make(map[string]User)}, &MockBlobStore{})
+    params := AdsListParams{Limit: 2, SortBy: "date", Order: "desc"}
+
+    feed, err := service.AdsFeed(params, "", uuid.Nil)
+    if err != nil {
         t.Fatalf("unexpected error: %v", err)
     }
-    if len(ads) != len(marketRepo.AdsResponse) {
-        t.Errorf("expected %d ads, got %d", len(marketRepo.Ads), len(ads))
+    if len(feed.Items) != 2 || feed.NextCursor == "" {
+        t.Fatalf("expected a full page with a next cursor, got %+v", feed)
     }
-}
\ No newline at end of file
+    after, err := decodeAdsCursor(feed.NextCursor)
+    if err != nil {
+        t.Fatalf("unexpected error decoding cursor: %v", err)
+    }
+    if after.ID != 2 || !after.CreatedAt.Equal(base.Add(time.Minute)) || after.SortBy != "date" || after.Order != "desc" {
+        t.Errorf("expected the cursor to point at the last item, got %+v", after)
+    }
+
+    marketRepo.AdsResponse = marketRepo.AdsResponse[2:]
+    feed, err = service.AdsFeed(params, feed.NextCursor, uuid.Nil)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if len(feed.Items) != 1 || feed.NextCursor != "" {
+        t.Errorf("expected the last page without a next cursor, got %+v", feed)
+    }
+
+    marketRepo.AdsResponse = nil
+    feed, err = service.AdsFeed(params, "", uuid.Nil)
+    if err != nil || feed.Items == nil || len(feed.Items) != 0 {
+        t.Errorf("expected an empty page, got %+v, %v", feed, err)
+    }
+}
+
+func TestAdsFeed_InvalidCursor(t *testing.T) {
+    service := NewMarketService(&MockMarketRepo{}, &MockUserRepo{Users: make(map[string]User)}, &MockBlobStore{})
+    params := AdsListParams{Limit: 10, SortBy: "date", Order: "desc"}
+    priceCursor := encodeAdsCursor(AdsCursor{SortBy: "price", Order: "desc", Price: 10, ID: 1})
+
+    tests := []struct {
+        name   string
+        params AdsListParams
+        cursor string
+    }{
+        {"not base64", params, "%%%"},
+        {"not json", params, "bm90IGpzb24"},
+        {"sort changed", params, priceCursor},
+        {"relevance", AdsListParams{Limit: 10, SortBy: "relevance", Order: "desc", Query: "bike"}, ""},
+    }
+    for _, tc := range tests {
+        t.Run(tc.name, func(t *testing.T) {
+            if _, err := service.AdsFeed(tc.params, tc.cursor, uuid.Nil); !errors.Is(err, ErrInvalidCursor) {
+                t.Errorf("expected ErrInvalidCursor, got %v", err)
+            }
+        })
+    }
+}
+
+func newLifecycleService(t *testing.T) (*MarketService, *MockMarketRepo, config.Config, User, Ad) {
+    marketRepo := &MockMarketRepo{Categories: testCategories()}
+    userRepo := &MockUserRepo{Users: make(map[string]User)}
+    service := NewMarketService(marketRepo, userRepo, &MockBlobStore{})
+    cfg := config.Config{
+        Ad: config.Ad{
+            MinLengthTitle: 3, MaxLengthTitle: 100,
+            MinLengthDescription: 10, MaxLengthDescription: 1000,
+            ImgType: []string{".jpg", ".png"},
+            AllowedImgTypesMap: map[string]bool{".jpg": true, ".png": true},
+            PriceMin: 1,
+        },
+        Images: config.Images{BaseURL: "/images", MaxPerAd: 10},
+    }
+    user := User{UUID: uuid.New(), Login: "user", Password: "pass"}
+    userRepo.SaveNewUser(user)
+    created, err := service.NewAd(Ad{
+        Title: "Test Ad",
+        Description: "Test Description for Ad",
+        Images: testImages(service, user.UUID, "image.jpg"),
+        Price: 10,
+        CategoryID: 1,
+    }, cfg, user.UUID)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    return service, marketRepo, cfg, user, created
+}
+
+func TestGetAd(t *testing.T) {
+    service, _, _, user, created := newLifecycleService(t)
+
+    ad, err := service.GetAd(created.UUID, user.UUID)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if !ad.Owner {
+        t.Error("expected owner flag for ad author")
+    }
+    if ad.Status != AdStatusActive {
+        t.Errorf("expected status %s, got %s", AdStatusActive, ad.Status)
+    }
+
+    ad, err = service.GetAd(created.UUID, uuid.Nil)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if ad.Owner {
+        t.Error("expected no owner flag for anonymous user")
+    }
+
+    _, err = service.GetAd(uuid.New(), user.UUID)
+    if !errors.Is(err, ErrAdNotFound) {
+        t.Errorf("expected ErrAdNotFound, got %v", err)
+    }
+}
+
+func TestUpdateAd(t *testing.T) {
+    service, _, cfg, user, created := newLifecycleService(t)
+
+    price := 25.5
+    title := "Updated title"
+    ad, err := service.UpdateAd(created.UUID, UpdateAdRequest{Title: &title, Price: &price}, cfg, user.UUID)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if ad.Title != title || ad.Price != price {
+        t.Errorf("expected title %q and price %v, got %q and %v", title, price, ad.Title, ad.Price)
+    }
+    if ad.Description != created.Description {
+        t.Errorf("expected description to stay %q, got %q", created.Description, ad.Description)
+    }
+
+    _, err = service.UpdateAd(created.UUID, UpdateAdRequest{Price: &price}, cfg, uuid.New())
+    if !errors.Is(err, ErrNotAdOwner) {
+        t.Errorf("expected ErrNotAdOwner, got %v", err)
+    }
+
+    shortTitle := "ab"
+    _, err = service.UpdateAd(created.UUID, UpdateAdRequest{Title: &shortTitle}, cfg, user.UUID)
+    if err == nil {
+        t.Error("expected validation error for too short title")
+    }
+}
+
+func TestCloseAd(t *testing.T) {
+    service, _, cfg, user, created := newLifecycleService(t)
+
+    _, err := service.CloseAd(created.UUID, CloseAdRequest{}, uuid.New())
+    if !errors.Is(err, ErrNotAdOwner) {
+        t.Errorf("expected ErrNotAdOwner, got %v", err)
+    }
+
+    ad, err := service.CloseAd(created.UUID, CloseAdRequest{Sold: true}, user.UUID)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if ad.Status != AdStatusSold {
+        t.Errorf("expected status %s, got %s", AdStatusSold, ad.Status)
+    }
+
+    _, err = service.CloseAd(created.UUID, CloseAdRequest{}, user.UUID)
+    if !errors.Is(err, ErrAdClosed) {
+        t.Errorf("expected ErrAdClosed on second close, got %v", err)
+    }
+
+    price := 50.0
+    _, err = service.UpdateAd(created.UUID, UpdateAdRequest{Price: &price}, cfg, user.UUID)
+    if !errors.Is(err, ErrAdClosed) {
+        t.Errorf("expected ErrAdClosed when updating closed ad, got %v", err)
+    }
+}
+
+func TestDeleteAd(t *testing.T) {
+    service, marketRepo, _, user, created := newLifecycleService(t)
+
+    if err := service.DeleteAd(created.UUID, uuid.New()); !errors.Is(err, ErrNotAdOwner) {
+        t.Errorf("expected ErrNotAdOwner, got %v", err)
+    }
+    if err := service.DeleteAd(created.UUID, user.UUID); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if len(marketRepo.Ads) != 0 {
+        t.Errorf("expected ad to be removed, %d left", len(marketRepo.Ads))
+    }
+    if err := service.DeleteAd(created.UUID, user.UUID); !errors.Is(err, ErrAdNotFound) {
+        t.Errorf("expected ErrAdNotFound, got %v", err)
+    }
+}
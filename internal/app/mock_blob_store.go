@@ -0,0 +1,35 @@
+package app
+
+import (
+    "bytes"
+    "io"
+)
+
+type MockBlobStore struct {
+    Blobs map[string][]byte
+}
+
+func (m *MockBlobStore) Put(key string, r io.Reader, contentType string) error {
+    data, err := io.ReadAll(r)
+    if err != nil {
+        return err
+    }
+    if m.Blobs == nil {
+        m.Blobs = make(map[string][]byte)
+    }
+    m.Blobs[key] = data
+    return nil
+}
+
+func (m *MockBlobStore) Open(key string) (io.ReadCloser, error) {
+    data, ok := m.Blobs[key]
+    if !ok {
+        return nil, ErrImageNotFound
+    }
+    return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *MockBlobStore) Delete(key string) error {
+    delete(m.Blobs, key)
+    return nil
+}
@@ -0,0 +1,47 @@
+package app
+
+import (
+    "errors"
+    "net/url"
+)
+
+// MockIdentityProvider knows a single provider, "mock". Authorize plays the user logging in:
+// the returned code exchanges for identity once the verifier matches the challenge.
+type MockIdentityProvider struct {
+    codes map[string]mockAuthorization
+}
+
+type mockAuthorization struct {
+    challenge string
+    identity  ExternalIdentity
+}
+
+func (m *MockIdentityProvider) AuthCodeURL(provider string, req AuthCodeRequest) (string, error) {
+    if provider != "mock" {
+        return "", ErrUnknownProvider
+    }
+    query := url.Values{"state": {req.State}, "nonce": {req.Nonce}, "code_challenge": {req.CodeChallenge}}
+    return "https://id.example.com/authorize?" + query.Encode(), nil
+}
+
+func (m *MockIdentityProvider) Authorize(authURL string, code string, identity ExternalIdentity) {
+    if m.codes == nil {
+        m.codes = make(map[string]mockAuthorization)
+    }
+    parsed, _ := url.Parse(authURL)
+    identity.Provider = "mock"
+    identity.Nonce = parsed.Query().Get("nonce")
+    m.codes[code] = mockAuthorization{challenge: parsed.Query().Get("code_challenge"), identity: identity}
+}
+
+func (m *MockIdentityProvider) Exchange(provider string, code string, codeVerifier string) (ExternalIdentity, error) {
+    if provider != "mock" {
+        return ExternalIdentity{}, ErrUnknownProvider
+    }
+    auth, ok := m.codes[code]
+    if !ok || pkceChallenge(codeVerifier) != auth.challenge {
+        return ExternalIdentity{}, errors.New("invalid_grant")
+    }
+    delete(m.codes, code)
+    return auth.identity, nil
+}
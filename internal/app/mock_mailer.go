@@ -0,0 +1,10 @@
+package app
+
+type MockMailer struct {
+    Sent []Message
+}
+
+func (m *MockMailer) Send(msg Message) error {
+    m.Sent = append(m.Sent, msg)
+    return nil
+}
@@ -4,12 +4,147 @@ package app
 type MockMarketRepo struct {
     Ads []Ad
     AdsResponse []AdsListResponse
+    Categories []Category
+    AddImageErr error // returned by AddAdImage when set
+    imageID int64
 }
 
 func (m *MockMarketRepo) SaveAd(ad Ad) (Ad, error) {
+    ad.Images = append([]AdImage(nil), ad.Images...)
+    for i := range ad.Images {
+        m.imageID++
+        ad.Images[i].ID = m.imageID
+    }
     m.Ads = append(m.Ads, ad)
     return ad, nil
 }
 func (m *MockMarketRepo) GetAdsList(params AdsListParams, user_id string) ([]AdsListResponse, error) {
     return m.AdsResponse, nil
-}
\ No newline at end of file
+}
+func (m *MockMarketRepo) CountAds(params AdsListParams) (int, error) {
+    return len(m.AdsResponse), nil
+}
+func (m *MockMarketRepo) GetAdByUUID(uuid string) (Ad, error) {
+    for _, ad := range m.Ads {
+        if ad.UUID.String() == uuid {
+            ad.Images = append([]AdImage(nil), ad.Images...)
+            return ad, nil
+        }
+    }
+    return Ad{}, ErrAdNotFound
+}
+func (m *MockMarketRepo) GetUserAds(userID string, limit int, offset int) ([]Ad, error) {
+    ads := []Ad{}
+    for i := len(m.Ads) - 1; i >= 0; i-- {
+        if m.Ads[i].UserID.String() == userID {
+            ads = append(ads, m.Ads[i])
+        }
+    }
+    start := min(offset, len(ads))
+    end := min(start+limit, len(ads))
+    return ads[start:end], nil
+}
+func (m *MockMarketRepo) CountUserAds(userID string) (int, error) {
+    ads, _ := m.GetUserAds(userID, len(m.Ads), 0)
+    return len(ads), nil
+}
+func (m *MockMarketRepo) UpdateAd(ad Ad) (Ad, error) {
+    for i := range m.Ads {
+        if m.Ads[i].UUID == ad.UUID {
+            images := m.Ads[i].Images
+            m.Ads[i] = ad
+            m.Ads[i].Images = images
+            return ad, nil
+        }
+    }
+    return Ad{}, ErrAdNotFound
+}
+func (m *MockMarketRepo) DeleteAd(uuid string) error {
+    for i := range m.Ads {
+        if m.Ads[i].UUID.String() == uuid {
+            m.Ads = append(m.Ads[:i], m.Ads[i+1:]...)
+            return nil
+        }
+    }
+    return ErrAdNotFound
+}
+func (m *MockMarketRepo) AddAdImage(aduuid string, image AdImage) (AdImage, error) {
+    if m.AddImageErr != nil {
+        return AdImage{}, m.AddImageErr
+    }
+    for i := range m.Ads {
+        if m.Ads[i].UUID.String() == aduuid {
+            m.imageID++
+            image.ID = m.imageID
+            m.Ads[i].Images = append(m.Ads[i].Images, image)
+            return image, nil
+        }
+    }
+    return AdImage{}, ErrAdNotFound
+}
+func (m *MockMarketRepo) SetAdImages(aduuid string, images []AdImage) error {
+    for i := range m.Ads {
+        if m.Ads[i].UUID.String() == aduuid {
+            m.Ads[i].Images = append([]AdImage(nil), images...)
+            return nil
+        }
+    }
+    return ErrAdNotFound
+}
+func (m *MockMarketRepo) ImageKeyInUse(key string) (bool, error) {
+    for _, ad := range m.Ads {
+        for _, img := range ad.Images {
+            if img.Key == key {
+                return true, nil
+            }
+        }
+    }
+    return false, nil
+}
+func (m *MockMarketRepo) SaveCategory(category Category) (Category, error) {
+    category.ID = int64(len(m.Categories) + 1)
+    for _, c := range m.Categories {
+        if c.ID >= category.ID {
+            category.ID = c.ID + 1
+        }
+    }
+    m.Categories = append(m.Categories, category)
+    return category, nil
+}
+func (m *MockMarketRepo) GetCategories() ([]Category, error) {
+    return append([]Category(nil), m.Categories...), nil
+}
+func (m *MockMarketRepo) GetCategory(id int64) (Category, error) {
+    for _, c := range m.Categories {
+        if c.ID == id {
+            return c, nil
+        }
+    }
+    return Category{}, ErrCategoryNotFound
+}
+func (m *MockMarketRepo) UpdateCategory(category Category) (Category, error) {
+    for i := range m.Categories {
+        if m.Categories[i].ID == category.ID {
+            m.Categories[i] = category
+            return category, nil
+        }
+    }
+    return Category{}, ErrCategoryNotFound
+}
+func (m *MockMarketRepo) DeleteCategory(id int64) error {
+    for i := range m.Categories {
+        if m.Categories[i].ID == id {
+            m.Categories = append(m.Categories[:i], m.Categories[i+1:]...)
+            return nil
+        }
+    }
+    return ErrCategoryNotFound
+}
+func (m *MockMarketRepo) CategoryHasAds(id int64) (bool, error) {
+    for _, ad := range m.Ads {
+        if ad.CategoryID == id {
+            return true, nil
+        }
+    }
+    return false, nil
+}
@@ -0,0 +1,172 @@
+package app
+
+import (
+    "sort"
+    "time"
+)
+
+type MockTokenRepo struct {
+    Tokens map[string]RefreshToken
+    Sessions map[string]Session
+    Touches int // TouchSession calls that reached the repository
+    ResetTokens map[string]PasswordResetToken
+    VerificationTokens map[string]EmailVerificationToken
+    OIDCStates map[string]OIDCState
+}
+
+func (m *MockTokenRepo) SaveRefreshToken(token RefreshToken) error {
+    if m.Tokens == nil {
+        m.Tokens = make(map[string]RefreshToken)
+    }
+    m.Tokens[token.ID] = token
+    return nil
+}
+func (m *MockTokenRepo) GetRefreshToken(id string) (RefreshToken, error) {
+    token, ok := m.Tokens[id]
+    if !ok {
+        return RefreshToken{}, ErrInvalidRefreshToken
+    }
+    return token, nil
+}
+func (m *MockTokenRepo) UseRefreshToken(id string, at time.Time) (bool, error) {
+    token, ok := m.Tokens[id]
+    if !ok || token.UsedAt != nil || token.RevokedAt != nil {
+        return false, nil
+    }
+    token.UsedAt = &at
+    m.Tokens[id] = token
+    return true, nil
+}
+func (m *MockTokenRepo) RevokeTokenFamily(familyID string, at time.Time) error {
+    for id, token := range m.Tokens {
+        if token.FamilyID == familyID && token.RevokedAt == nil {
+            token.RevokedAt = &at
+            m.Tokens[id] = token
+        }
+    }
+    return nil
+}
+func (m *MockTokenRepo) RevokeUserTokens(userID string, at time.Time) error {
+    for id, token := range m.Tokens {
+        if token.UserID.String() == userID && token.RevokedAt == nil {
+            token.RevokedAt = &at
+            m.Tokens[id] = token
+        }
+    }
+    return nil
+}
+func (m *MockTokenRepo) FamilyRevoked(familyID string) (bool, error) {
+    for _, token := range m.Tokens {
+        if token.FamilyID == familyID && token.RevokedAt != nil {
+            return true, nil
+        }
+    }
+    return false, nil
+}
+func (m *MockTokenRepo) SaveSession(session Session) error {
+    if m.Sessions == nil {
+        m.Sessions = make(map[string]Session)
+    }
+    m.Sessions[session.ID] = session
+    return nil
+}
+func (m *MockTokenRepo) UpdateSession(session Session) error {
+    stored, ok := m.Sessions[session.ID]
+    if !ok {
+        return nil
+    }
+    stored.UserAgent, stored.IP, stored.LastUsedAt = session.UserAgent, session.IP, session.LastUsedAt
+    m.Sessions[session.ID] = stored
+    return nil
+}
+func (m *MockTokenRepo) TouchSession(id string, at time.Time, since time.Time) error {
+    m.Touches++
+    stored, ok := m.Sessions[id]
+    if ok && stored.LastUsedAt.Before(since) {
+        stored.LastUsedAt = at
+        m.Sessions[id] = stored
+    }
+    return nil
+}
+func (m *MockTokenRepo) ActiveSessions(userID string, at time.Time) ([]Session, error) {
+    var sessions []Session
+    for _, session := range m.Sessions {
+        if session.UserID.String() != userID {
+            continue
+        }
+        for _, token := range m.Tokens {
+            if token.FamilyID == session.ID && token.UsedAt == nil && token.RevokedAt == nil && token.ExpiresAt.After(at) {
+                sessions = append(sessions, session)
+                break
+            }
+        }
+    }
+    sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt) })
+    return sessions, nil
+}
+func (m *MockTokenRepo) SavePasswordResetToken(token PasswordResetToken) error {
+    if m.ResetTokens == nil {
+        m.ResetTokens = make(map[string]PasswordResetToken)
+    }
+    m.ResetTokens[token.ID] = token
+    return nil
+}
+func (m *MockTokenRepo) UsePasswordResetToken(id string, at time.Time) (PasswordResetToken, error) {
+    token, ok := m.ResetTokens[id]
+    if !ok || token.UsedAt != nil || !token.ExpiresAt.After(at) {
+        return PasswordResetToken{}, ErrInvalidResetToken
+    }
+    token.UsedAt = &at
+    m.ResetTokens[id] = token
+    return token, nil
+}
+func (m *MockTokenRepo) RevokePasswordResetTokens(userID string, at time.Time) error {
+    for id, token := range m.ResetTokens {
+        if token.UserID.String() == userID && token.UsedAt == nil {
+            token.UsedAt = &at
+            m.ResetTokens[id] = token
+        }
+    }
+    return nil
+}
+func (m *MockTokenRepo) SaveEmailVerificationToken(token EmailVerificationToken) error {
+    if m.VerificationTokens == nil {
+        m.VerificationTokens = make(map[string]EmailVerificationToken)
+    }
+    m.VerificationTokens[token.ID] = token
+    return nil
+}
+func (m *MockTokenRepo) UseEmailVerificationToken(id string, at time.Time) (EmailVerificationToken, error) {
+    token, ok := m.VerificationTokens[id]
+    if !ok || token.UsedAt != nil || !token.ExpiresAt.After(at) {
+        return EmailVerificationToken{}, ErrInvalidVerificationToken
+    }
+    token.UsedAt = &at
+    m.VerificationTokens[id] = token
+    return token, nil
+}
+func (m *MockTokenRepo) RevokeEmailVerificationTokens(userID string, at time.Time) error {
+    for id, token := range m.VerificationTokens {
+        if token.UserID.String() == userID && token.UsedAt == nil {
+            token.UsedAt = &at
+            m.VerificationTokens[id] = token
+        }
+    }
+    return nil
+}
+func (m *MockTokenRepo) SaveOIDCState(state OIDCState) error {
+    if m.OIDCStates == nil {
+        m.OIDCStates = make(map[string]OIDCState)
+    }
+    m.OIDCStates[state.ID] = state
+    return nil
+}
+func (m *MockTokenRepo) UseOIDCState(id string, at time.Time) (OIDCState, error) {
+    state, ok := m.OIDCStates[id]
+    if !ok || state.UsedAt != nil || !state.ExpiresAt.After(at) {
+        return OIDCState{}, ErrInvalidOIDCState
+    }
+    state.UsedAt = &at
+    m.OIDCStates[id] = state
+    return state, nil
+}
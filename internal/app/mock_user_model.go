@@ -1,9 +1,16 @@
 package app
 
-import "errors"
+import (
+    "errors"
+    "sort"
+    "strings"
+    "time"
+)
 
 type MockUserRepo struct {
     Users map[string]User
+    RecoveryCodes map[string]*time.Time // code hash -> used at, for all users
+    Identities map[string]UserIdentity // by provider + "|" + subject
 }
 
 
@@ -14,6 +21,30 @@ func (m *MockUserRepo) SaveNewUser(user User) error {
     m.Users[user.Login] = user
     return nil
 }
+func (m *MockUserRepo) FindByIdentity(provider string, subject string) (User, error) {
+    identity, ok := m.Identities[provider+"|"+subject]
+    if !ok {
+        return User{}, errors.New("not found")
+    }
+    return m.FindByUUID(identity.UserID.String())
+}
+func (m *MockUserRepo) SaveIdentity(identity UserIdentity) error {
+    if m.Identities == nil {
+        m.Identities = make(map[string]UserIdentity)
+    }
+    key := identity.Provider + "|" + identity.Subject
+    if _, exists := m.Identities[key]; exists {
+        return errors.New("identity already linked")
+    }
+    m.Identities[key] = identity
+    return nil
+}
+func (m *MockUserRepo) SaveNewUserWithIdentity(user User, identity UserIdentity) error {
+    if err := m.SaveNewUser(user); err != nil {
+        return err
+    }
+    return m.SaveIdentity(identity)
+}
 func (m *MockUserRepo) FindByLogin(login string) (User, error) {
     user, ok := m.Users[login]
     if !ok {
@@ -21,6 +52,9 @@ func (m *MockUserRepo) FindByLogin(login string) (User, error) {
     }
     return user, nil
 }
+func (m *MockUserRepo) SetRole(uuid string, role string) error {
+    return m.update(uuid, func(user *User) { user.Role = role })
+}
 func (m *MockUserRepo) FindByUUID(uuid string) (User, error) {
     for _, user := range m.Users {
         if user.UUID.String() == uuid {
@@ -28,4 +62,107 @@ func (m *MockUserRepo) FindByUUID(uuid string) (User, error) {
         }
     }
     return User{}, errors.New("not found")
-}
\ No newline at end of file
+}
+func (m *MockUserRepo) FindByEmail(email string) (User, error) {
+    for _, user := range m.Users {
+        if email != "" && user.Email == email {
+            return user, nil
+        }
+    }
+    return User{}, errors.New("not found")
+}
+func (m *MockUserRepo) SetEmailVerified(uuid string, email string, at time.Time) error {
+    for login, user := range m.Users {
+        if user.UUID.String() == uuid && user.Email == email {
+            user.EmailVerifiedAt = &at
+            m.Users[login] = user
+            return nil
+        }
+    }
+    return ErrInvalidVerificationToken
+}
+func (m *MockUserRepo) SetTOTPSecret(uuid string, secret string) error {
+    return m.update(uuid, func(user *User) {
+        user.TOTPSecret = secret
+        user.TOTPEnabledAt = nil
+    })
+}
+func (m *MockUserRepo) EnableTOTP(uuid string, at time.Time, codeHashes []string) error {
+    m.RecoveryCodes = make(map[string]*time.Time)
+    for _, hash := range codeHashes {
+        m.RecoveryCodes[hash] = nil
+    }
+    return m.update(uuid, func(user *User) { user.TOTPEnabledAt = &at })
+}
+func (m *MockUserRepo) UseTOTPStep(uuid string, step int64) (bool, error) {
+    used := false
+    err := m.update(uuid, func(user *User) {
+        if user.TOTPLastStep < step {
+            user.TOTPLastStep = step
+            used = true
+        }
+    })
+    return used, err
+}
+func (m *MockUserRepo) UseRecoveryCode(uuid string, codeHash string, at time.Time) (bool, error) {
+    usedAt, ok := m.RecoveryCodes[codeHash]
+    if !ok || usedAt != nil {
+        return false, nil
+    }
+    m.RecoveryCodes[codeHash] = &at
+    return true, nil
+}
+func (m *MockUserRepo) ListUsers(params UsersListParams) ([]User, error) {
+    users := m.filter(params)
+    start := min((params.Page-1)*params.Limit, len(users))
+    end := min(start+params.Limit, len(users))
+    return users[start:end], nil
+}
+func (m *MockUserRepo) CountUsers(params UsersListParams) (int, error) {
+    return len(m.filter(params)), nil
+}
+func (m *MockUserRepo) filter(params UsersListParams) []User {
+    users := []User{}
+    for _, user := range m.Users {
+        if strings.Contains(user.Login, strings.ToLower(params.Query)) &&
+            (params.Role == "" || user.Role == params.Role) &&
+            (params.Status == "" || user.Status == params.Status) {
+            users = append(users, user)
+        }
+    }
+    sort.Slice(users, func(a, b int) bool { return users[a].Login < users[b].Login })
+    return users
+}
+func (m *MockUserRepo) SetStatus(uuid string, status string, reason string, until *time.Time) error {
+    return m.update(uuid, func(user *User) {
+        user.Status, user.StatusReason, user.SuspendedUntil = status, reason, until
+    })
+}
+func (m *MockUserRepo) SetPasswordResetRequired(uuid string, required bool) error {
+    return m.update(uuid, func(user *User) { user.PasswordResetRequired = required })
+}
+func (m *MockUserRepo) SetPassword(uuid string, hash string) error {
+    return m.update(uuid, func(user *User) {
+        user.Password = hash
+        user.PasswordResetRequired = false
+    })
+}
+func (m *MockUserRepo) DeleteUser(uuid string) error {
+    for login, user := range m.Users {
+        if user.UUID.String() == uuid {
+            delete(m.Users, login)
+            return nil
+        }
+    }
+    return ErrUserNotFound
+}
+func (m *MockUserRepo) update(uuid string, fn func(user *User)) error {
+    for login, user := range m.Users {
+        if user.UUID.String() == uuid {
+            fn(&user)
+            m.Users[login] = user
+            return nil
+        }
+    }
+    return ErrUserNotFound
+}
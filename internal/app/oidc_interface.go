@@ -0,0 +1,9 @@
+package app
+
+// IdentityProvider talks to the OpenID Connect providers from config.OIDC by name;
+// an unknown name gives ErrUnknownProvider.
+type IdentityProvider interface {
+	AuthCodeURL(provider string, req AuthCodeRequest) (string, error)
+	// Exchange redeems an authorization code and returns the identity from the verified ID token.
+	Exchange(provider string, code string, codeVerifier string) (ExternalIdentity, error)
+}
@@ -0,0 +1,53 @@
+package app
+
+import (
+	"time"
+	"github.com/google/uuid"
+)
+
+// AuthCodeRequest are the per-login parameters of the provider's authorization URL.
+type AuthCodeRequest struct {
+	State         string
+	Nonce         string
+	CodeChallenge string // S256 of the PKCE code verifier
+}
+
+// ExternalIdentity is what a provider's verified ID token says about the user.
+type ExternalIdentity struct {
+	Provider      string
+	Subject       string // sub claim, stable per provider
+	Email         string
+	EmailVerified bool
+	Username      string // preferred_username, a hint for the login of a new account
+	Nonce         string
+}
+
+// UserIdentity links an account at an external provider to a user.
+type UserIdentity struct {
+	Provider  string
+	Subject   string
+	UserID    uuid.UUID
+	Email     string // as the provider reported it when linked
+	CreatedAt time.Time
+}
+
+// OIDCState is the server-side record of a login started at a provider. Like the mailed
+// tokens only the SHA-256 of the state is stored.
+type OIDCState struct {
+	ID           string // hex SHA-256 of the state parameter
+	Provider     string
+	CodeVerifier string
+	Nonce        string
+	CreatedAt    time.Time
+	ExpiresAt    time.Time
+	UsedAt       *time.Time
+}
+
+// OIDCCallbackRequest is the provider's redirect back to us.
+type OIDCCallbackRequest struct {
+	Provider string
+	Code     string
+	State    string
+	Error    string // set by the provider instead of Code, e.g. access_denied
+	Device   Device
+}
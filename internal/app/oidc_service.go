@@ -0,0 +1,219 @@
+package app
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"marketplace/internal/config"
+	"math/rand/v2"
+	"regexp"
+	"strings"
+	"time"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrUnknownProvider  = errors.New("unknown identity provider")
+	ErrInvalidOIDCState = errors.New("invalid or expired login state")
+	ErrOIDCFailed       = errors.New("login with the identity provider failed")
+)
+
+// freeLoginAttempts is how many random suffixes are tried when the login a provider
+// suggests is taken.
+const freeLoginAttempts = 10
+
+// StartOIDCLogin returns the provider's login page URL. The state, nonce and PKCE verifier it is
+// made with are kept server-side for FinishOIDCLogin, so the browser only carries the state.
+func (s *UserService) StartOIDCLogin(provider string, config *config.Config) (string, error) {
+	var state, nonce, verifier string
+	for _, token := range []*string{&state, &nonce, &verifier} {
+		value, err := newMailToken()
+		if err != nil {
+			return "", fmt.Errorf("failed to generate login state: %w", err)
+		}
+		*token = value
+	}
+
+	authURL, err := s.identities.AuthCodeURL(provider, AuthCodeRequest{State: state, Nonce: nonce, CodeChallenge: pkceChallenge(verifier)})
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	record := OIDCState{
+		ID:           hashMailToken(state),
+		Provider:     provider,
+		CodeVerifier: verifier,
+		Nonce:        nonce,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(time.Duration(config.OIDC.StateTTL) * time.Second),
+	}
+	if err := s.tokens.SaveOIDCState(record); err != nil {
+		return "", fmt.Errorf("failed to save login state: %w", err)
+	}
+	return authURL, nil
+}
+
+// FinishOIDCLogin handles the provider's redirect back: it redeems the code, finds the user linked
+// to the external account or creates one, and logs them in like LoginJwt, two-factor step included.
+func (s *UserService) FinishOIDCLogin(req OIDCCallbackRequest, jwt *JwtProvider, config *config.Config) (JwtResponse, error) {
+	if req.State == "" {
+		return JwtResponse{}, ErrInvalidOIDCState
+	}
+	now := time.Now()
+	state, err := s.tokens.UseOIDCState(hashMailToken(req.State), now)
+	if err != nil {
+		return JwtResponse{}, err
+	}
+	if state.Provider != req.Provider {
+		return JwtResponse{}, ErrInvalidOIDCState
+	}
+	if req.Error != "" {
+		return JwtResponse{}, fmt.Errorf("%w: %s", ErrOIDCFailed, req.Error)
+	}
+	if req.Code == "" {
+		return JwtResponse{}, fmt.Errorf("%w: no authorization code", ErrOIDCFailed)
+	}
+
+	identity, err := s.identities.Exchange(req.Provider, req.Code, state.CodeVerifier)
+	if err != nil {
+		if errors.Is(err, ErrUnknownProvider) {
+			return JwtResponse{}, err
+		}
+		return JwtResponse{}, fmt.Errorf("%w: %s", ErrOIDCFailed, err)
+	}
+	// the nonce ties the ID token to this login, so one issued for another can't be injected
+	if identity.Subject == "" || subtle.ConstantTimeCompare([]byte(identity.Nonce), []byte(state.Nonce)) != 1 {
+		return JwtResponse{}, fmt.Errorf("%w: ID token doesn't match the login", ErrOIDCFailed)
+	}
+
+	user, err := s.externalUser(identity, config, now)
+	if err != nil {
+		return JwtResponse{}, err
+	}
+	if err := accountBlocked(user, now); err != nil {
+		return JwtResponse{}, err
+	}
+	// a forced reset locks the account, not only its password
+	if user.PasswordResetRequired {
+		return JwtResponse{}, ErrPasswordResetRequired
+	}
+	return s.finishLogin(user, req.Device, jwt, config)
+}
+
+// externalUser returns the user linked to identity. An unknown identity is linked to the account
+// with the same verified e-mail if the provider allows it (config.OIDCProvider.LinkByEmail),
+// otherwise it gets a new account without a password.
+func (s *UserService) externalUser(identity ExternalIdentity, config *config.Config, now time.Time) (User, error) {
+	if user, err := s.repo.FindByIdentity(identity.Provider, identity.Subject); err == nil {
+		return user, nil
+	}
+
+	// only an address the provider verified is trusted; an invalid one is dropped
+	email := ""
+	if identity.EmailVerified {
+		email, _ = normalizeEmail(identity.Email)
+	}
+	link := UserIdentity{Provider: identity.Provider, Subject: identity.Subject, Email: email, CreatedAt: now}
+	if email != "" {
+		if existing, err := s.repo.FindByEmail(email); err == nil {
+			if !oidcProvider(config, identity.Provider).LinkByEmail || existing.EmailVerifiedAt == nil {
+				return User{}, ErrEmailTaken
+			}
+			link.UserID = existing.UUID
+			if err := s.repo.SaveIdentity(link); err != nil {
+				return User{}, fmt.Errorf("failed to link identity: %w", err)
+			}
+			return existing, nil
+		}
+	}
+	if email == "" && config.Email.Required {
+		return User{}, ErrEmailRequired
+	}
+
+	login, err := s.freeLogin(identity, config)
+	if err != nil {
+		return User{}, err
+	}
+	user := User{
+		UUID:   uuid.New(),
+		Login:  login,
+		Role:   RoleUser,
+		Status: UserStatusActive,
+		Email:  email,
+	}
+	if email != "" {
+		user.EmailVerifiedAt = &now
+	}
+	link.UserID = user.UUID
+	if err := s.repo.SaveNewUserWithIdentity(user, link); err != nil {
+		return User{}, fmt.Errorf("failed to save user: %w", err)
+	}
+	return user, nil
+}
+
+// freeLogin makes a valid, unused login from the provider's username or e-mail.
+func (s *UserService) freeLogin(identity ExternalIdentity, config *config.Config) (string, error) {
+	hint := identity.Username
+	if hint == "" {
+		hint, _, _ = strings.Cut(identity.Email, "@")
+	}
+	allowed := regexp.MustCompile(`[` + regexp.QuoteMeta(config.Username.AllowedCharacters) + `]`)
+	var b strings.Builder
+	for _, r := range strings.ToLower(hint) {
+		if allowed.MatchString(string(r)) {
+			b.WriteRune(r)
+		}
+	}
+	// leave room for the suffix of a taken login
+	base := []rune(b.String())
+	if max := config.Username.MaxLength - 4; len(base) > max && max > 0 {
+		base = base[:max]
+	}
+	if len(base) == 0 {
+		base = []rune("user")
+	}
+
+	for i := 0; i <= freeLoginAttempts; i++ {
+		login := string(base)
+		if i > 0 || len(base) < config.Username.MinLength {
+			login += fmt.Sprintf("%04d", rand.IntN(10000))
+		}
+		if _, err := isValidLogin(login, config); err != nil {
+			continue
+		}
+		if _, err := s.repo.FindByLogin(login); err != nil {
+			return login, nil
+		}
+	}
+	return "", errors.New("failed to find a free login")
+}
+
+// finishLogin starts a session for a user who passed the first factor, or returns a challenge
+// for LoginTwoFactor if they have two-factor authentication on.
+func (s *UserService) finishLogin(user User, device Device, jwt *JwtProvider, config *config.Config) (JwtResponse, error) {
+	if user.TOTPEnabledAt != nil {
+		challenge, err := jwt.GenerateChallengeToken(user, time.Duration(config.TwoFactor.ChallengeTTL)*time.Second)
+		if err != nil {
+			return JwtResponse{}, errors.New("failed to generate challenge token")
+		}
+		return JwtResponse{Type: "2fa", ChallengeToken: challenge}, nil
+	}
+	return s.startSession(user, device, jwt, config)
+}
+
+func oidcProvider(cfg *config.Config, name string) config.OIDCProvider {
+	for _, provider := range cfg.OIDC.Providers {
+		if provider.Name == name {
+			return provider
+		}
+	}
+	return config.OIDCProvider{}
+}
+
+// pkceChallenge is the S256 code challenge of a PKCE verifier (RFC 7636).
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
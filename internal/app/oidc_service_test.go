@@ -0,0 +1,213 @@
+package app
+
+import (
+	"errors"
+	"marketplace/internal/config"
+	"net/url"
+	"testing"
+	"time"
+	"github.com/google/uuid"
+)
+
+func newOIDCTestService() (*UserService, *MockUserRepo, *MockTokenRepo, *MockIdentityProvider, *config.Config) {
+	repo := &MockUserRepo{Users: make(map[string]User)}
+	tokens := &MockTokenRepo{}
+	identities := &MockIdentityProvider{}
+	cfg := &config.Config{
+		JWT_ACCESS_SECRET: "access", JWT_REFRESH_SECRET: "refresh", JWT_EXP_ACCESS_TOKEN: 15, JWT_EXP_REFRESH_TOKEN: 24,
+		Username:  config.Username{MinLength: 3, MaxLength: 20, AllowedCharacters: "A-Za-z0-9_-"},
+		OIDC:      config.OIDC{StateTTL: 600, Providers: []config.OIDCProvider{{Name: "mock"}}},
+		TwoFactor: config.TwoFactor{ChallengeTTL: 300},
+	}
+	return NewUserService(repo, tokens, &MockMailer{}, identities), repo, tokens, identities, cfg
+}
+
+// oidcLogin runs a whole login as the user described by identity.
+func oidcLogin(t *testing.T, service *UserService, identities *MockIdentityProvider, cfg *config.Config, identity ExternalIdentity) (JwtResponse, error) {
+	t.Helper()
+	authURL, err := service.StartOIDCLogin("mock", cfg)
+	if err != nil {
+		t.Fatalf("failed to start login: %v", err)
+	}
+	parsed, _ := url.Parse(authURL)
+	code := uuid.NewString()
+	identities.Authorize(authURL, code, identity)
+	return service.FinishOIDCLogin(OIDCCallbackRequest{Provider: "mock", Code: code, State: parsed.Query().Get("state")}, NewJwtProvider(cfg), cfg)
+}
+
+func TestUserService_StartOIDCLogin(t *testing.T) {
+	service, _, tokens, _, cfg := newOIDCTestService()
+
+	authURL, err := service.StartOIDCLogin("mock", cfg)
+	if err != nil {
+		t.Fatalf("failed to start login: %v", err)
+	}
+	parsed, _ := url.Parse(authURL)
+	state := parsed.Query().Get("state")
+	stored, ok := tokens.OIDCStates[hashMailToken(state)]
+	if !ok {
+		t.Fatal("expected the hash of the state to be stored")
+	}
+	if pkceChallenge(stored.CodeVerifier) != parsed.Query().Get("code_challenge") || stored.Nonce != parsed.Query().Get("nonce") {
+		t.Errorf("expected the verifier and nonce of the url to be stored, got %+v", stored)
+	}
+	if stored.ExpiresAt.Sub(stored.CreatedAt) != 10*time.Minute {
+		t.Errorf("expected the state to expire after state_ttl, got %v", stored.ExpiresAt.Sub(stored.CreatedAt))
+	}
+
+	if _, err := service.StartOIDCLogin("nope", cfg); !errors.Is(err, ErrUnknownProvider) {
+		t.Errorf("expected ErrUnknownProvider, got %v", err)
+	}
+}
+
+func TestPKCEChallenge(t *testing.T) {
+	// RFC 7636 appendix B
+	if got := pkceChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"); got != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Errorf("unexpected challenge %s", got)
+	}
+}
+
+func TestUserService_FinishOIDCLogin(t *testing.T) {
+	service, repo, _, identities, cfg := newOIDCTestService()
+	alice := ExternalIdentity{Subject: "alice-1", Email: "Alice@Example.com", EmailVerified: true, Username: "Alice"}
+
+	resp, err := oidcLogin(t, service, identities, cfg, alice)
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	if resp.AccessToken == "" || resp.RefreshToken == "" {
+		t.Errorf("expected a token pair, got %+v", resp)
+	}
+	user, ok := repo.Users["alice"]
+	if !ok {
+		t.Fatalf("expected a user named after preferred_username, got %v", repo.Users)
+	}
+	if user.Email != "alice@example.com" || user.EmailVerifiedAt == nil || user.Password != "" || user.Role != RoleUser {
+		t.Errorf("unexpected user: %+v", user)
+	}
+
+	if _, err := oidcLogin(t, service, identities, cfg, alice); err != nil {
+		t.Fatalf("second login failed: %v", err)
+	}
+	if len(repo.Users) != 1 {
+		t.Errorf("expected the second login to use the linked user, got %d users", len(repo.Users))
+	}
+
+	// another person with the same username gets a suffix; an unverified address isn't kept
+	if _, err := oidcLogin(t, service, identities, cfg, ExternalIdentity{Subject: "alice-2", Email: "other@example.com", Username: "alice"}); err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	other, err := repo.FindByIdentity("mock", "alice-2")
+	if err != nil || other.Login == "alice" || len(other.Login) != len("alice")+4 || other.Email != "" {
+		t.Errorf("expected a new user with a suffixed login and no email, got %+v %v", other, err)
+	}
+
+	if _, err := oidcLogin(t, service, identities, cfg, ExternalIdentity{Subject: "x-1", Email: "x@example.com"}); err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	if _, err := repo.FindByLogin("x"); err == nil {
+		t.Error("expected a too short login not to be used as is")
+	}
+}
+
+func TestUserService_FinishOIDCLogin_State(t *testing.T) {
+	service, _, _, identities, cfg := newOIDCTestService()
+	jwt := NewJwtProvider(cfg)
+	start := func() (string, string) {
+		authURL, _ := service.StartOIDCLogin("mock", cfg)
+		parsed, _ := url.Parse(authURL)
+		code := uuid.NewString()
+		identities.Authorize(authURL, code, ExternalIdentity{Subject: "alice-1", Username: "alice"})
+		return code, parsed.Query().Get("state")
+	}
+
+	code, state := start()
+	if _, err := service.FinishOIDCLogin(OIDCCallbackRequest{Provider: "mock", Code: code}, jwt, cfg); !errors.Is(err, ErrInvalidOIDCState) {
+		t.Errorf("expected a missing state to be rejected, got %v", err)
+	}
+	if _, err := service.FinishOIDCLogin(OIDCCallbackRequest{Provider: "other", Code: code, State: state}, jwt, cfg); !errors.Is(err, ErrInvalidOIDCState) {
+		t.Errorf("expected a state of another provider to be rejected, got %v", err)
+	}
+	if _, err := service.FinishOIDCLogin(OIDCCallbackRequest{Provider: "mock", Code: code, State: state}, jwt, cfg); !errors.Is(err, ErrInvalidOIDCState) {
+		t.Errorf("expected a state to work once, got %v", err)
+	}
+
+	_, state = start()
+	if _, err := service.FinishOIDCLogin(OIDCCallbackRequest{Provider: "mock", Error: "access_denied", State: state}, jwt, cfg); !errors.Is(err, ErrOIDCFailed) {
+		t.Errorf("expected ErrOIDCFailed for a provider error, got %v", err)
+	}
+
+	_, state = start()
+	if _, err := service.FinishOIDCLogin(OIDCCallbackRequest{Provider: "mock", Code: "unknown", State: state}, jwt, cfg); !errors.Is(err, ErrOIDCFailed) {
+		t.Errorf("expected ErrOIDCFailed for a rejected code, got %v", err)
+	}
+
+	// a code obtained for one login can't finish another
+	code, _ = start()
+	_, state = start()
+	if _, err := service.FinishOIDCLogin(OIDCCallbackRequest{Provider: "mock", Code: code, State: state}, jwt, cfg); !errors.Is(err, ErrOIDCFailed) {
+		t.Errorf("expected a code of another login to be rejected, got %v", err)
+	}
+}
+
+func TestUserService_FinishOIDCLogin_ExistingEmail(t *testing.T) {
+	service, repo, _, identities, cfg := newOIDCTestService()
+	verified := time.Now()
+	existing := User{UUID: uuid.New(), Login: "carol", Password: "hash", Status: UserStatusActive, Email: "carol@example.com", EmailVerifiedAt: &verified}
+	repo.Users["carol"] = existing
+	carol := ExternalIdentity{Subject: "carol-1", Email: "carol@example.com", EmailVerified: true, Username: "carol"}
+
+	if _, err := oidcLogin(t, service, identities, cfg, carol); !errors.Is(err, ErrEmailTaken) {
+		t.Errorf("expected ErrEmailTaken without link_by_email, got %v", err)
+	}
+
+	cfg.OIDC.Providers[0].LinkByEmail = true
+	if _, err := oidcLogin(t, service, identities, cfg, carol); err != nil {
+		t.Fatalf("expected the account to be linked, got %v", err)
+	}
+	if linked, err := repo.FindByIdentity("mock", "carol-1"); err != nil || linked.UUID != existing.UUID {
+		t.Errorf("expected the identity to be linked to the existing user, got %+v %v", linked, err)
+	}
+
+	// an address nobody verified on our side isn't enough to take the account
+	unverified := User{UUID: uuid.New(), Login: "dave", Password: "hash", Status: UserStatusActive, Email: "dave@example.com"}
+	repo.Users["dave"] = unverified
+	if _, err := oidcLogin(t, service, identities, cfg, ExternalIdentity{Subject: "dave-1", Email: "dave@example.com", EmailVerified: true}); !errors.Is(err, ErrEmailTaken) {
+		t.Errorf("expected ErrEmailTaken for an unverified account, got %v", err)
+	}
+}
+
+func TestUserService_FinishOIDCLogin_Restrictions(t *testing.T) {
+	service, repo, _, identities, cfg := newOIDCTestService()
+
+	cfg.Email.Required = true
+	if _, err := oidcLogin(t, service, identities, cfg, ExternalIdentity{Subject: "anon-1", Username: "anon"}); !errors.Is(err, ErrEmailRequired) {
+		t.Errorf("expected ErrEmailRequired, got %v", err)
+	}
+	cfg.Email.Required = false
+
+	eve := ExternalIdentity{Subject: "eve-1", Username: "eve"}
+	if _, err := oidcLogin(t, service, identities, cfg, eve); err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	user := repo.Users["eve"]
+
+	now := time.Now()
+	user.TOTPEnabledAt = &now
+	repo.Users["eve"] = user
+	resp, err := oidcLogin(t, service, identities, cfg, eve)
+	if err != nil || resp.ChallengeToken == "" || resp.AccessToken != "" {
+		t.Errorf("expected a two-factor challenge, got %+v %v", resp, err)
+	}
+
+	repo.SetPasswordResetRequired(user.UUID.String(), true)
+	if _, err := oidcLogin(t, service, identities, cfg, eve); !errors.Is(err, ErrPasswordResetRequired) {
+		t.Errorf("expected ErrPasswordResetRequired, got %v", err)
+	}
+
+	repo.SetStatus(user.UUID.String(), UserStatusBanned, "spam", nil)
+	var blocked *AccountBlockedError
+	if _, err := oidcLogin(t, service, identities, cfg, eve); !errors.As(err, &blocked) || !errors.Is(err, ErrUserBanned) {
+		t.Errorf("expected a banned user to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,268 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"marketplace/internal/config"
+	"net/url"
+	"strings"
+	"time"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrInvalidResetToken = errors.New("invalid or expired password reset token")
+	ErrWeakPassword      = errors.New("password does not meet the policy")
+	ErrWrongPassword     = errors.New("wrong password")
+)
+
+// Password hash algorithms, see config.Password.Algorithm.
+const (
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+)
+
+const (
+	// mailTokenBytes is the entropy of the tokens in password reset and verification links,
+	// also used for the state, nonce and PKCE verifier of OIDC logins.
+	mailTokenBytes  = 32
+	argon2SaltBytes = 16
+	argon2KeyBytes  = 32
+)
+
+// ForgotPassword mails a one-time password reset link to the user's verified address. An unknown
+// login or one without such an address is not an error, so the endpoint can't be used to find
+// out which accounts exist.
+func (s *UserService) ForgotPassword(req ForgotPasswordRequest, config *config.Config) error {
+	user, err := s.repo.FindByLogin(req.Login)
+	if err != nil {
+		return nil
+	}
+	// an unverified address may be a typo or someone else's, who would get the account
+	if user.Email == "" || user.EmailVerifiedAt == nil {
+		return nil
+	}
+
+	token, err := newMailToken()
+	if err != nil {
+		return fmt.Errorf("failed to generate reset token: %w", err)
+	}
+
+	now := time.Now()
+	// only the latest link works
+	if err := s.tokens.RevokePasswordResetTokens(user.UUID.String(), now); err != nil {
+		return fmt.Errorf("failed to revoke reset tokens: %w", err)
+	}
+	record := PasswordResetToken{
+		ID:        hashMailToken(token),
+		UserID:    user.UUID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Duration(config.Password.ResetTokenTTL) * time.Minute),
+	}
+	if err := s.tokens.SavePasswordResetToken(record); err != nil {
+		return fmt.Errorf("failed to save reset token: %w", err)
+	}
+
+	msg := Message{
+		To:      user.Email,
+		Subject: "Password reset",
+		Body: fmt.Sprintf("To set a new password open %s?token=%s\nThe link is valid for %d minutes. If you didn't ask for it, ignore this message.\n",
+			config.Password.ResetURL, url.QueryEscape(token), config.Password.ResetTokenTTL),
+	}
+	if err := s.mailer.Send(msg); err != nil {
+		return fmt.Errorf("failed to send reset mail: %w", err)
+	}
+	return nil
+}
+
+// ResetPassword sets a new password with a token from ForgotPassword. The token works once;
+// all sessions of the user end, since whoever knew the old password may be logged in.
+func (s *UserService) ResetPassword(req ResetPasswordRequest, config *config.Config) error {
+	if _, err := isValidPassword(req.Password, config); err != nil {
+		return fmt.Errorf("%w: %s", ErrWeakPassword, err)
+	}
+	if req.Token == "" {
+		return ErrInvalidResetToken
+	}
+
+	now := time.Now()
+	token, err := s.tokens.UsePasswordResetToken(hashMailToken(req.Token), now)
+	if err != nil {
+		return err
+	}
+	user, err := s.repo.FindByUUID(token.UserID.String())
+	if err != nil {
+		return ErrInvalidResetToken
+	}
+
+	hashedPassword, err := hashPassword(req.Password, config.Password)
+	if err != nil {
+		return err
+	}
+	if err := s.repo.SetPassword(user.UUID.String(), hashedPassword); err != nil {
+		return fmt.Errorf("failed to set password: %w", err)
+	}
+	if err := s.tokens.RevokePasswordResetTokens(user.UUID.String(), now); err != nil {
+		return fmt.Errorf("failed to revoke reset tokens: %w", err)
+	}
+	if err := s.tokens.RevokeUserTokens(user.UUID.String(), now); err != nil {
+		return fmt.Errorf("failed to revoke refresh tokens: %w", err)
+	}
+	s.throttle.succeed(user.Login)
+	return nil
+}
+
+// ChangePassword replaces the password of a logged-in user who knows the current one. Wrong
+// guesses count as failed logins, so a stolen access token can't be used to brute-force it.
+// Every other session ends; sid is the one the request was made from and stays.
+func (s *UserService) ChangePassword(userID uuid.UUID, sid string, req ChangePasswordRequest, config *config.Config) error {
+	user, err := s.repo.FindByUUID(userID.String())
+	if err != nil {
+		return ErrUserNotFound
+	}
+	now := time.Now()
+	if wait := s.throttle.wait(user.Login, req.Device.IP, now); wait > 0 {
+		return &LoginThrottledError{RetryAfter: wait}
+	}
+	if err := checkPassword(user.Password, req.CurrentPassword); err != nil {
+		s.throttle.fail(user.Login, req.Device.IP, config.LoginThrottle, now)
+		return ErrWrongPassword
+	}
+	s.throttle.succeed(user.Login)
+	if _, err := isValidPassword(req.NewPassword, config); err != nil {
+		return fmt.Errorf("%w: %s", ErrWeakPassword, err)
+	}
+
+	hashedPassword, err := hashPassword(req.NewPassword, config.Password)
+	if err != nil {
+		return err
+	}
+	if err := s.repo.SetPassword(user.UUID.String(), hashedPassword); err != nil {
+		return fmt.Errorf("failed to set password: %w", err)
+	}
+	if err := s.tokens.RevokePasswordResetTokens(user.UUID.String(), now); err != nil {
+		return fmt.Errorf("failed to revoke reset tokens: %w", err)
+	}
+	sessions, err := s.tokens.ActiveSessions(user.UUID.String(), now)
+	if err != nil {
+		return fmt.Errorf("failed to get sessions: %w", err)
+	}
+	for _, session := range sessions {
+		if session.ID == sid {
+			continue
+		}
+		if err := s.tokens.RevokeTokenFamily(session.ID, now); err != nil {
+			return fmt.Errorf("failed to revoke refresh tokens: %w", err)
+		}
+	}
+	return nil
+}
+
+// hashPassword hashes with the configured algorithm. Hashes are self-describing
+// (bcrypt's $2a$ or the PHC string $argon2id$v=19$m=,t=,p=$salt$key), so several may coexist.
+func hashPassword(password string, cfg config.Password) (string, error) {
+	switch cfg.Algorithm {
+	case "", HashBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost(cfg))
+		return string(hash), err
+	case HashArgon2id:
+		salt := make([]byte, argon2SaltBytes)
+		if _, err := rand.Read(salt); err != nil {
+			return "", fmt.Errorf("failed to generate salt: %w", err)
+		}
+		p := cfg.Argon2
+		key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, argon2KeyBytes)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	default:
+		return "", fmt.Errorf("unknown password hash algorithm %q", cfg.Algorithm)
+	}
+}
+
+// checkPassword returns ErrWrongPassword if password doesn't match hash.
+func checkPassword(hash string, password string) error {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		p, salt, key, err := parseArgon2Hash(hash)
+		if err != nil {
+			return err
+		}
+		other := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, uint32(len(key)))
+		if subtle.ConstantTimeCompare(key, other) != 1 {
+			return ErrWrongPassword
+		}
+		return nil
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return ErrWrongPassword
+	}
+	return err
+}
+
+// needsRehash reports whether hash was made with another algorithm or a lower cost than configured.
+func needsRehash(hash string, cfg config.Password) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		if cfg.Algorithm != HashArgon2id {
+			return true
+		}
+		p, _, _, err := parseArgon2Hash(hash)
+		return err != nil || p.Memory < cfg.Argon2.Memory || p.Iterations < cfg.Argon2.Iterations || p.Parallelism < cfg.Argon2.Parallelism
+	}
+	if cfg.Algorithm != "" && cfg.Algorithm != HashBcrypt {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost < bcryptCost(cfg)
+}
+
+// bcryptCost is the configured cost; out of range values fall back to bcrypt.DefaultCost.
+func bcryptCost(cfg config.Password) int {
+	if cfg.BcryptCost < bcrypt.MinCost || cfg.BcryptCost > bcrypt.MaxCost {
+		return bcrypt.DefaultCost
+	}
+	return cfg.BcryptCost
+}
+
+func parseArgon2Hash(hash string) (config.Argon2, []byte, []byte, error) {
+	var p config.Argon2
+	var version int
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return p, nil, nil, errors.New("invalid argon2id hash")
+	}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, errors.New("unsupported argon2id version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return p, nil, nil, fmt.Errorf("invalid argon2id parameters: %w", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("invalid argon2id salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return p, nil, nil, errors.New("invalid argon2id key")
+	}
+	return p, salt, key, nil
+}
+
+func newMailToken() (string, error) {
+	raw := make([]byte, mailTokenBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func hashMailToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,282 @@
+package app
+
+import (
+	"errors"
+	"marketplace/internal/config"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"golang.org/x/crypto/bcrypt"
+	"github.com/google/uuid"
+)
+
+// tokenFromMail extracts the token from the link in the last message sent.
+func tokenFromMail(t *testing.T, mailer *MockMailer) string {
+	t.Helper()
+	if len(mailer.Sent) == 0 {
+		t.Fatal("expected a mail to be sent")
+	}
+	body := mailer.Sent[len(mailer.Sent)-1].Body
+	start := strings.Index(body, "token=")
+	if start < 0 {
+		t.Fatalf("expected a link in %q", body)
+	}
+	raw := body[start+len("token="):]
+	raw = raw[:strings.IndexAny(raw, " \n")]
+	token, err := url.QueryUnescape(raw)
+	if err != nil {
+		t.Fatalf("invalid token in link: %v", err)
+	}
+	return token
+}
+
+func TestUserService_ForgotPassword(t *testing.T) {
+	verified := time.Now()
+	user := User{UUID: uuid.New(), Login: "testuser", Password: "hash", Status: UserStatusActive, Email: "test@example.com", EmailVerifiedAt: &verified}
+	unverified := User{UUID: uuid.New(), Login: "unverified", Password: "hash", Status: UserStatusActive, Email: "other@example.com"}
+	noEmail := User{UUID: uuid.New(), Login: "noemail", Password: "hash", Status: UserStatusActive}
+	cfg := &config.Config{Password: config.Password{ResetTokenTTL: 60, ResetURL: "http://localhost/reset"}}
+	tokens := &MockTokenRepo{}
+	mailer := &MockMailer{}
+	repo := &MockUserRepo{Users: map[string]User{"testuser": user, "unverified": unverified, "noemail": noEmail}}
+	service := NewUserService(repo, tokens, mailer, &MockIdentityProvider{})
+
+	for _, login := range []string{"nobody", "unverified", "noemail"} {
+		if err := service.ForgotPassword(ForgotPasswordRequest{Login: login}, cfg); err != nil {
+			t.Fatalf("expected %s to be ignored, got %v", login, err)
+		}
+	}
+	if len(mailer.Sent) != 0 {
+		t.Fatalf("expected no mail without a verified address, got %+v", mailer.Sent)
+	}
+
+	if err := service.ForgotPassword(ForgotPasswordRequest{Login: "testuser"}, cfg); err != nil {
+		t.Fatalf("forgot password failed: %v", err)
+	}
+	msg := mailer.Sent[0]
+	if msg.To != "test@example.com" || !strings.Contains(msg.Body, "http://localhost/reset?token=") {
+		t.Errorf("unexpected mail: %+v", msg)
+	}
+	token := tokenFromMail(t, mailer)
+	if _, ok := tokens.ResetTokens[token]; ok {
+		t.Error("expected only the hash of the token to be stored")
+	}
+	stored, ok := tokens.ResetTokens[hashMailToken(token)]
+	if !ok || stored.UserID != user.UUID || stored.ExpiresAt.Sub(stored.CreatedAt) != time.Hour {
+		t.Errorf("unexpected stored token: %+v", stored)
+	}
+}
+
+func TestUserService_ResetPassword(t *testing.T) {
+	password := "StrongPass1"
+	hashed, _ := bcrypt.GenerateFromPassword([]byte("OldPass1"), bcrypt.DefaultCost)
+	verified := time.Now()
+	user := User{UUID: uuid.New(), Login: "testuser", Password: string(hashed), Status: UserStatusActive, PasswordResetRequired: true,
+		Email: "test@example.com", EmailVerifiedAt: &verified}
+	cfg := &config.Config{
+		JWT_REFRESH_SECRET: "secret", JWT_EXP_REFRESH_TOKEN: 24,
+		Password: config.Password{MinLength: 8, MaxLength: 64, RequireUpper: true, RequireDigit: true, ResetTokenTTL: 60},
+	}
+	repo := &MockUserRepo{Users: map[string]User{"testuser": user}}
+	tokens := &MockTokenRepo{}
+	mailer := &MockMailer{}
+	service := NewUserService(repo, tokens, mailer, &MockIdentityProvider{})
+
+	forgot := func(t *testing.T) string {
+		if err := service.ForgotPassword(ForgotPasswordRequest{Login: "testuser"}, cfg); err != nil {
+			t.Fatalf("forgot password failed: %v", err)
+		}
+		return tokenFromMail(t, mailer)
+	}
+
+	t.Run("weak password", func(t *testing.T) {
+		token := forgot(t)
+		if err := service.ResetPassword(ResetPasswordRequest{Token: token, Password: "weak"}, cfg); !errors.Is(err, ErrWeakPassword) {
+			t.Fatalf("expected ErrWeakPassword, got %v", err)
+		}
+		// the token isn't spent on a rejected password
+		if err := service.ResetPassword(ResetPasswordRequest{Token: token, Password: password}, cfg); err != nil {
+			t.Errorf("expected the token to still work, got %v", err)
+		}
+	})
+
+	t.Run("success", func(t *testing.T) {
+		session := RefreshToken{ID: uuid.NewString(), FamilyID: uuid.NewString(), UserID: user.UUID, ExpiresAt: time.Now().Add(time.Hour)}
+		tokens.SaveRefreshToken(session)
+		token := forgot(t)
+
+		if err := service.ResetPassword(ResetPasswordRequest{Token: token, Password: password}, cfg); err != nil {
+			t.Fatalf("reset failed: %v", err)
+		}
+		updated := repo.Users["testuser"]
+		if bcrypt.CompareHashAndPassword([]byte(updated.Password), []byte(password)) != nil || updated.PasswordResetRequired {
+			t.Errorf("expected the new password to be set, got %+v", updated)
+		}
+		if tokens.Tokens[session.ID].RevokedAt == nil {
+			t.Error("expected existing sessions to be revoked")
+		}
+		if err := service.ResetPassword(ResetPasswordRequest{Token: token, Password: password}, cfg); !errors.Is(err, ErrInvalidResetToken) {
+			t.Errorf("expected a used token to be rejected, got %v", err)
+		}
+	})
+
+	t.Run("only the latest link works", func(t *testing.T) {
+		first := forgot(t)
+		forgot(t)
+		if err := service.ResetPassword(ResetPasswordRequest{Token: first, Password: password}, cfg); !errors.Is(err, ErrInvalidResetToken) {
+			t.Errorf("expected an older token to be rejected, got %v", err)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		token := forgot(t)
+		stored := tokens.ResetTokens[hashMailToken(token)]
+		stored.ExpiresAt = time.Now().Add(-time.Minute)
+		tokens.ResetTokens[stored.ID] = stored
+		if err := service.ResetPassword(ResetPasswordRequest{Token: token, Password: password}, cfg); !errors.Is(err, ErrInvalidResetToken) {
+			t.Errorf("expected an expired token to be rejected, got %v", err)
+		}
+	})
+
+	t.Run("unknown token", func(t *testing.T) {
+		if err := service.ResetPassword(ResetPasswordRequest{Token: "nope", Password: password}, cfg); !errors.Is(err, ErrInvalidResetToken) {
+			t.Errorf("expected ErrInvalidResetToken, got %v", err)
+		}
+	})
+}
+
+func TestPasswordHash(t *testing.T) {
+	fastArgon2 := config.Argon2{Memory: 1024, Iterations: 1, Parallelism: 1}
+	cases := []struct {
+		name string
+		cfg  config.Password
+	}{
+		{"bcrypt by default", config.Password{}},
+		{"bcrypt", config.Password{Algorithm: HashBcrypt, BcryptCost: bcrypt.MinCost}},
+		{"argon2id", config.Password{Algorithm: HashArgon2id, Argon2: fastArgon2}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			hash, err := hashPassword("StrongPass1", tc.cfg)
+			if err != nil {
+				t.Fatalf("hash failed: %v", err)
+			}
+			if err := checkPassword(hash, "StrongPass1"); err != nil {
+				t.Errorf("expected the password to match, got %v", err)
+			}
+			if err := checkPassword(hash, "WrongPass1"); !errors.Is(err, ErrWrongPassword) {
+				t.Errorf("expected ErrWrongPassword, got %v", err)
+			}
+			if needsRehash(hash, tc.cfg) {
+				t.Error("expected a fresh hash not to need a rehash")
+			}
+		})
+	}
+
+	if _, err := hashPassword("StrongPass1", config.Password{Algorithm: "md5"}); err == nil {
+		t.Error("expected an unknown algorithm to be rejected")
+	}
+	if err := checkPassword("$argon2id$v=19$broken", "StrongPass1"); err == nil || errors.Is(err, ErrWrongPassword) {
+		t.Errorf("expected a malformed hash error, got %v", err)
+	}
+}
+
+func TestPasswordNeedsRehash(t *testing.T) {
+	weakBcrypt, _ := bcrypt.GenerateFromPassword([]byte("StrongPass1"), bcrypt.MinCost)
+	weakArgon2, _ := hashPassword("StrongPass1", config.Password{Algorithm: HashArgon2id, Argon2: config.Argon2{Memory: 1024, Iterations: 1, Parallelism: 1}})
+
+	cases := []struct {
+		name     string
+		hash     string
+		cfg      config.Password
+		expected bool
+	}{
+		{"bcrypt below the cost", string(weakBcrypt), config.Password{BcryptCost: bcrypt.MinCost + 1}, true},
+		{"bcrypt at the cost", string(weakBcrypt), config.Password{BcryptCost: bcrypt.MinCost}, false},
+		{"bcrypt to argon2id", string(weakBcrypt), config.Password{Algorithm: HashArgon2id}, true},
+		{"argon2id with less memory", weakArgon2, config.Password{Algorithm: HashArgon2id, Argon2: config.Argon2{Memory: 2048, Iterations: 1, Parallelism: 1}}, true},
+		{"argon2id with the same parameters", weakArgon2, config.Password{Algorithm: HashArgon2id, Argon2: config.Argon2{Memory: 1024, Iterations: 1, Parallelism: 1}}, false},
+		{"argon2id to bcrypt", weakArgon2, config.Password{Algorithm: HashBcrypt}, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := needsRehash(tc.hash, tc.cfg); got != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestUserService_LoginJwt_Rehash(t *testing.T) {
+	weak, _ := bcrypt.GenerateFromPassword([]byte("StrongPass1"), bcrypt.MinCost)
+	user := User{UUID: uuid.New(), Login: "testuser", Password: string(weak), Status: UserStatusActive}
+	repo := &MockUserRepo{Users: map[string]User{"testuser": user}}
+	service := NewUserService(repo, &MockTokenRepo{}, &MockMailer{}, &MockIdentityProvider{})
+	cfg := &config.Config{
+		JWT_REFRESH_SECRET: "secret", JWT_EXP_REFRESH_TOKEN: 24,
+		Password: config.Password{Algorithm: HashArgon2id, Argon2: config.Argon2{Memory: 1024, Iterations: 1, Parallelism: 1}},
+	}
+
+	if _, err := service.LoginJwt(JwtRequest{Login: "testuser", Password: "StrongPass1"}, NewJwtProvider(cfg), cfg); err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	upgraded := repo.Users["testuser"].Password
+	if !strings.HasPrefix(upgraded, "$argon2id$") {
+		t.Fatalf("expected the hash to be upgraded to argon2id, got %q", upgraded)
+	}
+	if _, err := service.LoginJwt(JwtRequest{Login: "testuser", Password: "StrongPass1"}, NewJwtProvider(cfg), cfg); err != nil {
+		t.Fatalf("expected login with the upgraded hash to work, got %v", err)
+	}
+	if repo.Users["testuser"].Password != upgraded {
+		t.Error("expected an up-to-date hash to be kept")
+	}
+}
+
+func TestUserService_ChangePassword(t *testing.T) {
+	hashed, _ := bcrypt.GenerateFromPassword([]byte("OldPass1"), bcrypt.MinCost)
+	user := User{UUID: uuid.New(), Login: "testuser", Password: string(hashed), Status: UserStatusActive}
+	repo := &MockUserRepo{Users: map[string]User{"testuser": user}}
+	tokens := &MockTokenRepo{}
+	service := NewUserService(repo, tokens, &MockMailer{}, &MockIdentityProvider{})
+	cfg := &config.Config{
+		Password:      config.Password{MinLength: 8, MaxLength: 64, RequireDigit: true},
+		LoginThrottle: config.LoginThrottle{Login: config.Throttle{FreeAttempts: 1, BaseDelay: 60, MaxDelay: 60, Window: 3600}},
+	}
+
+	now := time.Now()
+	for _, sid := range []string{"current", "other"} {
+		tokens.SaveSession(Session{ID: sid, UserID: user.UUID, CreatedAt: now, LastUsedAt: now})
+		tokens.SaveRefreshToken(RefreshToken{ID: sid + "-token", FamilyID: sid, UserID: user.UUID, CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	}
+	tokens.SavePasswordResetToken(PasswordResetToken{ID: "pending", UserID: user.UUID, CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+
+	if err := service.ChangePassword(user.UUID, "current", ChangePasswordRequest{CurrentPassword: "OldPass1", NewPassword: "short"}, cfg); !errors.Is(err, ErrWeakPassword) {
+		t.Errorf("expected ErrWeakPassword, got %v", err)
+	}
+	if err := service.ChangePassword(user.UUID, "current", ChangePasswordRequest{CurrentPassword: "OldPass1", NewPassword: "NewPassword1"}, cfg); err != nil {
+		t.Fatalf("change failed: %v", err)
+	}
+	if checkPassword(repo.Users["testuser"].Password, "NewPassword1") != nil {
+		t.Error("expected the new password to be set")
+	}
+	if tokens.Tokens["current-token"].RevokedAt != nil {
+		t.Error("expected the current session to stay")
+	}
+	if tokens.Tokens["other-token"].RevokedAt == nil {
+		t.Error("expected other sessions to be revoked")
+	}
+	if tokens.ResetTokens["pending"].UsedAt == nil {
+		t.Error("expected pending reset links to be revoked")
+	}
+
+	if err := service.ChangePassword(user.UUID, "current", ChangePasswordRequest{CurrentPassword: "OldPass1", NewPassword: "Another1pass"}, cfg); !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("expected ErrWrongPassword, got %v", err)
+	}
+	if err := service.ChangePassword(user.UUID, "current", ChangePasswordRequest{CurrentPassword: "NewPassword1", NewPassword: "Another1pass"}, cfg); !errors.Is(err, ErrTooManyLoginAttempts) {
+		t.Errorf("expected wrong guesses to be throttled, got %v", err)
+	}
+	if err := service.ChangePassword(uuid.New(), "", ChangePasswordRequest{CurrentPassword: "OldPass1", NewPassword: "NewPassword1"}, cfg); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,20 @@
+package app
+
+import (
+	"sync"
+	"time"
+)
+
+// loginThrottle counts failed logins per login and per client IP. The counters live in the
+// process, so every instance of the service counts on its own.
+type loginThrottle struct {
+	mu        sync.Mutex
+	failures  map[string]*loginFailures // keyed by "login:<login>" and "ip:<ip>"
+	lastSweep time.Time
+}
+
+type loginFailures struct {
+	count       int
+	lockedUntil time.Time // no attempts before this time
+	expires     time.Time // the counter is forgotten after this time
+}
@@ -0,0 +1,118 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"marketplace/internal/config"
+	"strings"
+	"time"
+)
+
+var ErrTooManyLoginAttempts = errors.New("too many failed login attempts")
+
+// LoginThrottledError tells how long to wait before the next login attempt.
+// errors.Is matches it with ErrTooManyLoginAttempts.
+type LoginThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LoginThrottledError) Error() string {
+	return fmt.Sprintf("%s, retry in %s", ErrTooManyLoginAttempts, e.RetryAfter.Round(time.Second))
+}
+
+func (e *LoginThrottledError) Unwrap() error {
+	return ErrTooManyLoginAttempts
+}
+
+// throttleSweepInterval is how often forgotten counters are removed from memory.
+const throttleSweepInterval = time.Minute
+
+func newLoginThrottle() *loginThrottle {
+	return &loginThrottle{failures: make(map[string]*loginFailures)}
+}
+
+// wait returns how long an attempt to log in as login from ip has to be put off; zero allows it.
+func (t *loginThrottle) wait(login string, ip string, now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var wait time.Duration
+	for _, key := range throttleKeys(login, ip) {
+		if f, ok := t.failures[key]; ok && f.lockedUntil.After(now) {
+			wait = max(wait, f.lockedUntil.Sub(now))
+		}
+	}
+	return wait
+}
+
+// fail records a failed attempt for both the login and the IP.
+func (t *loginThrottle) fail(login string, ip string, cfg config.LoginThrottle, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	keys := throttleKeys(login, ip)
+	t.record(keys[0], cfg.Login, now)
+	if len(keys) > 1 {
+		t.record(keys[1], cfg.IP, now)
+	}
+	if now.Sub(t.lastSweep) > throttleSweepInterval {
+		for key, f := range t.failures {
+			if now.After(f.expires) {
+				delete(t.failures, key)
+			}
+		}
+		t.lastSweep = now
+	}
+}
+
+// succeed forgets the failures of the login. Those of the IP wear off by themselves, so that
+// an attacker can't reset them by logging into their own account between guesses.
+func (t *loginThrottle) succeed(login string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.failures, throttleKeys(login, "")[0])
+}
+
+func (t *loginThrottle) record(key string, cfg config.Throttle, now time.Time) {
+	f, ok := t.failures[key]
+	if !ok || now.After(f.expires) {
+		f = &loginFailures{}
+		t.failures[key] = f
+	}
+	f.count++
+	if delay := throttleDelay(f.count, cfg); delay > 0 {
+		f.lockedUntil = now.Add(delay)
+	}
+	f.expires = now.Add(time.Duration(cfg.Window) * time.Second)
+	if f.lockedUntil.After(f.expires) {
+		f.expires = f.lockedUntil
+	}
+}
+
+// throttleDelay is the wait after count failures in a row: none for the free attempts, then
+// BaseDelay doubling with every failure up to MaxDelay, and LockoutDuration from LockoutAttempts on.
+func throttleDelay(count int, cfg config.Throttle) time.Duration {
+	if cfg.LockoutAttempts > 0 && count >= cfg.LockoutAttempts {
+		return time.Duration(cfg.LockoutDuration) * time.Second
+	}
+	if cfg.BaseDelay <= 0 || count < cfg.FreeAttempts {
+		return 0
+	}
+	delay := time.Duration(cfg.BaseDelay) * time.Second
+	maxDelay := time.Duration(cfg.MaxDelay) * time.Second
+	for i := cfg.FreeAttempts; i < count; i++ {
+		delay *= 2
+		if maxDelay > 0 && delay >= maxDelay {
+			return maxDelay
+		}
+	}
+	return delay
+}
+
+func throttleKeys(login string, ip string) []string {
+	keys := []string{"login:" + strings.ToLower(login)}
+	if ip != "" {
+		keys = append(keys, "ip:"+ip)
+	}
+	return keys
+}
@@ -0,0 +1,131 @@
+package app
+
+import (
+	"errors"
+	"marketplace/internal/config"
+	"testing"
+	"time"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestThrottleDelay(t *testing.T) {
+	cfg := config.Throttle{FreeAttempts: 3, BaseDelay: 1, MaxDelay: 10, LockoutAttempts: 8, LockoutDuration: 600}
+	cases := []struct {
+		count    int
+		expected time.Duration
+	}{
+		{1, 0},
+		{2, 0},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{5, 4 * time.Second},
+		{6, 8 * time.Second},
+		{7, 10 * time.Second},
+		{8, 10 * time.Minute},
+		{50, 10 * time.Minute},
+	}
+	for _, tc := range cases {
+		if got := throttleDelay(tc.count, cfg); got != tc.expected {
+			t.Errorf("%d failures: expected %s, got %s", tc.count, tc.expected, got)
+		}
+	}
+	if got := throttleDelay(100, config.Throttle{}); got != 0 {
+		t.Errorf("expected an unconfigured throttle to never delay, got %s", got)
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	cfg := config.LoginThrottle{
+		Login: config.Throttle{FreeAttempts: 2, BaseDelay: 1, MaxDelay: 60, LockoutAttempts: 4, LockoutDuration: 300, Window: 3600},
+		IP:    config.Throttle{FreeAttempts: 3, BaseDelay: 1, MaxDelay: 60, LockoutAttempts: 10, LockoutDuration: 300, Window: 3600},
+	}
+	now := time.Now()
+
+	t.Run("per login", func(t *testing.T) {
+		throttle := newLoginThrottle()
+		throttle.fail("victim", "192.0.2.1", cfg, now)
+		if wait := throttle.wait("victim", "192.0.2.1", now); wait != 0 {
+			t.Errorf("expected the first failure to be free, got %s", wait)
+		}
+		throttle.fail("Victim", "192.0.2.2", cfg, now)
+		if wait := throttle.wait("VICTIM", "192.0.2.3", now); wait != time.Second {
+			t.Errorf("expected the login to wait 1s from any IP, got %s", wait)
+		}
+		throttle.fail("victim", "192.0.2.4", cfg, now)
+		throttle.fail("victim", "192.0.2.5", cfg, now)
+		if wait := throttle.wait("victim", "", now.Add(time.Minute)); wait != 4*time.Minute {
+			t.Errorf("expected the login to be locked out, got %s", wait)
+		}
+		throttle.succeed("victim")
+		if wait := throttle.wait("victim", "", now); wait != 0 {
+			t.Errorf("expected success to reset the login, got %s", wait)
+		}
+	})
+
+	t.Run("per ip", func(t *testing.T) {
+		throttle := newLoginThrottle()
+		for _, login := range []string{"a", "b", "c"} {
+			throttle.fail(login, "198.51.100.1", cfg, now)
+		}
+		if wait := throttle.wait("d", "198.51.100.1", now); wait != time.Second {
+			t.Errorf("expected the IP to wait 1s for any login, got %s", wait)
+		}
+		if wait := throttle.wait("d", "198.51.100.2", now); wait != 0 {
+			t.Errorf("expected other IPs not to wait, got %s", wait)
+		}
+		throttle.succeed("a")
+		if wait := throttle.wait("d", "198.51.100.1", now); wait != time.Second {
+			t.Errorf("expected a success not to reset the IP, got %s", wait)
+		}
+	})
+
+	t.Run("forgotten after the window", func(t *testing.T) {
+		throttle := newLoginThrottle()
+		throttle.fail("victim", "", cfg, now)
+		throttle.fail("victim", "", cfg, now)
+		throttle.fail("other", "", cfg, now)
+		later := now.Add(2 * time.Hour)
+		throttle.fail("victim", "", cfg, later)
+		if wait := throttle.wait("victim", "", later); wait != 0 {
+			t.Errorf("expected old failures to be forgotten, got %s", wait)
+		}
+		if len(throttle.failures) != 1 {
+			t.Errorf("expected stale counters to be swept, got %d", len(throttle.failures))
+		}
+	})
+}
+
+func TestUserService_LoginJwtThrottled(t *testing.T) {
+	password := "StrongPass1"
+	hashed, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	user := User{UUID: uuid.New(), Login: "testuser", Password: string(hashed)}
+	repo := &MockUserRepo{Users: map[string]User{"testuser": user}}
+	cfg := &config.Config{
+		JWT_ACCESS_SECRET: "secret",
+		JWT_EXP_ACCESS_TOKEN: 15,
+		LoginThrottle: config.LoginThrottle{
+			Login: config.Throttle{FreeAttempts: 2, BaseDelay: 30, MaxDelay: 60, Window: 3600},
+		},
+	}
+	jwtProvider := NewJwtProvider(cfg)
+	service := NewUserService(repo, &MockTokenRepo{}, &MockMailer{}, &MockIdentityProvider{})
+	device := Device{IP: "192.0.2.1"}
+
+	for i := 0; i < 2; i++ {
+		if _, err := service.LoginJwt(JwtRequest{Login: "testuser", Password: "wrong", Device: device}, jwtProvider, cfg); err == nil || err.Error() != "unauthorized" {
+			t.Fatalf("expected unauthorized error, got: %v", err)
+		}
+	}
+	// even the right password has to wait, so the password isn't checked at all
+	_, err := service.LoginJwt(JwtRequest{Login: "testuser", Password: password, Device: device}, jwtProvider, cfg)
+	var throttled *LoginThrottledError
+	if !errors.Is(err, ErrTooManyLoginAttempts) || !errors.As(err, &throttled) || throttled.RetryAfter <= 0 || throttled.RetryAfter > 30*time.Second {
+		t.Fatalf("expected to wait up to 30s, got: %v", err)
+	}
+
+	service.throttle.succeed("testuser")
+	if _, err := service.LoginJwt(JwtRequest{Login: "testuser", Password: password, Device: device}, jwtProvider, cfg); err != nil {
+		t.Errorf("expected login to work once the wait is over, got: %v", err)
+	}
+}
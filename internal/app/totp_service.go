@@ -0,0 +1,283 @@
+package app
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"marketplace/internal/config"
+	"net/url"
+	"strings"
+	"time"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrTOTPAlreadyEnabled  = errors.New("two-factor authentication is already enabled")
+	ErrTOTPNotSetUp        = errors.New("two-factor authentication is not set up")
+	ErrInvalidTOTPCode     = errors.New("invalid two-factor code")
+	ErrInvalidChallenge    = errors.New("invalid or expired two-factor challenge")
+
+	// errTOTPSecret is a stored secret that can't be decrypted, e.g. after two_factor.secret_key changed.
+	errTOTPSecret = errors.New("totp secret can't be decrypted")
+)
+
+// TOTP parameters (RFC 6238) as authenticator apps expect them by default.
+const (
+	totpSecretBytes = 20
+	totpPeriod      = 30 // seconds
+	totpDigits      = 6
+	// totpSkew is how many periods a code may be off, for clocks that drift.
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+	recoveryCodeBytes = 5 // 8 base32 characters
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// SetupTOTP starts enrolment with a new secret for an authenticator app. Two-factor authentication
+// stays off until ConfirmTOTP proves the app has it; setting up again replaces a pending secret.
+func (s *UserService) SetupTOTP(userID uuid.UUID, config *config.Config) (TOTPSetupResponse, error) {
+	user, err := s.repo.FindByUUID(userID.String())
+	if err != nil {
+		return TOTPSetupResponse{}, ErrUserNotFound
+	}
+	if user.TOTPEnabledAt != nil {
+		return TOTPSetupResponse{}, ErrTOTPAlreadyEnabled
+	}
+
+	raw := make([]byte, totpSecretBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return TOTPSetupResponse{}, fmt.Errorf("failed to generate totp secret: %w", err)
+	}
+	secret := totpEncoding.EncodeToString(raw)
+	sealed, err := sealTOTPSecret(config, user.UUID, raw)
+	if err != nil {
+		return TOTPSetupResponse{}, err
+	}
+	if err := s.repo.SetTOTPSecret(user.UUID.String(), sealed); err != nil {
+		return TOTPSetupResponse{}, fmt.Errorf("failed to save totp secret: %w", err)
+	}
+	return TOTPSetupResponse{Secret: secret, URI: totpURI(config.TwoFactor.Issuer, user.Login, secret)}, nil
+}
+
+// ConfirmTOTP enables two-factor authentication with a code from the app and returns
+// single-use recovery codes for when the app is lost.
+func (s *UserService) ConfirmTOTP(userID uuid.UUID, req TOTPConfirmRequest, config *config.Config) (TOTPConfirmResponse, error) {
+	user, err := s.repo.FindByUUID(userID.String())
+	if err != nil {
+		return TOTPConfirmResponse{}, ErrUserNotFound
+	}
+	if user.TOTPEnabledAt != nil {
+		return TOTPConfirmResponse{}, ErrTOTPAlreadyEnabled
+	}
+	if user.TOTPSecret == "" {
+		return TOTPConfirmResponse{}, ErrTOTPNotSetUp
+	}
+	now := time.Now()
+	if err := s.checkTOTP(user, req.Code, now, config); err != nil {
+		return TOTPConfirmResponse{}, err
+	}
+	key, err := totpKey(config)
+	if err != nil {
+		return TOTPConfirmResponse{}, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, recoveryCodeBytes)
+		if _, err := rand.Read(raw); err != nil {
+			return TOTPConfirmResponse{}, fmt.Errorf("failed to generate recovery code: %w", err)
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(raw))
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = hashRecoveryCode(key, user.UUID, code)
+	}
+	if err := s.repo.EnableTOTP(user.UUID.String(), now, hashes); err != nil {
+		return TOTPConfirmResponse{}, fmt.Errorf("failed to enable totp: %w", err)
+	}
+	return TOTPConfirmResponse{RecoveryCodes: codes}, nil
+}
+
+// LoginTwoFactor finishes a login for which LoginJwt returned a challenge token. The code is
+// either from the authenticator app or a recovery code; wrong ones count as failed logins.
+func (s *UserService) LoginTwoFactor(req TwoFactorLoginRequest, jwt *JwtProvider, config *config.Config) (JwtResponse, error) {
+	claims, err := jwt.ValidateChallengeToken(req.ChallengeToken)
+	if err != nil {
+		return JwtResponse{}, ErrInvalidChallenge
+	}
+	userID, _ := claims["uuid"].(string)
+	user, err := s.repo.FindByUUID(userID)
+	if err != nil || user.TOTPEnabledAt == nil {
+		return JwtResponse{}, ErrInvalidChallenge
+	}
+
+	now := time.Now()
+	if wait := s.throttle.wait(user.Login, req.Device.IP, now); wait > 0 {
+		return JwtResponse{}, &LoginThrottledError{RetryAfter: wait}
+	}
+	if err := s.checkSecondFactor(user, req.Code, now, config); err != nil {
+		if errors.Is(err, ErrInvalidTOTPCode) {
+			s.throttle.fail(user.Login, req.Device.IP, config.LoginThrottle, now)
+		}
+		return JwtResponse{}, err
+	}
+	s.throttle.succeed(user.Login)
+	// the account may have been blocked or a reset forced since the password was checked
+	if err := accountBlocked(user, now); err != nil {
+		return JwtResponse{}, err
+	}
+	if user.PasswordResetRequired {
+		return JwtResponse{}, ErrPasswordResetRequired
+	}
+	return s.startSession(user, req.Device, jwt, config)
+}
+
+// checkSecondFactor accepts a TOTP code or, failing that, an unused recovery code.
+func (s *UserService) checkSecondFactor(user User, code string, now time.Time, config *config.Config) error {
+	err := s.checkTOTP(user, code, now, config)
+	// a secret that can't be decrypted counts as a wrong code, so that guesses are still throttled
+	if errors.Is(err, errTOTPSecret) {
+		err = fmt.Errorf("%w: %w", ErrInvalidTOTPCode, err)
+	}
+	if !errors.Is(err, ErrInvalidTOTPCode) {
+		return err
+	}
+	key, keyErr := totpKey(config)
+	if keyErr != nil {
+		return fmt.Errorf("%w: %w: %v", ErrInvalidTOTPCode, errTOTPSecret, keyErr)
+	}
+	used, useErr := s.repo.UseRecoveryCode(user.UUID.String(), hashRecoveryCode(key, user.UUID, code), now)
+	if useErr != nil {
+		return fmt.Errorf("failed to use recovery code: %w", useErr)
+	}
+	if !used {
+		return err
+	}
+	return nil
+}
+
+// checkTOTP accepts a code of the current period or a neighbouring one, once.
+func (s *UserService) checkTOTP(user User, code string, now time.Time, config *config.Config) error {
+	if len(code) != totpDigits {
+		return ErrInvalidTOTPCode
+	}
+	secret, err := openTOTPSecret(config, user.UUID, user.TOTPSecret)
+	if err != nil {
+		return err
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if !hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			continue
+		}
+		ok, err := s.repo.UseTOTPStep(user.UUID.String(), step)
+		if err != nil {
+			return fmt.Errorf("failed to use totp step: %w", err)
+		}
+		if !ok {
+			return ErrInvalidTOTPCode
+		}
+		return nil
+	}
+	return ErrInvalidTOTPCode
+}
+
+// sealTOTPSecret encrypts the raw TOTP key for the database, so that a leaked dump or backup
+// isn't enough to generate codes. The user's UUID is authenticated with it, so a secret copied
+// to another row doesn't decrypt.
+func sealTOTPSecret(config *config.Config, userID uuid.UUID, secret []byte) (string, error) {
+	aead, err := totpCipher(config)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, secret, userID[:])
+	return base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// openTOTPSecret decrypts a secret stored by sealTOTPSecret.
+func openTOTPSecret(config *config.Config, userID uuid.UUID, stored string) ([]byte, error) {
+	aead, err := totpCipher(config)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errTOTPSecret, err)
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(stored)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("%w: malformed", errTOTPSecret)
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	secret, err := aead.Open(nil, nonce, ciphertext, userID[:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errTOTPSecret, err)
+	}
+	return secret, nil
+}
+
+func totpCipher(config *config.Config) (cipher.AEAD, error) {
+	key, err := totpKey(config)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// totpCode is the HOTP value (RFC 4226) of the given time step.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// totpURI is the Key Uri Format understood by authenticator apps.
+func totpURI(issuer string, login string, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	uri := url.URL{Scheme: "otpauth", Host: "totp", Path: "/" + issuer + ":" + login, RawQuery: query.Encode()}
+	return uri.String()
+}
+
+// totpKey is two_factor.secret_key, which encrypts the TOTP secrets and keys the recovery code hashes.
+func totpKey(config *config.Config) ([]byte, error) {
+	key, err := hex.DecodeString(config.TwoFactor.SecretKey)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("two_factor.secret_key must be 32 bytes in hex")
+	}
+	return key, nil
+}
+
+// hashRecoveryCode ignores case and the dash the codes are shown with. The hash is keyed and
+// bound to the user, so that the short codes can't be brute-forced from a database dump.
+func hashRecoveryCode(key []byte, userID uuid.UUID, code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	mac := hmac.New(sha256.New, key)
+	mac.Write(userID[:])
+	mac.Write([]byte(code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,256 @@
+package app
+
+import (
+	"errors"
+	"marketplace/internal/config"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"golang.org/x/crypto/bcrypt"
+	"github.com/google/uuid"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, SHA1, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix     int64
+		expected string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tc := range tests {
+		if got := totpCode(secret, tc.unix/totpPeriod); got != tc.expected {
+			t.Errorf("at %d expected %s, got %s", tc.unix, tc.expected, got)
+		}
+	}
+}
+
+func TestHashRecoveryCode(t *testing.T) {
+	key := []byte(strings.Repeat("k", 32))
+	alice, bob := uuid.New(), uuid.New()
+	if hashRecoveryCode(key, alice, "abcd-efgh") != hashRecoveryCode(key, alice, " ABCDEFGH") {
+		t.Error("expected case, dashes and spaces to be ignored")
+	}
+	if hashRecoveryCode(key, alice, "abcd-efgh") == hashRecoveryCode(key, alice, "abcd-efgi") {
+		t.Error("expected different codes to differ")
+	}
+	if hashRecoveryCode(key, alice, "abcd-efgh") == hashRecoveryCode(key, bob, "abcd-efgh") {
+		t.Error("expected the same code of two users to be stored differently")
+	}
+	if hashRecoveryCode(key, alice, "abcd-efgh") == hashRecoveryCode([]byte(strings.Repeat("x", 32)), alice, "abcd-efgh") {
+		t.Error("expected the hash to depend on the key")
+	}
+}
+
+const testTOTPKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+func newTwoFactorTestService(t *testing.T) (*UserService, *MockUserRepo, *config.Config, User) {
+	t.Helper()
+	hashed, _ := bcrypt.GenerateFromPassword([]byte("StrongPass1"), bcrypt.MinCost)
+	user := User{UUID: uuid.New(), Login: "testuser", Password: string(hashed), Status: UserStatusActive}
+	repo := &MockUserRepo{Users: map[string]User{"testuser": user}}
+	cfg := &config.Config{
+		JWT_REFRESH_SECRET: "secret", JWT_EXP_REFRESH_TOKEN: 24,
+		TwoFactor:     config.TwoFactor{Issuer: "Marketplace", ChallengeTTL: 300, SecretKey: testTOTPKey},
+		LoginThrottle: config.LoginThrottle{Login: config.Throttle{FreeAttempts: 2, BaseDelay: 60, MaxDelay: 60, Window: 3600}},
+	}
+	return NewUserService(repo, &MockTokenRepo{}, &MockMailer{}, &MockIdentityProvider{}), repo, cfg, user
+}
+
+// currentTOTP is the code an authenticator app would show, steps periods from now.
+func currentTOTP(t *testing.T, secret string, steps int64) string {
+	t.Helper()
+	raw, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatalf("invalid secret %q: %v", secret, err)
+	}
+	return totpCode(raw, time.Now().Unix()/totpPeriod+steps)
+}
+
+func TestUserService_SetupTOTP(t *testing.T) {
+	service, repo, cfg, user := newTwoFactorTestService(t)
+
+	setup, err := service.SetupTOTP(user.UUID, cfg)
+	if err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+	uri, err := url.Parse(setup.URI)
+	if err != nil || uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Path != "/Marketplace:testuser" {
+		t.Fatalf("unexpected uri %q", setup.URI)
+	}
+	if uri.Query().Get("secret") != setup.Secret || uri.Query().Get("issuer") != "Marketplace" {
+		t.Errorf("unexpected uri parameters %q", setup.URI)
+	}
+	stored := repo.Users["testuser"].TOTPSecret
+	if stored == "" || repo.Users["testuser"].TOTPEnabledAt != nil {
+		t.Error("expected a pending secret to be stored")
+	}
+	raw, err := openTOTPSecret(cfg, user.UUID, stored)
+	if err != nil || totpEncoding.EncodeToString(raw) != setup.Secret || strings.Contains(stored, setup.Secret) {
+		t.Errorf("expected the secret to be stored encrypted, got %q %v", stored, err)
+	}
+	if _, err := openTOTPSecret(cfg, uuid.New(), stored); !errors.Is(err, errTOTPSecret) {
+		t.Errorf("expected the secret not to decrypt for another user, got %v", err)
+	}
+
+	if _, err := service.ConfirmTOTP(user.UUID, TOTPConfirmRequest{Code: "abcdef"}, cfg); !errors.Is(err, ErrInvalidTOTPCode) {
+		t.Errorf("expected ErrInvalidTOTPCode, got %v", err)
+	}
+	confirmed, err := service.ConfirmTOTP(user.UUID, TOTPConfirmRequest{Code: currentTOTP(t, setup.Secret, 0)}, cfg)
+	if err != nil {
+		t.Fatalf("confirm failed: %v", err)
+	}
+	if len(confirmed.RecoveryCodes) != recoveryCodeCount || len(repo.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("expected %d recovery codes, got %v", recoveryCodeCount, confirmed.RecoveryCodes)
+	}
+	if _, ok := repo.RecoveryCodes[confirmed.RecoveryCodes[0]]; ok {
+		t.Error("expected only hashes of the recovery codes to be stored")
+	}
+	if repo.Users["testuser"].TOTPEnabledAt == nil {
+		t.Error("expected two-factor authentication to be enabled")
+	}
+
+	if _, err := service.SetupTOTP(user.UUID, cfg); !errors.Is(err, ErrTOTPAlreadyEnabled) {
+		t.Errorf("expected ErrTOTPAlreadyEnabled, got %v", err)
+	}
+	if _, err := service.ConfirmTOTP(user.UUID, TOTPConfirmRequest{Code: currentTOTP(t, setup.Secret, 1)}, cfg); !errors.Is(err, ErrTOTPAlreadyEnabled) {
+		t.Errorf("expected ErrTOTPAlreadyEnabled, got %v", err)
+	}
+}
+
+func TestUserService_ConfirmTOTP_NotSetUp(t *testing.T) {
+	service, _, cfg, user := newTwoFactorTestService(t)
+	if _, err := service.ConfirmTOTP(user.UUID, TOTPConfirmRequest{Code: "123456"}, cfg); !errors.Is(err, ErrTOTPNotSetUp) {
+		t.Errorf("expected ErrTOTPNotSetUp, got %v", err)
+	}
+	if _, err := service.ConfirmTOTP(uuid.New(), TOTPConfirmRequest{Code: "123456"}, cfg); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestUserService_LoginTwoFactor(t *testing.T) {
+	service, _, cfg, user := newTwoFactorTestService(t)
+	jwt := NewJwtProvider(cfg)
+	setup, _ := service.SetupTOTP(user.UUID, cfg)
+	enrolCode := currentTOTP(t, setup.Secret, 0)
+	confirmed, err := service.ConfirmTOTP(user.UUID, TOTPConfirmRequest{Code: enrolCode}, cfg)
+	if err != nil {
+		t.Fatalf("confirm failed: %v", err)
+	}
+
+	login := func() string {
+		t.Helper()
+		resp, err := service.LoginJwt(JwtRequest{Login: "testuser", Password: "StrongPass1"}, jwt, cfg)
+		if err != nil {
+			t.Fatalf("login failed: %v", err)
+		}
+		if resp.ChallengeToken == "" || resp.AccessToken != "" || resp.RefreshToken != "" {
+			t.Fatalf("expected only a challenge token, got %+v", resp)
+		}
+		return resp.ChallengeToken
+	}
+
+	challenge := login()
+	if _, err := service.LoginTwoFactor(TwoFactorLoginRequest{ChallengeToken: "bogus", Code: currentTOTP(t, setup.Secret, 1)}, jwt, cfg); !errors.Is(err, ErrInvalidChallenge) {
+		t.Errorf("expected ErrInvalidChallenge, got %v", err)
+	}
+	if _, err := service.LoginTwoFactor(TwoFactorLoginRequest{ChallengeToken: challenge, Code: enrolCode}, jwt, cfg); !errors.Is(err, ErrInvalidTOTPCode) {
+		t.Errorf("expected a used code to be rejected, got %v", err)
+	}
+	resp, err := service.LoginTwoFactor(TwoFactorLoginRequest{ChallengeToken: challenge, Code: currentTOTP(t, setup.Secret, 1)}, jwt, cfg)
+	if err != nil {
+		t.Fatalf("two-factor login failed: %v", err)
+	}
+	if resp.AccessToken == "" || resp.RefreshToken == "" || resp.ChallengeToken != "" {
+		t.Errorf("expected a token pair, got %+v", resp)
+	}
+
+	recovery := strings.ToUpper(confirmed.RecoveryCodes[0])
+	if _, err := service.LoginTwoFactor(TwoFactorLoginRequest{ChallengeToken: login(), Code: recovery}, jwt, cfg); err != nil {
+		t.Fatalf("expected a recovery code to work, got %v", err)
+	}
+	if _, err := service.LoginTwoFactor(TwoFactorLoginRequest{ChallengeToken: login(), Code: recovery}, jwt, cfg); !errors.Is(err, ErrInvalidTOTPCode) {
+		t.Errorf("expected a recovery code to work once, got %v", err)
+	}
+	if _, err := service.LoginTwoFactor(TwoFactorLoginRequest{ChallengeToken: challenge, Code: "wrong"}, jwt, cfg); !errors.Is(err, ErrInvalidTOTPCode) {
+		t.Errorf("expected ErrInvalidTOTPCode, got %v", err)
+	}
+	if _, err := service.LoginTwoFactor(TwoFactorLoginRequest{ChallengeToken: challenge, Code: confirmed.RecoveryCodes[1]}, jwt, cfg); !errors.Is(err, ErrTooManyLoginAttempts) {
+		t.Errorf("expected wrong codes to be throttled, got %v", err)
+	}
+}
+
+func TestUserService_LoginTwoFactor_PasswordResetRequired(t *testing.T) {
+	service, repo, cfg, user := newTwoFactorTestService(t)
+	jwt := NewJwtProvider(cfg)
+	setup, _ := service.SetupTOTP(user.UUID, cfg)
+	if _, err := service.ConfirmTOTP(user.UUID, TOTPConfirmRequest{Code: currentTOTP(t, setup.Secret, 0)}, cfg); err != nil {
+		t.Fatalf("confirm failed: %v", err)
+	}
+	resp, err := service.LoginJwt(JwtRequest{Login: "testuser", Password: "StrongPass1"}, jwt, cfg)
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+
+	// an admin forces a reset while the challenge is pending
+	repo.SetPasswordResetRequired(user.UUID.String(), true)
+	_, err = service.LoginTwoFactor(TwoFactorLoginRequest{ChallengeToken: resp.ChallengeToken, Code: currentTOTP(t, setup.Secret, 1)}, jwt, cfg)
+	if !errors.Is(err, ErrPasswordResetRequired) {
+		t.Errorf("expected ErrPasswordResetRequired, got %v", err)
+	}
+}
+
+func TestUserService_LoginTwoFactor_ChangedKey(t *testing.T) {
+	service, _, cfg, user := newTwoFactorTestService(t)
+	jwt := NewJwtProvider(cfg)
+	setup, _ := service.SetupTOTP(user.UUID, cfg)
+	confirmed, err := service.ConfirmTOTP(user.UUID, TOTPConfirmRequest{Code: currentTOTP(t, setup.Secret, 0)}, cfg)
+	if err != nil {
+		t.Fatalf("confirm failed: %v", err)
+	}
+
+	changed := *cfg
+	changed.TwoFactor.SecretKey = strings.Repeat("ff", 32)
+	login := func() string {
+		t.Helper()
+		resp, err := service.LoginJwt(JwtRequest{Login: "testuser", Password: "StrongPass1"}, jwt, &changed)
+		if err != nil {
+			t.Fatalf("login failed: %v", err)
+		}
+		return resp.ChallengeToken
+	}
+	_, err = service.LoginTwoFactor(TwoFactorLoginRequest{ChallengeToken: login(), Code: currentTOTP(t, setup.Secret, 1)}, jwt, &changed)
+	if !errors.Is(err, ErrInvalidTOTPCode) || !errors.Is(err, errTOTPSecret) {
+		t.Errorf("expected the code to be refused, got %v", err)
+	}
+	// the recovery codes are keyed with the same key
+	if _, err := service.LoginTwoFactor(TwoFactorLoginRequest{ChallengeToken: login(), Code: confirmed.RecoveryCodes[0]}, jwt, &changed); !errors.Is(err, ErrInvalidTOTPCode) {
+		t.Errorf("expected the recovery code to be refused, got %v", err)
+	}
+	if _, err := service.LoginTwoFactor(TwoFactorLoginRequest{ChallengeToken: login(), Code: confirmed.RecoveryCodes[0]}, jwt, cfg); err != nil {
+		t.Errorf("expected the recovery code to work with the original key, got %v", err)
+	}
+}
+
+func TestUserService_LoginTwoFactor_ChallengeIsNotAccessToken(t *testing.T) {
+	service, _, cfg, user := newTwoFactorTestService(t)
+	jwt := NewJwtProvider(cfg)
+	setup, _ := service.SetupTOTP(user.UUID, cfg)
+	service.ConfirmTOTP(user.UUID, TOTPConfirmRequest{Code: currentTOTP(t, setup.Secret, 0)}, cfg)
+
+	resp, err := service.LoginJwt(JwtRequest{Login: "testuser", Password: "StrongPass1"}, jwt, cfg)
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	if _, err := jwt.ValidateAccessToken(resp.ChallengeToken); err == nil {
+		t.Error("expected the challenge token not to be accepted as an access token")
+	}
+	if _, err := jwt.ValidateRefreshToken(resp.ChallengeToken); err == nil {
+		t.Error("expected the challenge token not to be accepted as a refresh token")
+	}
+}
@@ -2,16 +2,94 @@ package app
 
 import (
 	"marketplace/internal/config"
+	"time"
+	"github.com/google/uuid"
 )
 
 type UserRepository interface {
 	SaveNewUser(user User) error
 	FindByLogin(login string) (User, error) // strings.ToLower(req.Login) допилить
 	FindByUUID(uuid string) (User, error)
+	FindByEmail(email string) (User, error)
+	SetRole(uuid string, role string) error
+	ListUsers(params UsersListParams) ([]User, error)
+	CountUsers(params UsersListParams) (int, error)
+	// SetStatus changes the account status; until is the end of a suspension and nil otherwise.
+	SetStatus(uuid string, status string, reason string, until *time.Time) error
+	SetPasswordResetRequired(uuid string, required bool) error
+	// SetPassword stores a new password hash and clears PasswordResetRequired.
+	SetPassword(uuid string, hash string) error
+	// SetEmailVerified marks the address verified if it's still the user's address;
+	// otherwise it returns ErrInvalidVerificationToken.
+	SetEmailVerified(uuid string, email string, at time.Time) error
+	// SetTOTPSecret stores a new, not yet enabled TOTP secret, already encrypted by the service.
+	SetTOTPSecret(uuid string, secret string) error
+	// EnableTOTP turns two-factor authentication on and replaces the recovery codes with codeHashes.
+	EnableTOTP(uuid string, at time.Time, codeHashes []string) error
+	// UseTOTPStep records the time step of an accepted code; false means a code of this or a later
+	// step was already used.
+	UseTOTPStep(uuid string, step int64) (bool, error)
+	// UseRecoveryCode marks an unused recovery code as used; false means there is no such code.
+	UseRecoveryCode(uuid string, codeHash string, at time.Time) (bool, error)
+	// FindByIdentity finds the user an external account is linked to.
+	FindByIdentity(provider string, subject string) (User, error)
+	SaveIdentity(identity UserIdentity) error
+	// SaveNewUserWithIdentity creates a user signed up through a provider together with the link.
+	SaveNewUserWithIdentity(user User, identity UserIdentity) error
+	// DeleteUser removes the user with their sessions and tokens, but not their ads.
+	DeleteUser(uuid string) error
+}
+
+type TokenRepository interface {
+	SaveRefreshToken(token RefreshToken) error
+	GetRefreshToken(id string) (RefreshToken, error)
+	// UseRefreshToken marks an unused, unrevoked token as used; false means it was already consumed.
+	UseRefreshToken(id string, at time.Time) (bool, error)
+	RevokeTokenFamily(familyID string, at time.Time) error
+	RevokeUserTokens(userID string, at time.Time) error
+	// FamilyRevoked reports whether the login session was ended; access tokens of such a session are denied.
+	FamilyRevoked(familyID string) (bool, error)
+	SaveSession(session Session) error
+	// UpdateSession stores the device and last-used time reported on refresh.
+	UpdateSession(session Session) error
+	// TouchSession moves last_used_at to at unless it was already updated after since.
+	TouchSession(id string, at time.Time, since time.Time) error
+	// ActiveSessions lists the user's sessions that are neither revoked nor expired at the given time.
+	ActiveSessions(userID string, at time.Time) ([]Session, error)
+	SavePasswordResetToken(token PasswordResetToken) error
+	// UsePasswordResetToken marks an unused token that hasn't expired at the given time as used
+	// and returns it; any other token gives ErrInvalidResetToken.
+	UsePasswordResetToken(id string, at time.Time) (PasswordResetToken, error)
+	// RevokePasswordResetTokens makes all unused reset tokens of the user unusable.
+	RevokePasswordResetTokens(userID string, at time.Time) error
+	SaveEmailVerificationToken(token EmailVerificationToken) error
+	// UseEmailVerificationToken is UsePasswordResetToken for verification links;
+	// it returns ErrInvalidVerificationToken.
+	UseEmailVerificationToken(id string, at time.Time) (EmailVerificationToken, error)
+	RevokeEmailVerificationTokens(userID string, at time.Time) error
+	SaveOIDCState(state OIDCState) error
+	// UseOIDCState is UsePasswordResetToken for OIDC logins; it returns ErrInvalidOIDCState.
+	UseOIDCState(id string, at time.Time) (OIDCState, error)
 }
 
 type UserServicer interface{
 	RegisterUser(req SignUpRequest, config *config.Config) (User, error)
 	LoginJwt(req JwtRequest, jwt *JwtProvider, config *config.Config) (JwtResponse, error)
 	RefreshAccessToken(req RefreshJwtRequest, jwt *JwtProvider, config *config.Config) (JwtResponse, error)
+	Logout(req RefreshJwtRequest, jwt *JwtProvider) error
+	LogoutAll(userID uuid.UUID) error
+	SessionRevoked(sid string) (bool, error)
+	TouchSession(sid string) error
+	Sessions(userID uuid.UUID, currentSID string) ([]Session, error)
+	DeleteSession(userID uuid.UUID, sid string) error
+	ForgotPassword(req ForgotPasswordRequest, config *config.Config) error
+	ResetPassword(req ResetPasswordRequest, config *config.Config) error
+	ChangePassword(userID uuid.UUID, sid string, req ChangePasswordRequest, config *config.Config) error
+	VerifyEmail(token string) (User, error)
+	SetupTOTP(userID uuid.UUID, config *config.Config) (TOTPSetupResponse, error)
+	ConfirmTOTP(userID uuid.UUID, req TOTPConfirmRequest, config *config.Config) (TOTPConfirmResponse, error)
+	LoginTwoFactor(req TwoFactorLoginRequest, jwt *JwtProvider, config *config.Config) (JwtResponse, error)
+	ResendVerification(userID uuid.UUID, config *config.Config) error
+	StartOIDCLogin(provider string, config *config.Config) (string, error)
+	FinishOIDCLogin(req OIDCCallbackRequest, jwt *JwtProvider, config *config.Config) (JwtResponse, error)
 }
\ No newline at end of file
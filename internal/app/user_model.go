@@ -1,6 +1,8 @@
 package app
 
 import (
+	"sync"
+	"time"
 	"github.com/google/uuid"
 )
 
@@ -8,19 +10,82 @@ type User struct {
 	UUID     uuid.UUID	`json:"uuid"`
 	Login    string		`json:"login"`
 	Password string		`json:"password"`
+	Role     string		`json:"role"`
+	Status   string		`json:"status"`
+	StatusReason   string     `json:"status_reason,omitempty"`   // why the user was suspended or banned
+	SuspendedUntil *time.Time `json:"suspended_until,omitempty"` // end of a suspension
+	// PasswordResetRequired is set by an admin; such a user can't log in until the password is changed.
+	PasswordResetRequired bool `json:"password_reset_required"`
+	Email           string     `json:"email,omitempty"` // lower-cased, unique; empty if the user gave none
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty"`
+	// TOTPSecret is the TOTP key encrypted with two_factor.secret_key, see sealTOTPSecret; it's set
+	// by SetupTOTP and in use once TOTPEnabledAt is set.
+	TOTPSecret    string     `json:"-"`
+	TOTPEnabledAt *time.Time `json:"totp_enabled_at,omitempty"`
+	TOTPLastStep  int64      `json:"-"` // time step of the last accepted code, so it can't be replayed
 }
 
+// Statuses of a user account. Suspended and banned users can't log in, refresh tokens or post ads;
+// a suspension ends by itself at SuspendedUntil, and banned users' ads are hidden from the list.
+const (
+	UserStatusActive    = "active"
+	UserStatusSuspended = "suspended"
+	UserStatusBanned    = "banned"
+)
+
+// Roles a user can have; every registered user starts as RoleUser.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
 type SignUpRequest struct {
 	Login    string `json:"login"`
 	Password string `json:"password"`
+	Email    string `json:"email"` // optional unless config.Email.Required
+}
+
+type ForgotPasswordRequest struct {
+	Login string `json:"login"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+	Device          Device `json:"-"`
 }
 
 type SignUpResponse struct {
 	UUID     uuid.UUID	`json:"uuid"`
 	Login    string		`json:"login"`
+	Email    string		`json:"email,omitempty"`
 }
 
+type VerifyEmailResponse struct {
+	Email           string    `json:"email"`
+	EmailVerifiedAt time.Time `json:"email_verified_at"`
+}
+
+
+// sessionTouches remembers when each session's last-used time was last written, see TouchSession.
+// Entries older than sessionTouchInterval are of no use and get swept out.
+type sessionTouches struct {
+	mu        sync.Mutex
+	last      map[string]time.Time
+	lastSweep time.Time
+}
 
 type UserService struct {
-	repo UserRepository
+	repo   UserRepository
+	tokens TokenRepository
+	touched  *sessionTouches
+	throttle *loginThrottle
+	mailer   Mailer
+	identities IdentityProvider
 }
\ No newline at end of file
@@ -7,15 +7,73 @@ import (
 	"strings"
 	"unicode/utf8"
 	"regexp"
+	"time"
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
 )
 
 
 
-func NewUserService(repo UserRepository) *UserService{
+var (
+	ErrInvalidRefreshToken   = errors.New("invalid refresh token")
+	ErrRefreshTokenReused    = errors.New("refresh token was already used, all tokens of this login are revoked")
+	ErrSessionNotFound       = errors.New("session not found")
+	ErrUserNotFound          = errors.New("user not found")
+	ErrUserSuspended         = errors.New("user is suspended")
+	ErrUserBanned            = errors.New("user is banned")
+	ErrPasswordResetRequired = errors.New("password reset required")
+)
+
+// AccountBlockedError explains why a suspended or banned user was refused.
+// errors.Is matches it with ErrUserSuspended or ErrUserBanned.
+type AccountBlockedError struct {
+	Status string
+	Reason string
+	Until  *time.Time // end of a suspension
+}
+
+func (e *AccountBlockedError) Error() string {
+	msg := e.Unwrap().Error()
+	if e.Until != nil {
+		msg += " until " + e.Until.UTC().Format(time.RFC3339)
+	}
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	return msg
+}
+
+func (e *AccountBlockedError) Unwrap() error {
+	if e.Status == UserStatusSuspended {
+		return ErrUserSuspended
+	}
+	return ErrUserBanned
+}
+
+// accountBlocked returns an AccountBlockedError if the user may not use the account at the given time.
+func accountBlocked(user User, now time.Time) error {
+	switch user.Status {
+	case UserStatusBanned:
+		return &AccountBlockedError{Status: UserStatusBanned, Reason: user.StatusReason}
+	case UserStatusSuspended:
+		if user.SuspendedUntil == nil || now.Before(*user.SuspendedUntil) {
+			return &AccountBlockedError{Status: UserStatusSuspended, Reason: user.StatusReason, Until: user.SuspendedUntil}
+		}
+	}
+	return nil
+}
+
+// sessionTouchInterval is how stale a session's last-used time may get, so that
+// authenticated requests don't write to the database every time.
+const sessionTouchInterval = time.Minute
+
+func NewUserService(repo UserRepository, tokens TokenRepository, mailer Mailer, identities IdentityProvider) *UserService{
 	return &UserService{
 		repo:repo,
+		tokens: tokens,
+		touched: newSessionTouches(),
+		throttle: newLoginThrottle(),
+		mailer: mailer,
+		identities: identities,
 	}
 }
 
@@ -38,7 +96,19 @@ func (s *UserService) RegisterUser(req SignUpRequest, config *config.Config) (Us
 	if err != nil {
 		return User{}, err
 	}
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	email, err := normalizeEmail(req.Email)
+	if err != nil {
+		return User{}, err
+	}
+	if email == "" && config.Email.Required {
+		return User{}, ErrEmailRequired
+	}
+	if email != "" {
+		if _, err := s.repo.FindByEmail(email); err == nil {
+			return User{}, ErrEmailTaken
+		}
+	}
+	hashedPassword, err := hashPassword(req.Password, config.Password)
 	if err != nil {
 		return User{}, err
 	}
@@ -50,12 +120,20 @@ func (s *UserService) RegisterUser(req SignUpRequest, config *config.Config) (Us
 	user := User{
 		UUID:     uuid.New(),
 		Login:    req.Login,
-		Password: string(hashedPassword),
+		Password: hashedPassword,
+		Role:     RoleUser,
+		Status:   UserStatusActive,
+		Email:    email,
 	}
 	err = s.repo.SaveNewUser(user)
 	if err != nil {
 		return User{}, fmt.Errorf("failed to save user: %w", err)
 	}	
+	if email != "" {
+		// the account exists already, so a mail failure doesn't undo the registration:
+		// the user can ask for another link with ResendVerification
+		s.sendVerification(user, config)
+	}
 
 	return user, nil
 }
@@ -102,49 +180,236 @@ func isValidPassword(password string, config *config.Config) (bool, error) {
 	return hasUpper && hasLower && hasDigit, nil
 }
 
+// LoginJwt checks the password and starts a new session. Failed attempts slow down further
+// ones for the same login and from the same IP, see config.LoginThrottle. With two-factor
+// authentication on it returns only a challenge token, see LoginTwoFactor.
 func (s *UserService) LoginJwt(req JwtRequest, jwt *JwtProvider, config *config.Config) (JwtResponse, error) {
+	now := time.Now()
+	if wait := s.throttle.wait(req.Login, req.Device.IP, now); wait > 0 {
+		return JwtResponse{}, &LoginThrottledError{RetryAfter: wait}
+	}
 	user, err := s.repo.FindByLogin(req.Login)
 	if err != nil {
+		s.throttle.fail(req.Login, req.Device.IP, config.LoginThrottle, now)
 		return JwtResponse{}, errors.New("user not found")
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password))
+	err = checkPassword(user.Password, req.Password)
 	if err != nil {
+		s.throttle.fail(req.Login, req.Device.IP, config.LoginThrottle, now)
 		return JwtResponse{}, errors.New("unauthorized")
 	}
-	accessToken, err := jwt.GenerateAccessToken(user, config)
+	s.throttle.succeed(req.Login)
+	// checked after the password, so that they don't reveal anything about the account to a guesser
+	if err := accountBlocked(user, now); err != nil {
+		return JwtResponse{}, err
+	}
+	if user.PasswordResetRequired {
+		return JwtResponse{}, ErrPasswordResetRequired
+	}
+	// the password is known only now, so this is the moment to upgrade an outdated hash; if
+	// saving fails the old hash keeps working and the upgrade is retried on the next login
+	if needsRehash(user.Password, config.Password) {
+		if hashedPassword, err := hashPassword(req.Password, config.Password); err == nil {
+			s.repo.SetPassword(user.UUID.String(), hashedPassword)
+		}
+	}
+	return s.finishLogin(user, req.Device, jwt, config)
+}
+
+// startSession issues the first token pair of a new login session.
+func (s *UserService) startSession(user User, device Device, jwt *JwtProvider, config *config.Config) (JwtResponse, error) {
+	now := time.Now()
+	sessionID := uuid.NewString()
+	resp, err := s.issueTokens(user, sessionID, jwt, config)
 	if err != nil {
-		return JwtResponse{}, errors.New("failed to generate access token")
+		return JwtResponse{}, err
 	}
-	refreshToken, err := jwt.GenerateRefreshToken(user, config)
+	session := Session{
+		ID:         sessionID,
+		UserID:     user.UUID,
+		UserAgent:  device.UserAgent,
+		IP:         device.IP,
+		CreatedAt:  now,
+		LastUsedAt: now,
+	}
+	if err := s.tokens.SaveSession(session); err != nil {
+		return JwtResponse{}, fmt.Errorf("failed to save session: %w", err)
+	}
+	return resp, nil
+}
+
+// RefreshAccessToken exchanges a refresh token for a new pair. Each refresh token works once:
+// presenting a consumed one means it was stolen, so its whole family is revoked.
+func (s *UserService) RefreshAccessToken(req RefreshJwtRequest, jwt *JwtProvider, config *config.Config) (JwtResponse, error){
+	token, err := s.refreshToken(req, jwt)
 	if err != nil {
-		return JwtResponse{}, errors.New("failed to generate access token")
+		return JwtResponse{}, err
+	}
+	if token.RevokedAt != nil {
+		return JwtResponse{}, ErrInvalidRefreshToken
 	}
 
-	return JwtResponse{
-		Type:        "Bearer",
-		AccessToken: accessToken,
-		RefreshToken: refreshToken,
+	now := time.Now()
+	fresh, err := s.tokens.UseRefreshToken(token.ID, now)
+	if err != nil {
+		return JwtResponse{}, fmt.Errorf("failed to use refresh token: %w", err)
+	}
+	if !fresh {
+		if err := s.tokens.RevokeTokenFamily(token.FamilyID, now); err != nil {
+			return JwtResponse{}, fmt.Errorf("failed to revoke refresh tokens: %w", err)
+		}
+		return JwtResponse{}, ErrRefreshTokenReused
+	}
 
-	}, nil
+	user, err := s.repo.FindByUUID(token.UserID.String())
+	if err != nil {
+		return JwtResponse{}, errors.New("user not found")
+	}
+	if err := accountBlocked(user, now); err != nil {
+		return JwtResponse{}, err
+	}
+	resp, err := s.issueTokens(user, token.FamilyID, jwt, config)
+	if err != nil {
+		return JwtResponse{}, err
+	}
+	session := Session{ID: token.FamilyID, UserAgent: req.Device.UserAgent, IP: req.Device.IP, LastUsedAt: now}
+	if err := s.tokens.UpdateSession(session); err != nil {
+		return JwtResponse{}, fmt.Errorf("failed to update session: %w", err)
+	}
+	return resp, nil
 }
 
-func (s *UserService) RefreshAccessToken(req RefreshJwtRequest, jwt *JwtProvider, config *config.Config) (JwtResponse, error){
-	claims, err := jwt.ValidateRefreshToken(req.RefreshToken)
+// Logout ends the login session the refresh token belongs to: the token, its rotations
+// and the access tokens issued with them stop working.
+func (s *UserService) Logout(req RefreshJwtRequest, jwt *JwtProvider) error {
+	token, err := s.refreshToken(req, jwt)
+	if err != nil {
+		return err
+	}
+	if err := s.tokens.RevokeTokenFamily(token.FamilyID, time.Now()); err != nil {
+		return fmt.Errorf("failed to revoke refresh tokens: %w", err)
+	}
+	return nil
+}
+
+// LogoutAll ends every login session of the user.
+func (s *UserService) LogoutAll(userID uuid.UUID) error {
+	if err := s.tokens.RevokeUserTokens(userID.String(), time.Now()); err != nil {
+		return fmt.Errorf("failed to revoke refresh tokens: %w", err)
+	}
+	return nil
+}
+
+func (s *UserService) SessionRevoked(sid string) (bool, error) {
+	return s.tokens.FamilyRevoked(sid)
+}
+
+// TouchSession records that the session was used. Writes are throttled to one per
+// sessionTouchInterval: in this process by touched, across instances by the query itself.
+func (s *UserService) TouchSession(sid string) error {
+	now := time.Now()
+	if !s.touched.due(sid, now) {
+		return nil
+	}
+	if err := s.tokens.TouchSession(sid, now, now.Add(-sessionTouchInterval)); err != nil {
+		return fmt.Errorf("failed to touch session: %w", err)
+	}
+	return nil
+}
+
+func newSessionTouches() *sessionTouches {
+	return &sessionTouches{last: make(map[string]time.Time)}
+}
+
+// due reports whether the session's last-used time has to be written and, if so, records
+// the write. Every sessionTouchInterval it forgets the sessions not touched since.
+func (t *sessionTouches) due(sid string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if last, ok := t.last[sid]; ok && now.Sub(last) < sessionTouchInterval {
+		return false
+	}
+	t.last[sid] = now
+	if now.Sub(t.lastSweep) > sessionTouchInterval {
+		for key, last := range t.last {
+			if now.Sub(last) >= sessionTouchInterval {
+				delete(t.last, key)
+			}
+		}
+		t.lastSweep = now
+	}
+	return true
+}
+
+// Sessions lists the user's active logins, marking the one currentSID belongs to.
+func (s *UserService) Sessions(userID uuid.UUID, currentSID string) ([]Session, error) {
+	sessions, err := s.tokens.ActiveSessions(userID.String(), time.Now())
 	if err != nil {
-		return JwtResponse{}, errors.New("invalid refresh token")
+		return nil, fmt.Errorf("failed to get sessions: %w", err)
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == currentSID
 	}
-	user, err := s.repo.FindByUUID(claims["uuid"].(string))
+	return sessions, nil
+}
+
+// DeleteSession ends one of the user's active logins.
+func (s *UserService) DeleteSession(userID uuid.UUID, sid string) error {
+	sessions, err := s.Sessions(userID, "")
 	if err != nil {
-		return JwtResponse{}, errors.New("user not found")
+		return err
+	}
+	for _, session := range sessions {
+		if session.ID == sid {
+			if err := s.tokens.RevokeTokenFamily(sid, time.Now()); err != nil {
+				return fmt.Errorf("failed to revoke refresh tokens: %w", err)
+			}
+			return nil
+		}
+	}
+	return ErrSessionNotFound
+}
+
+// refreshToken validates a refresh token and loads its server-side record.
+func (s *UserService) refreshToken(req RefreshJwtRequest, jwt *JwtProvider) (RefreshToken, error) {
+	claims, err := jwt.ValidateRefreshToken(req.RefreshToken)
+	if err != nil {
+		return RefreshToken{}, ErrInvalidRefreshToken
+	}
+	jti, _ := claims["jti"].(string)
+	userID, _ := claims["uuid"].(string)
+	if jti == "" {
+		return RefreshToken{}, ErrInvalidRefreshToken
+	}
+	token, err := s.tokens.GetRefreshToken(jti)
+	if err != nil || token.UserID.String() != userID {
+		return RefreshToken{}, ErrInvalidRefreshToken
 	}
-	accessToken, err := jwt.GenerateAccessToken(user, config)
+	return token, nil
+}
+
+// issueTokens signs an access token and a refresh token of the given family and stores the latter.
+func (s *UserService) issueTokens(user User, familyID string, jwt *JwtProvider, config *config.Config) (JwtResponse, error) {
+	accessToken, err := jwt.GenerateAccessToken(user, familyID, config)
 	if err != nil {
 		return JwtResponse{}, errors.New("failed to generate access token")
 	}
-	refreshToken, err := jwt.GenerateRefreshToken(user, config)
+	now := time.Now()
+	token := RefreshToken{
+		ID:        uuid.NewString(),
+		FamilyID:  familyID,
+		UserID:    user.UUID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(refreshTokenTTL(config)),
+	}
+	refreshToken, err := jwt.GenerateRefreshToken(user, token.ID, config)
 	if err != nil {
-		return JwtResponse{}, errors.New("failed to generate access token")
+		return JwtResponse{}, errors.New("failed to generate refresh token")
+	}
+	if err := s.tokens.SaveRefreshToken(token); err != nil {
+		return JwtResponse{}, fmt.Errorf("failed to save refresh token: %w", err)
 	}
 
 	return JwtResponse{
@@ -153,4 +418,4 @@ func (s *UserService) RefreshAccessToken(req RefreshJwtRequest, jwt *JwtProvider
 		RefreshToken: refreshToken,
 
 	}, nil
-}
\ No newline at end of file
+}
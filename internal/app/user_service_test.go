@@ -1,15 +1,17 @@
 package app
 
 import (
+	"errors"
 	"marketplace/internal/config"
 	"testing"
+	"time"
 	"golang.org/x/crypto/bcrypt"
 	"github.com/google/uuid"
 )
 
 func TestRegisterUser_Success(t *testing.T) {
 	repo := &MockUserRepo{Users: make(map[string]User)}
-	service := NewUserService(repo)
+	service := NewUserService(repo, &MockTokenRepo{}, &MockMailer{}, &MockIdentityProvider{})
 	cfg := &config.Config{
 		Username: config.Username{MinLength: 3, MaxLength: 20, AllowedCharacters: "A-Za-z0-9_-"},
 		Password: config.Password{MinLength: 8, MaxLength: 64, RequireUpper: true, RequireLower: true, RequireDigit: true},
@@ -22,11 +24,14 @@ func TestRegisterUser_Success(t *testing.T) {
 	if user.Login == "" || user.UUID == uuid.Nil {
 		t.Errorf("invalid user returned")
 	}
+	if user.Role != RoleUser {
+		t.Errorf("expected role %q, got %q", RoleUser, user.Role)
+	}
 }
 
 func TestRegisterUser_InvalidPassword(t *testing.T) {
 	repo := &MockUserRepo{Users: make(map[string]User)}
-	service := NewUserService(repo)
+	service := NewUserService(repo, &MockTokenRepo{}, &MockMailer{}, &MockIdentityProvider{})
 	cfg := &config.Config{
 		Username: config.Username{MinLength: 3, MaxLength: 20, AllowedCharacters: "A-Za-z0-9_-"},
 		Password: config.Password{
@@ -70,7 +75,7 @@ func TestRegisterUser_InvalidPassword(t *testing.T) {
 
 func TestRegisterUser_InvalidLogin(t *testing.T) {
 	repo := &MockUserRepo{Users: make(map[string]User)}
-	service := NewUserService(repo)
+	service := NewUserService(repo, &MockTokenRepo{}, &MockMailer{}, &MockIdentityProvider{})
 	cfg := &config.Config{
 		Username: config.Username{MinLength: 3, MaxLength: 20, AllowedCharacters: "A-Za-z0-9_-"},
 		Password: config.Password{
@@ -109,7 +114,7 @@ func TestRegisterUser_InvalidLogin(t *testing.T) {
 
 func TestRegisterUser_Duplicate(t *testing.T) {
 	repo := &MockUserRepo{Users: make(map[string]User)}
-	service := NewUserService(repo)
+	service := NewUserService(repo, &MockTokenRepo{}, &MockMailer{}, &MockIdentityProvider{})
 	cfg := &config.Config{
 		Username: config.Username{MinLength: 3, MaxLength: 20, AllowedCharacters: "A-Za-z0-9_-"},
 		Password: config.Password{MinLength: 8, MaxLength: 64, RequireUpper: false, RequireLower: false, RequireDigit: false},
@@ -135,7 +140,7 @@ func TestUserService_LoginJwt(t *testing.T) {
 	}
 	cfg := &config.Config{JWT_ACCESS_SECRET: "secret", JWT_EXP_ACCESS_TOKEN: 15}
 	jwtProvider := NewJwtProvider(cfg)
-	service := NewUserService(repo)
+	service := NewUserService(repo, &MockTokenRepo{}, &MockMailer{}, &MockIdentityProvider{})
 
 	t.Run("success", func(t *testing.T) {
 		req := JwtRequest{Login: "testuser", Password: password}
@@ -163,6 +168,39 @@ func TestUserService_LoginJwt(t *testing.T) {
 			t.Errorf("expected unauthorized error, got: %v", err)
 		}
 	})
+
+	t.Run("banned, suspended or reset by an admin", func(t *testing.T) {
+		req := JwtRequest{Login: "testuser", Password: password}
+		repo.SetStatus(user.UUID.String(), UserStatusBanned, "fraud", nil)
+		_, err := service.LoginJwt(req, jwtProvider, cfg)
+		var blocked *AccountBlockedError
+		if !errors.Is(err, ErrUserBanned) || !errors.As(err, &blocked) || blocked.Reason != "fraud" {
+			t.Errorf("expected ErrUserBanned with the reason, got: %v", err)
+		}
+
+		until := time.Now().Add(time.Hour)
+		repo.SetStatus(user.UUID.String(), UserStatusSuspended, "spam", &until)
+		_, err = service.LoginJwt(req, jwtProvider, cfg)
+		if !errors.Is(err, ErrUserSuspended) || !errors.As(err, &blocked) || blocked.Until == nil {
+			t.Errorf("expected ErrUserSuspended with the end time, got: %v", err)
+		}
+		// a suspension ends by itself
+		ended := time.Now().Add(-time.Minute)
+		repo.SetStatus(user.UUID.String(), UserStatusSuspended, "spam", &ended)
+		if _, err := service.LoginJwt(req, jwtProvider, cfg); err != nil {
+			t.Errorf("expected an expired suspension to allow login, got: %v", err)
+		}
+
+		repo.SetStatus(user.UUID.String(), UserStatusActive, "", nil)
+		repo.SetPasswordResetRequired(user.UUID.String(), true)
+		if _, err := service.LoginJwt(req, jwtProvider, cfg); !errors.Is(err, ErrPasswordResetRequired) {
+			t.Errorf("expected ErrPasswordResetRequired, got: %v", err)
+		}
+		// a wrong password is still reported as such
+		if _, err := service.LoginJwt(JwtRequest{Login: "testuser", Password: "wrong"}, jwtProvider, cfg); err == nil || err.Error() != "unauthorized" {
+			t.Errorf("expected unauthorized error, got: %v", err)
+		}
+	})
 }
 
 func TestUserService_RefreshAccessToken(t *testing.T) {
@@ -177,20 +215,51 @@ func TestUserService_RefreshAccessToken(t *testing.T) {
 	jwtProvider := NewJwtProvider(cfg)
 
 	repo := &MockUserRepo{
-		Users: map[string]User{user.UUID.String(): user},
+		Users: map[string]User{"testuser": user},
 	}
-	service := NewUserService(repo)
+	tokens := &MockTokenRepo{}
+	service := NewUserService(repo, tokens, &MockMailer{}, &MockIdentityProvider{})
 
-	refresh, _ := jwtProvider.GenerateRefreshToken(user, cfg)
+	login := func(t *testing.T) string {
+		resp, err := service.LoginJwt(JwtRequest{Login: "testuser", Password: password}, jwtProvider, cfg)
+		if err != nil {
+			t.Fatalf("login failed: %v", err)
+		}
+		return resp.RefreshToken
+	}
 
 	t.Run("success", func(t *testing.T) {
+		refresh := login(t)
 		req := RefreshJwtRequest{RefreshToken: refresh}
 		resp, err := service.RefreshAccessToken(req, jwtProvider, cfg)
 		if err != nil {
 			t.Fatalf("expected success, got error: %v", err)
 		}
-		if resp.AccessToken == "" || resp.RefreshToken == "" {
-			t.Error("expected tokens to be generated")
+		if resp.AccessToken == "" || resp.RefreshToken == "" || resp.RefreshToken == refresh {
+			t.Error("expected a new token pair to be generated")
+		}
+		if _, err := service.RefreshAccessToken(RefreshJwtRequest{RefreshToken: resp.RefreshToken}, jwtProvider, cfg); err != nil {
+			t.Errorf("expected the rotated token to work, got: %v", err)
+		}
+	})
+
+	t.Run("reuse revokes the family", func(t *testing.T) {
+		stolen := login(t)
+		other := login(t)
+		resp, err := service.RefreshAccessToken(RefreshJwtRequest{RefreshToken: stolen}, jwtProvider, cfg)
+		if err != nil {
+			t.Fatalf("expected success, got error: %v", err)
+		}
+
+		_, err = service.RefreshAccessToken(RefreshJwtRequest{RefreshToken: stolen}, jwtProvider, cfg)
+		if !errors.Is(err, ErrRefreshTokenReused) {
+			t.Fatalf("expected ErrRefreshTokenReused, got: %v", err)
+		}
+		if _, err := service.RefreshAccessToken(RefreshJwtRequest{RefreshToken: resp.RefreshToken}, jwtProvider, cfg); !errors.Is(err, ErrInvalidRefreshToken) {
+			t.Errorf("expected the rotated token to be revoked, got: %v", err)
+		}
+		if _, err := service.RefreshAccessToken(RefreshJwtRequest{RefreshToken: other}, jwtProvider, cfg); err != nil {
+			t.Errorf("expected another login to stay valid, got: %v", err)
 		}
 	})
 
@@ -202,10 +271,31 @@ func TestUserService_RefreshAccessToken(t *testing.T) {
 		}
 	})
 
+	t.Run("token not issued by the server", func(t *testing.T) {
+		for _, jti := range []string{"", uuid.NewString()} {
+			forged, _ := jwtProvider.GenerateRefreshToken(user, jti, cfg)
+			_, err := service.RefreshAccessToken(RefreshJwtRequest{RefreshToken: forged}, jwtProvider, cfg)
+			if !errors.Is(err, ErrInvalidRefreshToken) {
+				t.Errorf("jti %q: expected ErrInvalidRefreshToken, got: %v", jti, err)
+			}
+		}
+	})
+
+	t.Run("blocked user", func(t *testing.T) {
+		refresh := login(t)
+		repo.SetStatus(user.UUID.String(), UserStatusBanned, "", nil)
+		defer repo.SetStatus(user.UUID.String(), UserStatusActive, "", nil)
+
+		_, err := service.RefreshAccessToken(RefreshJwtRequest{RefreshToken: refresh}, jwtProvider, cfg)
+		if !errors.Is(err, ErrUserBanned) {
+			t.Errorf("expected ErrUserBanned, got: %v", err)
+		}
+	})
+
 	t.Run("user not found", func(t *testing.T) {
+		refresh := login(t)
 		// подменяем репо на пустое
-		emptyRepo := &MockUserRepo{}
-		service := NewUserService(emptyRepo)
+		service := NewUserService(&MockUserRepo{}, tokens, &MockMailer{}, &MockIdentityProvider{})
 
 		req := RefreshJwtRequest{RefreshToken: refresh}
 		_, err := service.RefreshAccessToken(req, jwtProvider, cfg)
@@ -213,4 +303,172 @@ func TestUserService_RefreshAccessToken(t *testing.T) {
 			t.Errorf("expected user not found error, got: %v", err)
 		}
 	})
-}
\ No newline at end of file
+}
+
+func TestUserService_Logout(t *testing.T) {
+	password := "StrongPass1"
+	hashed, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	user := User{UUID: uuid.New(), Login: "testuser", Password: string(hashed)}
+	cfg := &config.Config{JWT_ACCESS_SECRET: "secret", JWT_EXP_ACCESS_TOKEN: 15, JWT_REFRESH_SECRET: "secret", JWT_EXP_REFRESH_TOKEN: 24}
+	jwtProvider := NewJwtProvider(cfg)
+	service := NewUserService(&MockUserRepo{Users: map[string]User{"testuser": user}}, &MockTokenRepo{}, &MockMailer{}, &MockIdentityProvider{})
+
+	login := func(t *testing.T) (JwtResponse, string) {
+		resp, err := service.LoginJwt(JwtRequest{Login: "testuser", Password: password}, jwtProvider, cfg)
+		if err != nil {
+			t.Fatalf("login failed: %v", err)
+		}
+		claims, err := jwtProvider.ValidateAccessToken(resp.AccessToken)
+		if err != nil {
+			t.Fatalf("invalid access token: %v", err)
+		}
+		sid, _ := claims["sid"].(string)
+		return resp, sid
+	}
+	revoked := func(t *testing.T, sid string) bool {
+		revoked, err := service.SessionRevoked(sid)
+		if err != nil {
+			t.Fatalf("failed to check session: %v", err)
+		}
+		return revoked
+	}
+
+	t.Run("logout ends one session", func(t *testing.T) {
+		first, firstSID := login(t)
+		_, otherSID := login(t)
+		rotated, err := service.RefreshAccessToken(RefreshJwtRequest{RefreshToken: first.RefreshToken}, jwtProvider, cfg)
+		if err != nil {
+			t.Fatalf("refresh failed: %v", err)
+		}
+
+		if err := service.Logout(RefreshJwtRequest{RefreshToken: rotated.RefreshToken}, jwtProvider); err != nil {
+			t.Fatalf("logout failed: %v", err)
+		}
+		if !revoked(t, firstSID) {
+			t.Error("expected the session to be revoked")
+		}
+		if revoked(t, otherSID) {
+			t.Error("expected other sessions to stay active")
+		}
+		if _, err := service.RefreshAccessToken(RefreshJwtRequest{RefreshToken: rotated.RefreshToken}, jwtProvider, cfg); !errors.Is(err, ErrInvalidRefreshToken) {
+			t.Errorf("expected the refresh token to be revoked, got: %v", err)
+		}
+	})
+
+	t.Run("logout all ends every session", func(t *testing.T) {
+		_, firstSID := login(t)
+		second, secondSID := login(t)
+
+		if err := service.LogoutAll(user.UUID); err != nil {
+			t.Fatalf("logout all failed: %v", err)
+		}
+		if !revoked(t, firstSID) || !revoked(t, secondSID) {
+			t.Error("expected all sessions to be revoked")
+		}
+		if _, err := service.RefreshAccessToken(RefreshJwtRequest{RefreshToken: second.RefreshToken}, jwtProvider, cfg); !errors.Is(err, ErrInvalidRefreshToken) {
+			t.Errorf("expected the refresh token to be revoked, got: %v", err)
+		}
+	})
+
+	t.Run("invalid token", func(t *testing.T) {
+		err := service.Logout(RefreshJwtRequest{RefreshToken: "invalid.token.here"}, jwtProvider)
+		if !errors.Is(err, ErrInvalidRefreshToken) {
+			t.Errorf("expected ErrInvalidRefreshToken, got: %v", err)
+		}
+	})
+}
+
+func TestUserService_Sessions(t *testing.T) {
+	password := "StrongPass1"
+	hashed, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	user := User{UUID: uuid.New(), Login: "testuser", Password: string(hashed)}
+	cfg := &config.Config{JWT_ACCESS_SECRET: "secret", JWT_EXP_ACCESS_TOKEN: 15, JWT_REFRESH_SECRET: "secret", JWT_EXP_REFRESH_TOKEN: 24}
+	jwtProvider := NewJwtProvider(cfg)
+	tokens := &MockTokenRepo{}
+	service := NewUserService(&MockUserRepo{Users: map[string]User{"testuser": user}}, tokens, &MockMailer{}, &MockIdentityProvider{})
+
+	laptop := Device{UserAgent: "Firefox", IP: "10.0.0.1"}
+	first, err := service.LoginJwt(JwtRequest{Login: "testuser", Password: password, Device: laptop}, jwtProvider, cfg)
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	phone := Device{UserAgent: "Mobile Safari", IP: "10.0.0.2"}
+	second, err := service.LoginJwt(JwtRequest{Login: "testuser", Password: password, Device: phone}, jwtProvider, cfg)
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	claims, _ := jwtProvider.ValidateAccessToken(first.AccessToken)
+	firstSID := claims["sid"].(string)
+
+	roaming := Device{UserAgent: "Firefox", IP: "10.0.0.3"}
+	if _, err := service.RefreshAccessToken(RefreshJwtRequest{RefreshToken: first.RefreshToken, Device: roaming}, jwtProvider, cfg); err != nil {
+		t.Fatalf("refresh failed: %v", err)
+	}
+
+	sessions, err := service.Sessions(user.UUID, firstSID)
+	if err != nil {
+		t.Fatalf("failed to get sessions: %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %+v", sessions)
+	}
+	for _, session := range sessions {
+		if (session.ID == firstSID) != session.Current {
+			t.Errorf("unexpected current flag: %+v", session)
+		}
+		if session.Current && session.IP != roaming.IP {
+			t.Errorf("expected the refresh to update the device, got %+v", session)
+		}
+		if !session.Current && session.UserAgent != phone.UserAgent {
+			t.Errorf("expected the phone session, got %+v", session)
+		}
+	}
+
+	t.Run("touch is throttled", func(t *testing.T) {
+		before := tokens.Touches
+		for i := 0; i < 5; i++ {
+			if err := service.TouchSession(firstSID); err != nil {
+				t.Fatalf("failed to touch session: %v", err)
+			}
+		}
+		if tokens.Touches-before != 1 {
+			t.Errorf("expected 1 write, got %d", tokens.Touches-before)
+		}
+	})
+
+	t.Run("old touches are forgotten", func(t *testing.T) {
+		touches := newSessionTouches()
+		now := time.Now()
+		if !touches.due("a", now) || !touches.due("b", now) || touches.due("a", now.Add(time.Second)) {
+			t.Fatal("expected one write per session and interval")
+		}
+		if !touches.due("c", now.Add(2*sessionTouchInterval)) {
+			t.Fatal("expected a write for a new session")
+		}
+		if len(touches.last) != 1 {
+			t.Errorf("expected the stale sessions to be swept, got %v", touches.last)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if err := service.DeleteSession(uuid.New(), firstSID); !errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("expected ErrSessionNotFound for another user, got: %v", err)
+		}
+		if err := service.DeleteSession(user.UUID, firstSID); err != nil {
+			t.Fatalf("failed to delete session: %v", err)
+		}
+		if revoked, _ := service.SessionRevoked(firstSID); !revoked {
+			t.Error("expected the session to be revoked")
+		}
+		if err := service.DeleteSession(user.UUID, firstSID); !errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("expected ErrSessionNotFound for a deleted session, got: %v", err)
+		}
+		sessions, _ := service.Sessions(user.UUID, "")
+		if len(sessions) != 1 {
+			t.Errorf("expected 1 session left, got %+v", sessions)
+		}
+		if _, err := service.RefreshAccessToken(RefreshJwtRequest{RefreshToken: second.RefreshToken}, jwtProvider, cfg); err != nil {
+			t.Errorf("expected the other session to stay valid, got: %v", err)
+		}
+	})
+}
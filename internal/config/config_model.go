@@ -12,6 +12,18 @@ type Ad struct {
 	AllowedImgTypesMap map[string]bool `yaml:"-"`
 }
 
+// Images configures uploaded ad images; allowed formats are taken from Ad.ImgType.
+type Images struct {
+	Dir       string `yaml:"dir" env-default:"./storage/images"` // root of the local blob store
+	BaseURL   string `yaml:"base_url" env-default:"/images"` // public prefix the stored images are served under
+	MaxBytes  int64  `yaml:"max_bytes" env-default:"5242880"`
+	MinWidth  int    `yaml:"min_width" env-default:"100"`
+	MinHeight int    `yaml:"min_height" env-default:"100"`
+	MaxWidth  int    `yaml:"max_width" env-default:"6000"`
+	MaxHeight int    `yaml:"max_height" env-default:"6000"`
+	MaxPerAd  int    `yaml:"max_per_ad" env-default:"10"`
+}
+
 type Username struct{
 	MinLength int `yaml:"min_length" env-default:"3"`
 	MaxLength int `yaml:"max_length" env-default:"20"`
@@ -25,17 +37,128 @@ type Password struct {
 	RequireUpper     bool   `yaml:"require_upper" env-default:"true"`
 	RequireLower     bool   `yaml:"require_lower" env-default:"true"`
 	RequireDigit     bool   `yaml:"require_digit" env-default:"true"`
+	ResetTokenTTL    int    `yaml:"reset_token_ttl" env-default:"60"` // minutes a password reset link stays valid
+	ResetURL         string `yaml:"reset_url"` // page the reset link points to; the token is appended as ?token=
+	// Algorithm new hashes are made with: bcrypt or argon2id. Stored hashes of another algorithm
+	// or with a lower cost are replaced on the next successful login.
+	Algorithm        string `yaml:"algorithm" env-default:"bcrypt"`
+	BcryptCost       int    `yaml:"bcrypt_cost" env-default:"10"`
+	Argon2           Argon2 `yaml:"argon2"`
+}
+
+// Argon2 are the argon2id parameters, see RFC 9106.
+type Argon2 struct {
+	Memory      uint32 `yaml:"memory" env-default:"65536"` // KiB
+	Iterations  uint32 `yaml:"iterations" env-default:"3"`
+	Parallelism uint8  `yaml:"parallelism" env-default:"2"`
+}
+
+// Email configures users' e-mail addresses, which are verified by a link sent to them.
+type Email struct {
+	Required        bool   `yaml:"required"`         // registration needs an address
+	RequireVerified bool   `yaml:"require_verified"` // ads can be posted only once the address is verified
+	VerifyTokenTTL  int    `yaml:"verify_token_ttl" env-default:"1440"` // minutes a verification link stays valid
+	VerifyURL       string `yaml:"verify_url"` // the link in the mail; the token is appended as ?token=
+}
+
+// TwoFactor configures TOTP two-factor authentication.
+type TwoFactor struct {
+	Issuer       string `yaml:"issuer" env-default:"Marketplace"` // shown by authenticator apps next to the login
+	ChallengeTTL int    `yaml:"challenge_ttl" env-default:"300"`  // seconds to enter the code after the password
+	// SecretKey encrypts the users' TOTP secrets in the database (AES-256-GCM) and keys the
+	// recovery code hashes: 64 hex characters. Changing it makes the enabled second factors unusable.
+	SecretKey string `yaml:"secret_key"`
+}
+
+// OIDC configures login with external OpenID Connect providers (authorization code flow with PKCE).
+type OIDC struct {
+	StateTTL  int            `yaml:"state_ttl" env-default:"600"` // seconds to come back from the provider's login page
+	Providers []OIDCProvider `yaml:"providers"`
+}
+
+// OIDCProvider is one identity provider; its endpoints and keys are discovered from
+// Issuer + /.well-known/openid-configuration.
+type OIDCProvider struct {
+	Name         string   `yaml:"name"` // in the routes, /oauth/{name}/login
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	RedirectURL  string   `yaml:"redirect_url"` // our /oauth/{name}/callback as registered with the provider
+	Scopes       []string `yaml:"scopes" env-default:"openid,email,profile"`
+	// LinkByEmail logs into an existing account whose verified e-mail matches the one the provider
+	// verified. Only for providers that really verify addresses, or anyone could take over accounts.
+	LinkByEmail bool `yaml:"link_by_email"`
+}
+
+// Mail configures outgoing mail. Messages are written to files under Dir and logged,
+// which is enough for local development and tests.
+type Mail struct {
+	Dir  string `yaml:"dir" env-default:"./storage/mail"`
+	From string `yaml:"from" env-default:"no-reply@marketplace.local"`
+}
+
+// LoginThrottle slows down password guessing, separately for a login and for a client IP.
+type LoginThrottle struct {
+	Login Throttle `yaml:"login"` // failures for one login from any IP
+	IP    Throttle `yaml:"ip"`    // failures from one IP for any login
+}
+
+// Throttle: after FreeAttempts failed logins the next attempt has to wait BaseDelay seconds,
+// doubling with every further failure up to MaxDelay; after LockoutAttempts failures attempts
+// are refused for LockoutDuration seconds. Failures are forgotten after Window seconds without new ones.
+type Throttle struct {
+	FreeAttempts    int `yaml:"free_attempts"`
+	BaseDelay       int `yaml:"base_delay"`
+	MaxDelay        int `yaml:"max_delay"`
+	LockoutAttempts int `yaml:"lockout_attempts"`
+	LockoutDuration int `yaml:"lockout_duration"`
+	Window          int `yaml:"window"`
+}
+
+type Database struct {
+	Driver string `yaml:"driver" env-default:"sqlite3"` // sqlite3 or postgres
+	DSN    string `yaml:"dsn" env-default:"./storage/marketplace.db"`
+}
+
+// JWT configures asymmetric signing of access tokens. Without a signing key they are signed
+// with HS256 and JWT_ACCESS_SECRET; refresh tokens always use JWT_REFRESH_SECRET.
+type JWT struct {
+	SigningKey string   `yaml:"signing_key"` // kid of the key new access tokens are signed with
+	Keys       []JWTKey `yaml:"keys"`        // every key access tokens are accepted from, published at /.well-known/jwks.json
+	Issuer     string   `yaml:"issuer" env-default:"marketplace"`   // iss claim of issued tokens, required on validation
+	Audience   string   `yaml:"audience" env-default:"marketplace"` // aud claim of issued tokens, required on validation
+	Leeway     int      `yaml:"leeway"`                             // seconds of clock skew allowed when checking exp, nbf and iat
+}
+
+// JWTKey is a PEM file with an RSA or Ed25519 key. The signing key needs the private key;
+// a retired key may be just the public key, kept until the tokens it signed expire.
+type JWTKey struct {
+	ID   string `yaml:"kid"`
+	Path string `yaml:"path"`
+}
+
+type Migrations struct {
+	Auto bool `yaml:"auto" env-default:"true"`
 }
 
 type Config struct {
     Env	string	`yaml:"env" env-default:"local"`
     Http_port	int	`yaml:"http_port" env-default:"8080"`
-	Db	string	`yaml:"db" env-default:"./storage/marketplace.db"`
+	Db	Database	`yaml:"db"`
+	Migrations	Migrations	`yaml:"migrations"`
 	JWT_ACCESS_SECRET	string	`yaml:"JWT_ACCESS_SECRET" env-default:"YOUR_JWT_SECRET"`
 	JWT_REFRESH_SECRET	string	`yaml:"JWT_REFRESH_SECRET" env-default:"YOUR_JWT_SECRET"`
 	JWT_EXP_ACCESS_TOKEN	int	`yaml:"JWT_EXP_ACCESS_TOKEN" env-default:"15"`
 	JWT_EXP_REFRESH_TOKEN	int	`yaml:"JWT_EXP_REFRESH_TOKEN" env-default:"24"`
+	JWT       JWT `yaml:"jwt"`
 	Username  Username `yaml:"username"`
 	Password  Password `yaml:"password"`
 	Ad        Ad `yaml:"ad"`
+	Images    Images `yaml:"images"`
+	LoginThrottle LoginThrottle `yaml:"login_throttle"`
+	Email     Email `yaml:"email"`
+	TwoFactor TwoFactor `yaml:"two_factor"`
+	OIDC      OIDC `yaml:"oidc"`
+	Mail      Mail `yaml:"mail"`
+	Admins    []string `yaml:"admins"` // user uuids given the admin role on startup
 }
\ No newline at end of file
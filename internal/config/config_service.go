@@ -26,10 +26,154 @@ func LoadConfig(path string) (*Config, error) {
 		}
 		cfg.Ad.AllowedImgTypesMap[strings.ToLower(ext)] = true
 	}
+	cfg.Images.applyDefaults()
+	cfg.JWT.applyDefaults()
+	cfg.Password.applyDefaults()
+	cfg.Email.applyDefaults()
+	cfg.TwoFactor.applyDefaults()
+	cfg.OIDC.applyDefaults()
+	cfg.Mail.applyDefaults()
+	cfg.LoginThrottle.Login.applyDefaults(Throttle{FreeAttempts: 3, BaseDelay: 1, MaxDelay: 60, LockoutAttempts: 10, LockoutDuration: 900, Window: 3600})
+	// an IP may be shared by many users behind NAT, so it gets more room
+	cfg.LoginThrottle.IP.applyDefaults(Throttle{FreeAttempts: 20, BaseDelay: 1, MaxDelay: 60, LockoutAttempts: 100, LockoutDuration: 900, Window: 3600})
 
 	return &cfg, nil
 }
 
+// UnmarshalYAML also accepts the legacy scalar form `db: "./path.db"` as an SQLite DSN.
+func (d *Database) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		d.Driver = "sqlite3"
+		d.DSN = value.Value
+		return nil
+	}
+	type plain Database
+	if err := value.Decode((*plain)(d)); err != nil {
+		return err
+	}
+	if d.Driver == "" {
+		d.Driver = "sqlite3"
+	}
+	return nil
+}
+
+func (i *Images) applyDefaults() {
+	if i.Dir == "" {
+		i.Dir = "./storage/images"
+	}
+	if i.BaseURL == "" {
+		i.BaseURL = "/images"
+	}
+	i.BaseURL = strings.TrimSuffix(i.BaseURL, "/")
+	if i.MaxBytes == 0 {
+		i.MaxBytes = 5 << 20
+	}
+	if i.MaxWidth == 0 {
+		i.MaxWidth = 6000
+	}
+	if i.MaxHeight == 0 {
+		i.MaxHeight = 6000
+	}
+	if i.MaxPerAd == 0 {
+		i.MaxPerAd = 10
+	}
+}
+
+func (j *JWT) applyDefaults() {
+	if j.Issuer == "" {
+		j.Issuer = "marketplace"
+	}
+	if j.Audience == "" {
+		j.Audience = "marketplace"
+	}
+}
+
+func (p *Password) applyDefaults() {
+	if p.ResetTokenTTL == 0 {
+		p.ResetTokenTTL = 60
+	}
+	if p.ResetURL == "" {
+		p.ResetURL = "http://localhost:8080/password/reset"
+	}
+	if p.Algorithm == "" {
+		p.Algorithm = "bcrypt"
+	}
+	if p.BcryptCost == 0 {
+		p.BcryptCost = 10
+	}
+	if p.Argon2.Memory == 0 {
+		p.Argon2.Memory = 64 * 1024
+	}
+	if p.Argon2.Iterations == 0 {
+		p.Argon2.Iterations = 3
+	}
+	if p.Argon2.Parallelism == 0 {
+		p.Argon2.Parallelism = 2
+	}
+}
+
+func (e *Email) applyDefaults() {
+	if e.VerifyTokenTTL == 0 {
+		e.VerifyTokenTTL = 24 * 60
+	}
+	if e.VerifyURL == "" {
+		e.VerifyURL = "http://localhost:8080/verify-email"
+	}
+}
+
+func (t *TwoFactor) applyDefaults() {
+	if t.Issuer == "" {
+		t.Issuer = "Marketplace"
+	}
+	if t.ChallengeTTL == 0 {
+		t.ChallengeTTL = 300
+	}
+}
+
+func (o *OIDC) applyDefaults() {
+	if o.StateTTL == 0 {
+		o.StateTTL = 600
+	}
+	for i := range o.Providers {
+		p := &o.Providers[i]
+		p.Issuer = strings.TrimSuffix(p.Issuer, "/")
+		if len(p.Scopes) == 0 {
+			p.Scopes = []string{"openid", "email", "profile"}
+		}
+	}
+}
+
+func (m *Mail) applyDefaults() {
+	if m.Dir == "" {
+		m.Dir = "./storage/mail"
+	}
+	if m.From == "" {
+		m.From = "no-reply@marketplace.local"
+	}
+}
+
+// applyDefaults fills the settings missing from the file with those of def.
+func (t *Throttle) applyDefaults(def Throttle) {
+	if t.FreeAttempts == 0 {
+		t.FreeAttempts = def.FreeAttempts
+	}
+	if t.BaseDelay == 0 {
+		t.BaseDelay = def.BaseDelay
+	}
+	if t.MaxDelay == 0 {
+		t.MaxDelay = def.MaxDelay
+	}
+	if t.LockoutAttempts == 0 {
+		t.LockoutAttempts = def.LockoutAttempts
+	}
+	if t.LockoutDuration == 0 {
+		t.LockoutDuration = def.LockoutDuration
+	}
+	if t.Window == 0 {
+		t.Window = def.Window
+	}
+}
+
 func MustLoad() *Config {
 	path := os.Getenv("CONFIG_PATH")
 	if path == "" {
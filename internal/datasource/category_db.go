@@ -0,0 +1,126 @@
+package datasource
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"marketplace/internal/app"
+)
+
+func (s *MarketRepo) SaveCategory(category app.Category) (app.Category, error) {
+	names, err := json.Marshal(category.Names)
+	if err != nil {
+		return app.Category{}, fmt.Errorf("marshal category names error: %w", err)
+	}
+	err = s.db.QueryRow(`INSERT INTO categories (parent_id, slug, names) VALUES (?, ?, ?) RETURNING id`,
+		category.ParentID, category.Slug, string(names)).Scan(&category.ID)
+	if err != nil {
+		return app.Category{}, fmt.Errorf("exec error DB:%w", err)
+	}
+	return category, nil
+}
+
+func (s *MarketRepo) GetCategories() ([]app.Category, error) {
+	rows, err := s.db.Query(`SELECT id, parent_id, slug, names FROM categories ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("query error DB: %w", err)
+	}
+	defer rows.Close()
+
+	var categories []app.Category
+	for rows.Next() {
+		category, err := scanCategory(rows)
+		if err != nil {
+			return nil, err
+		}
+		categories = append(categories, category)
+	}
+	return categories, rows.Err()
+}
+
+func (s *MarketRepo) GetCategory(id int64) (app.Category, error) {
+	row := s.db.QueryRow(`SELECT id, parent_id, slug, names FROM categories WHERE id = ?`, id)
+	category, err := scanCategory(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return app.Category{}, app.ErrCategoryNotFound
+	}
+	return category, err
+}
+
+func (s *MarketRepo) UpdateCategory(category app.Category) (app.Category, error) {
+	names, err := json.Marshal(category.Names)
+	if err != nil {
+		return app.Category{}, fmt.Errorf("marshal category names error: %w", err)
+	}
+	res, err := s.db.Exec(`UPDATE categories SET parent_id = ?, slug = ?, names = ? WHERE id = ?`,
+		category.ParentID, category.Slug, string(names), category.ID)
+	if err != nil {
+		return app.Category{}, fmt.Errorf("exec error DB:%w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return app.Category{}, fmt.Errorf("rows affected error DB:%w", err)
+	}
+	if n == 0 {
+		return app.Category{}, app.ErrCategoryNotFound
+	}
+	return category, nil
+}
+
+func (s *MarketRepo) DeleteCategory(id int64) error {
+	res, err := s.db.Exec(`DELETE FROM categories WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("exec error DB:%w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected error DB:%w", err)
+	}
+	if n == 0 {
+		return app.ErrCategoryNotFound
+	}
+	return nil
+}
+
+func (s *MarketRepo) CategoryHasAds(id int64) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM ads WHERE category_id = ?)`, id).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("scan error DB:%w", err)
+	}
+	return exists, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanCategory(row rowScanner) (app.Category, error) {
+	var category app.Category
+	var parentID sql.NullInt64
+	var names string
+	if err := row.Scan(&category.ID, &parentID, &category.Slug, &names); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return app.Category{}, err
+		}
+		return app.Category{}, fmt.Errorf("scan error DB:%w", err)
+	}
+	if parentID.Valid {
+		category.ParentID = &parentID.Int64
+	}
+	if err := json.Unmarshal([]byte(names), &category.Names); err != nil {
+		return app.Category{}, fmt.Errorf("unmarshal category names error: %w", err)
+	}
+	return category, nil
+}
+
+// categorySubtreeSQL matches a category given by id or slug together with all its descendants.
+const categorySubtreeSQL = `(
+	WITH RECURSIVE subtree(id) AS (
+		SELECT id FROM categories WHERE slug = ? OR CAST(id AS TEXT) = ?
+		UNION ALL
+		SELECT c.id FROM categories c JOIN subtree st ON c.parent_id = st.id
+	)
+	SELECT id FROM subtree
+)`
@@ -4,41 +4,40 @@ import (
 	"database/sql"
 	"fmt"
 	"marketplace/internal/config"
-	_ "github.com/mattn/go-sqlite3"
+	"strings"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/mattn/go-sqlite3"
 )
 
+// sqliteDriver is go-sqlite3 with the helper functions our queries rely on.
+const sqliteDriver = "sqlite3_marketplace"
 
+func init() {
+	sql.Register(sqliteDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			// built-in LOWER only folds ASCII, which breaks case-insensitive search in Cyrillic
+			return conn.RegisterFunc("unicode_lower", strings.ToLower, true)
+		},
+	})
+}
 
+
+// NewStorage opens the database selected by db.driver; the schema is managed by Migrator.
 func NewStorage(config *config.Config) (*sql.DB, error){
-	db, err := sql.Open("sqlite3", config.Db)
-	if err != nil {
-		return nil, fmt.Errorf("init error DB:%w", err)
+	var driver string
+	switch config.Db.Driver {
+	case "", "sqlite", "sqlite3":
+		driver = sqliteDriver
+	case "postgres", "postgresql", "pgx":
+		driver = "pgx"
+	default:
+		return nil, fmt.Errorf("unsupported db driver %q", config.Db.Driver)
 	}
 
-    _, err = db.Exec(`CREATE TABLE IF NOT EXISTS users (
-        id INTEGER PRIMARY KEY AUTOINCREMENT,
-        uuid TEXT NOT NULL,
-        login TEXT NOT NULL UNIQUE,
-        password TEXT NOT NULL
-    );`)
-    if err != nil {
-        return nil, fmt.Errorf("create users table error: %w", err)
-    }
-
-    _, err = db.Exec(`CREATE TABLE IF NOT EXISTS ads (
-        id INTEGER PRIMARY KEY AUTOINCREMENT,
-        uuid TEXT NOT NULL,
-        title TEXT NOT NULL,
-        description TEXT NOT NULL,
-        price REAL NOT NULL,
-        img TEXT NOT NULL,
-        user_uuid TEXT NOT NULL,
-        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-        FOREIGN KEY (user_uuid) REFERENCES users(uuid)
-    );`)
-    if err != nil {
-        return nil, fmt.Errorf("create ads table error: %w", err)
+	db, err := sql.Open(driver, config.Db.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("init error DB:%w", err)
 	}
 
 	return db, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,122 @@
+package datasource
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/mattn/go-sqlite3"
+)
+
+type dialect int
+
+const (
+	sqliteDialect dialect = iota
+	postgresDialect
+)
+
+func dialectOf(db *sql.DB) dialect {
+	if _, ok := db.Driver().(*stdlib.Driver); ok {
+		return postgresDialect
+	}
+	return sqliteDialect
+}
+
+func (d dialect) String() string {
+	if d == postgresDialect {
+		return "postgres"
+	}
+	return "sqlite"
+}
+
+// rebind rewrites `?` placeholders into `$1, $2, ...` for Postgres.
+func (d dialect) rebind(query string) string {
+	if d != postgresDialect || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	b.Grow(len(query) + 8)
+	n := 0
+	inQuote := false
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			inQuote = !inQuote
+		case r == '?' && !inQuote:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// sqlDB lets the repositories write `?` placeholders regardless of the driver.
+type sqlDB struct {
+	*sql.DB
+	dialect dialect
+}
+
+func newSQLDB(db *sql.DB) sqlDB {
+	return sqlDB{DB: db, dialect: dialectOf(db)}
+}
+
+func (d sqlDB) Exec(query string, args ...any) (sql.Result, error) {
+	return d.DB.Exec(d.dialect.rebind(query), args...)
+}
+
+func (d sqlDB) Query(query string, args ...any) (*sql.Rows, error) {
+	return d.DB.Query(d.dialect.rebind(query), args...)
+}
+
+func (d sqlDB) QueryRow(query string, args ...any) *sql.Row {
+	return d.DB.QueryRow(d.dialect.rebind(query), args...)
+}
+
+func (d sqlDB) Prepare(query string) (*sql.Stmt, error) {
+	return d.DB.Prepare(d.dialect.rebind(query))
+}
+
+// sqlTx is the transactional counterpart of sqlDB.
+type sqlTx struct {
+	*sql.Tx
+	dialect dialect
+}
+
+func (d sqlDB) Begin() (sqlTx, error) {
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return sqlTx{}, fmt.Errorf("begin tx error DB:%w", err)
+	}
+	return sqlTx{Tx: tx, dialect: d.dialect}, nil
+}
+
+func (t sqlTx) Exec(query string, args ...any) (sql.Result, error) {
+	return t.Tx.Exec(t.dialect.rebind(query), args...)
+}
+
+func (t sqlTx) Query(query string, args ...any) (*sql.Rows, error) {
+	return t.Tx.Query(t.dialect.rebind(query), args...)
+}
+
+func (t sqlTx) QueryRow(query string, args ...any) *sql.Row {
+	return t.Tx.QueryRow(t.dialect.rebind(query), args...)
+}
+
+// isUniqueViolation reports whether err breaks the unique index, named by the index on Postgres
+// and by the table.column it covers on SQLite.
+func isUniqueViolation(err error, index, column string) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "23505" && pgErr.ConstraintName == index
+	}
+	var liteErr sqlite3.Error
+	if errors.As(err, &liteErr) {
+		return liteErr.ExtendedCode == sqlite3.ErrConstraintUnique && strings.Contains(liteErr.Error(), column)
+	}
+	return false
+}
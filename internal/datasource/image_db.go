@@ -0,0 +1,176 @@
+package datasource
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"marketplace/internal/app"
+	"strings"
+	"time"
+)
+
+func (s *MarketRepo) AddAdImage(aduuid string, image app.AdImage) (app.AdImage, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return app.AdImage{}, err
+	}
+	defer tx.Rollback()
+
+	adID, err := adIDByUUID(tx, aduuid)
+	if err != nil {
+		return app.AdImage{}, err
+	}
+	image, err = insertAdImage(tx, adID, image, time.Now())
+	if err != nil {
+		return app.AdImage{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return app.AdImage{}, fmt.Errorf("commit error DB:%w", err)
+	}
+	return image, nil
+}
+
+// SetAdImages makes images the whole gallery of the ad: images missing from the list are
+// deleted, the rest get the given position and cover flag.
+func (s *MarketRepo) SetAdImages(aduuid string, images []app.AdImage) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	adID, err := adIDByUUID(tx, aduuid)
+	if err != nil {
+		return err
+	}
+
+	query := `DELETE FROM ad_images WHERE ad_id = ?`
+	args := []any{adID}
+	if len(images) > 0 {
+		query += ` AND id NOT IN (?` + strings.Repeat(`, ?`, len(images)-1) + `)`
+		for _, img := range images {
+			args = append(args, img.ID)
+		}
+	}
+	if _, err := tx.Exec(query, args...); err != nil {
+		return fmt.Errorf("exec error DB:%w", err)
+	}
+	// the cover is unique per ad, so clear it before moving it to another image
+	if _, err := tx.Exec(`UPDATE ad_images SET is_cover = ? WHERE ad_id = ?`, false, adID); err != nil {
+		return fmt.Errorf("exec error DB:%w", err)
+	}
+	for _, img := range images {
+		res, err := tx.Exec(`UPDATE ad_images SET position = ?, is_cover = ? WHERE id = ? AND ad_id = ?`, img.Position, img.IsCover, img.ID, adID)
+		if err != nil {
+			return fmt.Errorf("exec error DB:%w", err)
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return fmt.Errorf("rows affected error DB:%w", err)
+		} else if n == 0 {
+			return app.ErrImageNotFound
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit error DB:%w", err)
+	}
+	return nil
+}
+
+func (s *MarketRepo) ImageKeyInUse(key string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM ad_images WHERE blob_key = ?)`, key).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("scan error DB:%w", err)
+	}
+	return exists, nil
+}
+
+func (s *MarketRepo) adImages(adID int64) ([]app.AdImage, error) {
+	images, err := s.adsImages([]int64{adID})
+	if err != nil {
+		return nil, err
+	}
+	return images[adID], nil
+}
+
+// adsImages loads the galleries of several ads in one query, keyed by ad id. Every ad
+// gets a non-nil slice, even without images.
+func (s *MarketRepo) adsImages(adIDs []int64) (map[int64][]app.AdImage, error) {
+	images := make(map[int64][]app.AdImage, len(adIDs))
+	if len(adIDs) == 0 {
+		return images, nil
+	}
+	args := make([]any, len(adIDs))
+	for i, id := range adIDs {
+		images[id] = []app.AdImage{}
+		args[i] = id
+	}
+	rows, err := s.db.Query(`SELECT ad_id, id, url, blob_key, variants, position, is_cover FROM ad_images
+		WHERE ad_id IN (?`+strings.Repeat(`, ?`, len(adIDs)-1)+`) ORDER BY ad_id, position, id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error DB: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var adID int64
+		var img app.AdImage
+		var key, variants sql.NullString
+		if err := rows.Scan(&adID, &img.ID, &img.URL, &key, &variants, &img.Position, &img.IsCover); err != nil {
+			return nil, fmt.Errorf("scan error DB: %w", err)
+		}
+		img.Key = key.String
+		if img.Variants, err = parseVariants(variants); err != nil {
+			return nil, err
+		}
+		images[adID] = append(images[adID], img)
+	}
+	return images, rows.Err()
+}
+
+func adIDByUUID(tx sqlTx, aduuid string) (int64, error) {
+	var adID int64
+	err := tx.QueryRow(`SELECT id FROM ads WHERE uuid = ?`, aduuid).Scan(&adID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, app.ErrAdNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("scan error DB:%w", err)
+	}
+	return adID, nil
+}
+
+func insertAdImage(tx sqlTx, adID int64, img app.AdImage, createdAt time.Time) (app.AdImage, error) {
+	key := sql.NullString{String: img.Key, Valid: img.Key != ""}
+	var variants sql.NullString
+	if img.Variants != nil {
+		data, err := json.Marshal(img.Variants)
+		if err != nil {
+			return app.AdImage{}, fmt.Errorf("marshal variants error: %w", err)
+		}
+		variants = sql.NullString{String: string(data), Valid: true}
+	}
+	err := tx.QueryRow(`INSERT INTO ad_images (ad_id, url, blob_key, variants, position, is_cover, created_at) VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING id`,
+		adID, img.URL, key, variants, img.Position, img.IsCover, createdAt).Scan(&img.ID)
+	if isUniqueViolation(err, "ad_images_blob_key_idx", "ad_images.blob_key") {
+		return app.AdImage{}, app.ErrImageInUse
+	}
+	if err != nil {
+		return app.AdImage{}, fmt.Errorf("exec error DB:%w", err)
+	}
+	return img, nil
+}
+
+// parseVariants decodes the variants column, which is NULL for images stored before variants existed.
+func parseVariants(column sql.NullString) (*app.ImageVariants, error) {
+	if !column.Valid {
+		return nil, nil
+	}
+	var variants app.ImageVariants
+	if err := json.Unmarshal([]byte(column.String), &variants); err != nil {
+		return nil, fmt.Errorf("unmarshal variants error: %w", err)
+	}
+	return &variants, nil
+}
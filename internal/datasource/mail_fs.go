@@ -0,0 +1,46 @@
+package datasource
+
+import (
+	"fmt"
+	"marketplace/internal/app"
+	"marketplace/internal/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// FileMailer doesn't send anything: each message is written to an .eml file under a directory
+// and logged, which is enough for local development and tests.
+type FileMailer struct {
+	dir    string
+	from   string
+	logger *zap.Logger
+}
+
+func NewFileMailer(config *config.Config, logger *zap.Logger) (*FileMailer, error) {
+	if err := os.MkdirAll(config.Mail.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create mail dir error: %w", err)
+	}
+	return &FileMailer{dir: config.Mail.Dir, from: config.Mail.From, logger: logger}, nil
+}
+
+func (m *FileMailer) Send(msg app.Message) error {
+	now := time.Now().UTC()
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", m.from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(msg.Body)
+
+	name := filepath.Join(m.dir, now.Format("20060102T150405")+"-"+uuid.NewString()+".eml")
+	if err := os.WriteFile(name, []byte(b.String()), 0o600); err != nil {
+		return fmt.Errorf("write mail error: %w", err)
+	}
+	m.logger.Info("mail written", zap.String("to", msg.To), zap.String("subject", msg.Subject), zap.String("file", name))
+	return nil
+}
@@ -2,68 +2,117 @@ package datasource
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"marketplace/internal/app"
+	"strings"
+	"sync"
 )
 
 
 type MarketRepo struct{
-	db *sql.DB
-	user app.UserRepository
+	db sqlDB
+
+	ftsMu      sync.Mutex
+	fts        bool
+	ftsChecked bool // only a successful probe is remembered
 }
 
-func NewMarketRepo(db *sql.DB, user app.UserRepository) *MarketRepo {
-	return &MarketRepo{db: db, user: user}
+func NewMarketRepo(db *sql.DB) *MarketRepo {
+	return &MarketRepo{db: newSQLDB(db)}
 }
 
 func (s *MarketRepo) SaveAd(ad app.Ad) (app.Ad, error){
-	stmt, err := s.db.Prepare(`INSERT INTO ads (uuid, title, description, price, img, user_uuid, created_at) 
-	VALUES (?, ?, ?, ?, ?, ?, ?)`)
+	tx, err := s.db.Begin()
 	if err != nil {
-		return app.Ad{}, fmt.Errorf("prepare error DB:%w", err)
+		return app.Ad{}, err
 	}
-	defer stmt.Close()
+	defer tx.Rollback()
 
-	_, err = stmt.Exec(ad.UUID.String(), ad.Title, ad.Description, ad.Price, ad.ImageURL, ad.UserID, ad.CreatedAt)
+	err = tx.QueryRow(`INSERT INTO ads (uuid, title, description, price, user_uuid, category_id, status, created_at, updated_at) 
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`,
+		ad.UUID.String(), ad.Title, ad.Description, ad.Price, ad.UserID, nullableID(ad.CategoryID), ad.Status, ad.CreatedAt, ad.UpdatedAt).Scan(&ad.ID)
 	if err != nil {
 		return app.Ad{}, fmt.Errorf("exec error DB:%w", err)
 	}
+	for i := range ad.Images {
+		if ad.Images[i], err = insertAdImage(tx, ad.ID, ad.Images[i], ad.CreatedAt); err != nil {
+			return app.Ad{}, err
+		}
+	}
 
+	if err := tx.Commit(); err != nil {
+		return app.Ad{}, fmt.Errorf("commit error DB:%w", err)
+	}
 	return ad, nil
 }
 
 func (s *MarketRepo) GetAdsList(params app.AdsListParams, user_id string) ([]app.AdsListResponse, error) {
 	var ads []app.AdsListResponse
 
+	terms := searchTerms(params.Query)
+	search, err := s.adsSearch(terms)
+	if err != nil {
+		return nil, err
+	}
+
+	filter, args := adsFilter(params, search)
 	query := `
 		SELECT 
 			a.id,
 			a.uuid,
 			a.title,
 			a.description,
-			a.img AS image_url,
+			COALESCE(ci.url, '') AS image_url,
+			ci.variants AS image_variants,
 			a.user_uuid,
+			u.login,
 			a.price,
-			a.created_at
+			a.category_id,
+			a.created_at,
+			` + search.titleSnippet + `,
+			` + search.descriptionSnippet + `
 		FROM ads a
 		JOIN users u ON a.user_uuid = u.uuid
-		WHERE a.price >= ? AND a.price <= ?
-	`
+		` + search.join + `
+		LEFT JOIN ad_images ci ON ci.ad_id = a.id AND ci.is_cover
+		WHERE ` + filter
 
 	sortBy := "a.created_at"
+	var sortKey any
+	if params.After != nil {
+		sortKey = params.After.CreatedAt
+	}
 	if params.SortBy == "price" {
 		sortBy = "a.price"
+		if params.After != nil {
+			sortKey = params.After.Price
+		}
 	}
-	order := "ASC"
+	order, cmp := "ASC", ">"
 	if params.Order == "desc" {
-		order = "DESC"
+		order, cmp = "DESC", "<"
+	}
+	if params.After != nil {
+		// keyset: rows strictly after the last one seen, id breaks ties between equal sort keys
+		query += fmt.Sprintf(" AND (%s, a.id) %s (?, ?)", sortBy, cmp)
+		args = append(args, sortKey, params.After.ID)
+	}
+	if params.SortBy == "relevance" && search.rank != "" {
+		query += fmt.Sprintf(" ORDER BY %s, a.id", search.rank)
+		args = append(args, search.rankArgs...)
+	} else {
+		query += fmt.Sprintf(" ORDER BY %s %s, a.id %s", sortBy, order, order)
 	}
-	query += fmt.Sprintf(" ORDER BY %s %s", sortBy, order)
 
-	offset := (params.Page - 1) * params.Limit
-	query += " LIMIT ? OFFSET ?"
+	query += " LIMIT ?"
+	args = append(args, params.Limit)
+	if params.After == nil {
+		query += " OFFSET ?"
+		args = append(args, (params.Page-1)*params.Limit)
+	}
 
-	rows, err := s.db.Query(query, params.MinPrice, params.MaxPrice, params.Limit, offset)
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("query error DB: %w", err)
 	}
@@ -71,33 +120,342 @@ func (s *MarketRepo) GetAdsList(params app.AdsListParams, user_id string) ([]app
 
 	for rows.Next() {
 		var adResp app.AdsListResponse
-		var ad app.Ad
+		var userID string
+		var snippet app.AdSnippet
+		var categoryID sql.NullInt64
+		var variants sql.NullString
 		err := rows.Scan(
-			&ad.ID,
-			&ad.UUID,
+			&adResp.ID,
+			&adResp.UUID,
 			&adResp.Title,
 			&adResp.Description,
 			&adResp.ImageURL,
-			&ad.UserID,
+			&variants,
+			&userID,
+			&adResp.Username,
 			&adResp.Price,
-			&ad.CreatedAt,
+			&categoryID,
+			&adResp.CreatedAt,
+			&snippet.Title,
+			&snippet.Description,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("scan error DB: %w", err)
 		}
-		if ad.UserID.String() == user_id {
+		if userID == user_id {
 			adResp.Owner = true
 		}
-		user, err := s.user.FindByUUID(ad.UserID.String())
+		adResp.CategoryID = categoryID.Int64
+		if adResp.Images, err = parseVariants(variants); err != nil {
+			return nil, err
+		}
+		if len(terms) > 0 {
+			if search.mode == searchLike {
+				snippet.Title = highlightText(adResp.Title, terms)
+				snippet.Description = snippetText(adResp.Description, terms)
+			} else {
+				snippet.Title = markSnippet(snippet.Title)
+				snippet.Description = markSnippet(snippet.Description)
+			}
+			adResp.Snippet = &snippet
+		}
+		ads = append(ads, adResp)
+	}
+
+	return ads, nil
+}
+
+// CountAds returns how many ads GetAdsList would return across all pages.
+func (s *MarketRepo) CountAds(params app.AdsListParams) (int, error) {
+	search, err := s.adsSearch(searchTerms(params.Query))
+	if err != nil {
+		return 0, err
+	}
+	filter, args := adsFilter(params, search)
+	var total int
+	err = s.db.QueryRow(`
+		SELECT COUNT(*)
+		FROM ads a
+		JOIN users u ON a.user_uuid = u.uuid
+		`+search.join+`
+		WHERE `+filter, args...).Scan(&total)
+	if err != nil {
+		return 0, fmt.Errorf("scan error DB:%w", err)
+	}
+	return total, nil
+}
+
+// adsFilter builds the WHERE conditions shared by GetAdsList and CountAds; the returned
+// args start with the search join args, so the join has to come right before the WHERE.
+// Ads of banned users are left out.
+func adsFilter(params app.AdsListParams, search adsSearchSQL) (string, []any) {
+	filter := "a.status = ? AND u.status <> ? AND a.price >= ? AND a.price <= ?"
+	args := append([]any{}, search.joinArgs...)
+	args = append(args, app.AdStatusActive, app.UserStatusBanned, params.MinPrice, params.MaxPrice)
+	if search.where != "" {
+		filter += " AND " + search.where
+		args = append(args, search.whereArgs...)
+	}
+	if params.Category != "" {
+		filter += " AND a.category_id IN " + categorySubtreeSQL
+		args = append(args, params.Category, params.Category)
+	}
+	return filter, args
+}
+
+type searchMode int
+
+const (
+	searchNone searchMode = iota
+	searchFTS5
+	searchTSVector
+	searchLike
+)
+
+// adsSearchSQL holds the pieces GetAdsList splices in to filter and rank by a text query.
+type adsSearchSQL struct {
+	mode               searchMode
+	join               string
+	joinArgs           []any
+	where              string
+	whereArgs          []any
+	rank               string
+	rankArgs           []any
+	titleSnippet       string
+	descriptionSnippet string
+}
+
+func (s *MarketRepo) adsSearch(terms []string) (adsSearchSQL, error) {
+	none := adsSearchSQL{mode: searchNone, titleSnippet: "''", descriptionSnippet: "''"}
+	if len(terms) == 0 {
+		return none, nil
+	}
+
+	if s.db.dialect == postgresDialect {
+		return adsSearchSQL{
+			mode:               searchTSVector,
+			join:               "JOIN (SELECT to_tsquery('russian', ?) || to_tsquery('english', ?) AS query) q ON a.search @@ q.query",
+			joinArgs:           []any{tsQuery(terms), tsQuery(terms)},
+			rank:               "ts_rank(a.search, q.query) DESC",
+			titleSnippet:       "ts_headline('russian', a.title, q.query, 'StartSel=" + sqlMarkOpen + ", StopSel=" + sqlMarkClose + ", HighlightAll=true')",
+			descriptionSnippet: "ts_headline('russian', a.description, q.query, 'StartSel=" + sqlMarkOpen + ", StopSel=" + sqlMarkClose + ", MaxWords=16, MinWords=6')",
+		}, nil
+	}
+
+	fts, err := s.hasFTS()
+	if err != nil {
+		return none, err
+	}
+	if fts {
+		return adsSearchSQL{
+			mode:               searchFTS5,
+			join:               "JOIN ads_fts ON ads_fts.rowid = a.id",
+			where:              "ads_fts MATCH ?",
+			whereArgs:          []any{ftsMatchQuery(terms)},
+			rank:               "bm25(ads_fts, 10.0, 1.0)",
+			titleSnippet:       "highlight(ads_fts, 0, '" + sqlMarkOpen + "', '" + sqlMarkClose + "')",
+			descriptionSnippet: "snippet(ads_fts, 1, '" + sqlMarkOpen + "', '" + sqlMarkClose + "', '…', 16)",
+		}, nil
+	}
+
+	// Without FTS5 every term has to appear in the title or the description,
+	// and title matches rank first.
+	search := adsSearchSQL{mode: searchLike, titleSnippet: "''", descriptionSnippet: "''"}
+	conds := make([]string, len(terms))
+	scores := make([]string, len(terms))
+	for i, term := range terms {
+		conds[i] = "(unicode_lower(a.title) LIKE ? OR unicode_lower(a.description) LIKE ?)"
+		scores[i] = "CASE WHEN unicode_lower(a.title) LIKE ? THEN 10 ELSE 1 END"
+		pattern := "%" + stemPrefix(term) + "%"
+		search.whereArgs = append(search.whereArgs, pattern, pattern)
+		search.rankArgs = append(search.rankArgs, pattern)
+	}
+	search.where = strings.Join(conds, " AND ")
+	search.rank = "(" + strings.Join(scores, " + ") + ") DESC"
+	return search, nil
+}
+
+// hasFTS reports whether the ads_fts index was created, which depends on the SQLite build.
+func (s *MarketRepo) hasFTS() (bool, error) {
+	s.ftsMu.Lock()
+	defer s.ftsMu.Unlock()
+	if s.ftsChecked {
+		return s.fts, nil
+	}
+	var count int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'ads_fts'`).Scan(&count); err != nil {
+		return false, fmt.Errorf("check fts index error DB: %w", err)
+	}
+	s.fts, s.ftsChecked = count > 0, true
+	return s.fts, nil
+}
+
+func (s *MarketRepo) GetAdByUUID(uuid string) (app.Ad, error) {
+	var ad app.Ad
+	var categoryID sql.NullInt64
+	row := s.db.QueryRow(`
+		SELECT
+			a.id,
+			a.uuid,
+			a.title,
+			a.description,
+			a.user_uuid,
+			u.login,
+			a.price,
+			a.category_id,
+			a.status,
+			a.created_at,
+			a.updated_at
+		FROM ads a
+		JOIN users u ON a.user_uuid = u.uuid
+		WHERE a.uuid = ?`, uuid)
+	err := row.Scan(
+		&ad.ID,
+		&ad.UUID,
+		&ad.Title,
+		&ad.Description,
+		&ad.UserID,
+		&ad.Username,
+		&ad.Price,
+		&categoryID,
+		&ad.Status,
+		&ad.CreatedAt,
+		&ad.UpdatedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return app.Ad{}, app.ErrAdNotFound
+	}
+	if err != nil {
+		return app.Ad{}, fmt.Errorf("scan error DB:%w", err)
+	}
+	ad.CategoryID = categoryID.Int64
+	ad.Images, err = s.adImages(ad.ID)
+	if err != nil {
+		return app.Ad{}, err
+	}
+	return ad, nil
+}
+
+// GetUserAds returns a page of the user's ads in every status, newest first, with their images.
+func (s *MarketRepo) GetUserAds(userID string, limit int, offset int) ([]app.Ad, error) {
+	rows, err := s.db.Query(`
+		SELECT
+			a.id,
+			a.uuid,
+			a.title,
+			a.description,
+			a.user_uuid,
+			u.login,
+			a.price,
+			a.category_id,
+			a.status,
+			a.created_at,
+			a.updated_at
+		FROM ads a
+		JOIN users u ON a.user_uuid = u.uuid
+		WHERE a.user_uuid = ?
+		ORDER BY a.created_at DESC, a.id DESC
+		LIMIT ? OFFSET ?`, userID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("query error DB: %w", err)
+	}
+	defer rows.Close()
 
+	ads := []app.Ad{}
+	for rows.Next() {
+		var ad app.Ad
+		var categoryID sql.NullInt64
+		err := rows.Scan(
+			&ad.ID,
+			&ad.UUID,
+			&ad.Title,
+			&ad.Description,
+			&ad.UserID,
+			&ad.Username,
+			&ad.Price,
+			&categoryID,
+			&ad.Status,
+			&ad.CreatedAt,
+			&ad.UpdatedAt,
+		)
 		if err != nil {
-			return nil, fmt.Errorf("err gettin username from DB: %w", err)
+			return nil, fmt.Errorf("scan error DB:%w", err)
 		}
+		ad.CategoryID = categoryID.Int64
+		ads = append(ads, ad)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
 
-		adResp.Username = user.Login
+	adIDs := make([]int64, len(ads))
+	for i := range ads {
+		adIDs[i] = ads[i].ID
+	}
+	images, err := s.adsImages(adIDs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range ads {
+		ads[i].Images = images[ads[i].ID]
+	}
+	return ads, nil
+}
 
-		ads = append(ads, adResp)
+func (s *MarketRepo) CountUserAds(userID string) (int, error) {
+	var total int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM ads WHERE user_uuid = ?`, userID).Scan(&total); err != nil {
+		return 0, fmt.Errorf("scan error DB:%w", err)
 	}
+	return total, nil
+}
 
-	return ads, nil
-}
\ No newline at end of file
+func (s *MarketRepo) UpdateAd(ad app.Ad) (app.Ad, error) {
+	res, err := s.db.Exec(`UPDATE ads SET title = ?, description = ?, price = ?, category_id = ?, status = ?, updated_at = ? WHERE uuid = ?`,
+		ad.Title, ad.Description, ad.Price, nullableID(ad.CategoryID), ad.Status, ad.UpdatedAt, ad.UUID.String())
+	if err != nil {
+		return app.Ad{}, fmt.Errorf("exec error DB:%w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return app.Ad{}, fmt.Errorf("rows affected error DB:%w", err)
+	}
+	if n == 0 {
+		return app.Ad{}, app.ErrAdNotFound
+	}
+	return ad, nil
+}
+
+func (s *MarketRepo) DeleteAd(uuid string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// SQLite does not enforce ON DELETE CASCADE unless foreign keys are switched on
+	if _, err := tx.Exec(`DELETE FROM ad_images WHERE ad_id IN (SELECT id FROM ads WHERE uuid = ?)`, uuid); err != nil {
+		return fmt.Errorf("exec error DB:%w", err)
+	}
+	res, err := tx.Exec(`DELETE FROM ads WHERE uuid = ?`, uuid)
+	if err != nil {
+		return fmt.Errorf("exec error DB:%w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected error DB:%w", err)
+	}
+	if n == 0 {
+		return app.ErrAdNotFound
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit error DB:%w", err)
+	}
+	return nil
+}
+
+// nullableID stores the zero id as NULL.
+func nullableID(id int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: id, Valid: id != 0}
+}
@@ -0,0 +1,285 @@
+package datasource
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//go:embed migrations
+var migrationsFS embed.FS
+
+var migrationFileRe = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// An up script starting with "-- requires: <feature>" is skipped while the database lacks that feature.
+var requiresRe = regexp.MustCompile(`^--\s*requires:\s*(\w+)`)
+
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+	Requires string
+}
+
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	Skipped   bool // pending, but the required feature is unavailable
+	AppliedAt time.Time
+}
+
+type appliedMigration struct {
+	checksum  string
+	appliedAt time.Time
+}
+
+// Migrator applies the versioned schema scripts and records them in schema_migrations.
+type Migrator struct {
+	db         sqlDB
+	migrations []Migration
+}
+
+// NewMigrator uses the embedded scripts for the driver db was opened with.
+func NewMigrator(db *sql.DB) (*Migrator, error) {
+	return NewMigratorFromFS(db, migrationsFS, path.Join("migrations", dialectOf(db).String()))
+}
+
+// NewMigratorFromFS reads NNNN_name.up.sql / NNNN_name.down.sql pairs from dir in fsys.
+func NewMigratorFromFS(db *sql.DB, fsys fs.FS, dir string) (*Migrator, error) {
+	migrations, err := loadMigrations(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: newSQLDB(db), migrations: migrations}, nil
+}
+
+func loadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("read migrations dir error: %w", err)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		match := migrationFileRe.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name %q", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		data, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("read migration %s error: %w", entry.Name(), err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has conflicting names %q and %q", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(data)
+			if req := requiresRe.FindStringSubmatch(m.Up); req != nil {
+				m.Requires = req[1]
+			}
+		} else {
+			m.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up script", m.Version, m.Name)
+		}
+		sum := sha256.Sum256([]byte(m.Up))
+		m.Checksum = hex.EncodeToString(sum[:])
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+func (m *Migrator) ensureTable() error {
+	timeType := "DATETIME"
+	if m.db.dialect == postgresDialect {
+		timeType = "TIMESTAMPTZ"
+	}
+	_, err := m.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+        version INTEGER PRIMARY KEY,
+        name TEXT NOT NULL,
+        checksum TEXT NOT NULL,
+        applied_at ` + timeType + ` NOT NULL
+    );`)
+	if err != nil {
+		return fmt.Errorf("create schema_migrations table error: %w", err)
+	}
+	return nil
+}
+
+// applied returns the recorded migrations and fails if any of them no longer matches its script.
+func (m *Migrator) applied() (map[int]appliedMigration, error) {
+	if err := m.ensureTable(); err != nil {
+		return nil, err
+	}
+	rows, err := m.db.Query(`SELECT version, checksum, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("query error DB: %w", err)
+	}
+	defer rows.Close()
+
+	known := make(map[int]Migration, len(m.migrations))
+	for _, mig := range m.migrations {
+		known[mig.Version] = mig
+	}
+
+	applied := make(map[int]appliedMigration)
+	for rows.Next() {
+		var version int
+		var a appliedMigration
+		if err := rows.Scan(&version, &a.checksum, &a.appliedAt); err != nil {
+			return nil, fmt.Errorf("scan error DB: %w", err)
+		}
+		mig, ok := known[version]
+		if !ok {
+			return nil, fmt.Errorf("migration %d is applied but missing from the migration set", version)
+		}
+		if mig.Checksum != a.checksum {
+			return nil, fmt.Errorf("checksum mismatch for migration %d_%s: applied script was modified", version, mig.Name)
+		}
+		applied[version] = a
+	}
+	return applied, rows.Err()
+}
+
+// Up applies every pending migration in version order and returns how many were applied.
+func (m *Migrator) Up() (int, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, mig := range m.migrations {
+		if _, ok := applied[mig.Version]; ok {
+			continue
+		}
+		supported, err := m.supports(mig.Requires)
+		if err != nil {
+			return count, err
+		}
+		if !supported {
+			continue
+		}
+		err = m.inTx(func(tx sqlTx) error {
+			if _, err := tx.Tx.Exec(mig.Up); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (?, ?, ?, ?)`,
+				mig.Version, mig.Name, mig.Checksum, time.Now().UTC())
+			return err
+		})
+		if err != nil {
+			return count, fmt.Errorf("apply migration %d_%s error: %w", mig.Version, mig.Name, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Down rolls back the last steps applied migrations and returns how many were rolled back.
+func (m *Migrator) Down(steps int) (int, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for i := len(m.migrations) - 1; i >= 0 && count < steps; i-- {
+		mig := m.migrations[i]
+		if _, ok := applied[mig.Version]; !ok {
+			continue
+		}
+		if mig.Down == "" {
+			return count, fmt.Errorf("migration %d_%s has no down script", mig.Version, mig.Name)
+		}
+		err := m.inTx(func(tx sqlTx) error {
+			if _, err := tx.Tx.Exec(mig.Down); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`DELETE FROM schema_migrations WHERE version = ?`, mig.Version)
+			return err
+		})
+		if err != nil {
+			return count, fmt.Errorf("roll back migration %d_%s error: %w", mig.Version, mig.Name, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(m.migrations))
+	for _, mig := range m.migrations {
+		a, ok := applied[mig.Version]
+		st := MigrationStatus{Migration: mig, Applied: ok, AppliedAt: a.appliedAt}
+		if !ok {
+			supported, err := m.supports(mig.Requires)
+			if err != nil {
+				return nil, err
+			}
+			st.Skipped = !supported
+		}
+		statuses = append(statuses, st)
+	}
+	return statuses, nil
+}
+
+func (m *Migrator) supports(feature string) (bool, error) {
+	switch feature {
+	case "":
+		return true, nil
+	case "fts5":
+		if m.db.dialect != sqliteDialect {
+			return false, nil
+		}
+		var used bool
+		if err := m.db.QueryRow(`SELECT sqlite_compileoption_used('ENABLE_FTS5')`).Scan(&used); err != nil {
+			return false, fmt.Errorf("check fts5 support error: %w", err)
+		}
+		return used, nil
+	default:
+		return false, fmt.Errorf("unknown migration requirement %q", feature)
+	}
+}
+
+func (m *Migrator) inTx(fn func(tx sqlTx) error) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS users (
+    id BIGSERIAL PRIMARY KEY,
+    uuid TEXT NOT NULL UNIQUE,
+    login TEXT NOT NULL UNIQUE,
+    password TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS ads (
+    id BIGSERIAL PRIMARY KEY,
+    uuid TEXT NOT NULL,
+    title TEXT NOT NULL,
+    description TEXT NOT NULL,
+    price DOUBLE PRECISION NOT NULL,
+    img TEXT NOT NULL,
+    user_uuid TEXT NOT NULL REFERENCES users(uuid),
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
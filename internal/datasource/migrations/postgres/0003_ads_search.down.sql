@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS ads_search_idx;
+ALTER TABLE ads DROP COLUMN search;
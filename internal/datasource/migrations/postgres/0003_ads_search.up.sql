@@ -0,0 +1,9 @@
+-- Both configurations are indexed so that Russian and English words are stemmed.
+ALTER TABLE ads ADD COLUMN search tsvector GENERATED ALWAYS AS (
+    setweight(to_tsvector('russian', title), 'A') ||
+    setweight(to_tsvector('english', title), 'A') ||
+    setweight(to_tsvector('russian', description), 'B') ||
+    setweight(to_tsvector('english', description), 'B')
+) STORED;
+
+CREATE INDEX ads_search_idx ON ads USING GIN (search);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS ads_category_id_idx;
+ALTER TABLE ads DROP COLUMN category_id;
+DROP TABLE IF EXISTS categories;
@@ -0,0 +1,3 @@
+ALTER TABLE ads ADD COLUMN img TEXT NOT NULL DEFAULT '';
+UPDATE ads SET img = COALESCE((SELECT url FROM ad_images WHERE ad_images.ad_id = ads.id AND ad_images.is_cover), '');
+DROP TABLE ad_images;
@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN status_reason TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN suspended_until TIMESTAMPTZ;
+UPDATE users SET status = 'banned' WHERE status = 'blocked';
@@ -0,0 +1,14 @@
+ALTER TABLE users ADD COLUMN email TEXT;
+ALTER TABLE users ADD COLUMN email_verified_at TIMESTAMPTZ;
+CREATE UNIQUE INDEX users_email_idx ON users(email);
+
+CREATE TABLE email_verification_tokens (
+    id TEXT PRIMARY KEY,
+    user_uuid TEXT NOT NULL REFERENCES users(uuid),
+    email TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ
+);
+
+CREATE INDEX email_verification_tokens_user_uuid_idx ON email_verification_tokens(user_uuid);
@@ -0,0 +1,2 @@
+ALTER TABLE ads DROP COLUMN updated_at;
+ALTER TABLE ads DROP COLUMN status;
@@ -0,0 +1,3 @@
+ALTER TABLE ads ADD COLUMN status TEXT NOT NULL DEFAULT 'active';
+ALTER TABLE ads ADD COLUMN updated_at DATETIME;
+UPDATE ads SET updated_at = created_at;
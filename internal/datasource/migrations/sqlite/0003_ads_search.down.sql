@@ -0,0 +1,4 @@
+DROP TRIGGER IF EXISTS ads_fts_after_update;
+DROP TRIGGER IF EXISTS ads_fts_after_delete;
+DROP TRIGGER IF EXISTS ads_fts_after_insert;
+DROP TABLE IF EXISTS ads_fts;
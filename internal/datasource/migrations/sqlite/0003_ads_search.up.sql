@@ -0,0 +1,24 @@
+-- requires: fts5
+-- Needs go-sqlite3 built with -tags sqlite_fts5; without it search falls back to LIKE.
+CREATE VIRTUAL TABLE ads_fts USING fts5(
+    title,
+    description,
+    content = 'ads',
+    content_rowid = 'id',
+    tokenize = 'porter unicode61 remove_diacritics 2'
+);
+
+INSERT INTO ads_fts (ads_fts) VALUES ('rebuild');
+
+CREATE TRIGGER ads_fts_after_insert AFTER INSERT ON ads BEGIN
+    INSERT INTO ads_fts (rowid, title, description) VALUES (new.id, new.title, new.description);
+END;
+
+CREATE TRIGGER ads_fts_after_delete AFTER DELETE ON ads BEGIN
+    INSERT INTO ads_fts (ads_fts, rowid, title, description) VALUES ('delete', old.id, old.title, old.description);
+END;
+
+CREATE TRIGGER ads_fts_after_update AFTER UPDATE OF title, description ON ads BEGIN
+    INSERT INTO ads_fts (ads_fts, rowid, title, description) VALUES ('delete', old.id, old.title, old.description);
+    INSERT INTO ads_fts (rowid, title, description) VALUES (new.id, new.title, new.description);
+END;
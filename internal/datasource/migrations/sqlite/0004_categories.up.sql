@@ -0,0 +1,12 @@
+CREATE TABLE categories (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    parent_id INTEGER REFERENCES categories(id),
+    slug TEXT NOT NULL UNIQUE,
+    names TEXT NOT NULL
+);
+
+CREATE INDEX categories_parent_id_idx ON categories(parent_id);
+
+ALTER TABLE ads ADD COLUMN category_id INTEGER REFERENCES categories(id);
+
+CREATE INDEX ads_category_id_idx ON ads(category_id);
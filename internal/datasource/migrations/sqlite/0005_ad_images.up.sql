@@ -0,0 +1,24 @@
+CREATE TABLE ad_images (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    ad_id INTEGER NOT NULL REFERENCES ads(id) ON DELETE CASCADE,
+    url TEXT NOT NULL,
+    blob_key TEXT,
+    position INTEGER NOT NULL,
+    is_cover BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at DATETIME NOT NULL
+);
+
+CREATE INDEX ad_images_ad_id_idx ON ad_images(ad_id, position);
+CREATE UNIQUE INDEX ad_images_cover_idx ON ad_images(ad_id) WHERE is_cover;
+-- a stored file belongs to one ad at most
+CREATE UNIQUE INDEX ad_images_blob_key_idx ON ad_images(blob_key) WHERE blob_key IS NOT NULL;
+
+-- images served under the default base_url are stored files: keep their key the way imageKey
+-- derives it, so they are deleted with the ad; a file shared by several legacy ads goes to the first one
+INSERT INTO ad_images (ad_id, url, blob_key, position, is_cover, created_at)
+SELECT id, img,
+    CASE WHEN img LIKE '/images/_%' AND img NOT LIKE '%//%' AND img NOT LIKE '%..%' AND img NOT LIKE '%/'
+        AND id = (SELECT MIN(a.id) FROM ads a WHERE a.img = ads.img) THEN substr(img, 9) END,
+    0, TRUE, COALESCE(updated_at, created_at, CURRENT_TIMESTAMP) FROM ads WHERE img <> '';
+
+ALTER TABLE ads DROP COLUMN img;
@@ -0,0 +1 @@
+ALTER TABLE ad_images DROP COLUMN variants;
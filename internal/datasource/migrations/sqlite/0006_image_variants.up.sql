@@ -0,0 +1 @@
+ALTER TABLE ad_images ADD COLUMN variants TEXT;
@@ -0,0 +1,10 @@
+CREATE TABLE sessions (
+    id TEXT PRIMARY KEY,
+    user_uuid TEXT NOT NULL REFERENCES users(uuid),
+    user_agent TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL,
+    last_used_at DATETIME NOT NULL
+);
+
+CREATE INDEX sessions_user_uuid_idx ON sessions(user_uuid);
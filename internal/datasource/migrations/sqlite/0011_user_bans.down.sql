@@ -0,0 +1,3 @@
+UPDATE users SET status = 'blocked' WHERE status IN ('suspended', 'banned');
+ALTER TABLE users DROP COLUMN suspended_until;
+ALTER TABLE users DROP COLUMN status_reason;
@@ -0,0 +1,9 @@
+CREATE TABLE password_reset_tokens (
+    id TEXT PRIMARY KEY,
+    user_uuid TEXT NOT NULL REFERENCES users(uuid),
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME
+);
+
+CREATE INDEX password_reset_tokens_user_uuid_idx ON password_reset_tokens(user_uuid);
@@ -0,0 +1,14 @@
+ALTER TABLE users ADD COLUMN email TEXT;
+ALTER TABLE users ADD COLUMN email_verified_at DATETIME;
+CREATE UNIQUE INDEX users_email_idx ON users(email);
+
+CREATE TABLE email_verification_tokens (
+    id TEXT PRIMARY KEY,
+    user_uuid TEXT NOT NULL REFERENCES users(uuid),
+    email TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME
+);
+
+CREATE INDEX email_verification_tokens_user_uuid_idx ON email_verification_tokens(user_uuid);
@@ -0,0 +1,10 @@
+ALTER TABLE users ADD COLUMN totp_secret TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN totp_enabled_at DATETIME;
+ALTER TABLE users ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE totp_recovery_codes (
+    user_uuid TEXT NOT NULL REFERENCES users(uuid),
+    code_hash TEXT NOT NULL,
+    used_at DATETIME,
+    PRIMARY KEY (user_uuid, code_hash)
+);
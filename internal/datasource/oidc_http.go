@@ -0,0 +1,361 @@
+package datasource
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"marketplace/internal/app"
+	"marketplace/internal/config"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+)
+
+const (
+	oidcTimeout = 10 * time.Second
+	// oidcMaxResponse caps what is read from a provider.
+	oidcMaxResponse = 1 << 20
+	// jwksRefreshInterval is how often an unknown kid may trigger fetching the provider's keys
+	// again, so that tokens with made-up kids can't be used to hammer the provider.
+	jwksRefreshInterval = time.Minute
+	// oidcLeeway is the clock skew allowed between us and a provider.
+	oidcLeeway = time.Minute
+)
+
+// idTokenMethods are the signature algorithms accepted on ID tokens; HS256 with the client
+// secret is left out on purpose.
+var idTokenMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// OIDCClient is the OpenID Connect client behind app.IdentityProvider. Each provider's endpoints
+// are discovered on first use and its signing keys fetched from jwks_uri when an ID token needs them.
+type OIDCClient struct {
+	providers map[string]config.OIDCProvider
+	client    *http.Client
+	logger    *zap.Logger
+
+	mu        sync.Mutex
+	discovery map[string]*oidcDiscovery // by provider name
+}
+
+// oidcDiscovery is the part of the provider metadata (OpenID Connect Discovery 1.0) we use,
+// with the keys fetched from JWKSURI.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	keys        map[string]any // public keys by kid
+	keysFetched time.Time
+}
+
+// oidcJWK is a provider's public key; unlike app.JWK it can be an EC key.
+type oidcJWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func NewOIDCClient(cfg *config.Config, logger *zap.Logger) *OIDCClient {
+	providers := make(map[string]config.OIDCProvider, len(cfg.OIDC.Providers))
+	for _, provider := range cfg.OIDC.Providers {
+		providers[provider.Name] = provider
+	}
+	return &OIDCClient{
+		providers: providers,
+		client:    &http.Client{Timeout: oidcTimeout},
+		logger:    logger,
+		discovery: make(map[string]*oidcDiscovery),
+	}
+}
+
+func (c *OIDCClient) AuthCodeURL(provider string, req app.AuthCodeRequest) (string, error) {
+	p, d, err := c.discover(provider)
+	if err != nil {
+		return "", err
+	}
+	authURL, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid authorization endpoint: %w", err)
+	}
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.ClientID)
+	query.Set("redirect_uri", p.RedirectURL)
+	query.Set("scope", strings.Join(p.Scopes, " "))
+	query.Set("state", req.State)
+	query.Set("nonce", req.Nonce)
+	query.Set("code_challenge", req.CodeChallenge)
+	query.Set("code_challenge_method", "S256")
+	authURL.RawQuery = query.Encode()
+	return authURL.String(), nil
+}
+
+func (c *OIDCClient) Exchange(provider string, code string, codeVerifier string) (app.ExternalIdentity, error) {
+	p, d, err := c.discover(provider)
+	if err != nil {
+		return app.ExternalIdentity{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("client_id", p.ClientID)
+	form.Set("code_verifier", codeVerifier)
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return app.ExternalIdentity{}, fmt.Errorf("token request error: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		// client_secret_basic, the default authentication method of the token endpoint
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	var tokenResp struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	status, err := c.getJSON(req, &tokenResp)
+	if err != nil {
+		return app.ExternalIdentity{}, err
+	}
+	if status != http.StatusOK {
+		return app.ExternalIdentity{}, fmt.Errorf("token endpoint returned %d: %s %s", status, tokenResp.Error, tokenResp.ErrorDescription)
+	}
+	if tokenResp.IDToken == "" {
+		return app.ExternalIdentity{}, errors.New("token endpoint returned no id_token")
+	}
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(tokenResp.IDToken, claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return c.key(provider, d, kid)
+	},
+		jwt.WithValidMethods(idTokenMethods),
+		jwt.WithIssuer(d.Issuer),
+		jwt.WithAudience(p.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(oidcLeeway),
+	)
+	if err != nil {
+		return app.ExternalIdentity{}, fmt.Errorf("invalid id_token: %w", err)
+	}
+	// with several audiences the token must have been issued to us
+	if azp, ok := claims["azp"].(string); ok && azp != p.ClientID {
+		return app.ExternalIdentity{}, errors.New("invalid id_token: azp is another client")
+	}
+
+	identity := app.ExternalIdentity{Provider: provider}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.Username, _ = claims["preferred_username"].(string)
+	identity.Nonce, _ = claims["nonce"].(string)
+	// some providers send the flag as a string
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		identity.EmailVerified = verified
+	case string:
+		identity.EmailVerified = verified == "true"
+	}
+	if identity.Subject == "" {
+		return app.ExternalIdentity{}, errors.New("invalid id_token: no sub")
+	}
+	return identity, nil
+}
+
+// discover returns the provider's config and metadata, fetching the metadata on first use.
+func (c *OIDCClient) discover(name string) (config.OIDCProvider, *oidcDiscovery, error) {
+	p, ok := c.providers[name]
+	if !ok {
+		return config.OIDCProvider{}, nil, app.ErrUnknownProvider
+	}
+	c.mu.Lock()
+	d, ok := c.discovery[name]
+	c.mu.Unlock()
+	if ok {
+		return p, d, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, p.Issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return p, nil, fmt.Errorf("discovery request error: %w", err)
+	}
+	d = &oidcDiscovery{}
+	status, err := c.getJSON(req, d)
+	if err != nil {
+		return p, nil, err
+	}
+	if status != http.StatusOK {
+		return p, nil, fmt.Errorf("discovery of %s returned %d", name, status)
+	}
+	// the issuer must be the one configured, or the metadata may be someone else's
+	if strings.TrimSuffix(d.Issuer, "/") != p.Issuer {
+		return p, nil, fmt.Errorf("discovery of %s returned issuer %q", name, d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return p, nil, fmt.Errorf("discovery of %s returned incomplete metadata", name)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.discovery[name]; ok {
+		return p, cached, nil
+	}
+	c.discovery[name] = d
+	c.logger.Info("oidc provider discovered", zap.String("provider", name), zap.String("issuer", d.Issuer))
+	return p, d, nil
+}
+
+// key returns the provider's public key with the given kid, fetching the keys again if
+// it's unknown; an empty kid is accepted when the provider has a single key.
+func (c *OIDCClient) key(provider string, d *oidcDiscovery, kid string) (any, error) {
+	c.mu.Lock()
+	key, ok := lookupKey(d.keys, kid)
+	stale := time.Since(d.keysFetched) > jwksRefreshInterval
+	c.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if !stale {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	keys, err := c.fetchKeys(d.JWKSURI)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d.keysFetched = time.Now()
+	if err != nil {
+		return nil, err
+	}
+	d.keys = keys
+	c.logger.Info("oidc provider keys fetched", zap.String("provider", provider), zap.Int("keys", len(keys)))
+	if key, ok := lookupKey(keys, kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+func lookupKey(keys map[string]any, kid string) (any, bool) {
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, true
+		}
+	}
+	key, ok := keys[kid]
+	return key, ok
+}
+
+func (c *OIDCClient) fetchKeys(jwksURI string) (map[string]any, error) {
+	req, err := http.NewRequest(http.MethodGet, jwksURI, nil)
+	if err != nil {
+		return nil, fmt.Errorf("jwks request error: %w", err)
+	}
+	var set struct {
+		Keys []oidcJWK `json:"keys"`
+	}
+	status, err := c.getJSON(req, &set)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("jwks endpoint returned %d", status)
+	}
+
+	keys := make(map[string]any, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			// one key of an unsupported type doesn't make the others unusable
+			c.logger.Warn("skipping oidc provider key", zap.String("kid", jwk.Kid), zap.Error(err))
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+// getJSON sends req and decodes the response body, whatever its status, into v.
+func (c *OIDCClient) getJSON(req *http.Request, v any) (int, error) {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("request to %s error: %w", req.URL.Host, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, oidcMaxResponse))
+	if err != nil {
+		return 0, fmt.Errorf("read response of %s error: %w", req.URL.Host, err)
+	}
+	if err := json.Unmarshal(body, v); err != nil && resp.StatusCode == http.StatusOK {
+		return 0, fmt.Errorf("decode response of %s error: %w", req.URL.Host, err)
+	}
+	return resp.StatusCode, nil
+}
+
+func (k oidcJWK) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid n: %w", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid e")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(k.X)
+		y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+		if errX != nil || errY != nil {
+			return nil, errors.New("invalid x or y")
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return key, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
@@ -0,0 +1,165 @@
+package datasource
+
+import (
+	"html"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxSearchTerms = 8
+	highlightOpen  = "<mark>"
+	highlightClose = "</mark>"
+	snippetWords   = 16
+
+	// The SQL highlighters mark matches with these control characters instead of HTML, so that
+	// the ad text can be escaped before the marks are turned into tags, see markSnippet.
+	sqlMarkOpen  = "\x02"
+	sqlMarkClose = "\x03"
+)
+
+// Inflectional endings stripped from Russian words before prefix matching,
+// longest first, so that "самокаты" and "самоката" both find "самокат".
+var russianEndings = []string{
+	"иями", "ями", "ами", "ого", "его", "ому", "ему", "ыми", "ими",
+	"ов", "ев", "ей", "ой", "ий", "ый", "ая", "яя", "ое", "ее", "ые", "ие",
+	"ам", "ям", "ах", "ях", "ом", "ем", "ую", "юю",
+	"а", "я", "ы", "и", "у", "ю", "е", "о", "ь",
+}
+
+// searchTerms splits a user query into lower-cased words, dropping punctuation
+// so that the terms are always safe to embed into FTS5 and tsquery syntax.
+func searchTerms(q string) []string {
+	words := strings.FieldsFunc(strings.ToLower(q), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) > maxSearchTerms {
+		words = words[:maxSearchTerms]
+	}
+	return words
+}
+
+// stemPrefix cuts a Russian ending off a word, keeping at least four letters.
+func stemPrefix(word string) string {
+	if !isCyrillic(word) {
+		return word
+	}
+	for _, ending := range russianEndings {
+		if strings.HasSuffix(word, ending) && utf8.RuneCountInString(word)-utf8.RuneCountInString(ending) >= 4 {
+			return strings.TrimSuffix(word, ending)
+		}
+	}
+	return word
+}
+
+func isCyrillic(word string) bool {
+	for _, r := range word {
+		if unicode.Is(unicode.Cyrillic, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// ftsMatchQuery builds an FTS5 query where every term must match as a prefix.
+func ftsMatchQuery(terms []string) string {
+	parts := make([]string, len(terms))
+	for i, term := range terms {
+		parts[i] = `"` + stemPrefix(term) + `"*`
+	}
+	return strings.Join(parts, " ")
+}
+
+// tsQuery builds a to_tsquery expression where every term must match as a prefix.
+func tsQuery(terms []string) string {
+	parts := make([]string, len(terms))
+	for i, term := range terms {
+		parts[i] = term + ":*"
+	}
+	return strings.Join(parts, " & ")
+}
+
+// highlightText HTML-escapes text and marks every word that starts with one of the terms.
+func highlightText(text string, terms []string) string {
+	var b strings.Builder
+	forEachWord(text, func(word string, isWord bool) {
+		if isWord && matchesAny(word, terms) {
+			b.WriteString(highlightOpen + html.EscapeString(word) + highlightClose)
+			return
+		}
+		b.WriteString(html.EscapeString(word))
+	})
+	return b.String()
+}
+
+// markSnippet HTML-escapes a snippet made by the database and turns its sqlMark* into tags.
+func markSnippet(snippet string) string {
+	return strings.NewReplacer(sqlMarkOpen, highlightOpen, sqlMarkClose, highlightClose).Replace(html.EscapeString(snippet))
+}
+
+// snippetText returns up to snippetWords words of text around the first match, highlighted.
+func snippetText(text string, terms []string) string {
+	var tokens []string
+	var words []int
+	first := -1
+	forEachWord(text, func(token string, isWord bool) {
+		if isWord {
+			if first < 0 && matchesAny(token, terms) {
+				first = len(words)
+			}
+			words = append(words, len(tokens))
+		}
+		tokens = append(tokens, token)
+	})
+	if len(words) <= snippetWords {
+		return highlightText(text, terms)
+	}
+
+	start := max(first-snippetWords/4, 0)
+	end := min(start+snippetWords, len(words))
+	start = max(end-snippetWords, 0)
+
+	from, to := words[start], len(tokens)
+	if end < len(words) {
+		to = words[end]
+	}
+	snippet := highlightText(strings.TrimSpace(strings.Join(tokens[from:to], "")), terms)
+	if start > 0 {
+		snippet = "…" + snippet
+	}
+	if end < len(words) {
+		snippet += "…"
+	}
+	return snippet
+}
+
+func matchesAny(word string, terms []string) bool {
+	lower := strings.ToLower(word)
+	for _, term := range terms {
+		if strings.HasPrefix(lower, stemPrefix(term)) {
+			return true
+		}
+	}
+	return false
+}
+
+// forEachWord walks text as alternating runs of word and non-word characters.
+func forEachWord(text string, fn func(token string, isWord bool)) {
+	isWordRune := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }
+	start := 0
+	for i, r := range text {
+		if i == 0 {
+			continue
+		}
+		prev, _ := utf8.DecodeLastRuneInString(text[:i])
+		if isWordRune(prev) != isWordRune(r) {
+			fn(text[start:i], isWordRune(prev))
+			start = i
+		}
+	}
+	if start < len(text) {
+		r, _ := utf8.DecodeRuneInString(text[start:])
+		fn(text[start:], isWordRune(r))
+	}
+}
@@ -0,0 +1,50 @@
+package datasource_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"marketplace/internal/app"
+	"marketplace/internal/config"
+	"marketplace/internal/datasource"
+	"testing"
+)
+
+func TestLocalBlobStore(t *testing.T) {
+	store, err := datasource.NewLocalBlobStore(&config.Config{Images: config.Images{Dir: t.TempDir()}})
+	if err != nil {
+		t.Fatalf("failed to create blob store: %v", err)
+	}
+
+	if err := store.Put("ads/1/a.png", bytes.NewReader([]byte("data")), "image/png"); err != nil {
+		t.Fatalf("failed to put blob: %v", err)
+	}
+	rc, err := store.Open("ads/1/a.png")
+	if err != nil {
+		t.Fatalf("failed to open blob: %v", err)
+	}
+	data, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(data) != "data" {
+		t.Errorf("expected stored content, got %q", data)
+	}
+
+	if err := store.Delete("ads/1/a.png"); err != nil {
+		t.Fatalf("failed to delete blob: %v", err)
+	}
+	if _, err := store.Open("ads/1/a.png"); !errors.Is(err, app.ErrImageNotFound) {
+		t.Errorf("expected ErrImageNotFound after delete, got %v", err)
+	}
+	if err := store.Delete("ads/1/a.png"); err != nil {
+		t.Errorf("expected deleting a missing blob to succeed, got %v", err)
+	}
+
+	for _, key := range []string{"../escape.png", "/etc/passwd", "ads/../../x"} {
+		if err := store.Put(key, bytes.NewReader(nil), ""); err == nil {
+			t.Errorf("expected invalid key %q to be rejected", key)
+		}
+		if _, err := store.Open(key); !errors.Is(err, app.ErrImageNotFound) {
+			t.Errorf("expected ErrImageNotFound for %q, got %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package datasource_test
+
+import (
+	"database/sql"
+	"errors"
+	"marketplace/internal/app"
+	"marketplace/internal/datasource"
+	"strconv"
+	"testing"
+	"time"
+	"github.com/google/uuid"
+)
+
+func TestMarketRepo_Categories(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, db *sql.DB) {
+		adRepo := datasource.NewMarketRepo(db)
+
+		root, err := adRepo.SaveCategory(app.Category{Slug: "transport", Names: map[string]string{"ru": "Транспорт", "en": "Transport"}})
+		if err != nil {
+			t.Fatalf("failed to save category: %v", err)
+		}
+		child, err := adRepo.SaveCategory(app.Category{ParentID: &root.ID, Slug: "bikes", Names: map[string]string{"ru": "Велосипеды"}})
+		if err != nil {
+			t.Fatalf("failed to save category: %v", err)
+		}
+
+		got, err := adRepo.GetCategory(child.ID)
+		if err != nil {
+			t.Fatalf("failed to get category: %v", err)
+		}
+		if got.ParentID == nil || *got.ParentID != root.ID || got.Names["ru"] != "Велосипеды" {
+			t.Errorf("unexpected category: %+v", got)
+		}
+
+		child.Names["en"] = "Bikes"
+		if _, err := adRepo.UpdateCategory(child); err != nil {
+			t.Fatalf("failed to update category: %v", err)
+		}
+		categories, err := adRepo.GetCategories()
+		if err != nil {
+			t.Fatalf("failed to get categories: %v", err)
+		}
+		if len(categories) != 2 || categories[1].Names["en"] != "Bikes" {
+			t.Errorf("unexpected categories: %+v", categories)
+		}
+
+		if err := adRepo.DeleteCategory(child.ID); err != nil {
+			t.Fatalf("failed to delete category: %v", err)
+		}
+		if _, err := adRepo.GetCategory(child.ID); !errors.Is(err, app.ErrCategoryNotFound) {
+			t.Errorf("expected ErrCategoryNotFound, got %v", err)
+		}
+		if err := adRepo.DeleteCategory(child.ID); !errors.Is(err, app.ErrCategoryNotFound) {
+			t.Errorf("expected ErrCategoryNotFound on second delete, got %v", err)
+		}
+	})
+}
+
+func TestMarketRepo_CategoryFilterIncludesDescendants(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, db *sql.DB) {
+		userRepo := datasource.NewUserRepo(db)
+		adRepo := datasource.NewMarketRepo(db)
+
+		user := app.User{UUID: uuid.New(), Login: "categories", Password: "secret"}
+		if err := userRepo.SaveNewUser(user); err != nil {
+			t.Fatalf("failed to save user: %v", err)
+		}
+
+		save := func(c app.Category) app.Category {
+			saved, err := adRepo.SaveCategory(c)
+			if err != nil {
+				t.Fatalf("failed to save category: %v", err)
+			}
+			return saved
+		}
+		transport := save(app.Category{Slug: "transport", Names: map[string]string{"ru": "Транспорт"}})
+		bikes := save(app.Category{ParentID: &transport.ID, Slug: "bikes", Names: map[string]string{"ru": "Велосипеды"}})
+		kids := save(app.Category{ParentID: &bikes.ID, Slug: "kids-bikes", Names: map[string]string{"ru": "Детские"}})
+		home := save(app.Category{Slug: "home", Names: map[string]string{"ru": "Дом"}})
+
+		for i, categoryID := range []int64{transport.ID, bikes.ID, kids.ID, home.ID} {
+			_, err := adRepo.SaveAd(app.Ad{
+				UUID:        uuid.New(),
+				Title:       "Ad " + strconv.Itoa(i),
+				Description: "Some description",
+				Price:       100,
+				UserID:      user.UUID,
+				CategoryID:  categoryID,
+				Status:      app.AdStatusActive,
+				CreatedAt:   time.Now(),
+				UpdatedAt:   time.Now(),
+			})
+			if err != nil {
+				t.Fatalf("failed to save ad: %v", err)
+			}
+		}
+
+		count := func(category string) int {
+			ads, err := adRepo.GetAdsList(app.AdsListParams{
+				MaxPrice: 1000, Page: 1, Limit: 10, SortBy: "date", Order: "desc", Category: category,
+			}, "")
+			if err != nil {
+				t.Fatalf("list for category %q failed: %v", category, err)
+			}
+			for _, ad := range ads {
+				if ad.CategoryID == 0 {
+					t.Errorf("expected category_id in list item %+v", ad)
+				}
+			}
+			return len(ads)
+		}
+
+		cases := map[string]int{
+			"transport":                   3,
+			"bikes":                       2,
+			strconv.FormatInt(kids.ID, 10): 1,
+			"home":                        1,
+			"unknown":                     0,
+			"":                            4,
+		}
+		for category, expected := range cases {
+			if got := count(category); got != expected {
+				t.Errorf("category %q: expected %d ads, got %d", category, expected, got)
+			}
+		}
+
+		if hasAds, err := adRepo.CategoryHasAds(home.ID); err != nil || !hasAds {
+			t.Errorf("expected home to have ads, got %v, %v", hasAds, err)
+		}
+	})
+}
@@ -0,0 +1,224 @@
+package datasource_test
+
+import (
+	"database/sql"
+	"errors"
+	"marketplace/internal/app"
+	"marketplace/internal/datasource"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestMarketRepo_AdImages(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, db *sql.DB) {
+		userRepo := datasource.NewUserRepo(db)
+		adRepo := datasource.NewMarketRepo(db)
+
+		user := app.User{UUID: uuid.New(), Login: "galleryuser", Password: "secret"}
+		if err := userRepo.SaveNewUser(user); err != nil {
+			t.Fatalf("failed to save user: %v", err)
+		}
+
+		ad := app.Ad{
+			UUID:        uuid.New(),
+			Title:       "Gallery Ad",
+			Description: "An ad with several images",
+			Price:       10,
+			UserID:      user.UUID,
+			Status:      app.AdStatusActive,
+			CreatedAt:   time.Now(),
+			UpdatedAt:   time.Now(),
+			Images: []app.AdImage{
+				{URL: "/images/a.png", Key: "a.png", Position: 0, IsCover: true},
+				{URL: "/images/b.png", Key: "b.png", Position: 1},
+			},
+		}
+		variants := &app.ImageVariants{Thumb: "/images/c_thumb.png", Medium: "/images/c_medium.png", Large: "/images/c_large.png"}
+		saved, err := adRepo.SaveAd(ad)
+		if err != nil {
+			t.Fatalf("failed to save ad: %v", err)
+		}
+		if saved.Images[0].ID == 0 || saved.Images[1].ID == 0 {
+			t.Fatalf("expected image ids to be assigned, got %+v", saved.Images)
+		}
+
+		added, err := adRepo.AddAdImage(ad.UUID.String(), app.AdImage{URL: "/images/c.png", Key: "c.png", Position: 2, Variants: variants})
+		if err != nil {
+			t.Fatalf("failed to add image: %v", err)
+		}
+		if _, err := adRepo.AddAdImage(uuid.NewString(), app.AdImage{URL: "/images/d.png", Position: 0}); !errors.Is(err, app.ErrAdNotFound) {
+			t.Errorf("expected ErrAdNotFound for unknown ad, got %v", err)
+		}
+
+		found, err := adRepo.GetAdByUUID(ad.UUID.String())
+		if err != nil {
+			t.Fatalf("failed to get ad: %v", err)
+		}
+		if len(found.Images) != 3 || found.Images[2].ID != added.ID || found.Images[1].Key != "b.png" || found.Images[1].Variants != nil {
+			t.Fatalf("unexpected images: %+v", found.Images)
+		}
+
+		// drop the first image, move the last one to the front and make it the cover
+		err = adRepo.SetAdImages(ad.UUID.String(), []app.AdImage{
+			{ID: added.ID, Position: 0, IsCover: true},
+			{ID: saved.Images[1].ID, Position: 1},
+		})
+		if err != nil {
+			t.Fatalf("failed to set images: %v", err)
+		}
+		found, err = adRepo.GetAdByUUID(ad.UUID.String())
+		if err != nil {
+			t.Fatalf("failed to get ad: %v", err)
+		}
+		if len(found.Images) != 2 || found.Images[0].ID != added.ID || !found.Images[0].IsCover || found.Images[1].IsCover {
+			t.Fatalf("unexpected images after reorder: %+v", found.Images)
+		}
+		for key, expected := range map[string]bool{"c.png": true, "a.png": false} {
+			if inUse, err := adRepo.ImageKeyInUse(key); err != nil || inUse != expected {
+				t.Errorf("expected %s in use to be %v, got %v %v", key, expected, inUse, err)
+			}
+		}
+		if err := adRepo.SetAdImages(ad.UUID.String(), []app.AdImage{{ID: saved.Images[0].ID, Position: 0}}); !errors.Is(err, app.ErrImageNotFound) {
+			t.Errorf("expected ErrImageNotFound for a deleted image, got %v", err)
+		}
+
+		ads, err := adRepo.GetAdsList(app.AdsListParams{MaxPrice: 100, Page: 1, Limit: 10}, "")
+		if err != nil {
+			t.Fatalf("failed to get ads list: %v", err)
+		}
+		if len(ads) != 1 || ads[0].ImageURL != "/images/c.png" || ads[0].Images == nil || *ads[0].Images != *variants {
+			t.Errorf("expected the cover and its variants in the list, got %+v", ads)
+		}
+
+		if err := adRepo.DeleteAd(ad.UUID.String()); err != nil {
+			t.Fatalf("failed to delete ad: %v", err)
+		}
+		var left int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM ad_images`).Scan(&left); err != nil {
+			t.Fatalf("failed to count images: %v", err)
+		}
+		if left != 0 {
+			t.Errorf("expected images to be deleted with the ad, %d left", left)
+		}
+	})
+}
+
+func TestMarketRepo_ImageKeyBelongsToOneAd(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, db *sql.DB) {
+		userRepo := datasource.NewUserRepo(db)
+		adRepo := datasource.NewMarketRepo(db)
+
+		user := app.User{UUID: uuid.New(), Login: "sharinguser", Password: "secret"}
+		if err := userRepo.SaveNewUser(user); err != nil {
+			t.Fatalf("failed to save user: %v", err)
+		}
+		newAd := func(images ...app.AdImage) app.Ad {
+			return app.Ad{
+				UUID:      uuid.New(),
+				Title:     "Shared image",
+				Price:     10,
+				UserID:    user.UUID,
+				Status:    app.AdStatusActive,
+				CreatedAt: time.Now(),
+				UpdatedAt: time.Now(),
+				Images:    images,
+			}
+		}
+
+		first, err := adRepo.SaveAd(newAd(app.AdImage{URL: "/images/a.png", Key: "a.png", IsCover: true}))
+		if err != nil {
+			t.Fatalf("failed to save ad: %v", err)
+		}
+		if _, err := adRepo.SaveAd(newAd(app.AdImage{URL: "/images/a.png", Key: "a.png", IsCover: true})); !errors.Is(err, app.ErrImageInUse) {
+			t.Errorf("expected ErrImageInUse when saving an ad with an attached image, got %v", err)
+		}
+		second, err := adRepo.SaveAd(newAd())
+		if err != nil {
+			t.Fatalf("failed to save ad: %v", err)
+		}
+		if _, err := adRepo.AddAdImage(second.UUID.String(), app.AdImage{URL: "/images/a.png", Key: "a.png"}); !errors.Is(err, app.ErrImageInUse) {
+			t.Errorf("expected ErrImageInUse when adding an attached image, got %v", err)
+		}
+
+		// images without a stored file may repeat
+		for _, ad := range []app.Ad{first, second} {
+			if _, err := adRepo.AddAdImage(ad.UUID.String(), app.AdImage{URL: "https://example.com/x.png", Position: 1}); err != nil {
+				t.Errorf("failed to add an external image: %v", err)
+			}
+		}
+		var count int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM ad_images WHERE blob_key = 'a.png'`).Scan(&count); err != nil {
+			t.Fatalf("failed to count images: %v", err)
+		}
+		if count != 1 {
+			t.Errorf("expected the image to be attached once, got %d", count)
+		}
+	})
+}
+
+func TestMigrator_AdImagesRoundTrip(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, db *sql.DB) {
+		userRepo := datasource.NewUserRepo(db)
+		adRepo := datasource.NewMarketRepo(db)
+
+		user := app.User{UUID: uuid.New(), Login: "legacyuser", Password: "secret"}
+		if err := userRepo.SaveNewUser(user); err != nil {
+			t.Fatalf("failed to save user: %v", err)
+		}
+		ad := app.Ad{
+			UUID:      uuid.New(),
+			Title:     "Legacy Ad",
+			Price:     5,
+			UserID:    user.UUID,
+			Status:    app.AdStatusActive,
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+			Images: []app.AdImage{
+				{URL: "/images/other.png", Position: 0},
+				{URL: "/images/cover.png", Position: 1, IsCover: true},
+			},
+		}
+		if _, err := adRepo.SaveAd(ad); err != nil {
+			t.Fatalf("failed to save ad: %v", err)
+		}
+
+		migrator, err := datasource.NewMigrator(db)
+		if err != nil {
+			t.Fatalf("failed to load migrations: %v", err)
+		}
+		// rolling the gallery back keeps only the cover in the old img column
+		statuses, err := migrator.Status()
+		if err != nil {
+			t.Fatalf("status failed: %v", err)
+		}
+		steps := 0
+		for _, st := range statuses {
+			if st.Applied && st.Version >= 5 {
+				steps++
+			}
+		}
+		if _, err := migrator.Down(steps); err != nil {
+			t.Fatalf("down failed: %v", err)
+		}
+		var img string
+		if err := db.QueryRow(`SELECT img FROM ads`).Scan(&img); err != nil {
+			t.Fatalf("failed to read img: %v", err)
+		}
+		if img != "/images/cover.png" {
+			t.Errorf("expected the cover in img, got %q", img)
+		}
+
+		if _, err := migrator.Up(); err != nil {
+			t.Fatalf("up failed: %v", err)
+		}
+		found, err := adRepo.GetAdByUUID(ad.UUID.String())
+		if err != nil {
+			t.Fatalf("failed to get ad: %v", err)
+		}
+		if len(found.Images) != 1 || found.Images[0].URL != "/images/cover.png" || !found.Images[0].IsCover {
+			t.Errorf("expected img to become the cover, got %+v", found.Images)
+		}
+	})
+}
@@ -0,0 +1,38 @@
+package datasource_test
+
+import (
+	"marketplace/internal/app"
+	"marketplace/internal/config"
+	"marketplace/internal/datasource"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"go.uber.org/zap"
+)
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	mailer, err := datasource.NewFileMailer(&config.Config{Mail: config.Mail{Dir: dir, From: "no-reply@test"}}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create mailer: %v", err)
+	}
+
+	if err := mailer.Send(app.Message{To: "alice", Subject: "Password reset", Body: "open the link"}); err != nil {
+		t.Fatalf("failed to send mail: %v", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("expected one mail file, got %v", files)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("failed to read mail: %v", err)
+	}
+	for _, part := range []string{"From: no-reply@test", "To: alice", "Subject: Password reset", "open the link"} {
+		if !strings.Contains(string(data), part) {
+			t.Errorf("expected mail to contain %q, got %q", part, data)
+		}
+	}
+}
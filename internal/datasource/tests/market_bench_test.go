@@ -0,0 +1,156 @@
+package datasource_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"marketplace/internal/app"
+	"marketplace/internal/config"
+	"marketplace/internal/datasource"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// countingDriver counts the statements sent to SQLite.
+type countingDriver struct {
+	driver.Driver
+	statements atomic.Int64
+}
+
+type countingConn struct {
+	driver.Conn
+	statements *atomic.Int64
+}
+
+func (d *countingDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{Conn: conn, statements: &d.statements}, nil
+}
+
+func (c countingConn) Prepare(query string) (driver.Stmt, error) {
+	c.statements.Add(1)
+	return c.Conn.Prepare(query)
+}
+
+func (c countingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.statements.Add(1)
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+func (c countingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.statements.Add(1)
+	return c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+}
+
+func (c countingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+var (
+	registerCounting sync.Once
+	counting         = &countingDriver{}
+)
+
+// openCountingDB opens a migrated in-memory SQLite database whose statements are counted.
+func openCountingDB(tb testing.TB) *sql.DB {
+	registerCounting.Do(func() {
+		base, err := datasource.NewStorage(&config.Config{Db: config.Database{Driver: "sqlite3"}})
+		if err != nil {
+			tb.Fatalf("failed to open sqlite: %v", err)
+		}
+		counting.Driver = base.Driver()
+		base.Close()
+		sql.Register("sqlite3_counting", counting)
+	})
+	db, err := sql.Open("sqlite3_counting", "file:"+tb.Name()+"?mode=memory&cache=shared")
+	if err != nil {
+		tb.Fatalf("failed to open counting DB: %v", err)
+	}
+	tb.Cleanup(func() { db.Close() })
+	migrator, err := datasource.NewMigrator(db)
+	if err != nil {
+		tb.Fatalf("failed to load migrations: %v", err)
+	}
+	if _, err := migrator.Up(); err != nil {
+		tb.Fatalf("failed to apply migrations: %v", err)
+	}
+	return db
+}
+
+// seedAds stores n active ads, each from its own user, with a cover image.
+func seedAds(tb testing.TB, db *sql.DB, n int) {
+	userRepo := datasource.NewUserRepo(db)
+	adRepo := datasource.NewMarketRepo(db)
+	base := time.Now()
+	for i := 0; i < n; i++ {
+		user := app.User{UUID: uuid.New(), Login: "seller" + strconv.Itoa(i), Password: "secret"}
+		if err := userRepo.SaveNewUser(user); err != nil {
+			tb.Fatalf("failed to save user: %v", err)
+		}
+		_, err := adRepo.SaveAd(app.Ad{
+			UUID:        uuid.New(),
+			Title:       "Ad " + strconv.Itoa(i),
+			Description: "Benchmark ad",
+			Price:       float64(i + 1),
+			UserID:      user.UUID,
+			Status:      app.AdStatusActive,
+			CreatedAt:   base.Add(time.Duration(i) * time.Second),
+			UpdatedAt:   base,
+			Images:      []app.AdImage{{URL: "/images/" + strconv.Itoa(i) + ".png", IsCover: true}},
+		})
+		if err != nil {
+			tb.Fatalf("failed to save ad: %v", err)
+		}
+	}
+}
+
+func TestMarketRepo_GetAdsListSingleQuery(t *testing.T) {
+	db := openCountingDB(t)
+	seedAds(t, db, 100)
+	adRepo := datasource.NewMarketRepo(db)
+
+	for _, limit := range []int{1, 10, 100} {
+		before := counting.statements.Load()
+		ads, err := adRepo.GetAdsList(app.AdsListParams{MaxPrice: 1000, Page: 1, Limit: limit}, "")
+		if err != nil {
+			t.Fatalf("failed to get ads list: %v", err)
+		}
+		if queries := counting.statements.Load() - before; queries != 1 {
+			t.Errorf("limit %d: expected 1 query, got %d", limit, queries)
+		}
+		if len(ads) != limit || ads[0].Username == "" {
+			t.Errorf("limit %d: expected %d ads with usernames, got %+v", limit, limit, ads[0])
+		}
+	}
+}
+
+func BenchmarkMarketRepo_GetAdsList(b *testing.B) {
+	db := openCountingDB(b)
+	seedAds(b, db, 1000)
+	adRepo := datasource.NewMarketRepo(db)
+
+	for _, limit := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("limit=%d", limit), func(b *testing.B) {
+			params := app.AdsListParams{MaxPrice: 100000, Page: 1, Limit: limit}
+			before := counting.statements.Load()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := adRepo.GetAdsList(params, ""); err != nil {
+					b.Fatalf("failed to get ads list: %v", err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(counting.statements.Load()-before)/float64(b.N), "queries/op")
+			b.ReportMetric(float64(b.Elapsed().Microseconds())/float64(b.N*limit), "µs/ad")
+		})
+	}
+}
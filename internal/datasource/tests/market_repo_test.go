@@ -5,92 +5,463 @@ import (
 	"marketplace/internal/datasource"
 	"testing"
 	"time"
-	_ "github.com/mattn/go-sqlite3"
 	"github.com/google/uuid"
 	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
 )
-func setupMarketTestDB(t *testing.T) *sql.DB {
-	dsn := "file:testdb?mode=memory&cache=shared"
-	db, err := sql.Open("sqlite3", dsn)
-	if err != nil {
-		t.Fatalf("failed to open test DB: %v", err)
-	}
-
-	_, err = db.Exec(`
-	CREATE TABLE IF NOT EXISTS users (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		uuid TEXT NOT NULL UNIQUE,
-		login TEXT NOT NULL,
-		password TEXT NOT NULL
-	);`)
-	if err != nil {
-		t.Fatalf("failed to create users table: %v", err)
-	}
-
-	_, err = db.Exec(`
-	CREATE TABLE IF NOT EXISTS ads (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		uuid TEXT NOT NULL UNIQUE,
-		title TEXT NOT NULL,
-		description TEXT NOT NULL,
-		img TEXT,
-		user_uuid TEXT NOT NULL,
-		price REAL NOT NULL,
-		created_at DATETIME NOT NULL,
-		FOREIGN KEY(user_uuid) REFERENCES users(uuid)
-	);`)
-	if err != nil {
-		t.Fatalf("failed to create ads table: %v", err)
-	}
-
-	return db
+func TestMarketRepo_SaveAndGetAds(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, db *sql.DB) {
+		userRepo := datasource.NewUserRepo(db)
+		adRepo := datasource.NewMarketRepo(db)
+
+		user := app.User{
+			UUID:     uuid.New(),
+			Login:    "testuser",
+			Password: "secret",
+		}
+		err := userRepo.SaveNewUser(user)
+		if err != nil {
+			t.Fatalf("failed to save user: %v", err)
+		}
+
+		ad := app.Ad{
+			ID:          0,
+			UUID:        uuid.New(),
+			Title:       "Test Ad",
+			Description: "This is a test ad",
+			Price:       9.99,
+			UserID:      user.UUID,
+			Status:      app.AdStatusActive,
+			CreatedAt:   time.Now(),
+			UpdatedAt:   time.Now(),
+		}
+
+		_, err = adRepo.SaveAd(ad)
+		if err != nil {
+			t.Fatalf("failed to save ad: %v", err)
+		}
+
+		ads, err := adRepo.GetAdsList(app.AdsListParams{
+			MinPrice: 0,
+			MaxPrice: 100,
+			Page:     1,
+			Limit:    10,
+			SortBy:   "created_at",
+			Order:    "asc",
+		}, user.UUID.String())
+		if err != nil {
+			t.Fatalf("failed to get ads list: %v", err)
+		}
+
+		if len(ads) != 1 {
+			t.Errorf("expected 1 ad, got %d", len(ads))
+		}
+	})
 }
 
+func TestMarketRepo_UpdateDeleteAd(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, db *sql.DB) {
+		userRepo := datasource.NewUserRepo(db)
+		adRepo := datasource.NewMarketRepo(db)
 
-func TestMarketRepo_SaveAndGetAds(t *testing.T) {
-	db := setupMarketTestDB(t)
-	userRepo := datasource.NewUserRepo(db)
-	adRepo := datasource.NewMarketRepo(db, userRepo)
-
-	user := app.User{
-		UUID:     uuid.New(),
-		Login:    "testuser",
-		Password: "secret",
-	}
-	err := userRepo.SaveNewUser(user)
-	if err != nil {
-		t.Fatalf("failed to save user: %v", err)
-	}
-
-	ad := app.Ad{
-		ID:          0,
-		UUID:        uuid.New(),
-		Title:       "Test Ad",
-		Description: "This is a test ad",
-		Price:       9.99,
-		ImageURL:    "img.jpg",
-		UserID:      user.UUID,
-		CreatedAt:   time.Now(),
-	}
-
-	_, err = adRepo.SaveAd(ad)
-	if err != nil {
-		t.Fatalf("failed to save ad: %v", err)
-	}
-
-	ads, err := adRepo.GetAdsList(app.AdsListParams{
-		MinPrice: 0,
-		MaxPrice: 100,
-		Page:     1,
-		Limit:    10,
-		SortBy:   "created_at",
-		Order:    "asc",
-	}, user.UUID.String())
-	if err != nil {
-		t.Fatalf("failed to get ads list: %v", err)
-	}
-
-	if len(ads) != 1 {
-		t.Errorf("expected 1 ad, got %d", len(ads))
-	}
-}
\ No newline at end of file
+		user := app.User{
+			UUID:     uuid.New(),
+			Login:    "lifecycleuser",
+			Password: "secret",
+		}
+		if err := userRepo.SaveNewUser(user); err != nil {
+			t.Fatalf("failed to save user: %v", err)
+		}
+
+		ad := app.Ad{
+			UUID:        uuid.New(),
+			Title:       "Lifecycle Ad",
+			Description: "This ad will be closed",
+			Price:       15,
+			UserID:      user.UUID,
+			Status:      app.AdStatusActive,
+			CreatedAt:   time.Now(),
+			UpdatedAt:   time.Now(),
+		}
+		if _, err := adRepo.SaveAd(ad); err != nil {
+			t.Fatalf("failed to save ad: %v", err)
+		}
+
+		found, err := adRepo.GetAdByUUID(ad.UUID.String())
+		if err != nil {
+			t.Fatalf("failed to get ad: %v", err)
+		}
+		if found.Username != user.Login {
+			t.Errorf("expected username %s, got %s", user.Login, found.Username)
+		}
+
+		found.Status = app.AdStatusSold
+		found.UpdatedAt = time.Now()
+		if _, err := adRepo.UpdateAd(found); err != nil {
+			t.Fatalf("failed to update ad: %v", err)
+		}
+
+		ads, err := adRepo.GetAdsList(app.AdsListParams{MinPrice: 15, MaxPrice: 15, Page: 1, Limit: 10}, "")
+		if err != nil {
+			t.Fatalf("failed to get ads list: %v", err)
+		}
+		if len(ads) != 0 {
+			t.Errorf("expected sold ad to be hidden from the list, got %d ads", len(ads))
+		}
+
+		if err := adRepo.DeleteAd(ad.UUID.String()); err != nil {
+			t.Fatalf("failed to delete ad: %v", err)
+		}
+		if _, err := adRepo.GetAdByUUID(ad.UUID.String()); !errors.Is(err, app.ErrAdNotFound) {
+			t.Errorf("expected ErrAdNotFound after delete, got %v", err)
+		}
+	})
+}
+
+func TestMarketRepo_GetUserAds(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, db *sql.DB) {
+		userRepo := datasource.NewUserRepo(db)
+		adRepo := datasource.NewMarketRepo(db)
+
+		user := app.User{UUID: uuid.New(), Login: "seller", Password: "secret"}
+		other := app.User{UUID: uuid.New(), Login: "neighbour", Password: "secret"}
+		for _, u := range []app.User{user, other} {
+			if err := userRepo.SaveNewUser(u); err != nil {
+				t.Fatalf("failed to save user: %v", err)
+			}
+		}
+
+		base := time.Now().Add(-time.Hour)
+		statuses := []string{app.AdStatusActive, app.AdStatusSold, app.AdStatusClosed}
+		for i, status := range statuses {
+			ad := app.Ad{
+				UUID:        uuid.New(),
+				Title:       "Ad " + status,
+				Description: "One of the seller's ads",
+				Price:       10,
+				UserID:      user.UUID,
+				Status:      status,
+				CreatedAt:   base.Add(time.Duration(i) * time.Minute),
+				UpdatedAt:   base,
+			}
+			if i == 0 {
+				ad.Images = []app.AdImage{{Key: "ads/a.jpg", URL: "/images/ads/a.jpg", IsCover: true}}
+			}
+			if i == 1 {
+				ad.Images = []app.AdImage{
+					{Key: "ads/b.jpg", URL: "/images/ads/b.jpg", Position: 0, IsCover: true},
+					{Key: "ads/c.jpg", URL: "/images/ads/c.jpg", Position: 1},
+				}
+			}
+			if _, err := adRepo.SaveAd(ad); err != nil {
+				t.Fatalf("failed to save ad: %v", err)
+			}
+		}
+		foreign := app.Ad{UUID: uuid.New(), Title: "Foreign", Description: "Not the seller's", Price: 10, UserID: other.UUID, Status: app.AdStatusActive, CreatedAt: base, UpdatedAt: base}
+		if _, err := adRepo.SaveAd(foreign); err != nil {
+			t.Fatalf("failed to save ad: %v", err)
+		}
+
+		ads, err := adRepo.GetUserAds(user.UUID.String(), 10, 0)
+		if err != nil {
+			t.Fatalf("failed to get user ads: %v", err)
+		}
+		if len(ads) != 3 || ads[0].Status != app.AdStatusClosed || ads[2].Status != app.AdStatusActive {
+			t.Fatalf("expected the seller's ads in every status newest first, got %+v", ads)
+		}
+		if len(ads[2].Images) != 1 || ads[2].Images[0].Key != "ads/a.jpg" {
+			t.Errorf("expected the ad images to be loaded, got %+v", ads[2].Images)
+		}
+		if len(ads[1].Images) != 2 || ads[1].Images[0].Key != "ads/b.jpg" || ads[1].Images[1].Key != "ads/c.jpg" {
+			t.Errorf("expected each ad to get its own gallery in order, got %+v", ads[1].Images)
+		}
+		if ads[0].Images == nil || len(ads[0].Images) != 0 {
+			t.Errorf("expected an empty gallery, got %+v", ads[0].Images)
+		}
+		if page, _ := adRepo.GetUserAds(user.UUID.String(), 2, 2); len(page) != 1 {
+			t.Errorf("expected 1 ad on the second page, got %d", len(page))
+		}
+		total, err := adRepo.CountUserAds(user.UUID.String())
+		if err != nil {
+			t.Fatalf("failed to count user ads: %v", err)
+		}
+		if total != 3 {
+			t.Errorf("expected 3 ads, got %d", total)
+		}
+	})
+}
+
+func TestMarketRepo_BannedUsersAdsHidden(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, db *sql.DB) {
+		userRepo := datasource.NewUserRepo(db)
+		adRepo := datasource.NewMarketRepo(db)
+
+		users := map[string]app.User{}
+		for _, login := range []string{"honest", "suspended", "banned"} {
+			users[login] = app.User{UUID: uuid.New(), Login: login, Password: "secret"}
+			if err := userRepo.SaveNewUser(users[login]); err != nil {
+				t.Fatalf("failed to save user: %v", err)
+			}
+			ad := app.Ad{UUID: uuid.New(), Title: "Ad by " + login, Description: "Status test ad", Price: 10, UserID: users[login].UUID, Status: app.AdStatusActive, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+			if _, err := adRepo.SaveAd(ad); err != nil {
+				t.Fatalf("failed to save ad: %v", err)
+			}
+		}
+		until := time.Now().Add(time.Hour)
+		userRepo.SetStatus(users["suspended"].UUID.String(), app.UserStatusSuspended, "", &until)
+		userRepo.SetStatus(users["banned"].UUID.String(), app.UserStatusBanned, "fraud", nil)
+
+		params := app.AdsListParams{MaxPrice: 100, Page: 1, Limit: 10, SortBy: "date", Order: "asc"}
+		ads, err := adRepo.GetAdsList(params, "")
+		if err != nil {
+			t.Fatalf("failed to get ads list: %v", err)
+		}
+		titles := []string{}
+		for _, ad := range ads {
+			titles = append(titles, ad.Title)
+		}
+		if strings.Join(titles, ",") != "Ad by honest,Ad by suspended" {
+			t.Errorf("expected the banned user's ad to be hidden, got %v", titles)
+		}
+		if total, _ := adRepo.CountAds(params); total != 2 {
+			t.Errorf("expected 2 ads, got %d", total)
+		}
+	})
+}
+
+func TestMarketRepo_Search(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, db *sql.DB) {
+		userRepo := datasource.NewUserRepo(db)
+		adRepo := datasource.NewMarketRepo(db)
+
+		user := app.User{UUID: uuid.New(), Login: "searcher", Password: "secret"}
+		if err := userRepo.SaveNewUser(user); err != nil {
+			t.Fatalf("failed to save user: %v", err)
+		}
+
+		seed := []struct{ title, description string }{
+			{"Велосипед детский", "Почти новый, к нему в подарок идёт самокат и шлем"},
+			{"Самокат зеленый", "Самокат, пользовались 1 год, состояние отличное"},
+			{"Laptop for sale", "Powerful laptops with good batteries"},
+			{"<script>alert(1)</script> Гитара", "Гитара & чехол <img src=x onerror=alert(1)>"},
+		}
+		base := time.Now()
+		for i, s := range seed {
+			_, err := adRepo.SaveAd(app.Ad{
+				UUID:        uuid.New(),
+				Title:       s.title,
+				Description: s.description,
+				Price:       100,
+				UserID:      user.UUID,
+				Status:      app.AdStatusActive,
+				CreatedAt:   base.Add(time.Duration(i) * time.Minute),
+				UpdatedAt:   base,
+			})
+			if err != nil {
+				t.Fatalf("failed to save ad: %v", err)
+			}
+		}
+
+		list := func(q, sortBy string) []app.AdsListResponse {
+			ads, err := adRepo.GetAdsList(app.AdsListParams{
+				MaxPrice: 1000, Page: 1, Limit: 10, SortBy: sortBy, Order: "asc", Query: q,
+			}, "")
+			if err != nil {
+				t.Fatalf("search %q failed: %v", q, err)
+			}
+			return ads
+		}
+
+		ads := list("самокаты", "relevance")
+		if len(ads) != 2 {
+			t.Fatalf("expected 2 ads for 'самокаты', got %d", len(ads))
+		}
+		if ads[0].Title != "Самокат зеленый" {
+			t.Errorf("expected title match to rank first, got %q", ads[0].Title)
+		}
+		if ads[0].Snippet == nil || !strings.Contains(ads[0].Snippet.Title, "<mark>") {
+			t.Errorf("expected highlighted title snippet, got %+v", ads[0].Snippet)
+		}
+
+		ads = list("САМОКАТ велосипед", "date")
+		if len(ads) != 1 || ads[0].Title != "Велосипед детский" {
+			t.Errorf("expected only the bicycle ad to match both terms, got %+v", ads)
+		}
+
+		ads = list("laptop", "relevance")
+		if len(ads) != 1 {
+			t.Fatalf("expected 1 ad for 'laptop', got %d", len(ads))
+		}
+		if !strings.Contains(ads[0].Snippet.Title, "<mark>Laptop</mark>") {
+			t.Errorf("expected Laptop to be highlighted, got %q", ads[0].Snippet.Title)
+		}
+
+		if ads := list("холодильник", "relevance"); len(ads) != 0 {
+			t.Errorf("expected no ads for unrelated query, got %d", len(ads))
+		}
+		if ads := list("", "date"); len(ads) != 4 || ads[0].Snippet != nil {
+			t.Errorf("expected all 4 ads without snippets when q is empty, got %d", len(ads))
+		}
+
+		// snippets are HTML, so the ad text in them is escaped
+		checkEscaped := func(ads []app.AdsListResponse) {
+			t.Helper()
+			if len(ads) != 1 || ads[0].Snippet == nil {
+				t.Fatalf("expected 1 ad with a snippet, got %+v", ads)
+			}
+			title, description := ads[0].Snippet.Title, ads[0].Snippet.Description
+			if strings.Contains(title, "<script>") || !strings.Contains(title, "&lt;script&gt;") || !strings.Contains(title, "<mark>Гитара</mark>") {
+				t.Errorf("expected an escaped title with a mark, got %q", title)
+			}
+			if strings.Contains(description, "<img") || !strings.Contains(description, "&amp;") {
+				t.Errorf("expected an escaped description, got %q", description)
+			}
+		}
+		checkEscaped(list("гитара", "relevance"))
+		if _, err := db.Exec(`DROP TABLE IF EXISTS ads_fts`); err == nil {
+			// without the index the snippets are made by the LIKE fallback
+			adRepo = datasource.NewMarketRepo(db)
+			checkEscaped(list("гитара", "relevance"))
+		}
+	})
+}
+
+func TestMarketRepo_GetAdsListKeyset(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, db *sql.DB) {
+		userRepo := datasource.NewUserRepo(db)
+		adRepo := datasource.NewMarketRepo(db)
+
+		user := app.User{UUID: uuid.New(), Login: "scrolluser", Password: "secret"}
+		if err := userRepo.SaveNewUser(user); err != nil {
+			t.Fatalf("failed to save user: %v", err)
+		}
+		// pairs of ads share the creation time and the price, so only the id tells them apart
+		base := time.Now().Truncate(time.Second)
+		save := func(title string, price float64, createdAt time.Time) {
+			_, err := adRepo.SaveAd(app.Ad{
+				UUID:        uuid.New(),
+				Title:       title,
+				Description: "Keyset pagination test ad",
+				Price:       price,
+				UserID:      user.UUID,
+				Status:      app.AdStatusActive,
+				CreatedAt:   createdAt,
+				UpdatedAt:   createdAt,
+			})
+			if err != nil {
+				t.Fatalf("failed to save ad: %v", err)
+			}
+		}
+		for i := 0; i < 6; i++ {
+			save("ad "+strconv.Itoa(i), float64(10+i/2), base.Add(time.Duration(i/2)*time.Minute))
+		}
+
+		scroll := func(sortBy, order string, during func()) []string {
+			params := app.AdsListParams{MaxPrice: 1000, Page: 1, Limit: 2, SortBy: sortBy, Order: order}
+			var titles []string
+			for page := 0; page < 10; page++ {
+				ads, err := adRepo.GetAdsList(params, "")
+				if err != nil {
+					t.Fatalf("failed to get ads list: %v", err)
+				}
+				for _, ad := range ads {
+					titles = append(titles, ad.Title)
+				}
+				if len(ads) < params.Limit {
+					return titles
+				}
+				last := ads[len(ads)-1]
+				params.After = &app.AdsCursor{SortBy: sortBy, Order: order, Price: last.Price, CreatedAt: last.CreatedAt, ID: last.ID}
+				if during != nil {
+					during()
+					during = nil
+				}
+			}
+			t.Fatal("scrolling did not stop")
+			return nil
+		}
+
+		if got := strings.Join(scroll("date", "asc", nil), ","); got != "ad 0,ad 1,ad 2,ad 3,ad 4,ad 5" {
+			t.Errorf("unexpected ascending order: %s", got)
+		}
+		if got := strings.Join(scroll("price", "desc", nil), ","); got != "ad 5,ad 4,ad 3,ad 2,ad 1,ad 0" {
+			t.Errorf("unexpected descending order: %s", got)
+		}
+		// a new ad on top of the feed neither shifts nor repeats the pages already loaded
+		got := scroll("date", "desc", func() { save("fresh", 50, base.Add(time.Hour)) })
+		if strings.Join(got, ",") != "ad 5,ad 4,ad 3,ad 2,ad 1,ad 0" {
+			t.Errorf("unexpected feed while inserting: %v", got)
+		}
+	})
+}
+
+func TestMarketRepo_CountAds(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, db *sql.DB) {
+		userRepo := datasource.NewUserRepo(db)
+		adRepo := datasource.NewMarketRepo(db)
+
+		user := app.User{UUID: uuid.New(), Login: "countuser", Password: "secret"}
+		if err := userRepo.SaveNewUser(user); err != nil {
+			t.Fatalf("failed to save user: %v", err)
+		}
+		seed := []struct {
+			title  string
+			price  float64
+			status string
+		}{
+			{"Red bike", 10, app.AdStatusActive},
+			{"Blue bike", 20, app.AdStatusActive},
+			{"Green bike", 30, app.AdStatusSold},
+			{"Old laptop", 40, app.AdStatusActive},
+			{"New laptop", 50, app.AdStatusActive},
+		}
+		for _, s := range seed {
+			_, err := adRepo.SaveAd(app.Ad{
+				UUID:        uuid.New(),
+				Title:       s.title,
+				Description: "Counted ad",
+				Price:       s.price,
+				UserID:      user.UUID,
+				Status:      s.status,
+				CreatedAt:   time.Now(),
+				UpdatedAt:   time.Now(),
+			})
+			if err != nil {
+				t.Fatalf("failed to save ad: %v", err)
+			}
+		}
+
+		tests := []struct {
+			name     string
+			params   app.AdsListParams
+			expected int
+		}{
+			{"all active", app.AdsListParams{MaxPrice: 1000}, 4},
+			{"price range", app.AdsListParams{MinPrice: 15, MaxPrice: 45}, 2},
+			{"search", app.AdsListParams{MaxPrice: 1000, Query: "laptop"}, 2},
+			{"search and price", app.AdsListParams{MaxPrice: 1000, MinPrice: 15, Query: "bike"}, 1},
+		}
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				total, err := adRepo.CountAds(tc.params)
+				if err != nil {
+					t.Fatalf("failed to count ads: %v", err)
+				}
+				if total != tc.expected {
+					t.Errorf("expected %d ads, got %d", tc.expected, total)
+				}
+				// the count covers every page the list query can return
+				tc.params.Page, tc.params.Limit = 2, 1
+				ads, err := adRepo.GetAdsList(tc.params, "")
+				if err != nil {
+					t.Fatalf("failed to get ads list: %v", err)
+				}
+				if len(ads) != min(1, total-1) {
+					t.Errorf("expected the second page to hold %d ads, got %d", min(1, total-1), len(ads))
+				}
+			})
+		}
+	})
+}
@@ -0,0 +1,194 @@
+package datasource_test
+
+import (
+	"database/sql"
+	"marketplace/internal/datasource"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestMigrator_UpDownStatus(t *testing.T) {
+	forEachEmptyDriver(t, func(t *testing.T, db *sql.DB) {
+		migrator, err := datasource.NewMigrator(db)
+		if err != nil {
+			t.Fatalf("failed to load migrations: %v", err)
+		}
+
+		applied, err := migrator.Up()
+		if err != nil {
+			t.Fatalf("up failed: %v", err)
+		}
+		statuses, err := migrator.Status()
+		if err != nil {
+			t.Fatalf("status failed: %v", err)
+		}
+		expected := 0
+		for _, st := range statuses {
+			if st.Skipped {
+				if st.Requires == "" {
+					t.Errorf("migration %d_%s skipped without a requirement", st.Version, st.Name)
+				}
+				continue
+			}
+			expected++
+			if !st.Applied {
+				t.Errorf("expected migration %d_%s to be applied", st.Version, st.Name)
+			}
+		}
+		if applied != expected {
+			t.Errorf("expected %d applied migrations, got %d", expected, applied)
+		}
+		if !tableExists(db, "users") || !tableExists(db, "ads") {
+			t.Fatal("expected users and ads tables after up")
+		}
+
+		applied, err = migrator.Up()
+		if err != nil || applied != 0 {
+			t.Errorf("expected second up to be a no-op, got %d, %v", applied, err)
+		}
+
+		rolledBack, err := migrator.Down(len(statuses))
+		if err != nil {
+			t.Fatalf("down failed: %v", err)
+		}
+		if rolledBack != expected {
+			t.Errorf("expected %d rolled back migrations, got %d", expected, rolledBack)
+		}
+		if tableExists(db, "users") || tableExists(db, "ads") {
+			t.Error("expected tables to be dropped after full down")
+		}
+	})
+}
+
+func TestMigrator_ChecksumMismatch(t *testing.T) {
+	forEachEmptyDriver(t, func(t *testing.T, db *sql.DB) {
+		fsys := fstest.MapFS{
+			"m/0001_things.up.sql":   {Data: []byte(`CREATE TABLE things (id INTEGER PRIMARY KEY);`)},
+			"m/0001_things.down.sql": {Data: []byte(`DROP TABLE things;`)},
+		}
+		migrator, err := datasource.NewMigratorFromFS(db, fsys, "m")
+		if err != nil {
+			t.Fatalf("failed to load migrations: %v", err)
+		}
+		if _, err := migrator.Up(); err != nil {
+			t.Fatalf("up failed: %v", err)
+		}
+
+		fsys["m/0001_things.up.sql"] = &fstest.MapFile{Data: []byte(`CREATE TABLE things (id INTEGER PRIMARY KEY, name TEXT);`)}
+		migrator, err = datasource.NewMigratorFromFS(db, fsys, "m")
+		if err != nil {
+			t.Fatalf("failed to load migrations: %v", err)
+		}
+		_, err = migrator.Up()
+		if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+			t.Errorf("expected checksum mismatch error, got %v", err)
+		}
+	})
+}
+
+func TestMigrator_FailedMigrationIsRolledBack(t *testing.T) {
+	forEachEmptyDriver(t, func(t *testing.T, db *sql.DB) {
+		fsys := fstest.MapFS{
+			"m/0001_ok.up.sql":     {Data: []byte(`CREATE TABLE ok_table (id INTEGER PRIMARY KEY);`)},
+			"m/0002_broken.up.sql": {Data: []byte(`CREATE TABLE half_done (id INTEGER); THIS IS NOT SQL;`)},
+		}
+		migrator, err := datasource.NewMigratorFromFS(db, fsys, "m")
+		if err != nil {
+			t.Fatalf("failed to load migrations: %v", err)
+		}
+		applied, err := migrator.Up()
+		if err == nil {
+			t.Fatal("expected error for broken migration")
+		}
+		if applied != 1 {
+			t.Errorf("expected 1 applied migration before the failure, got %d", applied)
+		}
+		if tableExists(db, "half_done") {
+			t.Error("expected broken migration to be rolled back")
+		}
+	})
+}
+
+func TestMigrator_SkipsUnsupportedRequirement(t *testing.T) {
+	forEachEmptyDriver(t, func(t *testing.T, db *sql.DB) {
+		fsys := fstest.MapFS{
+			"m/0001_base.up.sql":   {Data: []byte(`CREATE TABLE base (id INTEGER PRIMARY KEY);`)},
+			"m/0002_search.up.sql": {Data: []byte("-- requires: fts5\nCREATE VIRTUAL TABLE base_fts USING fts5(body);")},
+		}
+		migrator, err := datasource.NewMigratorFromFS(db, fsys, "m")
+		if err != nil {
+			t.Fatalf("failed to load migrations: %v", err)
+		}
+		statuses, err := migrator.Status()
+		if err != nil {
+			t.Fatalf("status failed: %v", err)
+		}
+		if statuses[1].Requires != "fts5" {
+			t.Fatalf("expected fts5 requirement to be parsed, got %q", statuses[1].Requires)
+		}
+
+		applied, err := migrator.Up()
+		if err != nil {
+			t.Fatalf("up failed: %v", err)
+		}
+		if statuses[1].Skipped {
+			if applied != 1 || tableExists(db, "base_fts") {
+				t.Errorf("expected only the base migration to be applied, got %d", applied)
+			}
+		} else if applied != 2 || !tableExists(db, "base_fts") {
+			t.Errorf("expected both migrations to be applied, got %d", applied)
+		}
+	})
+}
+
+func TestMigrator_LegacyImagesKeepBlobKey(t *testing.T) {
+	forEachEmptyDriver(t, func(t *testing.T, db *sql.DB) {
+		migrator, err := datasource.NewMigrator(db)
+		if err != nil {
+			t.Fatalf("failed to load migrations: %v", err)
+		}
+		if _, err := migrator.Up(); err != nil {
+			t.Fatalf("up failed: %v", err)
+		}
+		statuses, err := migrator.Status()
+		if err != nil {
+			t.Fatalf("status failed: %v", err)
+		}
+		steps := 0
+		for _, st := range statuses {
+			if st.Applied && st.Version >= 5 {
+				steps++
+			}
+		}
+		if _, err := migrator.Down(steps); err != nil {
+			t.Fatalf("down to the legacy schema failed: %v", err)
+		}
+
+		if _, err := db.Exec(`INSERT INTO users (uuid, login, password) VALUES ('u1', 'legacy', 'hash')`); err != nil {
+			t.Fatalf("failed to insert user: %v", err)
+		}
+		if _, err := db.Exec(`INSERT INTO ads (uuid, title, description, price, img, user_uuid) VALUES
+			('a1', 'Stored', 'Stored image', 1, '/images/ads/a1/x.png', 'u1'),
+			('a2', 'External', 'External image', 1, 'https://example.com/x.png', 'u1'),
+			('a3', 'Traversal', 'Unsafe key', 1, '/images/../secret.png', 'u1'),
+			('a4', 'Shared', 'Same file as a1', 1, '/images/ads/a1/x.png', 'u1')`); err != nil {
+			t.Fatalf("failed to insert ads: %v", err)
+		}
+		if _, err := migrator.Up(); err != nil {
+			t.Fatalf("up failed: %v", err)
+		}
+
+		expected := map[string]string{"a1": "ads/a1/x.png", "a2": "", "a3": "", "a4": ""}
+		for adUUID, key := range expected {
+			var blobKey sql.NullString
+			err := db.QueryRow(`SELECT blob_key FROM ad_images JOIN ads ON ads.id = ad_images.ad_id WHERE ads.uuid = '` + adUUID + `'`).Scan(&blobKey)
+			if err != nil {
+				t.Fatalf("failed to read image of %s: %v", adUUID, err)
+			}
+			if blobKey.String != key {
+				t.Errorf("expected key %q for %s, got %q", key, adUUID, blobKey.String)
+			}
+		}
+	})
+}
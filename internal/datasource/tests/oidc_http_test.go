@@ -0,0 +1,305 @@
+package datasource_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"marketplace/internal/app"
+	"marketplace/internal/config"
+	"marketplace/internal/datasource"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// fakeOIDCProvider is a minimal OpenID Connect provider: discovery, JWKS, an authorize endpoint
+// that logs in whoever is in next without asking, and a token endpoint checking PKCE.
+type fakeOIDCProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	kid    string
+
+	mu    sync.Mutex
+	next  jwt.MapClaims // claims of the user logging in at /authorize
+	codes map[string]fakeAuthorization
+	// tamper changes the claims of the next ID token, e.g. to make it invalid
+	tamper func(claims jwt.MapClaims)
+}
+
+type fakeAuthorization struct {
+	challenge   string
+	redirectURI string
+	claims      jwt.MapClaims
+}
+
+const (
+	fakeClientID     = "marketplace"
+	fakeClientSecret = "client-secret"
+	fakeRedirectURL  = "http://localhost:8080/oauth/fake/callback"
+)
+
+func newFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	p := &fakeOIDCProvider{key: key, kid: "fake-1", codes: make(map[string]fakeAuthorization)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.server.URL,
+			"authorization_endpoint": p.server.URL + "/authorize",
+			"token_endpoint":         p.server.URL + "/token",
+			"jwks_uri":               p.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "kid": p.kid, "use": "sig", "alg": "RS256",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("GET /authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("client_id") != fakeClientID || q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" {
+			http.Error(w, "invalid_request", http.StatusBadRequest)
+			return
+		}
+		p.mu.Lock()
+		claims := jwt.MapClaims{"nonce": q.Get("nonce")}
+		for k, v := range p.next {
+			claims[k] = v
+		}
+		code := uuid.NewString()
+		p.codes[code] = fakeAuthorization{challenge: q.Get("code_challenge"), redirectURI: q.Get("redirect_uri"), claims: claims}
+		p.mu.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?"+url.Values{"code": {code}, "state": {q.Get("state")}}.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		tokenError := func(code string) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": code})
+		}
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != fakeClientID || secret != fakeClientSecret {
+			tokenError("invalid_client")
+			return
+		}
+		p.mu.Lock()
+		auth, ok := p.codes[r.FormValue("code")]
+		delete(p.codes, r.FormValue("code"))
+		tamper := p.tamper
+		p.mu.Unlock()
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || r.FormValue("grant_type") != "authorization_code" || r.FormValue("redirect_uri") != auth.redirectURI ||
+			base64.RawURLEncoding.EncodeToString(sum[:]) != auth.challenge {
+			tokenError("invalid_grant")
+			return
+		}
+
+		now := time.Now()
+		claims := jwt.MapClaims{"iss": p.server.URL, "aud": fakeClientID, "iat": now.Unix(), "exp": now.Add(time.Hour).Unix()}
+		for k, v := range auth.claims {
+			claims[k] = v
+		}
+		signer := p.key
+		if tamper != nil {
+			tamper(claims)
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = p.kid
+		if kid, ok := claims["test_kid"].(string); ok {
+			token.Header["kid"] = kid
+			delete(claims, "test_kid")
+		}
+		if key, ok := claims["test_key"].(*rsa.PrivateKey); ok {
+			signer = key
+			delete(claims, "test_key")
+		}
+		idToken, err := token.SignedString(signer)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "opaque", "token_type": "Bearer", "id_token": idToken})
+	})
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func (p *fakeOIDCProvider) config() *config.Config {
+	return &config.Config{OIDC: config.OIDC{StateTTL: 600, Providers: []config.OIDCProvider{{
+		Name: "fake", Issuer: p.server.URL, ClientID: fakeClientID, ClientSecret: fakeClientSecret,
+		RedirectURL: fakeRedirectURL, Scopes: []string{"openid", "email", "profile"},
+	}}}}
+}
+
+// login plays the browser: it opens authURL as next and returns the code and state of the redirect back.
+func (p *fakeOIDCProvider) login(t *testing.T, authURL string, next jwt.MapClaims) (string, string) {
+	t.Helper()
+	p.mu.Lock()
+	p.next = next
+	p.mu.Unlock()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("authorize request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected a redirect from authorize, got %d", resp.StatusCode)
+	}
+	location, _ := url.Parse(resp.Header.Get("Location"))
+	if !strings.HasPrefix(location.String(), fakeRedirectURL+"?") {
+		t.Fatalf("unexpected redirect %q", location)
+	}
+	return location.Query().Get("code"), location.Query().Get("state")
+}
+
+func TestOIDCClient_Exchange(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	client := datasource.NewOIDCClient(provider.config(), zap.NewNop())
+	verifier := "verifier-0123456789-0123456789-0123456789"
+	sum := sha256.Sum256([]byte(verifier))
+	req := app.AuthCodeRequest{State: "state", Nonce: "nonce", CodeChallenge: base64.RawURLEncoding.EncodeToString(sum[:])}
+
+	authURL, err := client.AuthCodeURL("fake", req)
+	if err != nil {
+		t.Fatalf("failed to build auth url: %v", err)
+	}
+	parsed, _ := url.Parse(authURL)
+	q := parsed.Query()
+	if parsed.Path != "/authorize" || q.Get("scope") != "openid email profile" || q.Get("redirect_uri") != fakeRedirectURL || q.Get("state") != "state" {
+		t.Errorf("unexpected auth url %q", authURL)
+	}
+
+	alice := jwt.MapClaims{"sub": "alice-1", "email": "Alice@Example.com", "email_verified": true, "preferred_username": "alice"}
+	code, _ := provider.login(t, authURL, alice)
+	identity, err := client.Exchange("fake", code, verifier)
+	if err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	expected := app.ExternalIdentity{Provider: "fake", Subject: "alice-1", Email: "Alice@Example.com", EmailVerified: true, Username: "alice", Nonce: "nonce"}
+	if identity != expected {
+		t.Errorf("expected %+v, got %+v", expected, identity)
+	}
+	if _, err := client.Exchange("fake", code, verifier); err == nil {
+		t.Error("expected a used code to be rejected")
+	}
+
+	code, _ = provider.login(t, authURL, alice)
+	if _, err := client.Exchange("fake", code, "another-verifier"); err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("expected a wrong PKCE verifier to be rejected, got %v", err)
+	}
+
+	if _, err := client.AuthCodeURL("nope", req); !errors.Is(err, app.ErrUnknownProvider) {
+		t.Errorf("expected ErrUnknownProvider, got %v", err)
+	}
+	if _, err := client.Exchange("nope", code, verifier); !errors.Is(err, app.ErrUnknownProvider) {
+		t.Errorf("expected ErrUnknownProvider, got %v", err)
+	}
+}
+
+func TestOIDCClient_InvalidIDToken(t *testing.T) {
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	cases := []struct {
+		name   string
+		tamper func(claims jwt.MapClaims)
+	}{
+		{"another audience", func(c jwt.MapClaims) { c["aud"] = "someone-else" }},
+		{"another issuer", func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }},
+		{"expired", func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{"another client", func(c jwt.MapClaims) { c["aud"] = []string{fakeClientID, "other"}; c["azp"] = "other" }},
+		{"no subject", func(c jwt.MapClaims) { delete(c, "sub") }},
+		{"unknown key", func(c jwt.MapClaims) { c["test_kid"] = "unknown"; c["test_key"] = other }},
+		{"wrong signature", func(c jwt.MapClaims) { c["test_key"] = other }},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			provider := newFakeOIDCProvider(t)
+			provider.tamper = tc.tamper
+			client := datasource.NewOIDCClient(provider.config(), zap.NewNop())
+			sum := sha256.Sum256([]byte("verifier"))
+			authURL, err := client.AuthCodeURL("fake", app.AuthCodeRequest{State: "s", Nonce: "n", CodeChallenge: base64.RawURLEncoding.EncodeToString(sum[:])})
+			if err != nil {
+				t.Fatalf("failed to build auth url: %v", err)
+			}
+			code, _ := provider.login(t, authURL, jwt.MapClaims{"sub": "alice-1"})
+			if _, err := client.Exchange("fake", code, "verifier"); err == nil {
+				t.Error("expected the id_token to be rejected")
+			}
+		})
+	}
+}
+
+func TestOIDCClient_DiscoveryIssuerMismatch(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	cfg := provider.config()
+	// a provider that serves another issuer's metadata
+	cfg.OIDC.Providers[0].Issuer = strings.Replace(provider.server.URL, "127.0.0.1", "localhost", 1)
+	client := datasource.NewOIDCClient(cfg, zap.NewNop())
+	if _, err := client.AuthCodeURL("fake", app.AuthCodeRequest{}); err == nil || !strings.Contains(err.Error(), "issuer") {
+		t.Errorf("expected the issuer mismatch to be rejected, got %v", err)
+	}
+}
+
+func TestOIDCLogin_EndToEnd(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, db *sql.DB) {
+		provider := newFakeOIDCProvider(t)
+		cfg := provider.config()
+		cfg.JWT_ACCESS_SECRET, cfg.JWT_REFRESH_SECRET = "access", "refresh"
+		cfg.JWT_EXP_ACCESS_TOKEN, cfg.JWT_EXP_REFRESH_TOKEN = 15, 24
+		cfg.Username = config.Username{MinLength: 3, MaxLength: 20, AllowedCharacters: "A-Za-z0-9_-"}
+		userRepo := datasource.NewUserRepo(db)
+		service := app.NewUserService(userRepo, datasource.NewTokenRepo(db), &app.MockMailer{}, datasource.NewOIDCClient(cfg, zap.NewNop()))
+		jwtProvider := app.NewJwtProvider(cfg)
+
+		login := func(claims jwt.MapClaims) (app.JwtResponse, error) {
+			authURL, err := service.StartOIDCLogin("fake", cfg)
+			if err != nil {
+				t.Fatalf("failed to start login: %v", err)
+			}
+			code, state := provider.login(t, authURL, claims)
+			return service.FinishOIDCLogin(app.OIDCCallbackRequest{Provider: "fake", Code: code, State: state}, jwtProvider, cfg)
+		}
+
+		bob := jwt.MapClaims{"sub": "bob-1", "email": "bob@example.com", "email_verified": true, "preferred_username": "Bob"}
+		resp, err := login(bob)
+		if err != nil {
+			t.Fatalf("first login failed: %v", err)
+		}
+		if resp.AccessToken == "" || resp.RefreshToken == "" {
+			t.Fatalf("expected a token pair, got %+v", resp)
+		}
+		user, err := userRepo.FindByIdentity("fake", "bob-1")
+		if err != nil {
+			t.Fatalf("expected the identity to be linked: %v", err)
+		}
+		if user.Login != "bob" || user.Email != "bob@example.com" || user.EmailVerifiedAt == nil || user.Password != "" {
+			t.Errorf("unexpected user: %+v", user)
+		}
+
+		if _, err := login(bob); err != nil {
+			t.Fatalf("second login failed: %v", err)
+		}
+		if found, _ := userRepo.FindByLogin("bob"); found.UUID != user.UUID {
+			t.Error("expected the second login to find the same user")
+		}
+	})
+}
@@ -0,0 +1,278 @@
+package datasource_test
+
+import (
+	"database/sql"
+	"errors"
+	"marketplace/internal/app"
+	"marketplace/internal/datasource"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestTokenRepo_RefreshTokens(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, db *sql.DB) {
+		userRepo := datasource.NewUserRepo(db)
+		tokenRepo := datasource.NewTokenRepo(db)
+
+		user := app.User{UUID: uuid.New(), Login: "tokenuser", Password: "secret"}
+		if err := userRepo.SaveNewUser(user); err != nil {
+			t.Fatalf("failed to save user: %v", err)
+		}
+		now := time.Now()
+		family := uuid.NewString()
+		newToken := func(familyID string) app.RefreshToken {
+			token := app.RefreshToken{ID: uuid.NewString(), FamilyID: familyID, UserID: user.UUID, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+			if err := tokenRepo.SaveRefreshToken(token); err != nil {
+				t.Fatalf("failed to save token: %v", err)
+			}
+			return token
+		}
+		first := newToken(family)
+		second := newToken(family)
+		other := newToken(uuid.NewString())
+
+		got, err := tokenRepo.GetRefreshToken(first.ID)
+		if err != nil {
+			t.Fatalf("failed to get token: %v", err)
+		}
+		if got.FamilyID != family || got.UserID != user.UUID || got.UsedAt != nil || got.RevokedAt != nil {
+			t.Errorf("unexpected token: %+v", got)
+		}
+		if _, err := tokenRepo.GetRefreshToken(uuid.NewString()); !errors.Is(err, app.ErrInvalidRefreshToken) {
+			t.Errorf("expected ErrInvalidRefreshToken for unknown token, got %v", err)
+		}
+
+		if ok, err := tokenRepo.UseRefreshToken(first.ID, now); err != nil || !ok {
+			t.Fatalf("expected first use to succeed, got %v, %v", ok, err)
+		}
+		if ok, err := tokenRepo.UseRefreshToken(first.ID, now); err != nil || ok {
+			t.Errorf("expected second use to fail, got %v, %v", ok, err)
+		}
+
+		if err := tokenRepo.RevokeTokenFamily(family, now); err != nil {
+			t.Fatalf("failed to revoke family: %v", err)
+		}
+		got, err = tokenRepo.GetRefreshToken(second.ID)
+		if err != nil {
+			t.Fatalf("failed to get token: %v", err)
+		}
+		if got.RevokedAt == nil {
+			t.Error("expected the family to be revoked")
+		}
+		if ok, _ := tokenRepo.UseRefreshToken(second.ID, now); ok {
+			t.Error("expected a revoked token to be unusable")
+		}
+		if got, _ := tokenRepo.GetRefreshToken(other.ID); got.RevokedAt != nil {
+			t.Error("expected other families to stay valid")
+		}
+		if revoked, err := tokenRepo.FamilyRevoked(family); err != nil || !revoked {
+			t.Errorf("expected the family to be reported revoked, got %v, %v", revoked, err)
+		}
+		if revoked, err := tokenRepo.FamilyRevoked(other.FamilyID); err != nil || revoked {
+			t.Errorf("expected the other family to be active, got %v, %v", revoked, err)
+		}
+
+		if err := tokenRepo.RevokeUserTokens(user.UUID.String(), now); err != nil {
+			t.Fatalf("failed to revoke user tokens: %v", err)
+		}
+		if revoked, _ := tokenRepo.FamilyRevoked(other.FamilyID); !revoked {
+			t.Error("expected every family of the user to be revoked")
+		}
+	})
+}
+
+func TestTokenRepo_Sessions(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, db *sql.DB) {
+		userRepo := datasource.NewUserRepo(db)
+		tokenRepo := datasource.NewTokenRepo(db)
+
+		user := app.User{UUID: uuid.New(), Login: "sessionuser", Password: "secret"}
+		if err := userRepo.SaveNewUser(user); err != nil {
+			t.Fatalf("failed to save user: %v", err)
+		}
+		now := time.Now().Truncate(time.Microsecond)
+		login := func(userAgent string, lastUsed time.Time, expires time.Time) app.Session {
+			session := app.Session{ID: uuid.NewString(), UserID: user.UUID, UserAgent: userAgent, IP: "192.0.2.1", CreatedAt: lastUsed, LastUsedAt: lastUsed}
+			if err := tokenRepo.SaveSession(session); err != nil {
+				t.Fatalf("failed to save session: %v", err)
+			}
+			token := app.RefreshToken{ID: uuid.NewString(), FamilyID: session.ID, UserID: user.UUID, CreatedAt: lastUsed, ExpiresAt: expires}
+			if err := tokenRepo.SaveRefreshToken(token); err != nil {
+				t.Fatalf("failed to save token: %v", err)
+			}
+			return session
+		}
+		laptop := login("Firefox", now.Add(-time.Hour), now.Add(time.Hour))
+		phone := login("Mobile Safari", now.Add(-2*time.Hour), now.Add(time.Hour))
+		login("Expired", now.Add(-3*time.Hour), now.Add(-time.Minute))
+		revoked := login("Revoked", now.Add(-time.Hour), now.Add(time.Hour))
+		if err := tokenRepo.RevokeTokenFamily(revoked.ID, now); err != nil {
+			t.Fatalf("failed to revoke family: %v", err)
+		}
+
+		sessions, err := tokenRepo.ActiveSessions(user.UUID.String(), now)
+		if err != nil {
+			t.Fatalf("failed to list sessions: %v", err)
+		}
+		if len(sessions) != 2 || sessions[0].ID != laptop.ID || sessions[1].ID != phone.ID {
+			t.Fatalf("expected the laptop and phone sessions, got %+v", sessions)
+		}
+		if sessions[0].UserAgent != "Firefox" || sessions[0].IP != "192.0.2.1" || sessions[0].UserID != user.UUID {
+			t.Errorf("unexpected session: %+v", sessions[0])
+		}
+
+		// a touch within the interval is skipped, an older last-used time is moved forward
+		if err := tokenRepo.TouchSession(laptop.ID, now, now.Add(-2*time.Hour)); err != nil {
+			t.Fatalf("failed to touch session: %v", err)
+		}
+		if err := tokenRepo.TouchSession(phone.ID, now, now.Add(-time.Minute)); err != nil {
+			t.Fatalf("failed to touch session: %v", err)
+		}
+		phone.UserAgent, phone.IP, phone.LastUsedAt = "Mobile Chrome", "192.0.2.2", now.Add(time.Second)
+		if err := tokenRepo.UpdateSession(phone); err != nil {
+			t.Fatalf("failed to update session: %v", err)
+		}
+		sessions, _ = tokenRepo.ActiveSessions(user.UUID.String(), now)
+		if len(sessions) != 2 || sessions[0].ID != phone.ID || sessions[0].UserAgent != "Mobile Chrome" || sessions[0].IP != "192.0.2.2" {
+			t.Fatalf("expected the updated phone session first, got %+v", sessions)
+		}
+		if !sessions[1].LastUsedAt.Equal(laptop.LastUsedAt) {
+			t.Errorf("expected the laptop last-used time to stay %v, got %v", laptop.LastUsedAt, sessions[1].LastUsedAt)
+		}
+	})
+}
+
+func TestTokenRepo_PasswordResetTokens(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, db *sql.DB) {
+		userRepo := datasource.NewUserRepo(db)
+		tokenRepo := datasource.NewTokenRepo(db)
+
+		user := app.User{UUID: uuid.New(), Login: "resetuser", Password: "secret", Status: app.UserStatusActive}
+		if err := userRepo.SaveNewUser(user); err != nil {
+			t.Fatalf("failed to save user: %v", err)
+		}
+		now := time.Now()
+		newToken := func(expiresAt time.Time) app.PasswordResetToken {
+			token := app.PasswordResetToken{ID: uuid.NewString(), UserID: user.UUID, CreatedAt: now, ExpiresAt: expiresAt}
+			if err := tokenRepo.SavePasswordResetToken(token); err != nil {
+				t.Fatalf("failed to save reset token: %v", err)
+			}
+			return token
+		}
+		valid := newToken(now.Add(time.Hour))
+		expired := newToken(now.Add(-time.Minute))
+		revoked := newToken(now.Add(time.Hour))
+
+		got, err := tokenRepo.UsePasswordResetToken(valid.ID, now)
+		if err != nil {
+			t.Fatalf("expected first use to succeed, got %v", err)
+		}
+		if got.UserID != user.UUID || got.UsedAt == nil {
+			t.Errorf("unexpected token: %+v", got)
+		}
+		if _, err := tokenRepo.UsePasswordResetToken(valid.ID, now); !errors.Is(err, app.ErrInvalidResetToken) {
+			t.Errorf("expected second use to fail, got %v", err)
+		}
+		if _, err := tokenRepo.UsePasswordResetToken(expired.ID, now); !errors.Is(err, app.ErrInvalidResetToken) {
+			t.Errorf("expected expired token to fail, got %v", err)
+		}
+		if _, err := tokenRepo.UsePasswordResetToken(uuid.NewString(), now); !errors.Is(err, app.ErrInvalidResetToken) {
+			t.Errorf("expected unknown token to fail, got %v", err)
+		}
+
+		if err := tokenRepo.RevokePasswordResetTokens(user.UUID.String(), now); err != nil {
+			t.Fatalf("failed to revoke reset tokens: %v", err)
+		}
+		if _, err := tokenRepo.UsePasswordResetToken(revoked.ID, now); !errors.Is(err, app.ErrInvalidResetToken) {
+			t.Errorf("expected revoked token to fail, got %v", err)
+		}
+
+		if err := userRepo.DeleteUser(user.UUID.String()); err != nil {
+			t.Errorf("expected a user with reset tokens to be deletable, got %v", err)
+		}
+	})
+}
+
+func TestTokenRepo_EmailVerificationTokens(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, db *sql.DB) {
+		userRepo := datasource.NewUserRepo(db)
+		tokenRepo := datasource.NewTokenRepo(db)
+
+		user := app.User{UUID: uuid.New(), Login: "verifyuser", Password: "secret", Email: "verify@example.com"}
+		if err := userRepo.SaveNewUser(user); err != nil {
+			t.Fatalf("failed to save user: %v", err)
+		}
+		now := time.Now()
+		newToken := func(expiresAt time.Time) app.EmailVerificationToken {
+			token := app.EmailVerificationToken{ID: uuid.NewString(), UserID: user.UUID, Email: user.Email, CreatedAt: now, ExpiresAt: expiresAt}
+			if err := tokenRepo.SaveEmailVerificationToken(token); err != nil {
+				t.Fatalf("failed to save verification token: %v", err)
+			}
+			return token
+		}
+		valid := newToken(now.Add(time.Hour))
+		expired := newToken(now.Add(-time.Minute))
+		revoked := newToken(now.Add(time.Hour))
+
+		got, err := tokenRepo.UseEmailVerificationToken(valid.ID, now)
+		if err != nil {
+			t.Fatalf("expected first use to succeed, got %v", err)
+		}
+		if got.UserID != user.UUID || got.Email != user.Email || got.UsedAt == nil {
+			t.Errorf("unexpected token: %+v", got)
+		}
+		if _, err := tokenRepo.UseEmailVerificationToken(valid.ID, now); !errors.Is(err, app.ErrInvalidVerificationToken) {
+			t.Errorf("expected second use to fail, got %v", err)
+		}
+		if _, err := tokenRepo.UseEmailVerificationToken(expired.ID, now); !errors.Is(err, app.ErrInvalidVerificationToken) {
+			t.Errorf("expected expired token to fail, got %v", err)
+		}
+
+		if err := tokenRepo.RevokeEmailVerificationTokens(user.UUID.String(), now); err != nil {
+			t.Fatalf("failed to revoke verification tokens: %v", err)
+		}
+		if _, err := tokenRepo.UseEmailVerificationToken(revoked.ID, now); !errors.Is(err, app.ErrInvalidVerificationToken) {
+			t.Errorf("expected revoked token to fail, got %v", err)
+		}
+
+		if err := userRepo.DeleteUser(user.UUID.String()); err != nil {
+			t.Errorf("expected a user with verification tokens to be deletable, got %v", err)
+		}
+	})
+}
+
+func TestTokenRepo_OIDCStates(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, db *sql.DB) {
+		tokenRepo := datasource.NewTokenRepo(db)
+
+		now := time.Now()
+		newState := func(expiresAt time.Time) app.OIDCState {
+			state := app.OIDCState{ID: uuid.NewString(), Provider: "example", CodeVerifier: "verifier", Nonce: "nonce", CreatedAt: now, ExpiresAt: expiresAt}
+			if err := tokenRepo.SaveOIDCState(state); err != nil {
+				t.Fatalf("failed to save oidc state: %v", err)
+			}
+			return state
+		}
+		valid := newState(now.Add(10 * time.Minute))
+		expired := newState(now.Add(-time.Minute))
+
+		got, err := tokenRepo.UseOIDCState(valid.ID, now)
+		if err != nil {
+			t.Fatalf("expected first use to succeed, got %v", err)
+		}
+		if got.Provider != "example" || got.CodeVerifier != "verifier" || got.Nonce != "nonce" || got.UsedAt == nil {
+			t.Errorf("unexpected state: %+v", got)
+		}
+		if _, err := tokenRepo.UseOIDCState(valid.ID, now); !errors.Is(err, app.ErrInvalidOIDCState) {
+			t.Errorf("expected second use to fail, got %v", err)
+		}
+		if _, err := tokenRepo.UseOIDCState(expired.ID, now); !errors.Is(err, app.ErrInvalidOIDCState) {
+			t.Errorf("expected expired state to fail, got %v", err)
+		}
+		if _, err := tokenRepo.UseOIDCState("unknown", now); !errors.Is(err, app.ErrInvalidOIDCState) {
+			t.Errorf("expected unknown state to fail, got %v", err)
+		}
+	})
+}
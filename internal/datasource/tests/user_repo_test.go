@@ -2,51 +2,351 @@ package datasource_test
 
 import (
 	"database/sql"
+	"errors"
 	"marketplace/internal/app"
-	"marketplace/internal/config"
 	"marketplace/internal/datasource"
+	"strings"
 	"testing"
-	_ "github.com/mattn/go-sqlite3"
+	"time"
 	"github.com/google/uuid"
 )
 
-func setupTestDB(t *testing.T) *sql.DB {
-	cfg := &config.Config{Db: ":memory:"}
-	db, err := datasource.NewStorage(cfg)
-	if err != nil {
-		t.Fatalf("failed to setup test DB: %v", err)
-	}
-	return db
+func TestUserRepo_SaveAndFind(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, db *sql.DB) {
+		repo := datasource.NewUserRepo(db)
+
+		user := app.User{
+			UUID:     uuid.New(),
+			Login:    "testuser",
+			Password: "hashedPassword",
+		}
+
+		err := repo.SaveNewUser(user)
+		if err != nil {
+			t.Fatalf("failed to save user: %v", err)
+		}
+
+		found, err := repo.FindByLogin("TestUser")
+		if err != nil {
+			t.Fatalf("failed to find user by login: %v", err)
+		}
+		if found.UUID != user.UUID {
+			t.Errorf("expected UUID %s, got %s", user.UUID, found.UUID)
+		}
+
+		found2, err := repo.FindByUUID(user.UUID.String())
+		if err != nil {
+			t.Fatalf("failed to find user by uuid: %v", err)
+		}
+		if found2.Login != user.Login {
+			t.Errorf("expected login %s, got %s", user.Login, found2.Login)
+		}
+	})
 }
 
-func TestUserRepo_SaveAndFind(t *testing.T) {
-	db := setupTestDB(t)
-	repo := datasource.NewUserRepo(db)
-
-	user := app.User{
-		UUID:     uuid.New(),
-		Login:    "testuser",
-		Password: "hashedPassword",
-	}
-
-	err := repo.SaveNewUser(user)
-	if err != nil {
-		t.Fatalf("failed to save user: %v", err)
-	}
-
-	found, err := repo.FindByLogin("TestUser")
-	if err != nil {
-		t.Fatalf("failed to find user by login: %v", err)
-	}
-	if found.UUID != user.UUID {
-		t.Errorf("expected UUID %s, got %s", user.UUID, found.UUID)
-	}
-
-	found2, err := repo.FindByUUID(user.UUID.String())
-	if err != nil {
-		t.Fatalf("failed to find user by uuid: %v", err)
-	}
-	if found2.Login != user.Login {
-		t.Errorf("expected login %s, got %s", user.Login, found2.Login)
-	}
-}
\ No newline at end of file
+func TestUserRepo_Email(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, db *sql.DB) {
+		repo := datasource.NewUserRepo(db)
+
+		alice := app.User{UUID: uuid.New(), Login: "alice", Password: "hash", Email: "Alice@Example.com"}
+		if err := repo.SaveNewUser(alice); err != nil {
+			t.Fatalf("failed to save user: %v", err)
+		}
+		// users without an address don't collide on the unique index
+		for _, login := range []string{"bob", "carol"} {
+			if err := repo.SaveNewUser(app.User{UUID: uuid.New(), Login: login, Password: "hash"}); err != nil {
+				t.Fatalf("failed to save user without email: %v", err)
+			}
+		}
+		if err := repo.SaveNewUser(app.User{UUID: uuid.New(), Login: "dave", Password: "hash", Email: "alice@example.com"}); err == nil {
+			t.Error("expected a duplicate email to be rejected")
+		}
+
+		found, err := repo.FindByEmail("ALICE@example.com")
+		if err != nil {
+			t.Fatalf("failed to find user by email: %v", err)
+		}
+		if found.UUID != alice.UUID || found.Email != "alice@example.com" || found.EmailVerifiedAt != nil {
+			t.Errorf("unexpected user: %+v", found)
+		}
+		if bob, _ := repo.FindByLogin("bob"); bob.Email != "" {
+			t.Errorf("expected no email, got %q", bob.Email)
+		}
+
+		at := time.Now().UTC().Truncate(time.Second)
+		if err := repo.SetEmailVerified(alice.UUID.String(), "other@example.com", at); !errors.Is(err, app.ErrInvalidVerificationToken) {
+			t.Errorf("expected another address not to be verified, got %v", err)
+		}
+		if err := repo.SetEmailVerified(alice.UUID.String(), "alice@example.com", at); err != nil {
+			t.Fatalf("failed to verify email: %v", err)
+		}
+		found, _ = repo.FindByUUID(alice.UUID.String())
+		if found.EmailVerifiedAt == nil || !found.EmailVerifiedAt.Equal(at) {
+			t.Errorf("expected the email to be verified at %v, got %v", at, found.EmailVerifiedAt)
+		}
+	})
+}
+
+func TestUserRepo_TOTP(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, db *sql.DB) {
+		repo := datasource.NewUserRepo(db)
+
+		user := app.User{UUID: uuid.New(), Login: "totpuser", Password: "hash"}
+		if err := repo.SaveNewUser(user); err != nil {
+			t.Fatalf("failed to save user: %v", err)
+		}
+		if err := repo.SetTOTPSecret(user.UUID.String(), "SECRET"); err != nil {
+			t.Fatalf("failed to set secret: %v", err)
+		}
+		at := time.Now().UTC().Truncate(time.Second)
+		if err := repo.EnableTOTP(user.UUID.String(), at, []string{"hash1", "hash2"}); err != nil {
+			t.Fatalf("failed to enable totp: %v", err)
+		}
+		if err := repo.EnableTOTP(uuid.NewString(), at, nil); !errors.Is(err, app.ErrUserNotFound) {
+			t.Errorf("expected ErrUserNotFound, got %v", err)
+		}
+		found, _ := repo.FindByUUID(user.UUID.String())
+		if found.TOTPSecret != "SECRET" || found.TOTPEnabledAt == nil || !found.TOTPEnabledAt.Equal(at) {
+			t.Errorf("unexpected totp state: %q %v", found.TOTPSecret, found.TOTPEnabledAt)
+		}
+
+		for _, tc := range []struct {
+			step     int64
+			expected bool
+		}{{100, true}, {100, false}, {99, false}, {101, true}} {
+			used, err := repo.UseTOTPStep(user.UUID.String(), tc.step)
+			if err != nil || used != tc.expected {
+				t.Errorf("step %d: expected %v, got %v %v", tc.step, tc.expected, used, err)
+			}
+		}
+
+		for _, tc := range []struct {
+			hash     string
+			expected bool
+		}{{"hash1", true}, {"hash1", false}, {"unknown", false}, {"hash2", true}} {
+			used, err := repo.UseRecoveryCode(user.UUID.String(), tc.hash, at)
+			if err != nil || used != tc.expected {
+				t.Errorf("code %s: expected %v, got %v %v", tc.hash, tc.expected, used, err)
+			}
+		}
+
+		// enabling again replaces the codes
+		if err := repo.EnableTOTP(user.UUID.String(), at, []string{"hash1"}); err != nil {
+			t.Fatalf("failed to enable totp again: %v", err)
+		}
+		if used, _ := repo.UseRecoveryCode(user.UUID.String(), "hash1", at); !used {
+			t.Error("expected the new code to be usable")
+		}
+		if err := repo.DeleteUser(user.UUID.String()); err != nil {
+			t.Errorf("expected a user with recovery codes to be deleted, got %v", err)
+		}
+	})
+}
+
+func TestUserRepo_Identities(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, db *sql.DB) {
+		repo := datasource.NewUserRepo(db)
+
+		now := time.Now().UTC().Truncate(time.Second)
+		user := app.User{UUID: uuid.New(), Login: "External", Email: "ext@example.com", EmailVerifiedAt: &now}
+		identity := app.UserIdentity{Provider: "example", Subject: "sub-1", UserID: user.UUID, Email: "ext@example.com", CreatedAt: now}
+		if err := repo.SaveNewUserWithIdentity(user, identity); err != nil {
+			t.Fatalf("failed to save user with identity: %v", err)
+		}
+		found, err := repo.FindByIdentity("example", "sub-1")
+		if err != nil {
+			t.Fatalf("failed to find user by identity: %v", err)
+		}
+		if found.UUID != user.UUID || found.Login != "external" || found.Password != "" || found.EmailVerifiedAt == nil || !found.EmailVerifiedAt.Equal(now) {
+			t.Errorf("unexpected user: %+v", found)
+		}
+		if _, err := repo.FindByIdentity("other", "sub-1"); err == nil {
+			t.Error("expected subjects to be per provider")
+		}
+
+		// a failed link doesn't leave a user behind
+		dup := app.User{UUID: uuid.New(), Login: "dup"}
+		if err := repo.SaveNewUserWithIdentity(dup, app.UserIdentity{Provider: "example", Subject: "sub-1", UserID: dup.UUID, CreatedAt: now}); err == nil {
+			t.Error("expected a linked subject to be rejected")
+		}
+		if _, err := repo.FindByLogin("dup"); err == nil {
+			t.Error("expected the user to be rolled back")
+		}
+
+		if err := repo.SaveIdentity(app.UserIdentity{Provider: "other", Subject: "sub-1", UserID: user.UUID, CreatedAt: now}); err != nil {
+			t.Fatalf("failed to link a second identity: %v", err)
+		}
+		if found, err := repo.FindByIdentity("other", "sub-1"); err != nil || found.UUID != user.UUID {
+			t.Errorf("expected the second identity to find the user, got %+v %v", found, err)
+		}
+		// turning on two-factor authentication keeps the links
+		if err := repo.EnableTOTP(user.UUID.String(), now, []string{"hash1"}); err != nil {
+			t.Fatalf("failed to enable totp: %v", err)
+		}
+		if found, err := repo.FindByIdentity("example", "sub-1"); err != nil || found.UUID != user.UUID {
+			t.Errorf("expected the identity to survive EnableTOTP, got %+v %v", found, err)
+		}
+		if err := repo.DeleteUser(user.UUID.String()); err != nil {
+			t.Fatalf("expected a user with identities to be deleted, got %v", err)
+		}
+		if _, err := repo.FindByIdentity("example", "sub-1"); err == nil {
+			t.Error("expected the identities to be deleted with the user")
+		}
+	})
+}
+
+func TestUserRepo_SetRole(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, db *sql.DB) {
+		repo := datasource.NewUserRepo(db)
+
+		user := app.User{UUID: uuid.New(), Login: "roleuser", Password: "hashedPassword"}
+		if err := repo.SaveNewUser(user); err != nil {
+			t.Fatalf("failed to save user: %v", err)
+		}
+		found, _ := repo.FindByUUID(user.UUID.String())
+		if found.Role != app.RoleUser {
+			t.Errorf("expected new users to get role %q, got %q", app.RoleUser, found.Role)
+		}
+
+		if err := repo.SetRole(user.UUID.String(), app.RoleModerator); err != nil {
+			t.Fatalf("failed to set role: %v", err)
+		}
+		found, _ = repo.FindByLogin("roleuser")
+		if found.Role != app.RoleModerator {
+			t.Errorf("expected role %q, got %q", app.RoleModerator, found.Role)
+		}
+
+		if err := repo.SetRole(uuid.NewString(), app.RoleAdmin); !errors.Is(err, app.ErrUserNotFound) {
+			t.Errorf("expected ErrUserNotFound, got %v", err)
+		}
+	})
+}
+
+func TestUserRepo_ListUsers(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, db *sql.DB) {
+		repo := datasource.NewUserRepo(db)
+		for _, login := range []string{"carol", "alice", "al_ex", "bob"} {
+			if err := repo.SaveNewUser(app.User{UUID: uuid.New(), Login: login, Password: "hash"}); err != nil {
+				t.Fatalf("failed to save user: %v", err)
+			}
+		}
+		bob, _ := repo.FindByLogin("bob")
+		repo.SetRole(bob.UUID.String(), app.RoleAdmin)
+
+		cases := []struct {
+			name   string
+			params app.UsersListParams
+			total  int
+			logins []string
+		}{
+			{"all ordered by login", app.UsersListParams{Page: 1, Limit: 10}, 4, []string{"al_ex", "alice", "bob", "carol"}},
+			{"second page", app.UsersListParams{Page: 2, Limit: 3}, 4, []string{"carol"}},
+			{"by login part", app.UsersListParams{Page: 1, Limit: 10, Query: "AL"}, 2, []string{"al_ex", "alice"}},
+			{"underscore is literal", app.UsersListParams{Page: 1, Limit: 10, Query: "l_"}, 1, []string{"al_ex"}},
+			{"by role", app.UsersListParams{Page: 1, Limit: 10, Role: app.RoleAdmin}, 1, []string{"bob"}},
+			{"by status", app.UsersListParams{Page: 1, Limit: 10, Status: app.UserStatusBanned}, 0, []string{}},
+		}
+		for _, tc := range cases {
+			t.Run(tc.name, func(t *testing.T) {
+				users, err := repo.ListUsers(tc.params)
+				if err != nil {
+					t.Fatalf("failed to list users: %v", err)
+				}
+				logins := []string{}
+				for _, user := range users {
+					logins = append(logins, user.Login)
+				}
+				if strings.Join(logins, ",") != strings.Join(tc.logins, ",") {
+					t.Errorf("expected %v, got %v", tc.logins, logins)
+				}
+				total, err := repo.CountUsers(tc.params)
+				if err != nil {
+					t.Fatalf("failed to count users: %v", err)
+				}
+				if total != tc.total {
+					t.Errorf("expected total %d, got %d", tc.total, total)
+				}
+			})
+		}
+	})
+}
+
+func TestUserRepo_StatusAndDelete(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, db *sql.DB) {
+		repo := datasource.NewUserRepo(db)
+		tokens := datasource.NewTokenRepo(db)
+
+		user := app.User{UUID: uuid.New(), Login: "statususer", Password: "hash"}
+		if err := repo.SaveNewUser(user); err != nil {
+			t.Fatalf("failed to save user: %v", err)
+		}
+		found, _ := repo.FindByUUID(user.UUID.String())
+		if found.Status != app.UserStatusActive || found.PasswordResetRequired {
+			t.Errorf("expected an active user without a forced reset, got %+v", found)
+		}
+
+		until := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+		if err := repo.SetStatus(user.UUID.String(), app.UserStatusSuspended, "spam", &until); err != nil {
+			t.Fatalf("failed to set status: %v", err)
+		}
+		if err := repo.SetPasswordResetRequired(user.UUID.String(), true); err != nil {
+			t.Fatalf("failed to require password reset: %v", err)
+		}
+		found, _ = repo.FindByLogin("statususer")
+		if found.Status != app.UserStatusSuspended || found.StatusReason != "spam" || found.SuspendedUntil == nil || !found.SuspendedUntil.Equal(until) || !found.PasswordResetRequired {
+			t.Errorf("expected a suspended user with a forced reset, got %+v", found)
+		}
+		if err := repo.SetPassword(user.UUID.String(), "newhash"); err != nil {
+			t.Fatalf("failed to set password: %v", err)
+		}
+		found, _ = repo.FindByLogin("statususer")
+		if found.Password != "newhash" || found.PasswordResetRequired {
+			t.Errorf("expected a new password without a forced reset, got %+v", found)
+		}
+		if err := repo.SetPassword(uuid.NewString(), "hash"); !errors.Is(err, app.ErrUserNotFound) {
+			t.Errorf("expected ErrUserNotFound for unknown user, got %v", err)
+		}
+		if err := repo.SetStatus(user.UUID.String(), app.UserStatusActive, "", nil); err != nil {
+			t.Fatalf("failed to set status: %v", err)
+		}
+		found, _ = repo.FindByUUID(user.UUID.String())
+		if found.Status != app.UserStatusActive || found.StatusReason != "" || found.SuspendedUntil != nil {
+			t.Errorf("expected the suspension to be lifted, got %+v", found)
+		}
+		if err := repo.SetStatus(uuid.NewString(), app.UserStatusBanned, "", nil); !errors.Is(err, app.ErrUserNotFound) {
+			t.Errorf("expected ErrUserNotFound, got %v", err)
+		}
+
+		now := time.Now()
+		session := app.Session{ID: uuid.NewString(), UserID: user.UUID, CreatedAt: now, LastUsedAt: now}
+		if err := tokens.SaveSession(session); err != nil {
+			t.Fatalf("failed to save session: %v", err)
+		}
+		token := app.RefreshToken{ID: uuid.NewString(), FamilyID: session.ID, UserID: user.UUID, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+		if err := tokens.SaveRefreshToken(token); err != nil {
+			t.Fatalf("failed to save refresh token: %v", err)
+		}
+		identity := app.UserIdentity{Provider: "example", Subject: "sub-1", UserID: user.UUID, CreatedAt: now}
+		if err := repo.SaveIdentity(identity); err != nil {
+			t.Fatalf("failed to link identity: %v", err)
+		}
+
+		if err := repo.DeleteUser(user.UUID.String()); err != nil {
+			t.Fatalf("failed to delete user: %v", err)
+		}
+		if _, err := repo.FindByUUID(user.UUID.String()); err == nil {
+			t.Error("expected the user to be deleted")
+		}
+		if _, err := tokens.GetRefreshToken(token.ID); err == nil {
+			t.Error("expected the user's refresh tokens to be deleted")
+		}
+		// the external account can sign up again once its link is gone
+		again := app.User{UUID: uuid.New(), Login: "statususer2"}
+		if err := repo.SaveNewUserWithIdentity(again, app.UserIdentity{Provider: "example", Subject: "sub-1", UserID: again.UUID, CreatedAt: now}); err != nil {
+			t.Errorf("expected the user's identities to be deleted, got %v", err)
+		}
+		if err := repo.DeleteUser(user.UUID.String()); !errors.Is(err, app.ErrUserNotFound) {
+			t.Errorf("expected ErrUserNotFound, got %v", err)
+		}
+	})
+}
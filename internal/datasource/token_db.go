@@ -0,0 +1,249 @@
+package datasource
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"marketplace/internal/app"
+	"time"
+)
+
+type TokenRepo struct {
+	db sqlDB
+}
+
+func NewTokenRepo(db *sql.DB) *TokenRepo {
+	return &TokenRepo{db: newSQLDB(db)}
+}
+
+func (s *TokenRepo) SaveRefreshToken(token app.RefreshToken) error {
+	_, err := s.db.Exec(`INSERT INTO refresh_tokens (id, family_id, user_uuid, created_at, expires_at) VALUES (?, ?, ?, ?, ?)`,
+		token.ID, token.FamilyID, token.UserID.String(), token.CreatedAt, token.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("exec error DB:%w", err)
+	}
+	return nil
+}
+
+func (s *TokenRepo) GetRefreshToken(id string) (app.RefreshToken, error) {
+	var token app.RefreshToken
+	var usedAt, revokedAt sql.NullTime
+	err := s.db.QueryRow(`SELECT id, family_id, user_uuid, created_at, expires_at, used_at, revoked_at FROM refresh_tokens WHERE id = ?`, id).
+		Scan(&token.ID, &token.FamilyID, &token.UserID, &token.CreatedAt, &token.ExpiresAt, &usedAt, &revokedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return app.RefreshToken{}, app.ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return app.RefreshToken{}, fmt.Errorf("scan error DB:%w", err)
+	}
+	if usedAt.Valid {
+		token.UsedAt = &usedAt.Time
+	}
+	if revokedAt.Valid {
+		token.RevokedAt = &revokedAt.Time
+	}
+	return token, nil
+}
+
+// UseRefreshToken checks and marks the token in one statement, so two concurrent
+// refreshes with the same token can't both succeed.
+func (s *TokenRepo) UseRefreshToken(id string, at time.Time) (bool, error) {
+	res, err := s.db.Exec(`UPDATE refresh_tokens SET used_at = ? WHERE id = ? AND used_at IS NULL AND revoked_at IS NULL`, at, id)
+	if err != nil {
+		return false, fmt.Errorf("exec error DB:%w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("rows affected error DB:%w", err)
+	}
+	return n == 1, nil
+}
+
+func (s *TokenRepo) RevokeTokenFamily(familyID string, at time.Time) error {
+	_, err := s.db.Exec(`UPDATE refresh_tokens SET revoked_at = ? WHERE family_id = ? AND revoked_at IS NULL`, at, familyID)
+	if err != nil {
+		return fmt.Errorf("exec error DB:%w", err)
+	}
+	return nil
+}
+
+func (s *TokenRepo) RevokeUserTokens(userID string, at time.Time) error {
+	_, err := s.db.Exec(`UPDATE refresh_tokens SET revoked_at = ? WHERE user_uuid = ? AND revoked_at IS NULL`, at, userID)
+	if err != nil {
+		return fmt.Errorf("exec error DB:%w", err)
+	}
+	return nil
+}
+
+func (s *TokenRepo) FamilyRevoked(familyID string) (bool, error) {
+	var revoked int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM refresh_tokens WHERE family_id = ? AND revoked_at IS NOT NULL`, familyID).Scan(&revoked)
+	if err != nil {
+		return false, fmt.Errorf("scan error DB:%w", err)
+	}
+	return revoked > 0, nil
+}
+
+func (s *TokenRepo) SaveSession(session app.Session) error {
+	_, err := s.db.Exec(`INSERT INTO sessions (id, user_uuid, user_agent, ip, created_at, last_used_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		session.ID, session.UserID.String(), session.UserAgent, session.IP, session.CreatedAt, session.LastUsedAt)
+	if err != nil {
+		return fmt.Errorf("exec error DB:%w", err)
+	}
+	return nil
+}
+
+func (s *TokenRepo) UpdateSession(session app.Session) error {
+	_, err := s.db.Exec(`UPDATE sessions SET user_agent = ?, ip = ?, last_used_at = ? WHERE id = ?`,
+		session.UserAgent, session.IP, session.LastUsedAt, session.ID)
+	if err != nil {
+		return fmt.Errorf("exec error DB:%w", err)
+	}
+	return nil
+}
+
+func (s *TokenRepo) TouchSession(id string, at time.Time, since time.Time) error {
+	_, err := s.db.Exec(`UPDATE sessions SET last_used_at = ? WHERE id = ? AND last_used_at < ?`, at, id, since)
+	if err != nil {
+		return fmt.Errorf("exec error DB:%w", err)
+	}
+	return nil
+}
+
+// ActiveSessions treats a session as active while its family has a refresh token that
+// can still be exchanged: not used, not revoked and not expired.
+func (s *TokenRepo) ActiveSessions(userID string, at time.Time) ([]app.Session, error) {
+	rows, err := s.db.Query(`
+		SELECT s.id, s.user_uuid, s.user_agent, s.ip, s.created_at, s.last_used_at
+		FROM sessions s
+		WHERE s.user_uuid = ? AND EXISTS (
+			SELECT 1 FROM refresh_tokens t
+			WHERE t.family_id = s.id AND t.used_at IS NULL AND t.revoked_at IS NULL AND t.expires_at > ?
+		)
+		ORDER BY s.last_used_at DESC`, userID, at)
+	if err != nil {
+		return nil, fmt.Errorf("query error DB: %w", err)
+	}
+	defer rows.Close()
+
+	sessions := []app.Session{}
+	for rows.Next() {
+		var session app.Session
+		if err := rows.Scan(&session.ID, &session.UserID, &session.UserAgent, &session.IP, &session.CreatedAt, &session.LastUsedAt); err != nil {
+			return nil, fmt.Errorf("scan error DB:%w", err)
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *TokenRepo) SavePasswordResetToken(token app.PasswordResetToken) error {
+	_, err := s.db.Exec(`INSERT INTO password_reset_tokens (id, user_uuid, created_at, expires_at) VALUES (?, ?, ?, ?)`,
+		token.ID, token.UserID.String(), token.CreatedAt, token.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("exec error DB:%w", err)
+	}
+	return nil
+}
+
+// UsePasswordResetToken checks and marks the token in one statement, like UseRefreshToken,
+// so a reset link can't be used twice by concurrent requests.
+func (s *TokenRepo) UsePasswordResetToken(id string, at time.Time) (app.PasswordResetToken, error) {
+	res, err := s.db.Exec(`UPDATE password_reset_tokens SET used_at = ? WHERE id = ? AND used_at IS NULL AND expires_at > ?`, at, id, at)
+	if err != nil {
+		return app.PasswordResetToken{}, fmt.Errorf("exec error DB:%w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return app.PasswordResetToken{}, fmt.Errorf("rows affected error DB:%w", err)
+	}
+	if n == 0 {
+		return app.PasswordResetToken{}, app.ErrInvalidResetToken
+	}
+
+	token := app.PasswordResetToken{UsedAt: &at}
+	err = s.db.QueryRow(`SELECT id, user_uuid, created_at, expires_at FROM password_reset_tokens WHERE id = ?`, id).
+		Scan(&token.ID, &token.UserID, &token.CreatedAt, &token.ExpiresAt)
+	if err != nil {
+		return app.PasswordResetToken{}, fmt.Errorf("scan error DB:%w", err)
+	}
+	return token, nil
+}
+
+func (s *TokenRepo) RevokePasswordResetTokens(userID string, at time.Time) error {
+	_, err := s.db.Exec(`UPDATE password_reset_tokens SET used_at = ? WHERE user_uuid = ? AND used_at IS NULL`, at, userID)
+	if err != nil {
+		return fmt.Errorf("exec error DB:%w", err)
+	}
+	return nil
+}
+
+func (s *TokenRepo) SaveEmailVerificationToken(token app.EmailVerificationToken) error {
+	_, err := s.db.Exec(`INSERT INTO email_verification_tokens (id, user_uuid, email, created_at, expires_at) VALUES (?, ?, ?, ?, ?)`,
+		token.ID, token.UserID.String(), token.Email, token.CreatedAt, token.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("exec error DB:%w", err)
+	}
+	return nil
+}
+
+func (s *TokenRepo) UseEmailVerificationToken(id string, at time.Time) (app.EmailVerificationToken, error) {
+	res, err := s.db.Exec(`UPDATE email_verification_tokens SET used_at = ? WHERE id = ? AND used_at IS NULL AND expires_at > ?`, at, id, at)
+	if err != nil {
+		return app.EmailVerificationToken{}, fmt.Errorf("exec error DB:%w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return app.EmailVerificationToken{}, fmt.Errorf("rows affected error DB:%w", err)
+	}
+	if n == 0 {
+		return app.EmailVerificationToken{}, app.ErrInvalidVerificationToken
+	}
+
+	token := app.EmailVerificationToken{UsedAt: &at}
+	err = s.db.QueryRow(`SELECT id, user_uuid, email, created_at, expires_at FROM email_verification_tokens WHERE id = ?`, id).
+		Scan(&token.ID, &token.UserID, &token.Email, &token.CreatedAt, &token.ExpiresAt)
+	if err != nil {
+		return app.EmailVerificationToken{}, fmt.Errorf("scan error DB:%w", err)
+	}
+	return token, nil
+}
+
+func (s *TokenRepo) RevokeEmailVerificationTokens(userID string, at time.Time) error {
+	_, err := s.db.Exec(`UPDATE email_verification_tokens SET used_at = ? WHERE user_uuid = ? AND used_at IS NULL`, at, userID)
+	if err != nil {
+		return fmt.Errorf("exec error DB:%w", err)
+	}
+	return nil
+}
+
+func (s *TokenRepo) SaveOIDCState(state app.OIDCState) error {
+	_, err := s.db.Exec(`INSERT INTO oidc_states (id, provider, code_verifier, nonce, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		state.ID, state.Provider, state.CodeVerifier, state.Nonce, state.CreatedAt, state.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("exec error DB:%w", err)
+	}
+	return nil
+}
+
+func (s *TokenRepo) UseOIDCState(id string, at time.Time) (app.OIDCState, error) {
+	res, err := s.db.Exec(`UPDATE oidc_states SET used_at = ? WHERE id = ? AND used_at IS NULL AND expires_at > ?`, at, id, at)
+	if err != nil {
+		return app.OIDCState{}, fmt.Errorf("exec error DB:%w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return app.OIDCState{}, fmt.Errorf("rows affected error DB:%w", err)
+	}
+	if n == 0 {
+		return app.OIDCState{}, app.ErrInvalidOIDCState
+	}
+
+	state := app.OIDCState{UsedAt: &at}
+	err = s.db.QueryRow(`SELECT id, provider, code_verifier, nonce, created_at, expires_at FROM oidc_states WHERE id = ?`, id).
+		Scan(&state.ID, &state.Provider, &state.CodeVerifier, &state.Nonce, &state.CreatedAt, &state.ExpiresAt)
+	if err != nil {
+		return app.OIDCState{}, fmt.Errorf("scan error DB:%w", err)
+	}
+	return state, nil
+}
@@ -5,35 +5,107 @@ import (
 	"fmt"
 	"database/sql"
 	"strings"
+	"time"
 )
 
 type UserRepo struct{
-	db *sql.DB
+	db sqlDB
 }
 
 func NewUserRepo(db *sql.DB) *UserRepo {
-	return &UserRepo{db: db}
+	return &UserRepo{db: newSQLDB(db)}
 }
 
 func (s *UserRepo) SaveNewUser(user app.User) error {
-	stmt, err := s.db.Prepare(`INSERT INTO users (uuid, login, password) VALUES (?, ?, ?)`)
+	stmt, err := s.db.Prepare(`INSERT INTO users (uuid, login, password, role, status, email) VALUES (?, ?, ?, ?, ?, ?)`)
 	if err != nil {
 		return fmt.Errorf("prepare error DB:%w", err)
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(user.UUID, strings.ToLower(user.Login), user.Password)
+	role := user.Role
+	if role == "" {
+		role = app.RoleUser
+	}
+	status := user.Status
+	if status == "" {
+		status = app.UserStatusActive
+	}
+	email := sql.NullString{String: strings.ToLower(user.Email), Valid: user.Email != ""}
+	_, err = stmt.Exec(user.UUID, strings.ToLower(user.Login), user.Password, role, status, email)
+	if err != nil {
+		return fmt.Errorf("exec error DB:%w", err)
+	}
+
+	return nil
+}
+
+// SaveNewUserWithIdentity saves a user who signed up through an identity provider and the link
+// to their external account in one transaction; the provider may have verified the e-mail.
+func (s *UserRepo) SaveNewUserWithIdentity(user app.User, identity app.UserIdentity) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	role := user.Role
+	if role == "" {
+		role = app.RoleUser
+	}
+	status := user.Status
+	if status == "" {
+		status = app.UserStatusActive
+	}
+	email := sql.NullString{String: strings.ToLower(user.Email), Valid: user.Email != ""}
+	_, err = tx.Exec(`INSERT INTO users (uuid, login, password, role, status, email, email_verified_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		user.UUID, strings.ToLower(user.Login), user.Password, role, status, email, user.EmailVerifiedAt)
 	if err != nil {
 		return fmt.Errorf("exec error DB:%w", err)
 	}
+	if err := saveIdentity(tx, identity); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit error DB:%w", err)
+	}
+	return nil
+}
 
+func (s *UserRepo) SaveIdentity(identity app.UserIdentity) error {
+	return saveIdentity(s.db, identity)
+}
+
+// execer is a sqlDB or sqlTx.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func saveIdentity(db execer, identity app.UserIdentity) error {
+	_, err := db.Exec(`INSERT INTO user_identities (provider, subject, user_uuid, email, created_at) VALUES (?, ?, ?, ?, ?)`,
+		identity.Provider, identity.Subject, identity.UserID.String(), identity.Email, identity.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("exec error DB:%w", err)
+	}
 	return nil
 }
 
+func (s *UserRepo) FindByIdentity(provider string, subject string) (app.User, error) {
+	row := s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE uuid = (SELECT user_uuid FROM user_identities WHERE provider = ? AND subject = ?)`,
+		provider, subject)
+	user, err := scanUser(row)
+	if err != nil {
+		return app.User{}, fmt.Errorf("scan error DB:%w", err)
+	}
+	return user, nil
+}
+
+const userColumns = `uuid, login, password, role, status, status_reason, suspended_until, password_reset_required, email, email_verified_at,
+	totp_secret, totp_enabled_at, totp_last_step`
+
 func (s *UserRepo) FindByLogin(login string) (app.User, error) {
-	var user app.User
-	row := s.db.QueryRow(`SELECT uuid, login, password FROM users WHERE login = ?`, strings.ToLower(login))
-	err := row.Scan(&user.UUID, &user.Login, &user.Password)
+	row := s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE login = ?`, strings.ToLower(login))
+	user, err := scanUser(row)
 	if err != nil {
 		return app.User{}, fmt.Errorf("scan error DB:%w", err)
 	}
@@ -41,11 +113,247 @@ func (s *UserRepo) FindByLogin(login string) (app.User, error) {
 }
 
 func (s *UserRepo) FindByUUID(uuid string) (app.User, error) {
-	var user app.User
-	row := s.db.QueryRow(`SELECT uuid, login, password FROM users WHERE uuid = ?`, uuid)
-	err := row.Scan(&user.UUID, &user.Login, &user.Password)
+	row := s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE uuid = ?`, uuid)
+	user, err := scanUser(row)
+	if err != nil {
+		return app.User{}, fmt.Errorf("scan error DB:%w", err)
+	}
+	return user, nil
+}
+
+func (s *UserRepo) FindByEmail(email string) (app.User, error) {
+	row := s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE email = ?`, strings.ToLower(email))
+	user, err := scanUser(row)
 	if err != nil {
 		return app.User{}, fmt.Errorf("scan error DB:%w", err)
 	}
 	return user, nil
 }
+
+// ListUsers returns a page of users matching the filter, ordered by login.
+func (s *UserRepo) ListUsers(params app.UsersListParams) ([]app.User, error) {
+	filter, args := usersFilter(params)
+	args = append(args, params.Limit, (params.Page-1)*params.Limit)
+	rows, err := s.db.Query(`SELECT `+userColumns+` FROM users WHERE `+filter+` ORDER BY login LIMIT ? OFFSET ?`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query error DB: %w", err)
+	}
+	defer rows.Close()
+
+	users := []app.User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan error DB:%w", err)
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// CountUsers returns how many users ListUsers would return across all pages.
+func (s *UserRepo) CountUsers(params app.UsersListParams) (int, error) {
+	filter, args := usersFilter(params)
+	var total int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM users WHERE `+filter, args...).Scan(&total); err != nil {
+		return 0, fmt.Errorf("scan error DB:%w", err)
+	}
+	return total, nil
+}
+
+// usersFilter builds the WHERE conditions shared by ListUsers and CountUsers.
+func usersFilter(params app.UsersListParams) (string, []any) {
+	filter := "1 = 1"
+	args := []any{}
+	if params.Query != "" {
+		filter += ` AND login LIKE ? ESCAPE '\'`
+		args = append(args, "%"+escapeLike(strings.ToLower(params.Query))+"%")
+	}
+	if params.Role != "" {
+		filter += " AND role = ?"
+		args = append(args, params.Role)
+	}
+	if params.Status != "" {
+		filter += " AND status = ?"
+		args = append(args, params.Status)
+	}
+	return filter, args
+}
+
+// escapeLike makes % and _ in a search string match literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+func (s *UserRepo) SetRole(uuid string, role string) error {
+	return s.updateUser(`UPDATE users SET role = ? WHERE uuid = ?`, role, uuid)
+}
+
+// SetStatus changes the account status; until is the end of a suspension and nil otherwise.
+func (s *UserRepo) SetStatus(uuid string, status string, reason string, until *time.Time) error {
+	return s.updateUser(`UPDATE users SET status = ?, status_reason = ?, suspended_until = ? WHERE uuid = ?`, status, reason, until, uuid)
+}
+
+func (s *UserRepo) SetPasswordResetRequired(uuid string, required bool) error {
+	return s.updateUser(`UPDATE users SET password_reset_required = ? WHERE uuid = ?`, required, uuid)
+}
+
+func (s *UserRepo) SetPassword(uuid string, hash string) error {
+	return s.updateUser(`UPDATE users SET password = ?, password_reset_required = ? WHERE uuid = ?`, hash, false, uuid)
+}
+
+func (s *UserRepo) SetEmailVerified(uuid string, email string, at time.Time) error {
+	res, err := s.db.Exec(`UPDATE users SET email_verified_at = ? WHERE uuid = ? AND email = ?`, at, uuid, email)
+	if err != nil {
+		return fmt.Errorf("exec error DB:%w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected error DB:%w", err)
+	}
+	if n == 0 {
+		return app.ErrInvalidVerificationToken
+	}
+	return nil
+}
+
+func (s *UserRepo) SetTOTPSecret(uuid string, secret string) error {
+	return s.updateUser(`UPDATE users SET totp_secret = ?, totp_enabled_at = NULL WHERE uuid = ?`, secret, uuid)
+}
+
+// EnableTOTP sets totp_enabled_at and the recovery codes in one transaction.
+func (s *UserRepo) EnableTOTP(uuid string, at time.Time, codeHashes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE users SET totp_enabled_at = ? WHERE uuid = ?`, at, uuid)
+	if err != nil {
+		return fmt.Errorf("exec error DB:%w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected error DB:%w", err)
+	}
+	if n == 0 {
+		return app.ErrUserNotFound
+	}
+	if _, err := tx.Exec(`DELETE FROM totp_recovery_codes WHERE user_uuid = ?`, uuid); err != nil {
+		return fmt.Errorf("exec error DB:%w", err)
+	}
+	for _, hash := range codeHashes {
+		if _, err := tx.Exec(`INSERT INTO totp_recovery_codes (user_uuid, code_hash) VALUES (?, ?)`, uuid, hash); err != nil {
+			return fmt.Errorf("exec error DB:%w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit error DB:%w", err)
+	}
+	return nil
+}
+
+// UseTOTPStep only moves totp_last_step forward, so of two concurrent logins with the same
+// code just one succeeds.
+func (s *UserRepo) UseTOTPStep(uuid string, step int64) (bool, error) {
+	res, err := s.db.Exec(`UPDATE users SET totp_last_step = ? WHERE uuid = ? AND totp_last_step < ?`, step, uuid, step)
+	if err != nil {
+		return false, fmt.Errorf("exec error DB:%w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("rows affected error DB:%w", err)
+	}
+	return n == 1, nil
+}
+
+func (s *UserRepo) UseRecoveryCode(uuid string, codeHash string, at time.Time) (bool, error) {
+	res, err := s.db.Exec(`UPDATE totp_recovery_codes SET used_at = ? WHERE user_uuid = ? AND code_hash = ? AND used_at IS NULL`, at, uuid, codeHash)
+	if err != nil {
+		return false, fmt.Errorf("exec error DB:%w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("rows affected error DB:%w", err)
+	}
+	return n == 1, nil
+}
+
+// DeleteUser removes the user with their sessions and tokens; the ads have to be deleted before.
+func (s *UserRepo) DeleteUser(uuid string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM refresh_tokens WHERE user_uuid = ?`, uuid); err != nil {
+		return fmt.Errorf("exec error DB:%w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM sessions WHERE user_uuid = ?`, uuid); err != nil {
+		return fmt.Errorf("exec error DB:%w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM password_reset_tokens WHERE user_uuid = ?`, uuid); err != nil {
+		return fmt.Errorf("exec error DB:%w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM email_verification_tokens WHERE user_uuid = ?`, uuid); err != nil {
+		return fmt.Errorf("exec error DB:%w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM totp_recovery_codes WHERE user_uuid = ?`, uuid); err != nil {
+		return fmt.Errorf("exec error DB:%w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM user_identities WHERE user_uuid = ?`, uuid); err != nil {
+		return fmt.Errorf("exec error DB:%w", err)
+	}
+	res, err := tx.Exec(`DELETE FROM users WHERE uuid = ?`, uuid)
+	if err != nil {
+		return fmt.Errorf("exec error DB:%w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected error DB:%w", err)
+	}
+	if n == 0 {
+		return app.ErrUserNotFound
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit error DB:%w", err)
+	}
+	return nil
+}
+
+// updateUser runs an UPDATE of one user, reporting ErrUserNotFound when no row matched.
+func (s *UserRepo) updateUser(query string, args ...any) error {
+	res, err := s.db.Exec(query, args...)
+	if err != nil {
+		return fmt.Errorf("exec error DB:%w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected error DB:%w", err)
+	}
+	if n == 0 {
+		return app.ErrUserNotFound
+	}
+	return nil
+}
+
+func scanUser(row rowScanner) (app.User, error) {
+	var user app.User
+	var suspendedUntil, emailVerifiedAt, totpEnabledAt sql.NullTime
+	var email sql.NullString
+	err := row.Scan(&user.UUID, &user.Login, &user.Password, &user.Role, &user.Status, &user.StatusReason, &suspendedUntil, &user.PasswordResetRequired,
+		&email, &emailVerifiedAt, &user.TOTPSecret, &totpEnabledAt, &user.TOTPLastStep)
+	if suspendedUntil.Valid {
+		user.SuspendedUntil = &suspendedUntil.Time
+	}
+	user.Email = email.String
+	if emailVerifiedAt.Valid {
+		user.EmailVerifiedAt = &emailVerifiedAt.Time
+	}
+	if totpEnabledAt.Valid {
+		user.TOTPEnabledAt = &totpEnabledAt.Time
+	}
+	return user, err
+}
@@ -2,19 +2,24 @@ package di
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"github.com/go-chi/chi/v5"
 	"go.uber.org/fx"
+	"marketplace/internal/app"
 	"marketplace/internal/config"
+	"marketplace/internal/datasource"
 	"marketplace/internal/web"
 	"go.uber.org/zap"
 )
 
 
-func StartHTTPServer(lc fx.Lifecycle, user_handler *web.UserHandler, market_handler *web.MarketHandler, config *config.Config, logger *zap.Logger) {
+func StartHTTPServer(lc fx.Lifecycle, user_handler *web.UserHandler, market_handler *web.MarketHandler, admin_handler *web.AdminHandler, config *config.Config, logger *zap.Logger) {
 	router := chi.NewRouter()
-	web.RegisterRoutes(router, user_handler, market_handler)
+	web.RegisterRoutes(router, user_handler, market_handler, admin_handler)
 
 	addres := fmt.Sprintf(":%d", config.Http_port)
 	server := &http.Server{
@@ -33,4 +38,52 @@ func StartHTTPServer(lc fx.Lifecycle, user_handler *web.UserHandler, market_hand
 			return server.Close()
 		},
 	})
-}
\ No newline at end of file
+}
+
+func RunMigrations(lc fx.Lifecycle, db *sql.DB, config *config.Config, logger *zap.Logger) {
+	if !config.Migrations.Auto {
+		logger.Info("Automatic migrations are disabled")
+		return
+	}
+
+	lc.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			migrator, err := datasource.NewMigrator(db)
+			if err != nil {
+				return err
+			}
+			applied, err := migrator.Up()
+			if err != nil {
+				return err
+			}
+			logger.Info("Migrations applied", zap.Int("count", applied))
+			return nil
+		},
+	})
+}
+
+// PromoteAdmins gives the admin role to the users listed in config.Admins, so the first
+// administrator can be set up without an admin API. It runs after RunMigrations.
+func PromoteAdmins(lc fx.Lifecycle, repo app.UserRepository, config *config.Config, logger *zap.Logger) {
+	if len(config.Admins) == 0 {
+		return
+	}
+
+	lc.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			for _, id := range config.Admins {
+				id = strings.ToLower(strings.TrimSpace(id))
+				err := repo.SetRole(id, app.RoleAdmin)
+				if errors.Is(err, app.ErrUserNotFound) {
+					logger.Warn("Admin from config not found", zap.String("uuid", id))
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				logger.Info("Admin role granted", zap.String("uuid", id))
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,173 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"marketplace/internal/app"
+	"net/http"
+	"strconv"
+	"strings"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// AdminHandler serves /admin/users; the router lets only admins through.
+type AdminHandler struct {
+	logger *zap.Logger
+	app    app.AdminServicer
+}
+
+func NewAdminHandler(app app.AdminServicer, logger *zap.Logger) *AdminHandler {
+	return &AdminHandler{
+		app:    app,
+		logger: logger,
+	}
+}
+
+func (h *AdminHandler) Users(w http.ResponseWriter, r *http.Request) {
+	rq := r.URL.Query()
+	params := app.UsersListParams{
+		Page:   pageParam(rq.Get("page")),
+		Limit:  limitParam(rq.Get("limit")),
+		Query:  strings.TrimSpace(rq.Get("q")),
+		Role:   rq.Get("role"),
+		Status: rq.Get("status"),
+	}
+
+	users, err := h.app.Users(params)
+	if err != nil {
+		h.logger.Warn("failed to list users", zap.Error(err))
+		http.Error(w, err.Error(), adminErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(users)
+}
+
+func (h *AdminHandler) UserAds(w http.ResponseWriter, r *http.Request) {
+	userID, ok := h.userParam(w, r)
+	if !ok {
+		return
+	}
+	rq := r.URL.Query()
+
+	ads, err := h.app.UserAds(userID, pageParam(rq.Get("page")), limitParam(rq.Get("limit")))
+	if err != nil {
+		h.logger.Warn("failed to list user ads", zap.Error(err), zap.String("user", userID.String()))
+		http.Error(w, err.Error(), adminErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ads)
+}
+
+func (h *AdminHandler) BlockUser(w http.ResponseWriter, r *http.Request) {
+	userID, ok := h.userParam(w, r)
+	if !ok {
+		return
+	}
+	// an empty body bans without a reason
+	var req app.BlockUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		h.logger.Warn("invalid block request body", zap.Error(err))
+		http.Error(w, "bad block request", http.StatusBadRequest)
+		return
+	}
+	adminID, _ := contextUserID(r)
+	user, err := h.app.BlockUser(userID, req, adminID)
+	h.writeUser(w, "user blocked", adminID, user, err)
+}
+
+func (h *AdminHandler) UnblockUser(w http.ResponseWriter, r *http.Request) {
+	userID, ok := h.userParam(w, r)
+	if !ok {
+		return
+	}
+	adminID, _ := contextUserID(r)
+	user, err := h.app.UnblockUser(userID)
+	h.writeUser(w, "user unblocked", adminID, user, err)
+}
+
+func (h *AdminHandler) ForcePasswordReset(w http.ResponseWriter, r *http.Request) {
+	userID, ok := h.userParam(w, r)
+	if !ok {
+		return
+	}
+	adminID, _ := contextUserID(r)
+	user, err := h.app.ForcePasswordReset(userID)
+	h.writeUser(w, "password reset forced", adminID, user, err)
+}
+
+func (h *AdminHandler) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	userID, ok := h.userParam(w, r)
+	if !ok {
+		return
+	}
+	adminID, _ := contextUserID(r)
+
+	if err := h.app.DeleteUser(userID, adminID); err != nil {
+		h.logger.Warn("failed to delete user", zap.Error(err), zap.String("user", userID.String()))
+		http.Error(w, err.Error(), adminErrorStatus(err))
+		return
+	}
+	h.logger.Info("user deleted", zap.String("user", userID.String()), zap.String("admin", adminID.String()))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// userParam parses the {uuid} of the user being managed, answering 400 when it is malformed.
+func (h *AdminHandler) userParam(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	userID, err := uuid.Parse(chi.URLParam(r, "uuid"))
+	if err != nil {
+		h.logger.Warn("invalid user uuid", zap.Error(err))
+		http.Error(w, "invalid user uuid", http.StatusBadRequest)
+		return uuid.Nil, false
+	}
+	return userID, true
+}
+
+// writeUser answers an admin action with the updated user, logging who did it.
+func (h *AdminHandler) writeUser(w http.ResponseWriter, action string, adminID uuid.UUID, user app.UserSummary, err error) {
+	if err != nil {
+		h.logger.Warn("admin action failed", zap.Error(err), zap.String("action", action))
+		http.Error(w, err.Error(), adminErrorStatus(err))
+		return
+	}
+	h.logger.Info(action, zap.String("user", user.UUID.String()), zap.String("admin", adminID.String()))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(user)
+}
+
+// pageParam and limitParam fall back to the first page of 10, like /ads-list.
+func pageParam(s string) int {
+	page, err := strconv.Atoi(s)
+	if err != nil || page < 1 {
+		return 1
+	}
+	return page
+}
+
+func limitParam(s string) int {
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit < 1 {
+		return 10
+	}
+	return limit
+}
+
+func adminErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, app.ErrUserNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, app.ErrSelfAction), errors.Is(err, app.ErrInvalidUserFilter), errors.Is(err, app.ErrInvalidSuspension):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,168 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"marketplace/internal/app"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+func newAdminTestHandler() (*AdminHandler, *app.MockUserRepo) {
+	users := &app.MockUserRepo{Users: make(map[string]app.User)}
+	service := app.NewAdminService(users, &app.MockTokenRepo{}, &app.MockMarketRepo{}, &app.MockBlobStore{})
+	return NewAdminHandler(service, zap.NewNop()), users
+}
+
+// adminRequest builds a request to /admin/users/{uuid}... made by adminID.
+func adminRequest(method string, target string, userParam string, body string, adminID uuid.UUID) *http.Request {
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("uuid", userParam)
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	ctx := context.WithValue(req.Context(), chi.RouteCtxKey, rctx)
+	return req.WithContext(context.WithValue(ctx, UserIDKey, adminID.String()))
+}
+
+func TestAdminHandler_Users(t *testing.T) {
+	handler, users := newAdminTestHandler()
+	users.SaveNewUser(app.User{UUID: uuid.New(), Login: "alice", Password: "hash", Role: app.RoleUser, Status: app.UserStatusActive})
+	users.SaveNewUser(app.User{UUID: uuid.New(), Login: "bob", Password: "hash", Role: app.RoleAdmin, Status: app.UserStatusActive})
+
+	cases := []struct {
+		name     string
+		query    string
+		expected int
+		total    int
+	}{
+		{"all", "", http.StatusOK, 2},
+		{"by login", "?q=ali", http.StatusOK, 1},
+		{"by role", "?role=admin", http.StatusOK, 1},
+		{"unknown status", "?status=deleted", http.StatusBadRequest, 0},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/admin/users"+tc.query, nil)
+			w := httptest.NewRecorder()
+			handler.Users(w, req)
+
+			if w.Code != tc.expected {
+				t.Fatalf("expected %d, got %d", tc.expected, w.Code)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var page app.UsersPage
+			if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+				t.Fatalf("invalid json response: %v", err)
+			}
+			if page.Total != tc.total || page.Page != 1 || page.Limit != 10 {
+				t.Errorf("unexpected page: %+v", page)
+			}
+		})
+	}
+
+	req := httptest.NewRequest("GET", "/admin/users", nil)
+	w := httptest.NewRecorder()
+	handler.Users(w, req)
+	var raw map[string][]map[string]any
+	json.NewDecoder(w.Body).Decode(&raw)
+	if _, ok := raw["items"][0]["password"]; ok {
+		t.Error("expected password hashes to stay out of the response")
+	}
+}
+
+func TestAdminHandler_BlockUser(t *testing.T) {
+	handler, users := newAdminTestHandler()
+	adminID := uuid.New()
+	user := app.User{UUID: uuid.New(), Login: "spammer", Role: app.RoleUser, Status: app.UserStatusActive}
+	users.SaveNewUser(user)
+	until := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+
+	cases := []struct {
+		name     string
+		user     string
+		body     string
+		expected int
+		status   string
+	}{
+		{"suspended", user.UUID.String(), `{"reason":"spam","until":"` + until + `"}`, http.StatusOK, app.UserStatusSuspended},
+		{"banned without a body", user.UUID.String(), "", http.StatusOK, app.UserStatusBanned},
+		{"suspension in the past", user.UUID.String(), `{"until":"` + past + `"}`, http.StatusBadRequest, ""},
+		{"invalid body", user.UUID.String(), `{"until":"tomorrow"}`, http.StatusBadRequest, ""},
+		{"self", adminID.String(), "", http.StatusBadRequest, ""},
+		{"unknown user", uuid.NewString(), "", http.StatusNotFound, ""},
+		{"invalid uuid", "abc", "", http.StatusBadRequest, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.BlockUser(w, adminRequest("POST", "/admin/users/"+tc.user+"/block", tc.user, tc.body, adminID))
+			if w.Code != tc.expected {
+				t.Fatalf("expected %d, got %d", tc.expected, w.Code)
+			}
+			if tc.status == "" {
+				return
+			}
+			var summary app.UserSummary
+			json.NewDecoder(w.Body).Decode(&summary)
+			if summary.Status != tc.status {
+				t.Errorf("expected status %q, got %q", tc.status, summary.Status)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	handler.UnblockUser(w, adminRequest("POST", "/admin/users/"+user.UUID.String()+"/unblock", user.UUID.String(), "", adminID))
+	var summary app.UserSummary
+	json.NewDecoder(w.Body).Decode(&summary)
+	if w.Code != http.StatusOK || summary.Status != app.UserStatusActive {
+		t.Errorf("expected the user to be unblocked, got %d %+v", w.Code, summary)
+	}
+}
+
+func TestAdminHandler_ForcePasswordReset(t *testing.T) {
+	handler, users := newAdminTestHandler()
+	user := app.User{UUID: uuid.New(), Login: "victim", Role: app.RoleUser, Status: app.UserStatusActive}
+	users.SaveNewUser(user)
+
+	w := httptest.NewRecorder()
+	handler.ForcePasswordReset(w, adminRequest("POST", "/admin/users/"+user.UUID.String()+"/password-reset", user.UUID.String(), "", uuid.New()))
+	var summary app.UserSummary
+	json.NewDecoder(w.Body).Decode(&summary)
+	if w.Code != http.StatusOK || !summary.PasswordResetRequired {
+		t.Errorf("expected password_reset_required, got %d %+v", w.Code, summary)
+	}
+}
+
+func TestAdminHandler_DeleteUser(t *testing.T) {
+	handler, users := newAdminTestHandler()
+	adminID := uuid.New()
+	user := app.User{UUID: uuid.New(), Login: "leaver", Role: app.RoleUser, Status: app.UserStatusActive}
+	users.SaveNewUser(user)
+
+	cases := []struct {
+		name     string
+		user     string
+		expected int
+	}{
+		{"deleted", user.UUID.String(), http.StatusNoContent},
+		{"already deleted", user.UUID.String(), http.StatusNotFound},
+		{"self", adminID.String(), http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.DeleteUser(w, adminRequest("DELETE", "/admin/users/"+tc.user, tc.user, "", adminID))
+			if w.Code != tc.expected {
+				t.Errorf("expected %d, got %d", tc.expected, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"marketplace/internal/app"
+	"net/http"
+	"strconv"
+	"go.uber.org/zap"
+	"github.com/go-chi/chi/v5"
+)
+
+func (h *MarketHandler) CategoryTree(w http.ResponseWriter, r *http.Request) {
+	tree, err := h.app.CategoryTree(r.URL.Query().Get("lang"))
+	if err != nil {
+		h.logger.Error("failed to get category tree", zap.Error(err))
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if tree == nil {
+		tree = []app.Category{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tree)
+}
+
+func (h *MarketHandler) NewCategory(w http.ResponseWriter, r *http.Request) {
+	var req app.CategoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.logger.Warn("invalid category request body", zap.Error(err))
+		http.Error(w, "bad request in body", http.StatusBadRequest)
+		return
+	}
+
+	category, err := h.app.NewCategory(req)
+	if err != nil {
+		h.logger.Warn("failed to create category", zap.Error(err))
+		http.Error(w, err.Error(), categoryErrorStatus(err))
+		return
+	}
+	h.logger.Info("category created successfully", zap.Int64("category_id", category.ID))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(category)
+}
+
+func (h *MarketHandler) UpdateCategory(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		h.logger.Warn("invalid category id", zap.Error(err))
+		http.Error(w, "invalid category id", http.StatusBadRequest)
+		return
+	}
+	var req app.CategoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.logger.Warn("invalid category request body", zap.Error(err))
+		http.Error(w, "bad request in body", http.StatusBadRequest)
+		return
+	}
+
+	category, err := h.app.UpdateCategory(id, req)
+	if err != nil {
+		h.logger.Warn("failed to update category", zap.Error(err), zap.Int64("category_id", id))
+		http.Error(w, err.Error(), categoryErrorStatus(err))
+		return
+	}
+	h.logger.Info("category updated successfully", zap.Int64("category_id", id))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(category)
+}
+
+func (h *MarketHandler) DeleteCategory(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		h.logger.Warn("invalid category id", zap.Error(err))
+		http.Error(w, "invalid category id", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.app.DeleteCategory(id); err != nil {
+		h.logger.Warn("failed to delete category", zap.Error(err), zap.Int64("category_id", id))
+		http.Error(w, err.Error(), categoryErrorStatus(err))
+		return
+	}
+	h.logger.Info("category deleted successfully", zap.Int64("category_id", id))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func categoryErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, app.ErrCategoryNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, app.ErrCategorySlugTaken), errors.Is(err, app.ErrCategoryInUse):
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
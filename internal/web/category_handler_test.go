@@ -0,0 +1,137 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"marketplace/internal/app"
+	"marketplace/internal/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"go.uber.org/zap"
+)
+
+func TestMarketHandler_CategoryTree(t *testing.T) {
+	var gotLang string
+	mockService := &MockMarketService{
+		CategoryTreeFunc: func(lang string) ([]app.Category, error) {
+			gotLang = lang
+			return []app.Category{{ID: 1, Slug: "electronics", Name: "Electronics"}}, nil
+		},
+	}
+	handler := NewMarketHandler(mockService, &config.Config{}, zap.NewNop())
+
+	req := httptest.NewRequest("GET", "/categories?lang=en", nil)
+	w := httptest.NewRecorder()
+	handler.CategoryTree(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d", w.Code)
+	}
+	if gotLang != "en" {
+		t.Errorf("expected lang en, got %q", gotLang)
+	}
+	var tree []app.Category
+	if err := json.NewDecoder(w.Body).Decode(&tree); err != nil {
+		t.Fatalf("invalid json response: %v", err)
+	}
+	if len(tree) != 1 || tree[0].Name != "Electronics" {
+		t.Errorf("unexpected tree: %+v", tree)
+	}
+}
+
+func TestMarketHandler_NewCategory(t *testing.T) {
+	mockService := &MockMarketService{
+		NewCategoryFunc: func(req app.CategoryRequest) (app.Category, error) {
+			if req.Slug == "phones" {
+				return app.Category{}, app.ErrCategorySlugTaken
+			}
+			return app.Category{ID: 3, Slug: req.Slug, Names: req.Names}, nil
+		},
+	}
+	handler := NewMarketHandler(mockService, &config.Config{}, zap.NewNop())
+
+	cases := []struct {
+		name     string
+		body     string
+		expected int
+	}{
+		{"created", `{"slug":"tablets","names":{"ru":"Планшеты"}}`, http.StatusCreated},
+		{"slug taken", `{"slug":"phones","names":{"ru":"Телефоны"}}`, http.StatusConflict},
+		{"invalid body", `not json`, http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/admin/categories", bytes.NewBufferString(tc.body))
+			w := httptest.NewRecorder()
+			handler.NewCategory(w, req)
+			if w.Code != tc.expected {
+				t.Errorf("expected %d, got %d", tc.expected, w.Code)
+			}
+		})
+	}
+}
+
+func TestMarketHandler_UpdateCategory(t *testing.T) {
+	mockService := &MockMarketService{
+		UpdateCategoryFunc: func(id int64, req app.CategoryRequest) (app.Category, error) {
+			switch id {
+			case 1:
+				return app.Category{}, app.ErrCategoryCycle
+			case 2:
+				return app.Category{ID: id, Slug: req.Slug, Names: req.Names}, nil
+			default:
+				return app.Category{}, app.ErrCategoryNotFound
+			}
+		},
+	}
+	handler := NewMarketHandler(mockService, &config.Config{}, zap.NewNop())
+
+	cases := []struct {
+		name     string
+		id       string
+		expected int
+	}{
+		{"updated", "2", http.StatusOK},
+		{"cycle", "1", http.StatusBadRequest},
+		{"not found", "42", http.StatusNotFound},
+		{"invalid id", "abc", http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := bytes.NewBufferString(`{"slug":"phones","names":{"ru":"Телефоны"}}`)
+			req := withURLParam(httptest.NewRequest("PUT", "/admin/categories/"+tc.id, body), "id", tc.id)
+			w := httptest.NewRecorder()
+			handler.UpdateCategory(w, req)
+			if w.Code != tc.expected {
+				t.Errorf("expected %d, got %d", tc.expected, w.Code)
+			}
+		})
+	}
+}
+
+func TestMarketHandler_DeleteCategory(t *testing.T) {
+	mockService := &MockMarketService{
+		DeleteCategoryFunc: func(id int64) error {
+			if id == 1 {
+				return app.ErrCategoryInUse
+			}
+			return nil
+		},
+	}
+	handler := NewMarketHandler(mockService, &config.Config{}, zap.NewNop())
+
+	req := withURLParam(httptest.NewRequest("DELETE", "/admin/categories/2", nil), "id", "2")
+	w := httptest.NewRecorder()
+	handler.DeleteCategory(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", w.Code)
+	}
+
+	req = withURLParam(httptest.NewRequest("DELETE", "/admin/categories/1", nil), "id", "1")
+	w = httptest.NewRecorder()
+	handler.DeleteCategory(w, req)
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected 409 for category in use, got %d", w.Code)
+	}
+}
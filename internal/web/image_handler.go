@@ -0,0 +1,196 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"io"
+	"marketplace/internal/app"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strconv"
+)
+
+// multipartOverhead leaves room for the multipart headers around the image itself.
+const multipartOverhead = 64 << 10
+
+func (h *MarketHandler) UploadAdImage(w http.ResponseWriter, r *http.Request) {
+	aduuid, err := uuid.Parse(chi.URLParam(r, "uuid"))
+	if err != nil {
+		h.logger.Warn("invalid ad uuid", zap.Error(err))
+		http.Error(w, "invalid ad uuid", http.StatusBadRequest)
+		return
+	}
+	userid, ok := contextUserID(r)
+	if !ok {
+		h.logger.Warn("invalid user_id in context")
+		http.Error(w, "invalid user_id in context", http.StatusBadRequest)
+		return
+	}
+
+	file, ok := h.formImage(w, r)
+	if !ok {
+		return
+	}
+	defer file.Close()
+
+	ad, err := h.app.UploadAdImage(aduuid, userid, file, *h.config)
+	if err != nil {
+		h.logger.Warn("failed to upload ad image", zap.Error(err), zap.String("ad_id", aduuid.String()))
+		http.Error(w, err.Error(), imageErrorStatus(err))
+		return
+	}
+	h.logger.Info("ad image uploaded successfully", zap.String("ad_id", ad.UUID.String()), zap.Int("images", len(ad.Images)))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ad)
+}
+
+// UploadImage stores an image before the ad exists; the returned url is passed to NewAd.
+func (h *MarketHandler) UploadImage(w http.ResponseWriter, r *http.Request) {
+	userid, ok := contextUserID(r)
+	if !ok {
+		h.logger.Warn("invalid user_id in context")
+		http.Error(w, "invalid user_id in context", http.StatusBadRequest)
+		return
+	}
+	file, ok := h.formImage(w, r)
+	if !ok {
+		return
+	}
+	defer file.Close()
+
+	uploaded, err := h.app.UploadImage(userid, file, *h.config)
+	if err != nil {
+		h.logger.Warn("failed to upload image", zap.Error(err))
+		http.Error(w, err.Error(), imageErrorStatus(err))
+		return
+	}
+	h.logger.Info("image uploaded successfully", zap.String("url", uploaded.URL))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(uploaded)
+}
+
+func (h *MarketHandler) ReorderAdImages(w http.ResponseWriter, r *http.Request) {
+	aduuid, err := uuid.Parse(chi.URLParam(r, "uuid"))
+	if err != nil {
+		h.logger.Warn("invalid ad uuid", zap.Error(err))
+		http.Error(w, "invalid ad uuid", http.StatusBadRequest)
+		return
+	}
+	var req app.ReorderImagesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.logger.Warn("invalid reorder images request body", zap.Error(err))
+		http.Error(w, "bad request in body", http.StatusBadRequest)
+		return
+	}
+	userid, ok := contextUserID(r)
+	if !ok {
+		h.logger.Warn("invalid user_id in context")
+		http.Error(w, "invalid user_id in context", http.StatusBadRequest)
+		return
+	}
+
+	ad, err := h.app.ReorderAdImages(aduuid, req, userid)
+	if err != nil {
+		h.logger.Warn("failed to reorder ad images", zap.Error(err), zap.String("ad_id", aduuid.String()))
+		http.Error(w, err.Error(), imageErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ad)
+}
+
+func (h *MarketHandler) DeleteAdImage(w http.ResponseWriter, r *http.Request) {
+	aduuid, err := uuid.Parse(chi.URLParam(r, "uuid"))
+	if err != nil {
+		h.logger.Warn("invalid ad uuid", zap.Error(err))
+		http.Error(w, "invalid ad uuid", http.StatusBadRequest)
+		return
+	}
+	imageID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		h.logger.Warn("invalid image id", zap.Error(err))
+		http.Error(w, "invalid image id", http.StatusBadRequest)
+		return
+	}
+	userid, ok := contextUserID(r)
+	if !ok {
+		h.logger.Warn("invalid user_id in context")
+		http.Error(w, "invalid user_id in context", http.StatusBadRequest)
+		return
+	}
+
+	ad, err := h.app.DeleteAdImage(aduuid, imageID, userid)
+	if err != nil {
+		h.logger.Warn("failed to delete ad image", zap.Error(err), zap.String("ad_id", aduuid.String()), zap.Int64("image_id", imageID))
+		http.Error(w, err.Error(), imageErrorStatus(err))
+		return
+	}
+	h.logger.Info("ad image deleted successfully", zap.String("ad_id", aduuid.String()), zap.Int64("image_id", imageID))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ad)
+}
+
+// formImage returns the "image" file of a multipart request, answering the request itself on failure.
+func (h *MarketHandler) formImage(w http.ResponseWriter, r *http.Request) (multipart.File, bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, h.config.Images.MaxBytes+multipartOverhead)
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, app.ErrImageTooLarge.Error(), http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		h.logger.Warn("invalid image upload", zap.Error(err))
+		http.Error(w, "multipart form with an image field is required", http.StatusBadRequest)
+		return nil, false
+	}
+	return file, true
+}
+
+// ServeImage serves stored images; keys are random, so the response can be cached forever.
+func (h *MarketHandler) ServeImage(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "*")
+	rc, err := h.app.OpenImage(key)
+	if errors.Is(err, app.ErrImageNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		h.logger.Error("failed to open image", zap.Error(err), zap.String("key", key))
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+
+	w.Header().Set("Content-Type", mime.TypeByExtension(path.Ext(key)))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, rc)
+}
+
+func imageErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, app.ErrImageTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, app.ErrImageType):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, app.ErrImageDimensions):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, app.ErrTooManyImages):
+		return http.StatusConflict
+	case errors.Is(err, app.ErrImageNotFound):
+		return http.StatusNotFound
+	default:
+		return adErrorStatus(err)
+	}
+}
@@ -0,0 +1,209 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"io"
+	"marketplace/internal/app"
+	"marketplace/internal/config"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func multipartImage(t *testing.T, field string, data []byte) (*bytes.Buffer, string) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile(field, "photo.png")
+	if err != nil {
+		t.Fatalf("failed to create form file: %v", err)
+	}
+	part.Write(data)
+	mw.Close()
+	return &body, mw.FormDataContentType()
+}
+
+func TestMarketHandler_UploadAdImage(t *testing.T) {
+	adID := uuid.New()
+	var received []byte
+	mockService := &MockMarketService{
+		UploadAdImageFunc: func(id uuid.UUID, userID uuid.UUID, file io.Reader, cfg config.Config) (app.Ad, error) {
+			received, _ = io.ReadAll(file)
+			if bytes.Equal(received, []byte("text")) {
+				return app.Ad{}, app.ErrImageType
+			}
+			return app.Ad{UUID: id, Images: []app.AdImage{{ID: 1, URL: "/images/ads/" + id.String() + "/x.png", IsCover: true}}}, nil
+		},
+	}
+	handler := NewMarketHandler(mockService, &config.Config{Images: config.Images{MaxBytes: 1024}}, zap.NewNop())
+
+	cases := []struct {
+		name     string
+		field    string
+		data     []byte
+		expected int
+	}{
+		{"uploaded", "image", []byte("png-bytes"), http.StatusOK},
+		{"wrong content", "image", []byte("text"), http.StatusUnsupportedMediaType},
+		{"missing field", "file", []byte("png-bytes"), http.StatusBadRequest},
+		{"body too large", "image", bytes.Repeat([]byte("a"), 128<<10), http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			body, contentType := multipartImage(t, tc.field, tc.data)
+			req := withURLParam(httptest.NewRequest("POST", "/ads/"+adID.String()+"/images", body), "uuid", adID.String())
+			req.Header.Set("Content-Type", contentType)
+			req = req.WithContext(context.WithValue(req.Context(), UserIDKey, uuid.New().String()))
+			w := httptest.NewRecorder()
+
+			handler.UploadAdImage(w, req)
+
+			if w.Code != tc.expected {
+				t.Errorf("expected %d, got %d", tc.expected, w.Code)
+			}
+		})
+	}
+	if string(received) != "text" {
+		t.Errorf("expected file content to reach the service, got %q", received)
+	}
+}
+
+func TestMarketHandler_ServeImage(t *testing.T) {
+	mockService := &MockMarketService{
+		OpenImageFunc: func(key string) (io.ReadCloser, error) {
+			if key != "ads/1/a.png" {
+				return nil, app.ErrImageNotFound
+			}
+			return io.NopCloser(strings.NewReader("png-bytes")), nil
+		},
+	}
+	handler := NewMarketHandler(mockService, &config.Config{}, zap.NewNop())
+
+	req := withURLParam(httptest.NewRequest("GET", "/images/ads/1/a.png", nil), "*", "ads/1/a.png")
+	w := httptest.NewRecorder()
+	handler.ServeImage(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d", w.Code)
+	}
+	if w.Header().Get("Content-Type") != "image/png" || w.Body.String() != "png-bytes" {
+		t.Errorf("unexpected response %q with content type %q", w.Body.String(), w.Header().Get("Content-Type"))
+	}
+
+	req = withURLParam(httptest.NewRequest("GET", "/images/missing.png", nil), "*", "missing.png")
+	w = httptest.NewRecorder()
+	handler.ServeImage(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", w.Code)
+	}
+}
+
+func TestMarketHandler_UploadImage(t *testing.T) {
+	userID := uuid.New()
+	mockService := &MockMarketService{
+		UploadImageFunc: func(id uuid.UUID, file io.Reader, cfg config.Config) (app.UploadedImage, error) {
+			return app.UploadedImage{URL: "/images/uploads/" + id.String() + "/x.png"}, nil
+		},
+	}
+	handler := NewMarketHandler(mockService, &config.Config{Images: config.Images{MaxBytes: 1024}}, zap.NewNop())
+
+	body, contentType := multipartImage(t, "image", []byte("png-bytes"))
+	req := httptest.NewRequest("POST", "/images", body)
+	req.Header.Set("Content-Type", contentType)
+	req = req.WithContext(context.WithValue(req.Context(), UserIDKey, userID.String()))
+	w := httptest.NewRecorder()
+
+	handler.UploadImage(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201 Created, got %d", w.Code)
+	}
+	var result app.UploadedImage
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("could not decode response: %v", err)
+	}
+	if !strings.Contains(result.URL, userID.String()) {
+		t.Errorf("unexpected url %q", result.URL)
+	}
+}
+
+func TestMarketHandler_ReorderAdImages(t *testing.T) {
+	adID := uuid.New()
+	mockService := &MockMarketService{
+		ReorderAdImagesFunc: func(id uuid.UUID, req app.ReorderImagesRequest, userID uuid.UUID) (app.Ad, error) {
+			if len(req.Order) != 2 {
+				return app.Ad{}, app.ErrImageNotFound
+			}
+			return app.Ad{UUID: id}, nil
+		},
+	}
+	handler := NewMarketHandler(mockService, &config.Config{}, zap.NewNop())
+
+	cases := []struct {
+		name     string
+		body     string
+		expected int
+	}{
+		{"reordered", `{"order":[2,1],"cover_id":2}`, http.StatusOK},
+		{"incomplete order", `{"order":[2]}`, http.StatusNotFound},
+		{"bad body", `{"order":`, http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := withURLParam(httptest.NewRequest("PUT", "/ads/"+adID.String()+"/images", strings.NewReader(tc.body)), "uuid", adID.String())
+			req = req.WithContext(context.WithValue(req.Context(), UserIDKey, uuid.New().String()))
+			w := httptest.NewRecorder()
+
+			handler.ReorderAdImages(w, req)
+
+			if w.Code != tc.expected {
+				t.Errorf("expected %d, got %d", tc.expected, w.Code)
+			}
+		})
+	}
+}
+
+func TestMarketHandler_DeleteAdImage(t *testing.T) {
+	adID := uuid.New()
+	mockService := &MockMarketService{
+		DeleteAdImageFunc: func(id uuid.UUID, imageID int64, userID uuid.UUID) (app.Ad, error) {
+			if imageID != 1 {
+				return app.Ad{}, app.ErrImageNotFound
+			}
+			return app.Ad{UUID: id, Images: []app.AdImage{}}, nil
+		},
+	}
+	handler := NewMarketHandler(mockService, &config.Config{}, zap.NewNop())
+
+	cases := []struct {
+		name     string
+		imageID  string
+		expected int
+	}{
+		{"deleted", "1", http.StatusOK},
+		{"unknown image", "2", http.StatusNotFound},
+		{"invalid id", "abc", http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("uuid", adID.String())
+			rctx.URLParams.Add("id", tc.imageID)
+			req := httptest.NewRequest("DELETE", "/ads/"+adID.String()+"/images/"+tc.imageID, nil)
+			ctx := context.WithValue(req.Context(), chi.RouteCtxKey, rctx)
+			req = req.WithContext(context.WithValue(ctx, UserIDKey, uuid.New().String()))
+			w := httptest.NewRecorder()
+
+			handler.DeleteAdImage(w, req)
+
+			if w.Code != tc.expected {
+				t.Errorf("expected %d, got %d", tc.expected, w.Code)
+			}
+		})
+	}
+}
@@ -2,17 +2,26 @@ package web
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"marketplace/internal/app"
 	"marketplace/internal/config"
 	"net/http"
 	"strconv"
+	"strings"
+	"unicode/utf8"
 	"go.uber.org/zap"
+	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 )
 
+const maxSearchQueryLength = 200
+
+// AdsListResponse is a page of /ads-list with links to the neighbouring pages.
 type AdsListResponse struct {
-	Total int       `json:"total"`
-	Items []app.Ad  `json:"items"`
+	app.AdsPage
+	Next string `json:"next,omitempty"`
+	Prev string `json:"prev,omitempty"`
 }
 
 type MarketHandler struct {
@@ -54,7 +63,10 @@ func (h *MarketHandler) NewAd(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		h.logger.Warn("failed to create new ad", zap.Error(err))
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		if writeAccountBlocked(w, err) {
+			return
+		}
+		http.Error(w, err.Error(), adErrorStatus(err))
 		return
 	}
 	h.logger.Info("new ad created successfully", zap.String("ad_id", Adresp.UUID.String()))
@@ -77,14 +89,23 @@ func (h *MarketHandler) AdsList(w http.ResponseWriter, r *http.Request) {
 	if params.Limit == 0 || params.Limit < 1 || err != nil {
 		params.Limit = 10
 	}
+	params.Query = strings.TrimSpace(rq.Get("q"))
+	if utf8.RuneCountInString(params.Query) > maxSearchQueryLength {
+		http.Error(w, fmt.Sprintf("q must be at most %d characters", maxSearchQueryLength), http.StatusBadRequest)
+		return
+	}
 	params.SortBy = rq.Get("sort_by")
-	if params.SortBy != "date" && params.SortBy != "price" {
+	if params.SortBy != "date" && params.SortBy != "price" && params.SortBy != "relevance" {
+		params.SortBy = "date"
+	}
+	if params.SortBy == "relevance" && params.Query == "" {
 		params.SortBy = "date"
 	}
 	params.Order = rq.Get("order")
 	if params.Order != "asc" && params.Order != "desc" {
 		params.Order = "desc"
 	}
+	params.Category = strings.TrimSpace(rq.Get("category"))
 	params.MinPrice, err = strconv.Atoi(rq.Get("min_price"))
 
 	if err != nil {
@@ -108,14 +129,178 @@ func (h *MarketHandler) AdsList(w http.ResponseWriter, r *http.Request) {
 		id = uuid.Nil
 	}
 
+	if rq.Has("cursor") {
+		feed, err := h.app.AdsFeed(params, rq.Get("cursor"), id)
+		if err != nil {
+			h.logger.Warn("failed to get ads feed", zap.Error(err))
+			http.Error(w, err.Error(), adErrorStatus(err))
+			return
+		}
+		h.logger.Info("ads feed retrieved successfully", zap.Int("total", len(feed.Items)))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(feed)
+		return
+	}
+
 	AdsList, err := h.app.AdsList(params, id)
 	if err != nil {
 		h.logger.Warn("failed to get ads list", zap.Error(err))
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	h.logger.Info("ads list retrieved successfully", zap.Int("total", len(AdsList)))
+	resp := AdsListResponse{AdsPage: AdsList}
+	if AdsList.Page < AdsList.Pages {
+		resp.Next = pageLink(r, AdsList.Page+1)
+	}
+	if AdsList.Page > 1 {
+		// past the end prev leads back to the last page
+		resp.Prev = pageLink(r, min(AdsList.Page-1, max(AdsList.Pages, 1)))
+	}
+	h.logger.Info("ads list retrieved successfully", zap.Int("total", AdsList.Total), zap.Int("page", AdsList.Page))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// pageLink returns the request URL with the page query parameter replaced.
+func pageLink(r *http.Request, page int) string {
+	q := r.URL.Query()
+	q.Set("page", strconv.Itoa(page))
+	return r.URL.Path + "?" + q.Encode()
+}
+
+func (h *MarketHandler) GetAd(w http.ResponseWriter, r *http.Request) {
+	aduuid, err := uuid.Parse(chi.URLParam(r, "uuid"))
+	if err != nil {
+		h.logger.Warn("invalid ad uuid", zap.Error(err))
+		http.Error(w, "invalid ad uuid", http.StatusBadRequest)
+		return
+	}
+	userid, _ := contextUserID(r)
+
+	ad, err := h.app.GetAd(aduuid, userid)
+	if err != nil {
+		h.logger.Warn("failed to get ad", zap.Error(err), zap.String("ad_id", aduuid.String()))
+		http.Error(w, err.Error(), adErrorStatus(err))
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(AdsList)
-}
\ No newline at end of file
+	json.NewEncoder(w).Encode(ad)
+}
+
+func (h *MarketHandler) UpdateAd(w http.ResponseWriter, r *http.Request) {
+	aduuid, err := uuid.Parse(chi.URLParam(r, "uuid"))
+	if err != nil {
+		h.logger.Warn("invalid ad uuid", zap.Error(err))
+		http.Error(w, "invalid ad uuid", http.StatusBadRequest)
+		return
+	}
+	var req app.UpdateAdRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.logger.Warn("invalid update ad request body", zap.Error(err))
+		http.Error(w, "bad request in body", http.StatusBadRequest)
+		return
+	}
+	userid, ok := contextUserID(r)
+	if !ok {
+		h.logger.Warn("invalid user_id in context")
+		http.Error(w, "invalid user_id in context", http.StatusBadRequest)
+		return
+	}
+
+	ad, err := h.app.UpdateAd(aduuid, req, *h.config, userid)
+	if err != nil {
+		h.logger.Warn("failed to update ad", zap.Error(err), zap.String("ad_id", aduuid.String()))
+		http.Error(w, err.Error(), adErrorStatus(err))
+		return
+	}
+	h.logger.Info("ad updated successfully", zap.String("ad_id", ad.UUID.String()))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ad)
+}
+
+func (h *MarketHandler) CloseAd(w http.ResponseWriter, r *http.Request) {
+	aduuid, err := uuid.Parse(chi.URLParam(r, "uuid"))
+	if err != nil {
+		h.logger.Warn("invalid ad uuid", zap.Error(err))
+		http.Error(w, "invalid ad uuid", http.StatusBadRequest)
+		return
+	}
+	var req app.CloseAdRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			h.logger.Warn("invalid close ad request body", zap.Error(err))
+			http.Error(w, "bad request in body", http.StatusBadRequest)
+			return
+		}
+	}
+	userid, ok := contextUserID(r)
+	if !ok {
+		h.logger.Warn("invalid user_id in context")
+		http.Error(w, "invalid user_id in context", http.StatusBadRequest)
+		return
+	}
+
+	ad, err := h.app.CloseAd(aduuid, req, userid)
+	if err != nil {
+		h.logger.Warn("failed to close ad", zap.Error(err), zap.String("ad_id", aduuid.String()))
+		http.Error(w, err.Error(), adErrorStatus(err))
+		return
+	}
+	h.logger.Info("ad closed successfully", zap.String("ad_id", ad.UUID.String()), zap.String("status", ad.Status))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ad)
+}
+
+func (h *MarketHandler) DeleteAd(w http.ResponseWriter, r *http.Request) {
+	aduuid, err := uuid.Parse(chi.URLParam(r, "uuid"))
+	if err != nil {
+		h.logger.Warn("invalid ad uuid", zap.Error(err))
+		http.Error(w, "invalid ad uuid", http.StatusBadRequest)
+		return
+	}
+	userid, ok := contextUserID(r)
+	if !ok {
+		h.logger.Warn("invalid user_id in context")
+		http.Error(w, "invalid user_id in context", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.app.DeleteAd(aduuid, userid); err != nil {
+		h.logger.Warn("failed to delete ad", zap.Error(err), zap.String("ad_id", aduuid.String()))
+		http.Error(w, err.Error(), adErrorStatus(err))
+		return
+	}
+	h.logger.Info("ad deleted successfully", zap.String("ad_id", aduuid.String()))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// contextUserID returns the user uuid put into the request context by the auth middlewares.
+func contextUserID(r *http.Request) (uuid.UUID, bool) {
+	useruuid, ok := r.Context().Value(UserIDKey).(string)
+	if !ok {
+		return uuid.Nil, false
+	}
+	id, err := uuid.Parse(useruuid)
+	if err != nil {
+		return uuid.Nil, false
+	}
+	return id, true
+}
+
+func adErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, app.ErrAdNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, app.ErrNotAdOwner), errors.Is(err, app.ErrEmailNotVerified):
+		return http.StatusForbidden
+	case errors.Is(err, app.ErrAdClosed), errors.Is(err, app.ErrImageInUse):
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
@@ -4,29 +4,109 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"io"
 	"marketplace/internal/app"
 	"marketplace/internal/config"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 	"context"
 )
 
 type MockMarketService struct {
-	NewAdFunc   func(ad app.Ad, cfg config.Config, userID uuid.UUID) (app.Ad, error)
-	AdsListFunc func(params app.AdsListParams, userID uuid.UUID) ([]app.AdsListResponse, error)
+	NewAdFunc    func(ad app.Ad, cfg config.Config, userID uuid.UUID) (app.Ad, error)
+	AdsListFunc  func(params app.AdsListParams, userID uuid.UUID) (app.AdsPage, error)
+	AdsFeedFunc  func(params app.AdsListParams, cursor string, userID uuid.UUID) (app.AdsFeedResponse, error)
+	GetAdFunc    func(adID uuid.UUID, userID uuid.UUID) (app.Ad, error)
+	UpdateAdFunc func(adID uuid.UUID, req app.UpdateAdRequest, cfg config.Config, userID uuid.UUID) (app.Ad, error)
+	DeleteAdFunc func(adID uuid.UUID, userID uuid.UUID) error
+	CloseAdFunc  func(adID uuid.UUID, req app.CloseAdRequest, userID uuid.UUID) (app.Ad, error)
+	UploadImageFunc   func(userID uuid.UUID, file io.Reader, cfg config.Config) (app.UploadedImage, error)
+	UploadAdImageFunc func(adID uuid.UUID, userID uuid.UUID, file io.Reader, cfg config.Config) (app.Ad, error)
+	ReorderAdImagesFunc func(adID uuid.UUID, req app.ReorderImagesRequest, userID uuid.UUID) (app.Ad, error)
+	DeleteAdImageFunc   func(adID uuid.UUID, imageID int64, userID uuid.UUID) (app.Ad, error)
+	OpenImageFunc     func(key string) (io.ReadCloser, error)
+
+	CategoryTreeFunc   func(lang string) ([]app.Category, error)
+	NewCategoryFunc    func(req app.CategoryRequest) (app.Category, error)
+	UpdateCategoryFunc func(id int64, req app.CategoryRequest) (app.Category, error)
+	DeleteCategoryFunc func(id int64) error
 }
 
 func (m *MockMarketService) NewAd(ad app.Ad, cfg config.Config, userID uuid.UUID) (app.Ad, error) {
 	return m.NewAdFunc(ad, cfg, userID)
 }
 
-func (m *MockMarketService) AdsList(params app.AdsListParams, userID uuid.UUID) ([]app.AdsListResponse, error) {
+func (m *MockMarketService) AdsList(params app.AdsListParams, userID uuid.UUID) (app.AdsPage, error) {
 	return m.AdsListFunc(params, userID)
 }
 
+func (m *MockMarketService) AdsFeed(params app.AdsListParams, cursor string, userID uuid.UUID) (app.AdsFeedResponse, error) {
+	return m.AdsFeedFunc(params, cursor, userID)
+}
+
+func (m *MockMarketService) GetAd(adID uuid.UUID, userID uuid.UUID) (app.Ad, error) {
+	return m.GetAdFunc(adID, userID)
+}
+
+func (m *MockMarketService) UpdateAd(adID uuid.UUID, req app.UpdateAdRequest, cfg config.Config, userID uuid.UUID) (app.Ad, error) {
+	return m.UpdateAdFunc(adID, req, cfg, userID)
+}
+
+func (m *MockMarketService) DeleteAd(adID uuid.UUID, userID uuid.UUID) error {
+	return m.DeleteAdFunc(adID, userID)
+}
+
+func (m *MockMarketService) CloseAd(adID uuid.UUID, req app.CloseAdRequest, userID uuid.UUID) (app.Ad, error) {
+	return m.CloseAdFunc(adID, req, userID)
+}
+
+func (m *MockMarketService) UploadImage(userID uuid.UUID, file io.Reader, cfg config.Config) (app.UploadedImage, error) {
+	return m.UploadImageFunc(userID, file, cfg)
+}
+
+func (m *MockMarketService) ReorderAdImages(adID uuid.UUID, req app.ReorderImagesRequest, userID uuid.UUID) (app.Ad, error) {
+	return m.ReorderAdImagesFunc(adID, req, userID)
+}
+
+func (m *MockMarketService) DeleteAdImage(adID uuid.UUID, imageID int64, userID uuid.UUID) (app.Ad, error) {
+	return m.DeleteAdImageFunc(adID, imageID, userID)
+}
+
+func (m *MockMarketService) UploadAdImage(adID uuid.UUID, userID uuid.UUID, file io.Reader, cfg config.Config) (app.Ad, error) {
+	return m.UploadAdImageFunc(adID, userID, file, cfg)
+}
+
+func (m *MockMarketService) OpenImage(key string) (io.ReadCloser, error) {
+	return m.OpenImageFunc(key)
+}
+
+func (m *MockMarketService) CategoryTree(lang string) ([]app.Category, error) {
+	return m.CategoryTreeFunc(lang)
+}
+
+func (m *MockMarketService) NewCategory(req app.CategoryRequest) (app.Category, error) {
+	return m.NewCategoryFunc(req)
+}
+
+func (m *MockMarketService) UpdateCategory(id int64, req app.CategoryRequest) (app.Category, error) {
+	return m.UpdateCategoryFunc(id, req)
+}
+
+func (m *MockMarketService) DeleteCategory(id int64) error {
+	return m.DeleteCategoryFunc(id)
+}
+
+func withURLParam(req *http.Request, key, value string) *http.Request {
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add(key, value)
+	return req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+}
+
 func TestMarketHandler_NewAd_Success(t *testing.T) {
 	mockService := &MockMarketService{
 		NewAdFunc: func(ad app.Ad, cfg config.Config, userID uuid.UUID) (app.Ad, error) {
@@ -40,7 +120,7 @@ func TestMarketHandler_NewAd_Success(t *testing.T) {
 	ad := app.Ad{
 		Title:       "Test Ad",
 		Description: "Desc",
-		ImageURL:    "img.png",
+		Images:      []app.AdImage{{URL: "/images/uploads/u/img.png"}},
 		Price:       100,
 	}
 	body, _ := json.Marshal(ad)
@@ -64,6 +144,26 @@ func TestMarketHandler_NewAd_Success(t *testing.T) {
 	}
 }
 
+func TestMarketHandler_NewAd_EmailNotVerified(t *testing.T) {
+	mockService := &MockMarketService{
+		NewAdFunc: func(ad app.Ad, cfg config.Config, userID uuid.UUID) (app.Ad, error) {
+			return app.Ad{}, app.ErrEmailNotVerified
+		},
+	}
+	handler := NewMarketHandler(mockService, &config.Config{}, zap.NewNop())
+
+	body, _ := json.Marshal(app.Ad{Title: "Test Ad"})
+	req := httptest.NewRequest("POST", "/ads", bytes.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), UserIDKey, uuid.New().String()))
+	w := httptest.NewRecorder()
+
+	handler.NewAd(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", w.Code)
+	}
+}
+
 func TestMarketHandler_NewAd_InvalidBody(t *testing.T) {
 	handler := NewMarketHandler(nil, &config.Config{}, zap.NewNop())
 	req := httptest.NewRequest("POST", "/ads", bytes.NewBufferString("invalid json"))
@@ -97,47 +197,281 @@ func TestMarketHandler_NewAd_InvalidUUID(t *testing.T) {
 
 func TestMarketHandler_AdsList_Success(t *testing.T) {
 	mockService := &MockMarketService{
-		AdsListFunc: func(params app.AdsListParams, userID uuid.UUID) ([]app.AdsListResponse, error) {
-			return []app.AdsListResponse{
-				{Title: "Ad1",},
+		AdsListFunc: func(params app.AdsListParams, userID uuid.UUID) (app.AdsPage, error) {
+			return app.AdsPage{
+				Total: 12, Page: params.Page, Limit: params.Limit, Pages: 3,
+				Items: []app.AdsListResponse{{Title: "Ad1"}},
 			}, nil
 		},
 	}
 	handler := NewMarketHandler(mockService, &config.Config{}, zap.NewNop())
 
-	req := httptest.NewRequest("GET", "/ads?page=1&limit=5&sort_by=price&order=desc", nil)
-	ctx := context.WithValue(req.Context(), UserIDKey, uuid.New().String())
-	req = req.WithContext(ctx)
+	cases := []struct {
+		name string
+		page string
+		next string
+		prev string
+	}{
+		{"first page", "1", "/ads-list?limit=5&order=desc&page=2&sort_by=price", ""},
+		{"middle page", "2", "/ads-list?limit=5&order=desc&page=3&sort_by=price", "/ads-list?limit=5&order=desc&page=1&sort_by=price"},
+		{"last page", "3", "", "/ads-list?limit=5&order=desc&page=2&sort_by=price"},
+		{"past the end", "7", "", "/ads-list?limit=5&order=desc&page=3&sort_by=price"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/ads-list?page="+tc.page+"&limit=5&sort_by=price&order=desc", nil)
+			ctx := context.WithValue(req.Context(), UserIDKey, uuid.New().String())
+			req = req.WithContext(ctx)
+			w := httptest.NewRecorder()
+
+			handler.AdsList(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200 OK, got %d", w.Code)
+			}
+			var resp AdsListResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("invalid json response: %v", err)
+			}
+			if resp.Total != 12 || resp.Pages != 3 || resp.Limit != 5 || len(resp.Items) != 1 || resp.Items[0].Title != "Ad1" {
+				t.Errorf("unexpected ads response: %+v", resp)
+			}
+			if resp.Next != tc.next || resp.Prev != tc.prev {
+				t.Errorf("expected next %q and prev %q, got %q and %q", tc.next, tc.prev, resp.Next, resp.Prev)
+			}
+		})
+	}
+}
+
+func TestMarketHandler_AdsList_ServiceError(t *testing.T) {
+	mockService := &MockMarketService{
+		AdsListFunc: func(params app.AdsListParams, userID uuid.UUID) (app.AdsPage, error) {
+			return app.AdsPage{}, errors.New("failed to fetch")
+		},
+	}
+	handler := NewMarketHandler(mockService, &config.Config{}, zap.NewNop())
+
+	req := httptest.NewRequest("GET", "/ads?page=1&limit=5", nil)
 	w := httptest.NewRecorder()
 
 	handler.AdsList(w, req)
 
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+}
+
+func TestMarketHandler_AdsList_Cursor(t *testing.T) {
+	var gotCursor string
+	mockService := &MockMarketService{
+		AdsFeedFunc: func(params app.AdsListParams, cursor string, userID uuid.UUID) (app.AdsFeedResponse, error) {
+			if cursor == "bad" {
+				return app.AdsFeedResponse{}, app.ErrInvalidCursor
+			}
+			gotCursor = cursor
+			return app.AdsFeedResponse{Items: []app.AdsListResponse{{Title: "Ad1"}}, NextCursor: "next"}, nil
+		},
+	}
+	handler := NewMarketHandler(mockService, &config.Config{}, zap.NewNop())
+
+	req := httptest.NewRequest("GET", "/ads-list?limit=1&cursor=abc", nil)
+	w := httptest.NewRecorder()
+	handler.AdsList(w, req)
+
 	if w.Code != http.StatusOK {
 		t.Fatalf("expected 200 OK, got %d", w.Code)
 	}
-	var ads []app.Ad
-	if err := json.NewDecoder(w.Body).Decode(&ads); err != nil {
+	var feed app.AdsFeedResponse
+	if err := json.NewDecoder(w.Body).Decode(&feed); err != nil {
 		t.Fatalf("invalid json response: %v", err)
 	}
-	if len(ads) != 1 || ads[0].Title != "Ad1" {
-		t.Errorf("unexpected ads response: %+v", ads)
+	if gotCursor != "abc" || len(feed.Items) != 1 || feed.NextCursor != "next" {
+		t.Errorf("unexpected feed response: %+v (cursor %q)", feed, gotCursor)
+	}
+
+	req = httptest.NewRequest("GET", "/ads-list?cursor=bad", nil)
+	w = httptest.NewRecorder()
+	handler.AdsList(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid cursor, got %d", w.Code)
 	}
 }
 
-func TestMarketHandler_AdsList_ServiceError(t *testing.T) {
+func TestMarketHandler_GetAd(t *testing.T) {
+	adID := uuid.New()
 	mockService := &MockMarketService{
-		AdsListFunc: func(params app.AdsListParams, userID uuid.UUID) ([]app.AdsListResponse, error) {
-			return nil, errors.New("failed to fetch")
+		GetAdFunc: func(id uuid.UUID, userID uuid.UUID) (app.Ad, error) {
+			if id != adID {
+				return app.Ad{}, app.ErrAdNotFound
+			}
+			return app.Ad{UUID: id, Title: "Ad1", Status: app.AdStatusActive}, nil
 		},
 	}
 	handler := NewMarketHandler(mockService, &config.Config{}, zap.NewNop())
 
-	req := httptest.NewRequest("GET", "/ads?page=1&limit=5", nil)
+	req := withURLParam(httptest.NewRequest("GET", "/ads/"+adID.String(), nil), "uuid", adID.String())
 	w := httptest.NewRecorder()
+	handler.GetAd(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d", w.Code)
+	}
+	var ad app.Ad
+	if err := json.NewDecoder(w.Body).Decode(&ad); err != nil {
+		t.Fatalf("invalid json response: %v", err)
+	}
+	if ad.UUID != adID {
+		t.Errorf("expected ad %s, got %s", adID, ad.UUID)
+	}
 
-	handler.AdsList(w, req)
+	missing := uuid.New().String()
+	req = withURLParam(httptest.NewRequest("GET", "/ads/"+missing, nil), "uuid", missing)
+	w = httptest.NewRecorder()
+	handler.GetAd(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", w.Code)
+	}
 
+	req = withURLParam(httptest.NewRequest("GET", "/ads/bad", nil), "uuid", "bad")
+	w = httptest.NewRecorder()
+	handler.GetAd(w, req)
 	if w.Code != http.StatusBadRequest {
 		t.Errorf("expected 400, got %d", w.Code)
 	}
-}
\ No newline at end of file
+}
+
+func TestMarketHandler_UpdateAd(t *testing.T) {
+	owner := uuid.New()
+	adID := uuid.New()
+	mockService := &MockMarketService{
+		UpdateAdFunc: func(id uuid.UUID, req app.UpdateAdRequest, cfg config.Config, userID uuid.UUID) (app.Ad, error) {
+			if userID != owner {
+				return app.Ad{}, app.ErrNotAdOwner
+			}
+			return app.Ad{UUID: id, Price: *req.Price}, nil
+		},
+	}
+	handler := NewMarketHandler(mockService, &config.Config{}, zap.NewNop())
+
+	cases := []struct {
+		name   string
+		userID uuid.UUID
+		code   int
+	}{
+		{"owner", owner, http.StatusOK},
+		{"stranger", uuid.New(), http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("PATCH", "/ads/"+adID.String(), bytes.NewBufferString(`{"price": 42}`))
+			req = withURLParam(req, "uuid", adID.String())
+			req = req.WithContext(context.WithValue(req.Context(), UserIDKey, tc.userID.String()))
+			w := httptest.NewRecorder()
+			handler.UpdateAd(w, req)
+			if w.Code != tc.code {
+				t.Errorf("expected %d, got %d", tc.code, w.Code)
+			}
+		})
+	}
+}
+
+func TestMarketHandler_CloseAd(t *testing.T) {
+	adID := uuid.New()
+	mockService := &MockMarketService{
+		CloseAdFunc: func(id uuid.UUID, req app.CloseAdRequest, userID uuid.UUID) (app.Ad, error) {
+			if !req.Sold {
+				return app.Ad{}, app.ErrAdClosed
+			}
+			return app.Ad{UUID: id, Status: app.AdStatusSold}, nil
+		},
+	}
+	handler := NewMarketHandler(mockService, &config.Config{}, zap.NewNop())
+
+	req := httptest.NewRequest("POST", "/ads/"+adID.String()+"/close", bytes.NewBufferString(`{"sold": true}`))
+	req = withURLParam(req, "uuid", adID.String())
+	req = req.WithContext(context.WithValue(req.Context(), UserIDKey, uuid.New().String()))
+	w := httptest.NewRecorder()
+	handler.CloseAd(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/ads/"+adID.String()+"/close", nil)
+	req = withURLParam(req, "uuid", adID.String())
+	req = req.WithContext(context.WithValue(req.Context(), UserIDKey, uuid.New().String()))
+	w = httptest.NewRecorder()
+	handler.CloseAd(w, req)
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected 409, got %d", w.Code)
+	}
+}
+
+func TestMarketHandler_DeleteAd(t *testing.T) {
+	adID := uuid.New()
+	mockService := &MockMarketService{
+		DeleteAdFunc: func(id uuid.UUID, userID uuid.UUID) error {
+			return nil
+		},
+	}
+	handler := NewMarketHandler(mockService, &config.Config{}, zap.NewNop())
+
+	req := withURLParam(httptest.NewRequest("DELETE", "/ads/"+adID.String(), nil), "uuid", adID.String())
+	req = req.WithContext(context.WithValue(req.Context(), UserIDKey, uuid.New().String()))
+	w := httptest.NewRecorder()
+	handler.DeleteAd(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", w.Code)
+	}
+
+	req = withURLParam(httptest.NewRequest("DELETE", "/ads/"+adID.String(), nil), "uuid", adID.String())
+	w = httptest.NewRecorder()
+	handler.DeleteAd(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without user in context, got %d", w.Code)
+	}
+}
+
+func TestMarketHandler_AdsList_SearchParams(t *testing.T) {
+	var got app.AdsListParams
+	mockService := &MockMarketService{
+		AdsListFunc: func(params app.AdsListParams, userID uuid.UUID) (app.AdsPage, error) {
+			got = params
+			return app.AdsPage{Items: []app.AdsListResponse{{Title: "Ad1"}}}, nil
+		},
+	}
+	handler := NewMarketHandler(mockService, &config.Config{}, zap.NewNop())
+
+	cases := []struct {
+		name   string
+		query  string
+		q      string
+		sortBy string
+	}{
+		{"relevance with query", "?q=%20%D1%81%D0%B0%D0%BC%D0%BE%D0%BA%D0%B0%D1%82%20&sort_by=relevance", "самокат", "relevance"},
+		{"relevance without query", "?sort_by=relevance", "", "date"},
+		{"query with price sort", "?q=bike&sort_by=price", "bike", "price"},
+		{"category filter", "?category=%20phones%20", "", "date"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/ads-list"+tc.query, nil)
+			w := httptest.NewRecorder()
+			handler.AdsList(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200 OK, got %d", w.Code)
+			}
+			if strings.Contains(tc.query, "category") && got.Category != "phones" {
+				t.Errorf("expected category phones, got %q", got.Category)
+			}
+			if got.Query != tc.q || got.SortBy != tc.sortBy {
+				t.Errorf("expected q=%q sort_by=%q, got q=%q sort_by=%q", tc.q, tc.sortBy, got.Query, got.SortBy)
+			}
+		})
+	}
+
+	req := httptest.NewRequest("GET", "/ads-list?q="+strings.Repeat("a", 201), nil)
+	w := httptest.NewRecorder()
+	handler.AdsList(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for too long query, got %d", w.Code)
+	}
+}
@@ -5,12 +5,22 @@ import (
 	"marketplace/internal/app"
 	"net/http"
 	"strings"
+	"github.com/golang-jwt/jwt/v5"
 )
 
 type ContextKey string
 const UserIDKey ContextKey = "user_id"
+const SessionIDKey ContextKey = "session_id"
+const RoleKey ContextKey = "role"
 
-func AuthMiddleware(jwtProvider *app.JwtProvider) func(http.Handler) http.Handler {
+// SessionChecker reports whether the login session an access token was issued for has been ended
+// and records that it is still in use.
+type SessionChecker interface {
+	SessionRevoked(sid string) (bool, error)
+	TouchSession(sid string) error
+}
+
+func AuthMiddleware(jwtProvider *app.JwtProvider, sessions SessionChecker) func(http.Handler) http.Handler {
     return func(next http.Handler) http.Handler {
         return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
             authHeader := r.Header.Get("Authorization")
@@ -30,14 +40,25 @@ func AuthMiddleware(jwtProvider *app.JwtProvider) func(http.Handler) http.Handle
                 http.Error(w, "invalid or expired token", http.StatusUnauthorized)
                 return
             }
+            sid, active, err := sessionActive(claims, sessions)
+            if err != nil {
+                http.Error(w, "failed to check session", http.StatusInternalServerError)
+                return
+            }
+            if !active {
+                http.Error(w, "session has been revoked", http.StatusUnauthorized)
+                return
+            }
 
             ctx := context.WithValue(r.Context(), UserIDKey, claims["uuid"])
+            ctx = context.WithValue(ctx, SessionIDKey, sid)
+            ctx = context.WithValue(ctx, RoleKey, claims["role"])
             next.ServeHTTP(w, r.WithContext(ctx))
         })
     }
 }
 
-func OptionalAuthMiddleware(jwtProvider *app.JwtProvider) func(http.Handler) http.Handler {
+func OptionalAuthMiddleware(jwtProvider *app.JwtProvider, sessions SessionChecker) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			authHeader := r.Header.Get("Authorization")
@@ -57,9 +78,49 @@ func OptionalAuthMiddleware(jwtProvider *app.JwtProvider) func(http.Handler) htt
 				next.ServeHTTP(w, r)
 				return
 			}
+			sid, active, err := sessionActive(claims, sessions)
+			if err != nil || !active {
+				next.ServeHTTP(w, r)
+				return
+			}
 
 			ctx := context.WithValue(r.Context(), UserIDKey, claims["uuid"])
+			ctx = context.WithValue(ctx, SessionIDKey, sid)
+			ctx = context.WithValue(ctx, RoleKey, claims["role"])
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
-}
\ No newline at end of file
+}
+
+// sessionActive checks the token's sid against the revoked sessions; tokens without a sid are not accepted.
+// For an active session it also updates the last-used time, which is best effort and never fails the request.
+func sessionActive(claims jwt.MapClaims, sessions SessionChecker) (string, bool, error) {
+	sid, _ := claims["sid"].(string)
+	if sid == "" {
+		return "", false, nil
+	}
+	revoked, err := sessions.SessionRevoked(sid)
+	if err != nil || revoked {
+		return "", false, err
+	}
+	sessions.TouchSession(sid)
+	return sid, true, nil
+}
+
+// RequireRole must run after AuthMiddleware; it lets through only users whose token carries one of roles.
+func RequireRole(roles ...string) func(http.Handler) http.Handler {
+	allowed := make(map[string]bool, len(roles))
+	for _, role := range roles {
+		allowed[role] = true
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			role, _ := r.Context().Value(RoleKey).(string)
+			if !allowed[role] {
+				http.Error(w, "insufficient role", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package web
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -9,9 +10,20 @@ import (
 	"github.com/google/uuid"
 )
 
+// revokedSessions is a SessionChecker backed by a set of ended sessions.
+type revokedSessions map[string]bool
+
+func (s revokedSessions) SessionRevoked(sid string) (bool, error) {
+	return s[sid], nil
+}
+
+func (s revokedSessions) TouchSession(sid string) error {
+	return nil
+}
+
 func TestAuthMiddleware_MissingHeader(t *testing.T) {
 	jwt := app.NewJwtProvider(&config.Config{})
-	handler := AuthMiddleware(jwt)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	handler := AuthMiddleware(jwt, revokedSessions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		t.Error("handler should not be called on missing header")
 	}))
 	req := httptest.NewRequest("GET", "/", nil)
@@ -26,7 +38,7 @@ func TestAuthMiddleware_MissingHeader(t *testing.T) {
 
 func TestAuthMiddleware_InvalidHeader(t *testing.T) {
 	jwt := app.NewJwtProvider(&config.Config{})
-	handler := AuthMiddleware(jwt)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	handler := AuthMiddleware(jwt, revokedSessions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		t.Error("handler should not be called on invalid header")
 	}))
 	req := httptest.NewRequest("GET", "/", nil)
@@ -42,7 +54,7 @@ func TestAuthMiddleware_InvalidHeader(t *testing.T) {
 
 func TestAuthMiddleware_InvalidToken(t *testing.T) {
 	jwt := app.NewJwtProvider(&config.Config{})
-	handler := AuthMiddleware(jwt)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	handler := AuthMiddleware(jwt, revokedSessions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		t.Error("handler should not be called on invalid token")
 	}))
 	req := httptest.NewRequest("GET", "/", nil)
@@ -67,15 +79,18 @@ func TestAuthMiddleware_ValidToken(t *testing.T) {
 		Password: "hashedPassword",
 		UUID:    uuid.New(),
 	}
-	token, _ := jwt.GenerateAccessToken(user, cfg)
+	token, _ := jwt.GenerateAccessToken(user, "session-id", cfg)
 
 	called := false
-	handler := AuthMiddleware(jwt)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	handler := AuthMiddleware(jwt, revokedSessions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		called = true
 		val := r.Context().Value(UserIDKey)
 		if val == nil || val != user.UUID.String() {
 			t.Errorf("expected uuid %v in context, got %v", user.UUID, val)
 		}
+		if sid := r.Context().Value(SessionIDKey); sid != "session-id" {
+			t.Errorf("expected sid session-id in context, got %v", sid)
+		}
 		w.WriteHeader(http.StatusOK)
 	}))
 
@@ -93,11 +108,50 @@ func TestAuthMiddleware_ValidToken(t *testing.T) {
 	}
 }
 
+func TestAuthMiddleware_RevokedSession(t *testing.T) {
+	cfg := &config.Config{JWT_ACCESS_SECRET: "testsecret", JWT_EXP_ACCESS_TOKEN: 15}
+	jwt := app.NewJwtProvider(cfg)
+	user := app.User{Login: "testuser", UUID: uuid.New()}
+	sessions := revokedSessions{"ended": true}
+
+	cases := []struct {
+		name string
+		sid  string
+	}{
+		{"revoked session", "ended"},
+		{"token without session", ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			token, _ := jwt.GenerateAccessToken(user, tc.sid, cfg)
+			handler := AuthMiddleware(jwt, sessions)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				t.Error("handler should not be called for a revoked session")
+			}))
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp := httptest.NewRecorder()
+
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != http.StatusUnauthorized {
+				t.Errorf("expected 401, got %d", resp.Code)
+			}
+
+			optional := OptionalAuthMiddleware(jwt, sessions)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Context().Value(UserIDKey) != nil {
+					t.Error("expected no user in context for a revoked session")
+				}
+			}))
+			optional.ServeHTTP(httptest.NewRecorder(), req)
+		})
+	}
+}
+
 func TestOptionalAuthMiddleware_NoHeader(t *testing.T) {
 	jwt := app.NewJwtProvider(&config.Config{})
 	called := false
 
-	handler := OptionalAuthMiddleware(jwt)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	handler := OptionalAuthMiddleware(jwt, revokedSessions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		called = true
 		if r.Context().Value(UserIDKey) != nil {
 			t.Error("expected no user in context")
@@ -122,7 +176,7 @@ func TestOptionalAuthMiddleware_InvalidHeader(t *testing.T) {
 	jwt := app.NewJwtProvider(&config.Config{})
 	called := false
 
-	handler := OptionalAuthMiddleware(jwt)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	handler := OptionalAuthMiddleware(jwt, revokedSessions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		called = true
 		if r.Context().Value(UserIDKey) != nil {
 			t.Error("expected no user in context")
@@ -148,7 +202,7 @@ func TestOptionalAuthMiddleware_InvalidToken(t *testing.T) {
 	jwt := app.NewJwtProvider(&config.Config{})
 	called := false
 
-	handler := OptionalAuthMiddleware(jwt)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	handler := OptionalAuthMiddleware(jwt, revokedSessions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		called = true
 		if r.Context().Value(UserIDKey) != nil {
 			t.Error("expected no user in context for invalid token")
@@ -181,10 +235,10 @@ func TestOptionalAuthMiddleware_ValidToken(t *testing.T) {
 		Password: "hashedPassword",
 		UUID:    uuid.New(),
 	}
-	token, _ := jwt.GenerateAccessToken(user, cfg)
+	token, _ := jwt.GenerateAccessToken(user, "session-id", cfg)
 
 	called := false
-	handler := OptionalAuthMiddleware(jwt)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	handler := OptionalAuthMiddleware(jwt, revokedSessions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		called = true
 		val := r.Context().Value(UserIDKey)
 		if val != user.UUID.String() {
@@ -205,4 +259,65 @@ func TestOptionalAuthMiddleware_ValidToken(t *testing.T) {
 	if resp.Code != http.StatusOK {
 		t.Errorf("expected 200, got %d", resp.Code)
 	}
-}
\ No newline at end of file
+}
+func TestRequireRole(t *testing.T) {
+	called := false
+	handler := RequireRole(app.RoleAdmin, app.RoleModerator)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	cases := []struct {
+		name     string
+		role     any
+		expected int
+	}{
+		{"admin", app.RoleAdmin, http.StatusOK},
+		{"moderator", app.RoleModerator, http.StatusOK},
+		{"regular user", app.RoleUser, http.StatusForbidden},
+		{"no role", nil, http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			called = false
+			req := httptest.NewRequest("POST", "/admin/categories", nil)
+			if tc.role != nil {
+				req = req.WithContext(context.WithValue(req.Context(), RoleKey, tc.role))
+			}
+			resp := httptest.NewRecorder()
+
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tc.expected {
+				t.Errorf("expected %d, got %d", tc.expected, resp.Code)
+			}
+			if called != (tc.expected == http.StatusOK) {
+				t.Errorf("unexpected handler call state: %v", called)
+			}
+		})
+	}
+}
+
+func TestRequireRole_FromToken(t *testing.T) {
+	cfg := &config.Config{JWT_ACCESS_SECRET: "testsecret", JWT_EXP_ACCESS_TOKEN: 15}
+	jwt := app.NewJwtProvider(cfg)
+	handler := AuthMiddleware(jwt, revokedSessions{})(RequireRole(app.RoleAdmin)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+
+	for _, tc := range []struct {
+		role     string
+		expected int
+	}{{app.RoleAdmin, http.StatusOK}, {app.RoleUser, http.StatusForbidden}, {"", http.StatusForbidden}} {
+		token, _ := jwt.GenerateAccessToken(app.User{UUID: uuid.New(), Role: tc.role}, "session-id", cfg)
+		req := httptest.NewRequest("POST", "/admin/categories", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp := httptest.NewRecorder()
+
+		handler.ServeHTTP(resp, req)
+
+		if resp.Code != tc.expected {
+			t.Errorf("role %q: expected %d, got %d", tc.role, tc.expected, resp.Code)
+		}
+	}
+}
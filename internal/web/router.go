@@ -1,18 +1,61 @@
 package web
 
 import (
+	"marketplace/internal/app"
 	"github.com/go-chi/chi/v5"
 )
 
-func RegisterRoutes(r chi.Router, userHandler *UserHandler, marketHandler *MarketHandler) {
+func RegisterRoutes(r chi.Router, userHandler *UserHandler, marketHandler *MarketHandler, adminHandler *AdminHandler) {
 	r.Post("/login", userHandler.Login)
+	r.Post("/login/2fa", userHandler.LoginTwoFactor)
+	r.Get("/oauth/{provider}/login", userHandler.OIDCLogin)
+	r.Get("/oauth/{provider}/callback", userHandler.OIDCCallback)
 	r.Post("/register", userHandler.Register)
+	r.Post("/logout", userHandler.Logout)
+	r.Post("/password/forgot", userHandler.ForgotPassword)
+	r.Post("/password/reset", userHandler.ResetPassword)
+	r.Get("/verify-email", userHandler.VerifyEmail)
+	r.Get("/.well-known/jwks.json", userHandler.JWKS)
 	
-	r.With(OptionalAuthMiddleware(userHandler.jwt)).Get("/ads-list", marketHandler.AdsList)
+	r.With(OptionalAuthMiddleware(userHandler.jwt, userHandler.app)).Get("/ads-list", marketHandler.AdsList)
+	r.With(OptionalAuthMiddleware(userHandler.jwt, userHandler.app)).Get("/ads/{uuid}", marketHandler.GetAd)
+	r.Get("/categories", marketHandler.CategoryTree)
+	r.Get("/images/*", marketHandler.ServeImage)
 
 	r.Group(func(r chi.Router) {
-		r.Use(AuthMiddleware(userHandler.jwt))
+		r.Use(AuthMiddleware(userHandler.jwt, userHandler.app))
 		r.Post("/new-ad", marketHandler.NewAd)
+		r.Patch("/ads/{uuid}", marketHandler.UpdateAd)
+		r.Delete("/ads/{uuid}", marketHandler.DeleteAd)
+		r.Post("/ads/{uuid}/close", marketHandler.CloseAd)
+		r.Post("/images", marketHandler.UploadImage)
+		r.Post("/ads/{uuid}/images", marketHandler.UploadAdImage)
+		r.Put("/ads/{uuid}/images", marketHandler.ReorderAdImages)
+		r.Delete("/ads/{uuid}/images/{id}", marketHandler.DeleteAdImage)
 		r.Post("/refresh-access-token", userHandler.RefreshAccessToken)
+		r.Post("/logout-all", userHandler.LogoutAll)
+		r.Get("/me/sessions", userHandler.Sessions)
+		r.Delete("/me/sessions/{id}", userHandler.DeleteSession)
+		r.Post("/me/password", userHandler.ChangePassword)
+		r.Post("/me/email/verify", userHandler.ResendVerification)
+		r.Post("/me/2fa/setup", userHandler.SetupTOTP)
+		r.Post("/me/2fa/confirm", userHandler.ConfirmTOTP)
+
+		r.Route("/admin/categories", func(r chi.Router) {
+			r.Use(RequireRole(app.RoleAdmin))
+			r.Post("/", marketHandler.NewCategory)
+			r.Put("/{id}", marketHandler.UpdateCategory)
+			r.Delete("/{id}", marketHandler.DeleteCategory)
+		})
+
+		r.Route("/admin/users", func(r chi.Router) {
+			r.Use(RequireRole(app.RoleAdmin))
+			r.Get("/", adminHandler.Users)
+			r.Get("/{uuid}/ads", adminHandler.UserAds)
+			r.Post("/{uuid}/block", adminHandler.BlockUser)
+			r.Post("/{uuid}/unblock", adminHandler.UnblockUser)
+			r.Post("/{uuid}/password-reset", adminHandler.ForcePasswordReset)
+			r.Delete("/{uuid}", adminHandler.DeleteUser)
+		})
 	})
 }
\ No newline at end of file
@@ -2,9 +2,15 @@ package web
 
 import (
 	"encoding/json"
+	"errors"
+	"net"
 	"marketplace/internal/app"
 	"marketplace/internal/config"
 	"net/http"
+	"math"
+	"strconv"
+	"time"
+	"github.com/go-chi/chi/v5"
 	"go.uber.org/zap"
 )
 
@@ -31,10 +37,20 @@ func (h *UserHandler) Login(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bad login request", http.StatusBadRequest)
 		return
 	}
+	login_req.Device = requestDevice(r)
 	login_resp, err := h.app.LoginJwt(login_req, h.jwt, h.config)
 	if err != nil {
 		h.logger.Warn("login failed", zap.Error(err), zap.String("login", login_req.Login))
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		var throttled *app.LoginThrottledError
+		if errors.As(err, &throttled) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		if writeAccountBlocked(w, err) {
+			return
+		}
+		http.Error(w, err.Error(), authErrorStatus(err))
 		return
 	}
 
@@ -63,6 +79,7 @@ func (h *UserHandler) Register(w http.ResponseWriter, r *http.Request) {
 	var user_resp app.SignUpResponse
 	user_resp.Login = user.Login
 	user_resp.UUID = user.UUID
+	user_resp.Email = user.Email
 
 	h.logger.Info("registration successful", zap.String("login", user_resp.Login))
 	w.Header().Set("Content-Type", "Application/json")
@@ -77,11 +94,16 @@ func (h *UserHandler) RefreshAccessToken(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "bad refresh request", http.StatusBadRequest)
 		return
 	}
+	refresh_req.Device = requestDevice(r)
 
 	refresh_resp, err := h.app.RefreshAccessToken(refresh_req, h.jwt, h.config)
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		h.logger.Warn("refresh token rejected", zap.Error(err))
+		if writeAccountBlocked(w, err) {
+			return
+		}
+		http.Error(w, err.Error(), authErrorStatus(err))
 		return
 	}
 
@@ -90,3 +112,416 @@ func (h *UserHandler) RefreshAccessToken(w http.ResponseWriter, r *http.Request)
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(refresh_resp)
 }
+
+func (h *UserHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	var logout_req app.RefreshJwtRequest
+	if err := json.NewDecoder(r.Body).Decode(&logout_req); err != nil {
+		h.logger.Warn("bad logout request", zap.Error(err))
+		http.Error(w, "bad logout request", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.app.Logout(logout_req, h.jwt); err != nil {
+		if errors.Is(err, app.ErrInvalidRefreshToken) {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		h.logger.Error("logout failed", zap.Error(err))
+		http.Error(w, "failed to logout", http.StatusInternalServerError)
+		return
+	}
+
+	h.logger.Info("logout successful")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *UserHandler) LogoutAll(w http.ResponseWriter, r *http.Request) {
+	userID, ok := contextUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.app.LogoutAll(userID); err != nil {
+		h.logger.Error("logout from all devices failed", zap.Error(err), zap.String("user", userID.String()))
+		http.Error(w, "failed to logout", http.StatusInternalServerError)
+		return
+	}
+
+	h.logger.Info("logout from all devices successful", zap.String("user", userID.String()))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *UserHandler) Sessions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := contextUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	sid, _ := r.Context().Value(SessionIDKey).(string)
+
+	sessions, err := h.app.Sessions(userID, sid)
+	if err != nil {
+		h.logger.Error("failed to get sessions", zap.Error(err), zap.String("user", userID.String()))
+		http.Error(w, "failed to get sessions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "Application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(sessions)
+}
+
+func (h *UserHandler) DeleteSession(w http.ResponseWriter, r *http.Request) {
+	userID, ok := contextUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.app.DeleteSession(userID, chi.URLParam(r, "id")); err != nil {
+		if errors.Is(err, app.ErrSessionNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		h.logger.Error("failed to delete session", zap.Error(err), zap.String("user", userID.String()))
+		http.Error(w, "failed to delete session", http.StatusInternalServerError)
+		return
+	}
+
+	h.logger.Info("session deleted", zap.String("user", userID.String()))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ForgotPassword answers 202 whether or not the login exists, so it doesn't reveal accounts.
+func (h *UserHandler) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var forgot_req app.ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&forgot_req); err != nil || forgot_req.Login == "" {
+		h.logger.Warn("bad forgot password request", zap.Error(err))
+		http.Error(w, "bad forgot password request", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.app.ForgotPassword(forgot_req, h.config); err != nil {
+		h.logger.Error("failed to send password reset", zap.Error(err), zap.String("login", forgot_req.Login))
+		http.Error(w, "failed to send password reset", http.StatusInternalServerError)
+		return
+	}
+
+	h.logger.Info("password reset requested", zap.String("login", forgot_req.Login))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *UserHandler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var reset_req app.ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&reset_req); err != nil {
+		h.logger.Warn("bad reset password request", zap.Error(err))
+		http.Error(w, "bad reset password request", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.app.ResetPassword(reset_req, h.config); err != nil {
+		if errors.Is(err, app.ErrInvalidResetToken) || errors.Is(err, app.ErrWeakPassword) {
+			h.logger.Warn("password reset rejected", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.logger.Error("password reset failed", zap.Error(err))
+		http.Error(w, "failed to reset password", http.StatusInternalServerError)
+		return
+	}
+
+	h.logger.Info("password reset successful")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ChangePassword keeps the session the request was made with and ends all others.
+func (h *UserHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	userID, ok := contextUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	sid, _ := r.Context().Value(SessionIDKey).(string)
+
+	var change_req app.ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&change_req); err != nil {
+		h.logger.Warn("bad change password request", zap.Error(err))
+		http.Error(w, "bad change password request", http.StatusBadRequest)
+		return
+	}
+	change_req.Device = requestDevice(r)
+
+	if err := h.app.ChangePassword(userID, sid, change_req, h.config); err != nil {
+		h.logger.Warn("password change failed", zap.Error(err), zap.String("user", userID.String()))
+		var throttled *app.LoginThrottledError
+		switch {
+		case errors.As(err, &throttled):
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+		case errors.Is(err, app.ErrWrongPassword):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case errors.Is(err, app.ErrWeakPassword):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, app.ErrUserNotFound):
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		default:
+			http.Error(w, "failed to change password", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	h.logger.Info("password changed", zap.String("user", userID.String()))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// VerifyEmail is opened from the link in the verification mail.
+func (h *UserHandler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	user, err := h.app.VerifyEmail(r.URL.Query().Get("token"))
+	if err != nil {
+		if errors.Is(err, app.ErrInvalidVerificationToken) {
+			h.logger.Warn("email verification rejected", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.logger.Error("email verification failed", zap.Error(err))
+		http.Error(w, "failed to verify email", http.StatusInternalServerError)
+		return
+	}
+
+	h.logger.Info("email verified", zap.String("user", user.UUID.String()))
+	w.Header().Set("Content-Type", "Application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(app.VerifyEmailResponse{Email: user.Email, EmailVerifiedAt: *user.EmailVerifiedAt})
+}
+
+func (h *UserHandler) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	userID, ok := contextUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.app.ResendVerification(userID, h.config); err != nil {
+		switch {
+		case errors.Is(err, app.ErrNoEmail), errors.Is(err, app.ErrEmailAlreadyVerified):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, app.ErrUserNotFound):
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		default:
+			h.logger.Error("failed to resend verification", zap.Error(err), zap.String("user", userID.String()))
+			http.Error(w, "failed to send verification", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	h.logger.Info("verification resent", zap.String("user", userID.String()))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// LoginTwoFactor is the second step of Login for users with two-factor authentication.
+func (h *UserHandler) LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var login_req app.TwoFactorLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&login_req); err != nil {
+		h.logger.Warn("invalid two-factor login body", zap.Error(err))
+		http.Error(w, "bad two-factor login request", http.StatusBadRequest)
+		return
+	}
+	login_req.Device = requestDevice(r)
+	login_resp, err := h.app.LoginTwoFactor(login_req, h.jwt, h.config)
+	if err != nil {
+		h.logger.Warn("two-factor login failed", zap.Error(err))
+		var throttled *app.LoginThrottledError
+		switch {
+		case errors.As(err, &throttled):
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+		case writeAccountBlocked(w, err):
+		case errors.Is(err, app.ErrInvalidChallenge):
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		case errors.Is(err, app.ErrPasswordResetRequired):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case errors.Is(err, app.ErrInvalidTOTPCode):
+			// the cause, e.g. a secret that can't be decrypted, is only logged
+			http.Error(w, app.ErrInvalidTOTPCode.Error(), http.StatusUnauthorized)
+		default:
+			http.Error(w, "failed to login", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	h.logger.Info("two-factor login successful")
+	w.Header().Set("Content-Type", "Application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(login_resp)
+}
+
+func (h *UserHandler) SetupTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, ok := contextUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	setup_resp, err := h.app.SetupTOTP(userID, h.config)
+	if err != nil {
+		switch {
+		case errors.Is(err, app.ErrTOTPAlreadyEnabled):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, app.ErrUserNotFound):
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		default:
+			h.logger.Error("failed to set up two-factor authentication", zap.Error(err), zap.String("user", userID.String()))
+			http.Error(w, "failed to set up two-factor authentication", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "Application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(setup_resp)
+}
+
+// ConfirmTOTP returns the recovery codes; they are not shown again.
+func (h *UserHandler) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, ok := contextUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var confirm_req app.TOTPConfirmRequest
+	if err := json.NewDecoder(r.Body).Decode(&confirm_req); err != nil {
+		h.logger.Warn("bad two-factor confirm request", zap.Error(err))
+		http.Error(w, "bad two-factor confirm request", http.StatusBadRequest)
+		return
+	}
+
+	confirm_resp, err := h.app.ConfirmTOTP(userID, confirm_req, h.config)
+	if err != nil {
+		switch {
+		case errors.Is(err, app.ErrInvalidTOTPCode):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, app.ErrTOTPNotSetUp), errors.Is(err, app.ErrTOTPAlreadyEnabled):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, app.ErrUserNotFound):
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		default:
+			h.logger.Error("failed to enable two-factor authentication", zap.Error(err), zap.String("user", userID.String()))
+			http.Error(w, "failed to enable two-factor authentication", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	h.logger.Info("two-factor authentication enabled", zap.String("user", userID.String()))
+	w.Header().Set("Content-Type", "Application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(confirm_resp)
+}
+
+// OIDCLogin sends the browser to the identity provider's login page.
+func (h *UserHandler) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	provider := chi.URLParam(r, "provider")
+	authURL, err := h.app.StartOIDCLogin(provider, h.config)
+	if err != nil {
+		if errors.Is(err, app.ErrUnknownProvider) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		h.logger.Error("failed to start oidc login", zap.Error(err), zap.String("provider", provider))
+		http.Error(w, "identity provider is unavailable", http.StatusBadGateway)
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCCallback is where the provider sends the browser back; it answers like Login.
+func (h *UserHandler) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	callback_req := app.OIDCCallbackRequest{
+		Provider: chi.URLParam(r, "provider"),
+		Code:     query.Get("code"),
+		State:    query.Get("state"),
+		Error:    query.Get("error"),
+		Device:   requestDevice(r),
+	}
+	login_resp, err := h.app.FinishOIDCLogin(callback_req, h.jwt, h.config)
+	if err != nil {
+		h.logger.Warn("oidc login failed", zap.Error(err), zap.String("provider", callback_req.Provider))
+		switch {
+		case writeAccountBlocked(w, err):
+		case errors.Is(err, app.ErrUnknownProvider):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, app.ErrInvalidOIDCState), errors.Is(err, app.ErrEmailRequired):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, app.ErrOIDCFailed):
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		case errors.Is(err, app.ErrEmailTaken):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, app.ErrPasswordResetRequired):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, "failed to login", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	h.logger.Info("oidc login successful", zap.String("provider", callback_req.Provider))
+	w.Header().Set("Content-Type", "Application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(login_resp)
+}
+
+// JWKS serves the public access token keys; caches may keep them for a few minutes, so a new
+// key should be published before it starts signing.
+func (h *UserHandler) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(h.jwt.JWKS())
+}
+
+// requestDevice takes the client's User-Agent and the address of the connection.
+func requestDevice(r *http.Request) app.Device {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return app.Device{UserAgent: r.UserAgent(), IP: ip}
+}
+
+// authErrorStatus tells a wrong credential (401) from an account that may not log in (403).
+func authErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, app.ErrPasswordResetRequired):
+		return http.StatusForbidden
+	default:
+		return http.StatusUnauthorized
+	}
+}
+
+// accountBlockedResponse is the 403 body for a suspended or banned user.
+type accountBlockedResponse struct {
+	Code   string     `json:"code"` // "account_suspended" or "account_banned"
+	Error  string     `json:"error"`
+	Reason string     `json:"reason,omitempty"`
+	Until  *time.Time `json:"until,omitempty"`
+}
+
+// writeAccountBlocked answers 403 with a machine-readable code if err is an app.AccountBlockedError,
+// so clients can explain the ban; it reports whether it did.
+func writeAccountBlocked(w http.ResponseWriter, err error) bool {
+	var blocked *app.AccountBlockedError
+	if !errors.As(err, &blocked) {
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(accountBlockedResponse{
+		Code:   "account_" + blocked.Status,
+		Error:  blocked.Error(),
+		Reason: blocked.Reason,
+		Until:  blocked.Until,
+	})
+	return true
+}
@@ -1,21 +1,31 @@
 package web
 
 import (
+    "context"
+    "crypto/hmac"
+    "crypto/sha1"
+    "encoding/base32"
+    "encoding/binary"
+    "fmt"
     "testing"
     "net/http"
     "net/http/httptest"
+    "strings"
+    "net/url"
     "bytes"
     "go.uber.org/zap"
     "marketplace/internal/app"
     "marketplace/internal/config"
     "encoding/json"
+    "time"
+	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
 func TestUserHandler_Register_Success(t *testing.T) {
     repo := &app.MockUserRepo{Users: make(map[string]app.User)}
-    service := app.NewUserService(repo)
+    service := app.NewUserService(repo, &app.MockTokenRepo{}, &app.MockMailer{}, &app.MockIdentityProvider{})
     cfg := &config.Config{Username: config.Username{MinLength: 3, MaxLength: 20, AllowedCharacters: "A-Za-z0-9_-"}, Password: config.Password{MinLength: 8, MaxLength: 64}}
     logger := zap.NewNop()
     jwt := app.NewJwtProvider(cfg)
@@ -33,7 +43,7 @@ func TestUserHandler_Register_Success(t *testing.T) {
 
 func TestUserHandler_Register_Fail(t *testing.T) {
     repo := &app.MockUserRepo{Users: make(map[string]app.User)}
-    service := app.NewUserService(repo)
+    service := app.NewUserService(repo, &app.MockTokenRepo{}, &app.MockMailer{}, &app.MockIdentityProvider{})
     cfg := &config.Config{Username: config.Username{MinLength: 3, MaxLength: 20, AllowedCharacters: "A-Za-z0-9_-"}, Password: config.Password{MinLength: 8, MaxLength: 64}}
     logger := zap.NewNop()
     jwt := app.NewJwtProvider(cfg)
@@ -50,7 +60,7 @@ func TestUserHandler_Register_Fail(t *testing.T) {
 }
 func TestUserHandler_Login(t *testing.T) {
 	repo := &app.MockUserRepo{Users: make(map[string]app.User)}
-	service := app.NewUserService(repo)
+	service := app.NewUserService(repo, &app.MockTokenRepo{}, &app.MockMailer{}, &app.MockIdentityProvider{})
 	cfg := &config.Config{}
 	logger := zap.NewNop()
 	jwt := &app.JwtProvider{}
@@ -90,27 +100,235 @@ func TestUserHandler_Login(t *testing.T) {
 	if w.Code != http.StatusUnauthorized {
 		t.Errorf("expected status 401 for wrong password, got %d", w.Code)
 	}
+
+	until := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	repo.SetStatus(user.UUID.String(), app.UserStatusSuspended, "spam", &until)
+	body, _ = json.Marshal(validReq)
+	req = httptest.NewRequest("POST", "/login", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+	handler.Login(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected status 403 for a suspended user, got %d", w.Code)
+	}
+	var blocked struct {
+		Code   string    `json:"code"`
+		Reason string    `json:"reason"`
+		Until  time.Time `json:"until"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&blocked); err != nil {
+		t.Fatalf("invalid json response: %v", err)
+	}
+	if blocked.Code != "account_suspended" || blocked.Reason != "spam" || !blocked.Until.Equal(until) {
+		t.Errorf("unexpected response for a suspended user: %+v", blocked)
+	}
+}
+
+func TestUserHandler_LoginThrottled(t *testing.T) {
+	repo := &app.MockUserRepo{Users: make(map[string]app.User)}
+	service := app.NewUserService(repo, &app.MockTokenRepo{}, &app.MockMailer{}, &app.MockIdentityProvider{})
+	cfg := &config.Config{LoginThrottle: config.LoginThrottle{
+		IP: config.Throttle{FreeAttempts: 1, BaseDelay: 90, MaxDelay: 600, Window: 3600},
+	}}
+	handler := NewUserHandler(service, cfg, &app.JwtProvider{}, zap.NewNop())
+
+	login := func(name string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(app.JwtRequest{Login: name, Password: "wrong"})
+		req := httptest.NewRequest("POST", "/login", bytes.NewReader(body))
+		req.RemoteAddr = "192.0.2.1:5000"
+		w := httptest.NewRecorder()
+		handler.Login(w, req)
+		return w
+	}
+
+	if w := login("first"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status 401, got %d", w.Code)
+	}
+	w := login("second")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %d", w.Code)
+	}
+	if retry := w.Header().Get("Retry-After"); retry != "90" {
+		t.Errorf("expected Retry-After 90, got %q", retry)
+	}
+}
+
+func TestUserHandler_PasswordReset(t *testing.T) {
+	verified := time.Now()
+	user := app.User{UUID: uuid.New(), Login: "testuser", Password: "hash", Status: app.UserStatusActive, Email: "test@example.com", EmailVerifiedAt: &verified}
+	repo := &app.MockUserRepo{Users: map[string]app.User{"testuser": user}}
+	mailer := &app.MockMailer{}
+	service := app.NewUserService(repo, &app.MockTokenRepo{}, mailer, &app.MockIdentityProvider{})
+	cfg := &config.Config{Password: config.Password{MinLength: 8, MaxLength: 64, ResetTokenTTL: 60, ResetURL: "http://localhost/reset"}}
+	handler := NewUserHandler(service, cfg, &app.JwtProvider{}, zap.NewNop())
+
+	forgotCases := []struct {
+		name     string
+		body     string
+		expected int
+		mails    int
+	}{
+		{"unknown login", `{"login":"nobody"}`, http.StatusAccepted, 0},
+		{"known login", `{"login":"testuser"}`, http.StatusAccepted, 1},
+		{"no login", `{}`, http.StatusBadRequest, 1},
+		{"invalid body", `{`, http.StatusBadRequest, 1},
+	}
+	for _, tc := range forgotCases {
+		t.Run("forgot "+tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ForgotPassword(w, httptest.NewRequest("POST", "/password/forgot", strings.NewReader(tc.body)))
+			if w.Code != tc.expected {
+				t.Errorf("expected %d, got %d", tc.expected, w.Code)
+			}
+			if len(mailer.Sent) != tc.mails {
+				t.Errorf("expected %d mails, got %d", tc.mails, len(mailer.Sent))
+			}
+		})
+	}
+
+	body := mailer.Sent[0].Body
+	token := body[strings.Index(body, "token=")+len("token="):]
+	token = token[:strings.Index(token, "\n")]
+
+	resetCases := []struct {
+		name     string
+		body     string
+		expected int
+	}{
+		{"weak password", `{"token":"` + token + `","password":"short"}`, http.StatusBadRequest},
+		{"success", `{"token":"` + token + `","password":"NewPassword1"}`, http.StatusNoContent},
+		{"token reused", `{"token":"` + token + `","password":"NewPassword1"}`, http.StatusBadRequest},
+		{"invalid body", `{`, http.StatusBadRequest},
+	}
+	for _, tc := range resetCases {
+		t.Run("reset "+tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ResetPassword(w, httptest.NewRequest("POST", "/password/reset", strings.NewReader(tc.body)))
+			if w.Code != tc.expected {
+				t.Errorf("expected %d, got %d", tc.expected, w.Code)
+			}
+		})
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(repo.Users["testuser"].Password), []byte("NewPassword1")); err != nil {
+		t.Error("expected the password to be changed")
+	}
+}
+
+func TestUserHandler_ChangePassword(t *testing.T) {
+	hashed, _ := bcrypt.GenerateFromPassword([]byte("OldPass1"), bcrypt.MinCost)
+	user := app.User{UUID: uuid.New(), Login: "testuser", Password: string(hashed), Status: app.UserStatusActive}
+	repo := &app.MockUserRepo{Users: map[string]app.User{"testuser": user}}
+	service := app.NewUserService(repo, &app.MockTokenRepo{}, &app.MockMailer{}, &app.MockIdentityProvider{})
+	cfg := &config.Config{Password: config.Password{MinLength: 8, MaxLength: 64}}
+	handler := NewUserHandler(service, cfg, &app.JwtProvider{}, zap.NewNop())
+
+	cases := []struct {
+		name     string
+		user     uuid.UUID
+		body     string
+		expected int
+	}{
+		{"wrong current password", user.UUID, `{"current_password":"nope","new_password":"NewPassword1"}`, http.StatusForbidden},
+		{"weak new password", user.UUID, `{"current_password":"OldPass1","new_password":"short"}`, http.StatusBadRequest},
+		{"invalid body", user.UUID, `{`, http.StatusBadRequest},
+		{"unknown user", uuid.New(), `{"current_password":"OldPass1","new_password":"NewPassword1"}`, http.StatusUnauthorized},
+		{"success", user.UUID, `{"current_password":"OldPass1","new_password":"NewPassword1"}`, http.StatusNoContent},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/me/password", strings.NewReader(tc.body))
+			ctx := context.WithValue(req.Context(), UserIDKey, tc.user.String())
+			ctx = context.WithValue(ctx, SessionIDKey, "current")
+			w := httptest.NewRecorder()
+			handler.ChangePassword(w, req.WithContext(ctx))
+			if w.Code != tc.expected {
+				t.Errorf("expected %d, got %d", tc.expected, w.Code)
+			}
+		})
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(repo.Users["testuser"].Password), []byte("NewPassword1")); err != nil {
+		t.Error("expected the password to be changed")
+	}
+}
+
+func TestUserHandler_VerifyEmail(t *testing.T) {
+	repo := &app.MockUserRepo{Users: make(map[string]app.User)}
+	mailer := &app.MockMailer{}
+	service := app.NewUserService(repo, &app.MockTokenRepo{}, mailer, &app.MockIdentityProvider{})
+	cfg := &config.Config{
+		Username: config.Username{MinLength: 3, MaxLength: 20, AllowedCharacters: "A-Za-z0-9_-"},
+		Password: config.Password{MinLength: 8, MaxLength: 64},
+		Email:    config.Email{VerifyTokenTTL: 60, VerifyURL: "http://localhost/verify-email"},
+	}
+	handler := NewUserHandler(service, cfg, &app.JwtProvider{}, zap.NewNop())
+
+	w := httptest.NewRecorder()
+	handler.Register(w, httptest.NewRequest("POST", "/register", strings.NewReader(`{"login":"alice","password":"Password1","email":"alice@example.com"}`)))
+	var signUp app.SignUpResponse
+	json.NewDecoder(w.Body).Decode(&signUp)
+	if w.Code != http.StatusOK || signUp.Email != "alice@example.com" || len(mailer.Sent) != 1 {
+		t.Fatalf("expected registration with a verification mail, got %d %+v %d mails", w.Code, signUp, len(mailer.Sent))
+	}
+
+	resend := func(userID uuid.UUID) int {
+		req := httptest.NewRequest("POST", "/me/email/verify", nil)
+		w := httptest.NewRecorder()
+		handler.ResendVerification(w, req.WithContext(context.WithValue(req.Context(), UserIDKey, userID.String())))
+		return w.Code
+	}
+	if code := resend(signUp.UUID); code != http.StatusAccepted || len(mailer.Sent) != 2 {
+		t.Fatalf("expected a new verification mail, got %d and %d mails", code, len(mailer.Sent))
+	}
+
+	body := mailer.Sent[1].Body
+	token := body[strings.Index(body, "token=")+len("token="):]
+	token = token[:strings.Index(token, "\n")]
+
+	cases := []struct {
+		name     string
+		query    string
+		expected int
+	}{
+		{"no token", "", http.StatusBadRequest},
+		{"unknown token", "?token=nope", http.StatusBadRequest},
+		{"success", "?token=" + token, http.StatusOK},
+		{"token reused", "?token=" + token, http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.VerifyEmail(w, httptest.NewRequest("GET", "/verify-email"+tc.query, nil))
+			if w.Code != tc.expected {
+				t.Errorf("expected %d, got %d", tc.expected, w.Code)
+			}
+		})
+	}
+
+	if code := resend(signUp.UUID); code != http.StatusConflict {
+		t.Errorf("expected 409 for a verified email, got %d", code)
+	}
 }
 
 func TestUserHandler_RefreshAccessToken(t *testing.T) {
 	repo := &app.MockUserRepo{Users: make(map[string]app.User)}
-    service := app.NewUserService(repo)
+    service := app.NewUserService(repo, &app.MockTokenRepo{}, &app.MockMailer{}, &app.MockIdentityProvider{})
 	cfg := &config.Config{JWT_ACCESS_SECRET: "secret", JWT_EXP_ACCESS_TOKEN: 15, JWT_REFRESH_SECRET: "secret", JWT_EXP_REFRESH_TOKEN: 24}
 	logger := zap.NewNop()
 	jwt := &app.JwtProvider{}
 	handler := NewUserHandler(service, cfg, jwt, logger)
 
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("somepass"), bcrypt.DefaultCost)
 	user := app.User{
 		UUID:     uuid.New(),
 		Login:    "refreshUser",
-		Password: "somepass",
+		Password: string(hashedPassword),
 	}
 	repo.SaveNewUser(user)
 
-	refreshToken, err := jwt.GenerateRefreshToken(user, cfg)
+	login, err := service.LoginJwt(app.JwtRequest{Login: "refreshUser", Password: "somepass"}, jwt, cfg)
 	if err != nil {
-		t.Fatalf("failed to generate refresh token: %v", err)
+		t.Fatalf("failed to login: %v", err)
 	}
+	refreshToken := login.RefreshToken
 
 	validReq := app.RefreshJwtRequest{RefreshToken: refreshToken}
 	body, _ := json.Marshal(validReq)
@@ -122,6 +340,14 @@ func TestUserHandler_RefreshAccessToken(t *testing.T) {
 		t.Errorf("expected status 200, got %d", w.Code)
 	}
 
+	// the same refresh token works only once
+	req = httptest.NewRequest("POST", "/refresh", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+	handler.RefreshAccessToken(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 for a reused token, got %d", w.Code)
+	}
+
 	req = httptest.NewRequest("POST", "/refresh", bytes.NewBufferString("{bad json"))
 	w = httptest.NewRecorder()
 	handler.RefreshAccessToken(w, req)
@@ -137,4 +363,328 @@ func TestUserHandler_RefreshAccessToken(t *testing.T) {
 	if w.Code != http.StatusUnauthorized {
 		t.Errorf("expected status 401, got %d", w.Code)
 	}
-}
\ No newline at end of file
+}
+func TestUserHandler_Logout(t *testing.T) {
+	repo := &app.MockUserRepo{Users: make(map[string]app.User)}
+	service := app.NewUserService(repo, &app.MockTokenRepo{}, &app.MockMailer{}, &app.MockIdentityProvider{})
+	cfg := &config.Config{JWT_ACCESS_SECRET: "secret", JWT_EXP_ACCESS_TOKEN: 15, JWT_REFRESH_SECRET: "secret", JWT_EXP_REFRESH_TOKEN: 24}
+	jwt := app.NewJwtProvider(cfg)
+	handler := NewUserHandler(service, cfg, jwt, zap.NewNop())
+
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("somepass"), bcrypt.DefaultCost)
+	user := app.User{UUID: uuid.New(), Login: "logoutUser", Password: string(hashedPassword)}
+	repo.SaveNewUser(user)
+	login := func(t *testing.T) app.JwtResponse {
+		resp, err := service.LoginJwt(app.JwtRequest{Login: "logoutUser", Password: "somepass"}, jwt, cfg)
+		if err != nil {
+			t.Fatalf("failed to login: %v", err)
+		}
+		return resp
+	}
+	// authorized reports whether the access token still passes AuthMiddleware
+	authorized := func(accessToken string) bool {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		w := httptest.NewRecorder()
+		AuthMiddleware(jwt, service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, req)
+		return w.Code == http.StatusOK
+	}
+
+	t.Run("logout", func(t *testing.T) {
+		session, other := login(t), login(t)
+		body, _ := json.Marshal(app.RefreshJwtRequest{RefreshToken: session.RefreshToken})
+		w := httptest.NewRecorder()
+		handler.Logout(w, httptest.NewRequest("POST", "/logout", bytes.NewReader(body)))
+
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("expected status 204, got %d", w.Code)
+		}
+		if authorized(session.AccessToken) {
+			t.Error("expected the access token of the ended session to be rejected")
+		}
+		if !authorized(other.AccessToken) {
+			t.Error("expected other sessions to stay valid")
+		}
+	})
+
+	t.Run("logout all", func(t *testing.T) {
+		first, second := login(t), login(t)
+		req := httptest.NewRequest("POST", "/logout-all", nil)
+		req = req.WithContext(context.WithValue(req.Context(), UserIDKey, user.UUID.String()))
+		w := httptest.NewRecorder()
+		handler.LogoutAll(w, req)
+
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("expected status 204, got %d", w.Code)
+		}
+		if authorized(first.AccessToken) || authorized(second.AccessToken) {
+			t.Error("expected all access tokens to be rejected")
+		}
+	})
+
+	t.Run("bad requests", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler.Logout(w, httptest.NewRequest("POST", "/logout", bytes.NewBufferString(`{"refresh_token":"invalid"}`)))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected status 401, got %d", w.Code)
+		}
+		w = httptest.NewRecorder()
+		handler.Logout(w, httptest.NewRequest("POST", "/logout", bytes.NewBufferString("{bad json")))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+		w = httptest.NewRecorder()
+		handler.LogoutAll(w, httptest.NewRequest("POST", "/logout-all", nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected status 401, got %d", w.Code)
+		}
+	})
+}
+
+func TestUserHandler_Sessions(t *testing.T) {
+	repo := &app.MockUserRepo{Users: make(map[string]app.User)}
+	service := app.NewUserService(repo, &app.MockTokenRepo{}, &app.MockMailer{}, &app.MockIdentityProvider{})
+	cfg := &config.Config{JWT_ACCESS_SECRET: "secret", JWT_EXP_ACCESS_TOKEN: 15, JWT_REFRESH_SECRET: "secret", JWT_EXP_REFRESH_TOKEN: 24}
+	jwt := app.NewJwtProvider(cfg)
+	handler := NewUserHandler(service, cfg, jwt, zap.NewNop())
+	router := chi.NewRouter()
+	router.Use(AuthMiddleware(jwt, service))
+	router.Get("/me/sessions", handler.Sessions)
+	router.Delete("/me/sessions/{id}", handler.DeleteSession)
+
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("somepass"), bcrypt.DefaultCost)
+	user := app.User{UUID: uuid.New(), Login: "sessionUser", Password: string(hashedPassword)}
+	repo.SaveNewUser(user)
+	login := func(t *testing.T, userAgent string) app.JwtResponse {
+		req := httptest.NewRequest("POST", "/login", bytes.NewBufferString(`{"login":"sessionUser","password":"somepass"}`))
+		req.Header.Set("User-Agent", userAgent)
+		req.RemoteAddr = "192.0.2.1:5555"
+		w := httptest.NewRecorder()
+		handler.Login(w, req)
+		var resp app.JwtResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to login: %v", err)
+		}
+		return resp
+	}
+	do := func(method, path, accessToken string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	current := login(t, "Firefox")
+	other := login(t, "Mobile Safari")
+
+	w := do("GET", "/me/sessions", current.AccessToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	var sessions []app.Session
+	if err := json.NewDecoder(w.Body).Decode(&sessions); err != nil {
+		t.Fatalf("failed to decode sessions: %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %+v", sessions)
+	}
+	var otherID string
+	for _, session := range sessions {
+		if session.IP != "192.0.2.1" {
+			t.Errorf("expected the client IP, got %q", session.IP)
+		}
+		if session.UserAgent == "Mobile Safari" {
+			otherID = session.ID
+			if session.Current {
+				t.Error("expected the other session not to be current")
+			}
+		} else if !session.Current {
+			t.Errorf("expected the Firefox session to be current, got %+v", session)
+		}
+	}
+
+	if w := do("DELETE", "/me/sessions/"+otherID, current.AccessToken); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", w.Code)
+	}
+	if w := do("GET", "/me/sessions", other.AccessToken); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the deleted session to be rejected, got %d", w.Code)
+	}
+	if w := do("DELETE", "/me/sessions/"+otherID, current.AccessToken); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", w.Code)
+	}
+}
+
+func TestUserHandler_JWKS(t *testing.T) {
+	cfg := &config.Config{}
+	handler := NewUserHandler(app.NewUserService(&app.MockUserRepo{}, &app.MockTokenRepo{}, &app.MockMailer{}, &app.MockIdentityProvider{}), cfg, app.NewJwtProvider(cfg), zap.NewNop())
+
+	w := httptest.NewRecorder()
+	handler.JWKS(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/jwk-set+json" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	// without asymmetric keys there is nothing to publish, but the set is still valid
+	if body := strings.TrimSpace(w.Body.String()); body != `{"keys":[]}` {
+		t.Errorf("unexpected body %s", body)
+	}
+}
+
+// totpNow computes the code an authenticator app shows for secret (RFC 6238, SHA1, 6 digits).
+func totpNow(t *testing.T, secret string) string {
+	t.Helper()
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatalf("invalid secret %q: %v", secret, err)
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(time.Now().Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:offset+4])&0x7fffffff)%1000000)
+}
+
+func TestUserHandler_TwoFactor(t *testing.T) {
+	hashed, _ := bcrypt.GenerateFromPassword([]byte("Password1"), bcrypt.MinCost)
+	user := app.User{UUID: uuid.New(), Login: "testuser", Password: string(hashed), Status: app.UserStatusActive}
+	repo := &app.MockUserRepo{Users: map[string]app.User{"testuser": user}}
+	service := app.NewUserService(repo, &app.MockTokenRepo{}, &app.MockMailer{}, &app.MockIdentityProvider{})
+	cfg := &config.Config{
+		JWT_ACCESS_SECRET: "secret", JWT_REFRESH_SECRET: "refresh", JWT_EXP_ACCESS_TOKEN: 15, JWT_EXP_REFRESH_TOKEN: 24,
+		TwoFactor: config.TwoFactor{Issuer: "Marketplace", ChallengeTTL: 300, SecretKey: strings.Repeat("ab", 32)},
+	}
+	handler := NewUserHandler(service, cfg, app.NewJwtProvider(cfg), zap.NewNop())
+
+	authed := func(req *http.Request) *http.Request {
+		return req.WithContext(context.WithValue(req.Context(), UserIDKey, user.UUID.String()))
+	}
+	confirm := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ConfirmTOTP(w, authed(httptest.NewRequest("POST", "/me/2fa/confirm", strings.NewReader(body))))
+		return w
+	}
+	setup := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.SetupTOTP(w, authed(httptest.NewRequest("POST", "/me/2fa/setup", nil)))
+		return w
+	}
+
+	if w := confirm(`{"code":"123456"}`); w.Code != http.StatusConflict {
+		t.Errorf("expected 409 before setup, got %d", w.Code)
+	}
+	w := setup()
+	var setupResp app.TOTPSetupResponse
+	json.NewDecoder(w.Body).Decode(&setupResp)
+	if w.Code != http.StatusOK || !strings.HasPrefix(setupResp.URI, "otpauth://totp/") {
+		t.Fatalf("expected an otpauth uri, got %d %+v", w.Code, setupResp)
+	}
+	if w := confirm(`{"code":"abcdef"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a wrong code, got %d", w.Code)
+	}
+	if w := confirm(`{`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid body, got %d", w.Code)
+	}
+	w = confirm(`{"code":"` + totpNow(t, setupResp.Secret) + `"}`)
+	var confirmResp app.TOTPConfirmResponse
+	json.NewDecoder(w.Body).Decode(&confirmResp)
+	if w.Code != http.StatusOK || len(confirmResp.RecoveryCodes) == 0 {
+		t.Fatalf("expected recovery codes, got %d %+v", w.Code, confirmResp)
+	}
+	if w := setup(); w.Code != http.StatusConflict {
+		t.Errorf("expected 409 once enabled, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.Login(w, httptest.NewRequest("POST", "/login", strings.NewReader(`{"login":"testuser","password":"Password1"}`)))
+	var loginResp app.JwtResponse
+	json.NewDecoder(w.Body).Decode(&loginResp)
+	if w.Code != http.StatusOK || loginResp.ChallengeToken == "" || loginResp.AccessToken != "" {
+		t.Fatalf("expected a challenge, got %d %+v", w.Code, loginResp)
+	}
+
+	cases := []struct {
+		name     string
+		body     string
+		expected int
+	}{
+		{"invalid body", `{`, http.StatusBadRequest},
+		{"invalid challenge", `{"challenge_token":"nope","code":"` + confirmResp.RecoveryCodes[0] + `"}`, http.StatusUnauthorized},
+		{"wrong code", `{"challenge_token":"` + loginResp.ChallengeToken + `","code":"abcdef"}`, http.StatusUnauthorized},
+		{"recovery code", `{"challenge_token":"` + loginResp.ChallengeToken + `","code":"` + confirmResp.RecoveryCodes[0] + `"}`, http.StatusOK},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.LoginTwoFactor(w, httptest.NewRequest("POST", "/login/2fa", strings.NewReader(tc.body)))
+			if w.Code != tc.expected {
+				t.Errorf("expected %d, got %d", tc.expected, w.Code)
+			}
+		})
+	}
+}
+
+func TestUserHandler_OIDC(t *testing.T) {
+	repo := &app.MockUserRepo{Users: make(map[string]app.User)}
+	identities := &app.MockIdentityProvider{}
+	service := app.NewUserService(repo, &app.MockTokenRepo{}, &app.MockMailer{}, identities)
+	cfg := &config.Config{
+		JWT_ACCESS_SECRET: "secret", JWT_REFRESH_SECRET: "refresh", JWT_EXP_ACCESS_TOKEN: 15, JWT_EXP_REFRESH_TOKEN: 24,
+		Username: config.Username{MinLength: 3, MaxLength: 20, AllowedCharacters: "A-Za-z0-9_-"},
+		OIDC:     config.OIDC{StateTTL: 600, Providers: []config.OIDCProvider{{Name: "mock"}}},
+	}
+	handler := NewUserHandler(service, cfg, app.NewJwtProvider(cfg), zap.NewNop())
+	router := chi.NewRouter()
+	router.Get("/oauth/{provider}/login", handler.OIDCLogin)
+	router.Get("/oauth/{provider}/callback", handler.OIDCCallback)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	start := func(identity app.ExternalIdentity) (string, string) {
+		w := get("/oauth/mock/login")
+		if w.Code != http.StatusFound {
+			t.Fatalf("expected a redirect to the provider, got %d", w.Code)
+		}
+		location := w.Header().Get("Location")
+		code := uuid.NewString()
+		identities.Authorize(location, code, identity)
+		parsed, _ := url.Parse(location)
+		return code, parsed.Query().Get("state")
+	}
+
+	if w := get("/oauth/nope/login"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown provider, got %d", w.Code)
+	}
+
+	code, state := start(app.ExternalIdentity{Subject: "alice-1", Username: "alice"})
+	w := get("/oauth/mock/callback?" + url.Values{"code": {code}, "state": {state}}.Encode())
+	var resp app.JwtResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	if w.Code != http.StatusOK || resp.AccessToken == "" {
+		t.Fatalf("expected a token pair, got %d %+v", w.Code, resp)
+	}
+	if _, ok := repo.Users["alice"]; !ok {
+		t.Error("expected a user to be created")
+	}
+	if w := get("/oauth/mock/callback?" + url.Values{"code": {code}, "state": {state}}.Encode()); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a used state, got %d", w.Code)
+	}
+
+	_, state = start(app.ExternalIdentity{Subject: "alice-1"})
+	if w := get("/oauth/mock/callback?" + url.Values{"error": {"access_denied"}, "state": {state}}.Encode()); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 when the user declined, got %d", w.Code)
+	}
+
+	repo.SetStatus(repo.Users["alice"].UUID.String(), app.UserStatusBanned, "spam", nil)
+	code, state = start(app.ExternalIdentity{Subject: "alice-1"})
+	if w := get("/oauth/mock/callback?" + url.Values{"code": {code}, "state": {state}}.Encode()); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a banned user, got %d", w.Code)
+	}
+}